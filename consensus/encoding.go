@@ -0,0 +1,102 @@
+package consensus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"go-blockchain/core"
+)
+
+// The messages are sent in the canonical encoding of core:
+//
+//	Message   0x01 followed by a Proposal, or 0x02 followed by a SignedVote
+//	Proposal  SignedVote | POLRound int32 (4 bytes, big-endian two's
+//	          complement) | Block
+const (
+	messageProposal uint8 = 0x01
+	messageVote     uint8 = 0x02
+)
+
+type CanonicalMessageEncoder struct {
+	w io.Writer
+}
+
+func NewCanonicalMessageEncoder(w io.Writer) *CanonicalMessageEncoder {
+	return &CanonicalMessageEncoder{
+		w: w,
+	}
+}
+
+func (e *CanonicalMessageEncoder) Encode(msg *Message) error {
+	switch {
+	case msg.Proposal != nil && msg.Vote == nil:
+		p := msg.Proposal
+		if p.Block == nil {
+			return fmt.Errorf("proposal at height %d has no block", p.Vote.Height)
+		}
+		if _, err := e.w.Write([]byte{messageProposal}); err != nil {
+			return err
+		}
+		if err := core.NewCanonicalVoteEncoder(e.w).Encode(&p.Vote); err != nil {
+			return err
+		}
+		if err := binary.Write(e.w, binary.BigEndian, p.POLRound); err != nil {
+			return err
+		}
+		return p.Block.Encode(core.NewCanonicalBlockEncoder(e.w))
+
+	case msg.Vote != nil && msg.Proposal == nil:
+		if _, err := e.w.Write([]byte{messageVote}); err != nil {
+			return err
+		}
+		return core.NewCanonicalVoteEncoder(e.w).Encode(msg.Vote)
+
+	default:
+		return fmt.Errorf("%w: exactly one of proposal and vote must be set", ErrInvalidMessage)
+	}
+}
+
+type CanonicalMessageDecoder struct {
+	r io.Reader
+}
+
+func NewCanonicalMessageDecoder(r io.Reader) *CanonicalMessageDecoder {
+	return &CanonicalMessageDecoder{
+		r: r,
+	}
+}
+
+func (d *CanonicalMessageDecoder) Decode(msg *Message) error {
+	kind := make([]byte, 1)
+	if _, err := io.ReadFull(d.r, kind); err != nil {
+		return err
+	}
+
+	switch kind[0] {
+	case messageProposal:
+		p := &Proposal{Block: new(core.Block)}
+		if err := core.NewCanonicalVoteDecoder(d.r).Decode(&p.Vote); err != nil {
+			return err
+		}
+		if err := binary.Read(d.r, binary.BigEndian, &p.POLRound); err != nil {
+			return err
+		}
+		if err := p.Block.Decode(core.NewCanonicalBlockDecoder(d.r)); err != nil {
+			return err
+		}
+		*msg = Message{Proposal: p}
+
+	case messageVote:
+		v := new(core.Vote)
+		if err := core.NewCanonicalVoteDecoder(d.r).Decode(v); err != nil {
+			return err
+		}
+		*msg = Message{Vote: v}
+
+	default:
+		return fmt.Errorf("%w: unknown message kind 0x%02x", ErrInvalidMessage, kind[0])
+	}
+
+	return nil
+}
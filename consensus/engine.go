@@ -0,0 +1,64 @@
+package consensus
+
+import (
+	"context"
+	"errors"
+
+	"go-blockchain/core"
+	"go-blockchain/types"
+)
+
+var (
+	ErrInvalidMessage = errors.New("invalid consensus message")
+	ErrQueueFull      = errors.New("consensus message queue is full")
+)
+
+// Backend is the node an engine produces blocks for.
+type Backend interface {
+	// Chain returns the chain the engine extends
+	Chain() *core.Blockchain
+	// BuildBlock returns an unsigned block of mempool transactions on top of
+	// parent, their fees are paid to coinbase
+	BuildBlock(parent *core.Header, coinbase types.Address) (*core.Block, error)
+	// Broadcast sends a consensus message to every peer
+	Broadcast(msg *Message) error
+}
+
+// Engine produces the blocks of a validator.
+type Engine interface {
+	// Run drives the block production until ctx is done.
+	Run(ctx context.Context)
+	// HandleMessage takes a consensus message of a peer, it must not block.
+	HandleMessage(msg *Message) error
+}
+
+// Factory creates the engine of a node on top of its backend.
+type Factory func(Backend) (Engine, error)
+
+// Message is exchanged between the validators, exactly one field is set.
+type Message struct {
+	Proposal *Proposal
+	Vote     *core.Vote
+}
+
+// Height returns the height of the block the message is about.
+func (m *Message) Height() uint32 {
+	if m.Proposal != nil {
+		return m.Proposal.Vote.Height
+	}
+	if m.Vote != nil {
+		return m.Vote.Height
+	}
+	return 0
+}
+
+// Proposal is the block the proposer of a round puts to the vote.
+type Proposal struct {
+	// Vote is the signature of the proposer over the height, round and hash
+	// of the block
+	Vote core.Vote
+	// POLRound is the round in which the block got the prevotes of a quorum,
+	// -1 for a new block
+	POLRound int32
+	Block    *core.Block
+}
@@ -0,0 +1,209 @@
+package consensus
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"go-blockchain/core"
+	"go-blockchain/crypto"
+
+	"github.com/go-kit/log"
+)
+
+// abortCheckInterval is how many nonces a worker tries between checks whether
+// the search was aborted.
+const abortCheckInterval = 1 << 10
+
+// Miner searches for a nonce that makes the hash of a block on top of the tip
+// meet its target, the nonce space is split between a number of worker
+// goroutines. A new tip, mined locally or received from a peer, aborts the
+// search and it restarts on top of the new tip.
+type Miner struct {
+	backend Backend
+	chain   *core.Blockchain
+	privKey crypto.PrivateKey
+	workers int
+	logger  log.Logger
+
+	// tipCh wakes the loop when the tip of the chain changes
+	tipCh chan struct{}
+}
+
+// NewMiner creates a miner for a chain with proof of work, workers defaults to
+// the number of CPUs.
+func NewMiner(backend Backend, privKey crypto.PrivateKey, workers int, logger log.Logger) (*Miner, error) {
+	chain := backend.Chain()
+	if chain.ProofOfWork() == nil {
+		return nil, fmt.Errorf("mining requires a chain with proof of work")
+	}
+
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	m := &Miner{
+		backend: backend,
+		chain:   chain,
+		privKey: privKey,
+		workers: workers,
+		logger:  logger,
+		tipCh:   make(chan struct{}, 1),
+	}
+
+	chain.OnBlock(func(*core.Block) {
+		select {
+		case m.tipCh <- struct{}{}:
+		default:
+		}
+	})
+
+	return m, nil
+}
+
+func (m *Miner) Run(ctx context.Context) {
+	_ = m.logger.Log("msg", "Starting miner", "workers", m.workers)
+
+	for {
+		// the tip read below is the latest, earlier notifications are stale
+		select {
+		case <-m.tipCh:
+		default:
+		}
+
+		header, err := m.chain.GetHeader(m.chain.Height())
+		if err != nil {
+			_ = m.logger.Log("msg", "failed to get tip", "err", err)
+			if !m.waitForTip(ctx) {
+				return
+			}
+			continue
+		}
+
+		if err := m.mine(ctx, header); err != nil {
+			_ = m.logger.Log("msg", "failed to mine block", "err", err)
+			if !m.waitForTip(ctx) {
+				return
+			}
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// HandleMessage rejects every message, miners do not vote.
+func (m *Miner) HandleMessage(msg *Message) error {
+	return fmt.Errorf("unexpected consensus message at height %d, the chain has proof of work", msg.Height())
+}
+
+// waitForTip blocks until the tip changes or the target block time passed,
+// it returns false once ctx is done.
+func (m *Miner) waitForTip(ctx context.Context) bool {
+	select {
+	case <-m.tipCh:
+	case <-time.After(m.chain.ProofOfWork().BlockTime):
+	case <-ctx.Done():
+		return false
+	}
+	return true
+}
+
+// mine searches for a block on top of parent and adds it to the chain. It
+// returns without a block when the tip changes or ctx is done.
+func (m *Miner) mine(ctx context.Context, parent *core.Header) error {
+	block, err := m.backend.BuildBlock(parent, m.privKey.PublicKey().Address())
+	if err != nil {
+		return err
+	}
+
+	block.Version = core.HeaderVersionPoW
+	if block.Timestamp <= parent.Timestamp {
+		block.Timestamp = parent.Timestamp + 1
+	}
+	if block.Bits, err = m.chain.NextBits(parent); err != nil {
+		return err
+	}
+
+	searchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-m.tipCh:
+			cancel()
+		case <-done:
+		}
+	}()
+
+	nonce, ok, err := m.search(searchCtx, block.Header)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if ctx.Err() == nil {
+			_ = m.logger.Log("msg", "new tip, restarting mining", "height", parent.Height+1)
+		}
+		return nil
+	}
+
+	block.Nonce = nonce
+	if err := block.Sign(m.privKey); err != nil {
+		return err
+	}
+
+	_ = m.logger.Log("msg", "mined block", "height", block.Height, "nonce", nonce, "bits", fmt.Sprintf("0x%08x", block.Bits))
+
+	// handleBlock of the backend broadcasts the block once it is added
+	return m.chain.AddBlock(block)
+}
+
+// search tries the nonces of the header on all workers, worker i tries the
+// nonces i, i+workers, i+2*workers and so on. ok is false if ctx was done
+// before a nonce was found.
+func (m *Miner) search(ctx context.Context, header *core.Header) (nonce uint64, ok bool, err error) {
+	target, err := core.CompactToTarget(header.Bits)
+	if err != nil {
+		return 0, false, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	found := make(chan uint64, m.workers)
+	wg := sync.WaitGroup{}
+	for i := 0; i < m.workers; i++ {
+		wg.Add(1)
+		go func(start uint64) {
+			defer wg.Done()
+
+			h := *header
+			h.Nonce = start
+			for tries := 0; ; tries++ {
+				if tries%abortCheckInterval == 0 && ctx.Err() != nil {
+					return
+				}
+				if core.MeetsTarget(core.BlockHasher{}.Hash(&h), target) {
+					found <- h.Nonce
+					return
+				}
+				h.Nonce += uint64(m.workers)
+			}
+		}(uint64(i))
+	}
+
+	select {
+	case nonce = <-found:
+		ok = true
+	case <-ctx.Done():
+	}
+
+	cancel()
+	wg.Wait()
+	return nonce, ok, nil
+}
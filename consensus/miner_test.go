@@ -0,0 +1,136 @@
+package consensus
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"go-blockchain/core"
+	"go-blockchain/crypto"
+	"go-blockchain/types"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// minerNode records the parents of the blocks its miner builds.
+type minerNode struct {
+	testNode
+
+	lock    sync.Mutex
+	parents []uint32
+}
+
+func (n *minerNode) BuildBlock(parent *core.Header, coinbase types.Address) (*core.Block, error) {
+	n.lock.Lock()
+	n.parents = append(n.parents, parent.Height)
+	n.lock.Unlock()
+
+	return n.testNode.BuildBlock(parent, coinbase)
+}
+
+func (n *minerNode) builtOn(height uint32) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	for _, parent := range n.parents {
+		if parent == height {
+			return true
+		}
+	}
+	return false
+}
+
+// newMiner creates a miner on a chain with proof of work of the given
+// difficulty.
+func newMiner(t *testing.T, bits uint32) (*minerNode, *Miner) {
+	g := &core.Genesis{
+		Timestamp: time.Now().UnixNano(),
+		Params:    core.GenesisParams{Consensus: core.ConsensusPoW, Bits: bits, RetargetInterval: 4, BlockTimeMs: 1},
+	}
+	chain, err := core.NewBlockChainFromGenesis(g, core.BlockchainOpts{})
+	assert.Nil(t, err)
+
+	node := &minerNode{testNode: testNode{chain: chain}}
+	m, err := NewMiner(node, crypto.GeneratePrivateKey(), 2, log.NewNopLogger())
+	assert.Nil(t, err)
+	return node, m
+}
+
+// runMiner starts a new miner that runs until the test ends.
+func runMiner(t *testing.T, bits uint32) *minerNode {
+	node, m := newMiner(t, bits)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return node
+}
+
+func TestMinerMinesBlocks(t *testing.T) {
+	node := runMiner(t, 0x2000ffff)
+
+	assert.Eventually(t, func() bool {
+		return node.chain.Height() >= 10
+	}, 10*time.Second, 5*time.Millisecond)
+
+	for h := uint32(1); h <= 10; h++ {
+		b, err := node.chain.GetBlock(h)
+		assert.Nil(t, err)
+		assert.Equal(t, core.HeaderVersionPoW, b.Version)
+		assert.True(t, node.builtOn(h-1))
+	}
+}
+
+func TestMinerRestartsOnNewTip(t *testing.T) {
+	// the target is too hard to be met during the test
+	node := runMiner(t, 0x1c00ffff)
+
+	assert.Eventually(t, func() bool {
+		return node.builtOn(0)
+	}, time.Second, time.Millisecond)
+
+	// a block from a peer becomes the new tip, the validator is replaced as
+	// the block carries no proof of work
+	node.chain.SetValidator(acceptAll{})
+	genesis, err := node.chain.GetHeader(0)
+	assert.Nil(t, err)
+	b, err := core.NewBlockFromPrevHeader(genesis, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, b.Sign(crypto.GeneratePrivateKey()))
+	assert.Nil(t, node.chain.AddBlock(b))
+
+	assert.Eventually(t, func() bool {
+		return node.builtOn(1)
+	}, time.Second, time.Millisecond)
+}
+
+type acceptAll struct{}
+
+func (acceptAll) ValidateBlock(*core.Block) error {
+	return nil
+}
+
+func TestMinerSearchAborts(t *testing.T) {
+	node, m := newMiner(t, 0x2000ffff)
+
+	header, err := node.chain.GetHeader(0)
+	assert.Nil(t, err)
+	hard := *header
+	hard.Bits = 0x1c00ffff
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, ok, err := m.search(ctx, &hard)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+}
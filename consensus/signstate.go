@@ -0,0 +1,146 @@
+package consensus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"go-blockchain/core"
+)
+
+var ErrDoubleSign = errors.New("would sign a second block at the height")
+
+// SignState remembers the last block a validator signed and the round it was
+// signed in. A second block at the same height is evidence for slashing the
+// validator, so the engines only sign one once the state of the last one is
+// saved and hand out the saved block again when they propose at its height.
+//
+// With a path the state is written to that file before Save returns and read
+// back by LoadSignState, it outlives a restart of the node. The file holds
+// the round as 4 bytes (big-endian) followed by the canonical block.
+type SignState struct {
+	path string
+
+	lock  sync.Mutex
+	round uint32
+	block *core.Block
+}
+
+// LoadSignState returns the state saved at path, a missing file is an empty
+// state. An empty path keeps the state in memory only.
+func LoadSignState(path string) (*SignState, error) {
+	s := &SignState{path: path}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < 4 {
+		return nil, fmt.Errorf("sign state %s is truncated", path)
+	}
+	b := new(core.Block)
+	if err := b.Decode(core.NewCanonicalBlockDecoder(bytes.NewReader(data[4:]))); err != nil {
+		return nil, fmt.Errorf("failed to decode sign state %s: %w", path, err)
+	}
+	s.round, s.block = binary.BigEndian.Uint32(data[:4]), b
+
+	return s, nil
+}
+
+// Height returns the height of the last block signed, zero if none was.
+func (s *SignState) Height() uint32 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.block == nil {
+		return 0
+	}
+	return s.block.Height
+}
+
+// Block returns the block signed at height and the round it was signed in,
+// nil if the last block signed is at another height.
+func (s *SignState) Block(height uint32) (*core.Block, uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.block == nil || s.block.Height != height {
+		return nil, 0
+	}
+	return s.block, s.round
+}
+
+// Save records a signed block, it must be called before the block leaves the
+// node. A block below the last one signed or another block at its height is
+// refused with ErrDoubleSign.
+func (s *SignState) Save(b *core.Block, round uint32) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if last := s.block; last != nil {
+		if b.Height < last.Height || (b.Height == last.Height && b.Hash(core.BlockHasher{}) != last.Hash(core.BlockHasher{})) {
+			return fmt.Errorf("%w %d, signed up to height %d", ErrDoubleSign, b.Height, last.Height)
+		}
+	}
+
+	if s.path != "" {
+		if err := s.write(b, round); err != nil {
+			return err
+		}
+	}
+	s.round, s.block = round, b
+
+	return nil
+}
+
+// write replaces the file atomically, a crash leaves either the old or the
+// new state behind.
+func (s *SignState) write(b *core.Block, round uint32) error {
+	buf := &bytes.Buffer{}
+	_ = binary.Write(buf, binary.BigEndian, round)
+	if err := b.Encode(core.NewCanonicalBlockEncoder(buf)); err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(s.path))
+	if err != nil {
+		return err
+	}
+	if err := dir.Sync(); err != nil {
+		_ = dir.Close()
+		return err
+	}
+	return dir.Close()
+}
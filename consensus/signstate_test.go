@@ -0,0 +1,56 @@
+package consensus
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go-blockchain/core"
+	"go-blockchain/crypto"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func signedBlock(t *testing.T, privKey crypto.PrivateKey, parent *core.Header) *core.Block {
+	b, err := core.NewBlockFromPrevHeader(parent, nil)
+	assert.Nil(t, err)
+	b.Timestamp = time.Now().UnixNano()
+	assert.Nil(t, b.Sign(privKey))
+	return b
+}
+
+func TestSignState(t *testing.T) {
+	privKey := crypto.GeneratePrivateKey()
+	genesis := &core.Header{Version: core.HeaderVersionMerkle}
+	path := filepath.Join(t.TempDir(), "sign_state")
+
+	s, err := LoadSignState(path)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(0), s.Height())
+
+	b := signedBlock(t, privKey, genesis)
+	assert.Nil(t, s.Save(b, 2))
+	assert.Nil(t, s.Save(b, 2))
+	assert.ErrorIs(t, s.Save(signedBlock(t, privKey, genesis), 3), ErrDoubleSign)
+
+	// the state outlives a restart
+	s, err = LoadSignState(path)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), s.Height())
+	signed, round := s.Block(1)
+	assert.Equal(t, b.Hash(core.BlockHasher{}), signed.Hash(core.BlockHasher{}))
+	assert.Equal(t, uint32(2), round)
+	assert.ErrorIs(t, s.Save(signedBlock(t, privKey, genesis), 0), ErrDoubleSign)
+
+	next := signedBlock(t, privKey, b.Header)
+	assert.Nil(t, s.Save(next, 0))
+	assert.ErrorIs(t, s.Save(b, 2), ErrDoubleSign)
+	signed, _ = s.Block(1)
+	assert.Nil(t, signed)
+
+	// a damaged file is not taken for an empty state
+	assert.Nil(t, os.WriteFile(path, []byte{0x00, 0x01}, 0o600))
+	_, err = LoadSignState(path)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,166 @@
+package consensus
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go-blockchain/core"
+	"go-blockchain/crypto"
+	"go-blockchain/types"
+
+	"github.com/go-kit/log"
+)
+
+// Solo proposes a block once the tip is a block time old, the blocks carry
+// no commit and are never final. With a validator set the node only proposes
+// on its turn, or when the validators in line before it missed theirs for a
+// timeout each. A validator never signs a second block at a height, even
+// after a reorg or a restart, as that is evidence for slashing it.
+type Solo struct {
+	backend   Backend
+	chain     *core.Blockchain
+	privKey   crypto.PrivateKey
+	blockTime time.Duration
+	state     *SignState
+	logger    log.Logger
+
+	// tipCh wakes the loop when the tip of the chain changes
+	tipCh chan struct{}
+}
+
+// NewSolo returns the engine of the validator privKey, state keeps the last
+// block it signed and is kept in memory when nil.
+func NewSolo(backend Backend, privKey crypto.PrivateKey, state *SignState, blockTime time.Duration, logger log.Logger) *Solo {
+	if state == nil {
+		state = &SignState{}
+	}
+
+	s := &Solo{
+		backend:   backend,
+		chain:     backend.Chain(),
+		privKey:   privKey,
+		blockTime: blockTime,
+		state:     state,
+		logger:    logger,
+		tipCh:     make(chan struct{}, 1),
+	}
+
+	s.chain.OnBlock(func(*core.Block) {
+		select {
+		case s.tipCh <- struct{}{}:
+		default:
+		}
+	})
+
+	return s
+}
+
+func (s *Solo) Run(ctx context.Context) {
+	_ = s.logger.Log("msg", "Starting validator loop")
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	// since is when the node first saw the current tip
+	tip, since := types.Hash{}, time.Time{}
+	for {
+		select {
+		case <-timer.C:
+		case <-s.tipCh:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+
+		header, err := s.chain.GetHeader(s.chain.Height())
+		if err != nil {
+			_ = s.logger.Log("msg", "failed to get tip", "err", err)
+			timer.Reset(s.blockTime)
+			continue
+		}
+		if hash := (core.BlockHasher{}).Hash(header); hash != tip {
+			tip, since = hash, time.Now()
+		}
+
+		at, ok := s.proposeAt(header, since)
+		if !ok {
+			// the set may take the node in again on another branch, so it
+			// waits for the next tip
+			continue
+		}
+		if wait := time.Until(at); wait > 0 {
+			timer.Reset(wait)
+			continue
+		}
+
+		if err := s.propose(header); err != nil {
+			_ = s.logger.Log("msg", "failed to create block", "err", err)
+		}
+		timer.Reset(s.blockTime)
+	}
+}
+
+// HandleMessage rejects every message, solo validators do not vote.
+func (s *Solo) HandleMessage(msg *Message) error {
+	return fmt.Errorf("unexpected consensus message at height %d, the chain has no BFT consensus", msg.Height())
+}
+
+// proposeAt returns when the node may propose the block on top of parent,
+// which it first saw at since. ok is false if the node is not in the set of
+// the next block.
+func (s *Solo) proposeAt(parent *core.Header, since time.Time) (time.Time, bool) {
+	at := since.Add(s.blockTime)
+
+	authority := s.chain.Authority()
+	if authority == nil {
+		return at, true
+	}
+
+	round, ok := authority.Validators().Round(parent.Height+1, s.privKey.PublicKey().Address())
+	if !ok {
+		return time.Time{}, false
+	}
+
+	// the timestamp of the block must fall into the turn of the node
+	at = at.Add(time.Duration(round) * authority.Timeout)
+	if earliest := authority.Earliest(parent, round); at.Before(earliest) {
+		at = earliest.Add(time.Nanosecond)
+	}
+	return at, true
+}
+
+func (s *Solo) propose(parent *core.Header) error {
+	authority := s.chain.Authority()
+	if authority != nil && parent.Height < s.state.Height() {
+		// a block signed on top of the parent before a restart may not have
+		// left the node, it is handed out again
+		signed, _ := s.state.Block(parent.Height + 1)
+		if signed == nil || signed.PrevBlockHash != (core.BlockHasher{}).Hash(parent) {
+			return fmt.Errorf("already signed a block at height %d", parent.Height+1)
+		}
+		return s.chain.AddBlock(signed)
+	}
+
+	block, err := s.backend.BuildBlock(parent, s.privKey.PublicKey().Address())
+	if err != nil {
+		return err
+	}
+
+	if err := block.Sign(s.privKey); err != nil {
+		return err
+	}
+
+	if authority != nil {
+		if err := s.state.Save(block, 0); err != nil {
+			return err
+		}
+	}
+
+	return s.chain.AddBlock(block)
+}
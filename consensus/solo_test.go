@@ -0,0 +1,54 @@
+package consensus
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go-blockchain/core"
+	"go-blockchain/crypto"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSoloWaitsOutsideValidatorSet(t *testing.T) {
+	validator := crypto.GeneratePrivateKey()
+	g := &core.Genesis{
+		Timestamp:  time.Now().Add(-time.Hour).UnixNano(),
+		Validators: []core.GenesisValidator{{PublicKey: validator.PublicKey(), Power: 1}},
+	}
+	chain, err := core.NewBlockChainFromGenesis(g, core.BlockchainOpts{})
+	assert.Nil(t, err)
+
+	node := &testNode{chain: chain}
+	s := NewSolo(node, crypto.GeneratePrivateKey(), nil, time.Millisecond, log.NewNopLogger())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run(ctx)
+	}()
+
+	// the node keeps following the tip without proposing
+	for i := 0; i < 3; i++ {
+		tip, err := chain.GetHeader(chain.Height())
+		assert.Nil(t, err)
+		b, err := core.NewBlockFromPrevHeader(tip, nil)
+		assert.Nil(t, err)
+		assert.Nil(t, b.Sign(validator))
+		assert.Nil(t, chain.AddBlock(b))
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case <-done:
+		t.Fatal("validator loop stopped")
+	default:
+	}
+	assert.Equal(t, uint32(3), chain.Height())
+
+	cancel()
+	<-done
+}
@@ -0,0 +1,569 @@
+package consensus
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go-blockchain/core"
+	"go-blockchain/crypto"
+	"go-blockchain/types"
+
+	"github.com/go-kit/log"
+)
+
+const (
+	DefaultTimeoutPropose   = 3 * time.Second
+	DefaultTimeoutPrevote   = time.Second
+	DefaultTimeoutPrecommit = time.Second
+	DefaultTimeoutDelta     = 500 * time.Millisecond
+	DefaultTimeoutCommit    = time.Second
+	DefaultQueueSize        = 1024
+)
+
+type TendermintOpts struct {
+	// TimeoutPropose, TimeoutPrevote and TimeoutPrecommit bound the steps of
+	// round 0, every later round waits TimeoutDelta longer per step
+	TimeoutPropose   time.Duration
+	TimeoutPrevote   time.Duration
+	TimeoutPrecommit time.Duration
+	TimeoutDelta     time.Duration
+	// TimeoutCommit is how long a validator waits after a commit before it
+	// starts the next height, it sets the pace of the chain
+	TimeoutCommit time.Duration
+	// QueueSize bounds the received messages waiting to be processed and the
+	// ones kept for the next height
+	QueueSize int
+}
+
+type step uint8
+
+const (
+	stepPropose step = iota
+	stepPrevote
+	stepPrecommit
+	// stepCommit waits for the next height once the block was committed
+	stepCommit
+)
+
+type timeout struct {
+	height uint32
+	round  uint32
+	step   step
+}
+
+// Tendermint commits every block in rounds of a proposal, a prevote and a
+// precommit step. The proposer of the round proposes a block, the validators
+// prevote for it if it is valid and they are not locked on another block, and
+// once prevotes of more than two thirds of the voting power are seen they
+// lock on the block and precommit it. Precommits of more than two thirds
+// commit the block, they become the commit certificate stored with it. A step
+// that makes no progress times out and the next round starts with the next
+// proposer, so up to a third of the voting power may be faulty.
+//
+// Validators broadcast their messages to their peers and are expected to be
+// connected to each other, other nodes follow the committed blocks.
+type Tendermint struct {
+	opts       TendermintOpts
+	backend    Backend
+	chain      *core.Blockchain
+	validators *core.ValidatorSet
+	privKey    crypto.PrivateKey
+	addr       types.Address
+	state      *SignState
+	logger     log.Logger
+
+	msgCh     chan *Message
+	tipCh     chan struct{}
+	timeoutCh chan timeout
+
+	// the state below is only touched by Run
+	done        <-chan struct{}
+	timers      []*time.Timer
+	height      uint32
+	round       uint32
+	step        step
+	lockedBlock *core.Block
+	lockedRound int32
+	validBlock  *core.Block
+	validRound  int32
+	rounds      map[uint32]*roundState
+	// blocks holds the proposed blocks of the height by hash and valid the
+	// result of checking them
+	blocks map[types.Hash]*core.Block
+	valid  map[types.Hash]error
+	// future holds the messages of the next height
+	future []*Message
+}
+
+// NewTendermint returns the engine of the validator privKey, state keeps the
+// last block it signed and is kept in memory when nil.
+func NewTendermint(backend Backend, privKey crypto.PrivateKey, state *SignState, opts TendermintOpts, logger log.Logger) (*Tendermint, error) {
+	if opts.TimeoutPropose == 0 {
+		opts.TimeoutPropose = DefaultTimeoutPropose
+	}
+	if opts.TimeoutPrevote == 0 {
+		opts.TimeoutPrevote = DefaultTimeoutPrevote
+	}
+	if opts.TimeoutPrecommit == 0 {
+		opts.TimeoutPrecommit = DefaultTimeoutPrecommit
+	}
+	if opts.TimeoutDelta == 0 {
+		opts.TimeoutDelta = DefaultTimeoutDelta
+	}
+	if opts.TimeoutCommit == 0 {
+		opts.TimeoutCommit = DefaultTimeoutCommit
+	}
+	if opts.QueueSize == 0 {
+		opts.QueueSize = DefaultQueueSize
+	}
+	if state == nil {
+		state = &SignState{}
+	}
+
+	chain := backend.Chain()
+	authority := chain.Authority()
+	if authority == nil {
+		return nil, fmt.Errorf("tendermint consensus needs a validator set")
+	}
+
+	addr := privKey.PublicKey().Address()
+	if !authority.Validators().Has(addr) {
+		return nil, fmt.Errorf("%s is not in the validator set", addr)
+	}
+
+	t := &Tendermint{
+		opts:       opts,
+		backend:    backend,
+		chain:      chain,
+		validators: authority.Validators(),
+		privKey:    privKey,
+		addr:       addr,
+		state:      state,
+		logger:     logger,
+		msgCh:      make(chan *Message, opts.QueueSize),
+		tipCh:      make(chan struct{}, 1),
+		timeoutCh:  make(chan timeout),
+	}
+
+	chain.OnBlock(func(*core.Block) {
+		select {
+		case t.tipCh <- struct{}{}:
+		default:
+		}
+	})
+
+	return t, nil
+}
+
+// HandleMessage checks the signature of a message and queues it.
+func (t *Tendermint) HandleMessage(msg *Message) error {
+	if err := t.verify(msg); err != nil {
+		return err
+	}
+
+	select {
+	case t.msgCh <- msg:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// verify checks what can be checked without the state of the engine. The
+// signature is checked first, a message of a peer may carry no key or one
+// that is not on the curve.
+func (t *Tendermint) verify(msg *Message) error {
+	validators := t.chain.Authority().Validators()
+
+	switch {
+	case msg.Proposal != nil && msg.Vote == nil:
+		p := msg.Proposal
+		if p.Vote.Type != core.VoteProposal || p.Block == nil || p.Block.Header == nil {
+			return fmt.Errorf("%w: malformed proposal", ErrInvalidMessage)
+		}
+		if err := p.Vote.Verify(); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+		}
+		if p.POLRound < -1 || p.POLRound >= int32(p.Vote.Round) {
+			return fmt.Errorf("%w: proposal of round %d has POL round %d", ErrInvalidMessage, p.Vote.Round, p.POLRound)
+		}
+		if p.Block.Height != p.Vote.Height || p.Block.Hash(core.BlockHasher{}) != p.Vote.BlockHash {
+			return fmt.Errorf("%w: proposal does not match its block", ErrInvalidMessage)
+		}
+		proposer := validators.Proposer(p.Vote.Height, p.Vote.Round)
+		if p.Vote.Validator.Address() != proposer.Address() {
+			return fmt.Errorf("%w: proposal of %s at height %d round %d, expected %s",
+				ErrInvalidMessage, p.Vote.Validator.Address(), p.Vote.Height, p.Vote.Round, proposer.Address())
+		}
+	case msg.Vote != nil && msg.Proposal == nil:
+		v := msg.Vote
+		if v.Type != core.VotePrevote && v.Type != core.VotePrecommit {
+			return fmt.Errorf("%w: unexpected %s", ErrInvalidMessage, v.Type)
+		}
+		if err := v.Verify(); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+		}
+		if !validators.Has(v.Validator.Address()) {
+			return fmt.Errorf("%w: %s of %s, not a validator", ErrInvalidMessage, v.Type, v.Validator.Address())
+		}
+	default:
+		return fmt.Errorf("%w: message must hold either a proposal or a vote", ErrInvalidMessage)
+	}
+
+	return nil
+}
+
+func (t *Tendermint) Run(ctx context.Context) {
+	_ = t.logger.Log("msg", "Starting tendermint consensus", "validators", t.validators.Len())
+
+	t.done = ctx.Done()
+	defer t.stopTimers()
+
+	t.startHeight()
+	for {
+		select {
+		case msg := <-t.msgCh:
+			t.handle(msg)
+		case to := <-t.timeoutCh:
+			t.onTimeout(to)
+		case <-t.tipCh:
+			t.onTip()
+		case <-ctx.Done():
+			return
+		}
+		t.apply()
+	}
+}
+
+// startHeight starts round 0 on top of the tip of the chain.
+func (t *Tendermint) startHeight() {
+	t.stopTimers()
+
+	t.height = t.chain.Height() + 1
+	// slashed validators leave the set with the block holding the evidence
+	t.validators = t.chain.Authority().Validators()
+	t.lockedBlock, t.lockedRound = nil, -1
+	t.validBlock, t.validRound = nil, -1
+	t.rounds = map[uint32]*roundState{}
+	t.blocks = map[types.Hash]*core.Block{}
+	t.valid = map[types.Hash]error{}
+
+	future := t.future
+	t.future = nil
+
+	t.startRound(0)
+	for _, msg := range future {
+		t.handle(msg)
+	}
+}
+
+func (t *Tendermint) startRound(round uint32) {
+	t.round, t.step = round, stepPropose
+	t.schedule(t.opts.TimeoutPropose, stepPropose)
+
+	proposer := t.validators.Proposer(t.height, round)
+	if proposer.Address() != t.addr {
+		return
+	}
+
+	block, polRound := t.validBlock, t.validRound
+	if block == nil {
+		// the block signed in an earlier round, or before a restart, is
+		// proposed again, signing another one would be a double sign
+		block, _ = t.state.Block(t.height)
+	}
+	if block == nil {
+		var err error
+		if block, err = t.buildBlock(round); err != nil {
+			_ = t.logger.Log("msg", "failed to build proposal", "height", t.height, "round", round, "err", err)
+			return
+		}
+	}
+
+	p := &Proposal{
+		Vote: core.Vote{
+			Type:      core.VoteProposal,
+			Height:    t.height,
+			Round:     round,
+			BlockHash: block.Hash(core.BlockHasher{}),
+		},
+		POLRound: polRound,
+		Block:    block,
+	}
+	if err := p.Vote.Sign(t.privKey); err != nil {
+		_ = t.logger.Log("msg", "failed to sign proposal", "err", err)
+		return
+	}
+
+	t.broadcast(&Message{Proposal: p})
+	t.handle(&Message{Proposal: p})
+}
+
+// buildBlock builds and signs a block for round, it is saved to the sign
+// state before it is returned.
+func (t *Tendermint) buildBlock(round uint32) (*core.Block, error) {
+	parent, err := t.chain.GetHeader(t.height - 1)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := t.backend.BuildBlock(parent, t.addr)
+	if err != nil {
+		return nil, err
+	}
+	if block.Timestamp <= parent.Timestamp {
+		block.Timestamp = parent.Timestamp + 1
+	}
+
+	if err := block.Sign(t.privKey); err != nil {
+		return nil, err
+	}
+
+	return block, t.state.Save(block, round)
+}
+
+// handle records a verified message of the current height, messages of the
+// next height are kept until it starts.
+func (t *Tendermint) handle(msg *Message) {
+	switch height := msg.Height(); {
+	case height == t.height+1:
+		if len(t.future) < t.opts.QueueSize {
+			t.future = append(t.future, msg)
+		}
+		return
+	case height != t.height:
+		return
+	}
+
+	if p := msg.Proposal; p != nil {
+		rs := t.roundState(p.Vote.Round)
+		rs.senders[p.Vote.Validator.Address()] = true
+		if rs.proposal == nil {
+			rs.proposal = p
+			t.blocks[p.Vote.BlockHash] = p.Block
+		}
+		return
+	}
+
+	v := msg.Vote
+	rs := t.roundState(v.Round)
+	rs.senders[v.Validator.Address()] = true
+	if v.Type == core.VotePrevote {
+		rs.prevotes.add(v)
+	} else {
+		rs.precommits.add(v)
+	}
+}
+
+func (t *Tendermint) roundState(round uint32) *roundState {
+	rs, ok := t.rounds[round]
+	if !ok {
+		rs = newRoundState(t.validators)
+		t.rounds[round] = rs
+	}
+	return rs
+}
+
+// apply fires the rules of the algorithm until none applies anymore.
+func (t *Tendermint) apply() {
+	for t.step != stepCommit && t.applyOnce() {
+	}
+}
+
+func (t *Tendermint) applyOnce() bool {
+	// a block precommitted by a quorum in any round is committed
+	for round, rs := range t.rounds {
+		hash, ok := rs.precommits.quorumHash()
+		if !ok || hash.IsZero() {
+			continue
+		}
+		if block, ok := t.blocks[hash]; ok && t.isValid(block) {
+			t.commit(round, block)
+			return true
+		}
+	}
+
+	// a third of the voting power in a later round means the validators
+	// moved on
+	for round, rs := range t.rounds {
+		if round > t.round && t.validators.HasThird(t.power(rs.senders)) {
+			t.startRound(round)
+			return true
+		}
+	}
+
+	rs := t.roundState(t.round)
+	p := rs.proposal
+
+	if t.step == stepPropose && p != nil {
+		hash := p.Vote.BlockHash
+		switch {
+		case p.POLRound == -1:
+			if t.isValid(p.Block) && (t.lockedRound == -1 || t.lockedHash() == hash) {
+				t.vote(core.VotePrevote, hash)
+			} else {
+				t.vote(core.VotePrevote, types.Hash{})
+			}
+			t.step = stepPrevote
+			return true
+		case t.roundState(uint32(p.POLRound)).prevotes.hasQuorumFor(hash):
+			if t.isValid(p.Block) && (t.lockedRound <= p.POLRound || t.lockedHash() == hash) {
+				t.vote(core.VotePrevote, hash)
+			} else {
+				t.vote(core.VotePrevote, types.Hash{})
+			}
+			t.step = stepPrevote
+			return true
+		}
+	}
+
+	if t.step == stepPrevote && !rs.prevoteTimeout && rs.prevotes.hasQuorum() {
+		rs.prevoteTimeout = true
+		t.schedule(t.opts.TimeoutPrevote, stepPrevote)
+	}
+
+	if t.step >= stepPrevote && !rs.polka && p != nil &&
+		rs.prevotes.hasQuorumFor(p.Vote.BlockHash) && t.isValid(p.Block) {
+		rs.polka = true
+		if t.step == stepPrevote {
+			t.lockedBlock, t.lockedRound = p.Block, int32(t.round)
+			t.vote(core.VotePrecommit, p.Vote.BlockHash)
+			t.step = stepPrecommit
+		}
+		t.validBlock, t.validRound = p.Block, int32(t.round)
+		return true
+	}
+
+	if t.step == stepPrevote && rs.prevotes.hasQuorumFor(types.Hash{}) {
+		t.vote(core.VotePrecommit, types.Hash{})
+		t.step = stepPrecommit
+		return true
+	}
+
+	if !rs.precommitTimeout && rs.precommits.hasQuorum() {
+		rs.precommitTimeout = true
+		t.schedule(t.opts.TimeoutPrecommit, stepPrecommit)
+	}
+
+	return false
+}
+
+func (t *Tendermint) onTimeout(to timeout) {
+	if to.height != t.height {
+		return
+	}
+
+	switch {
+	case to.step == stepCommit && t.step == stepCommit:
+		t.startHeight()
+	case to.round != t.round:
+	case to.step == stepPropose && t.step == stepPropose:
+		t.vote(core.VotePrevote, types.Hash{})
+		t.step = stepPrevote
+	case to.step == stepPrevote && t.step == stepPrevote:
+		t.vote(core.VotePrecommit, types.Hash{})
+		t.step = stepPrecommit
+	case to.step == stepPrecommit && t.step != stepCommit:
+		t.startRound(t.round + 1)
+	}
+}
+
+// onTip waits for the next height once the chain reached the current one,
+// the block may have been committed by the engine or arrived from a peer.
+func (t *Tendermint) onTip() {
+	if t.step == stepCommit || t.chain.Height() < t.height {
+		return
+	}
+
+	t.step = stepCommit
+	t.schedule(t.opts.TimeoutCommit, stepCommit)
+}
+
+// commit adds the block with the precommits of the round as its commit.
+func (t *Tendermint) commit(round uint32, block *core.Block) {
+	hash := block.Hash(core.BlockHasher{})
+	committed := *block
+	committed.Commit = core.NewCommit(round, t.rounds[round].precommits.votesFor(hash))
+
+	if err := t.chain.AddBlock(&committed); err != nil && !t.chain.HasBlockHash(hash) {
+		_ = t.logger.Log("msg", "failed to add committed block", "height", t.height, "hash", hash, "err", err)
+	}
+
+	t.step = stepCommit
+	t.schedule(t.opts.TimeoutCommit, stepCommit)
+}
+
+func (t *Tendermint) vote(voteType core.VoteType, hash types.Hash) {
+	v := &core.Vote{
+		Type:      voteType,
+		Height:    t.height,
+		Round:     t.round,
+		BlockHash: hash,
+	}
+	if err := v.Sign(t.privKey); err != nil {
+		_ = t.logger.Log("msg", "failed to sign vote", "err", err)
+		return
+	}
+
+	t.broadcast(&Message{Vote: v})
+	t.handle(&Message{Vote: v})
+}
+
+func (t *Tendermint) broadcast(msg *Message) {
+	if err := t.backend.Broadcast(msg); err != nil {
+		_ = t.logger.Log("msg", "failed to broadcast consensus message", "height", t.height, "round", t.round, "err", err)
+	}
+}
+
+// isValid checks a proposed block on top of the tip once.
+func (t *Tendermint) isValid(b *core.Block) bool {
+	hash := b.Hash(core.BlockHasher{})
+	err, ok := t.valid[hash]
+	if !ok {
+		err = t.chain.CheckProposal(b)
+		t.valid[hash] = err
+		if err != nil {
+			_ = t.logger.Log("msg", "invalid proposal", "height", b.Height, "hash", hash, "err", err)
+		}
+	}
+	return err == nil
+}
+
+func (t *Tendermint) lockedHash() types.Hash {
+	if t.lockedBlock == nil {
+		return types.Hash{}
+	}
+	return t.lockedBlock.Hash(core.BlockHasher{})
+}
+
+func (t *Tendermint) power(addrs map[types.Address]bool) uint64 {
+	power := uint64(0)
+	for addr := range addrs {
+		power += t.validators.Power(addr)
+	}
+	return power
+}
+
+// schedule delivers a timeout for the current height and round after the
+// duration of the step, which grows with the round.
+func (t *Tendermint) schedule(d time.Duration, s step) {
+	if s != stepCommit {
+		d += time.Duration(t.round) * t.opts.TimeoutDelta
+	}
+
+	to := timeout{height: t.height, round: t.round, step: s}
+	t.timers = append(t.timers, time.AfterFunc(d, func() {
+		select {
+		case t.timeoutCh <- to:
+		case <-t.done:
+		}
+	}))
+}
+
+func (t *Tendermint) stopTimers() {
+	for _, timer := range t.timers {
+		timer.Stop()
+	}
+	t.timers = nil
+}
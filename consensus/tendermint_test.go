@@ -0,0 +1,309 @@
+package consensus
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"go-blockchain/core"
+	"go-blockchain/crypto"
+	"go-blockchain/types"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+var testOpts = TendermintOpts{
+	TimeoutPropose:   50 * time.Millisecond,
+	TimeoutPrevote:   20 * time.Millisecond,
+	TimeoutPrecommit: 20 * time.Millisecond,
+	TimeoutDelta:     10 * time.Millisecond,
+	TimeoutCommit:    5 * time.Millisecond,
+}
+
+// testNode is the backend of an engine, its messages reach every other node
+// of the network right away.
+type testNode struct {
+	net    *testNetwork
+	chain  *core.Blockchain
+	engine Engine
+}
+
+type testNetwork struct {
+	lock  sync.RWMutex
+	nodes []*testNode
+}
+
+func (n *testNode) Chain() *core.Blockchain {
+	return n.chain
+}
+
+func (n *testNode) BuildBlock(parent *core.Header, _ types.Address) (*core.Block, error) {
+	return core.NewBlockFromPrevHeader(parent, nil)
+}
+
+// Broadcast hands every other node its own decoded copy of the message.
+func (n *testNode) Broadcast(msg *Message) error {
+	buf := &bytes.Buffer{}
+	if err := NewCanonicalMessageEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
+
+	n.net.lock.RLock()
+	defer n.net.lock.RUnlock()
+
+	for _, other := range n.net.nodes {
+		if other == n || other.engine == nil {
+			continue
+		}
+		decoded := new(Message)
+		if err := NewCanonicalMessageDecoder(bytes.NewReader(buf.Bytes())).Decode(decoded); err != nil {
+			return err
+		}
+		_ = other.engine.HandleMessage(decoded)
+	}
+	return nil
+}
+
+// newTestNetwork creates a node per key on a chain with BFT consensus, the
+// engines are created by newEngine and run until the test ends.
+func newTestNetwork(t *testing.T, privKeys []crypto.PrivateKey, newEngine func(*testNode, crypto.PrivateKey) Engine) []*testNode {
+	g := &core.Genesis{
+		Timestamp: time.Now().UnixNano(),
+		Params:    core.GenesisParams{Consensus: core.ConsensusBFT},
+	}
+	for _, privKey := range privKeys {
+		g.Validators = append(g.Validators, core.GenesisValidator{PublicKey: privKey.PublicKey(), Power: 1})
+	}
+
+	net := &testNetwork{}
+	for range privKeys {
+		chain, err := core.NewBlockChainFromGenesis(g, core.BlockchainOpts{})
+		assert.Nil(t, err)
+		net.nodes = append(net.nodes, &testNode{net: net, chain: chain})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	net.lock.Lock()
+	for i, node := range net.nodes {
+		node.engine = newEngine(node, privKeys[i])
+	}
+	net.lock.Unlock()
+
+	for _, node := range net.nodes {
+		if node.engine == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(e Engine) {
+			defer wg.Done()
+			e.Run(ctx)
+		}(node.engine)
+	}
+
+	return net.nodes
+}
+
+func newTestTendermint(t *testing.T) func(*testNode, crypto.PrivateKey) Engine {
+	return func(node *testNode, privKey crypto.PrivateKey) Engine {
+		e, err := NewTendermint(node, privKey, nil, testOpts, log.NewNopLogger())
+		assert.Nil(t, err)
+		return e
+	}
+}
+
+func generateKeys(n int) []crypto.PrivateKey {
+	keys := make([]crypto.PrivateKey, n)
+	for i := range keys {
+		keys[i] = crypto.GeneratePrivateKey()
+	}
+	return keys
+}
+
+// assertCommitted waits for the honest nodes to reach height and checks that
+// they committed the same blocks.
+func assertCommitted(t *testing.T, nodes []*testNode, height uint32) {
+	for _, node := range nodes {
+		assert.Eventually(t, func() bool {
+			return node.chain.Height() >= height
+		}, 10*time.Second, 5*time.Millisecond)
+	}
+
+	validators := nodes[0].chain.Authority().Validators()
+	for h := uint32(1); h <= height; h++ {
+		b, err := nodes[0].chain.GetBlock(h)
+		assert.Nil(t, err)
+		assert.NotNil(t, b.Commit)
+		assert.Nil(t, b.Commit.Verify(b, validators))
+
+		for _, node := range nodes[1:] {
+			other, err := node.chain.GetBlock(h)
+			assert.Nil(t, err)
+			assert.Equal(t, b.Hash(core.BlockHasher{}), other.Hash(core.BlockHasher{}))
+		}
+	}
+
+	for _, node := range nodes {
+		assert.GreaterOrEqual(t, node.chain.FinalizedHeight(), height)
+	}
+}
+
+func TestTendermintCommitsBlocks(t *testing.T) {
+	nodes := newTestNetwork(t, generateKeys(4), newTestTendermint(t))
+	assertCommitted(t, nodes, 5)
+}
+
+// byzantine votes for random blocks in the first rounds of every height and
+// never proposes.
+type byzantine struct {
+	node    *testNode
+	privKey crypto.PrivateKey
+}
+
+func (b *byzantine) Run(ctx context.Context) {
+	ticker := time.NewTicker(5 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		height := b.node.chain.Height() + 1
+		for round := uint32(0); round < 3; round++ {
+			for _, voteType := range []core.VoteType{core.VotePrevote, core.VotePrecommit} {
+				v := &core.Vote{Type: voteType, Height: height, Round: round, BlockHash: types.RandomHash()}
+				if err := v.Sign(b.privKey); err != nil {
+					return
+				}
+				_ = b.node.Broadcast(&Message{Vote: v})
+			}
+		}
+	}
+}
+
+func (b *byzantine) HandleMessage(*Message) error {
+	return nil
+}
+
+func TestTendermintToleratesFaultyThird(t *testing.T) {
+	tendermint := newTestTendermint(t)
+	nodes := newTestNetwork(t, generateKeys(4), func(node *testNode, privKey crypto.PrivateKey) Engine {
+		if node == node.net.nodes[1] {
+			return &byzantine{node: node, privKey: privKey}
+		}
+		return tendermint(node, privKey)
+	})
+
+	// the heights proposed by the faulty validator are committed in later rounds
+	honest := []*testNode{nodes[0], nodes[2], nodes[3]}
+	assertCommitted(t, honest, 6)
+}
+
+func TestTendermintHaltsWithoutQuorum(t *testing.T) {
+	tendermint := newTestTendermint(t)
+	nodes := newTestNetwork(t, generateKeys(4), func(node *testNode, privKey crypto.PrivateKey) Engine {
+		// two of four validators are offline
+		if node == node.net.nodes[0] || node == node.net.nodes[1] {
+			return nil
+		}
+		return tendermint(node, privKey)
+	})
+
+	time.Sleep(300 * time.Millisecond)
+	for _, node := range nodes {
+		assert.Equal(t, uint32(0), node.chain.Height())
+	}
+}
+
+func TestTendermintReproposesSignedBlock(t *testing.T) {
+	privKeys := generateKeys(4)
+	nodes := newTestNetwork(t, privKeys, func(*testNode, crypto.PrivateKey) Engine { return nil })
+	path := filepath.Join(t.TempDir(), "sign_state")
+	done := make(chan struct{})
+	close(done)
+
+	// the validator proposing at height 1 in rounds 0 and 4
+	newEngine := func() *Tendermint {
+		state, err := LoadSignState(path)
+		assert.Nil(t, err)
+		e, err := NewTendermint(nodes[1], privKeys[1], state, testOpts, log.NewNopLogger())
+		assert.Nil(t, err)
+		e.done = done
+		t.Cleanup(e.stopTimers)
+		return e
+	}
+
+	e := newEngine()
+	e.startHeight()
+	signed := e.rounds[0].proposal.Block
+	assert.NotNil(t, signed)
+
+	// without a valid block the block of round 0 is proposed again, also
+	// after a restart
+	e.startRound(4)
+	assert.Equal(t, signed.Hash(core.BlockHasher{}), e.rounds[4].proposal.Block.Hash(core.BlockHasher{}))
+
+	restarted := newEngine()
+	restarted.startHeight()
+	assert.Equal(t, signed.Hash(core.BlockHasher{}), restarted.rounds[0].proposal.Block.Hash(core.BlockHasher{}))
+}
+
+func TestTendermintRejectsInvalidMessages(t *testing.T) {
+	privKeys := generateKeys(4)
+	nodes := newTestNetwork(t, privKeys, func(*testNode, crypto.PrivateKey) Engine { return nil })
+	e, err := NewTendermint(nodes[0], privKeys[0], nil, testOpts, log.NewNopLogger())
+	assert.Nil(t, err)
+
+	_, err = NewTendermint(nodes[0], crypto.GeneratePrivateKey(), nil, testOpts, log.NewNopLogger())
+	assert.NotNil(t, err)
+
+	// a vote of a node outside of the set
+	v := &core.Vote{Type: core.VotePrevote, Height: 1}
+	assert.Nil(t, v.Sign(crypto.GeneratePrivateKey()))
+	assert.ErrorIs(t, e.HandleMessage(&Message{Vote: v}), ErrInvalidMessage)
+
+	// a tampered vote
+	assert.Nil(t, v.Sign(privKeys[2]))
+	v.Round = 1
+	assert.ErrorIs(t, e.HandleMessage(&Message{Vote: v}), ErrInvalidMessage)
+
+	// a proposal of a validator whose turn it is not
+	genesis, err := nodes[0].chain.GetHeader(0)
+	assert.Nil(t, err)
+	block, err := core.NewBlockFromPrevHeader(genesis, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, block.Sign(privKeys[2]))
+
+	p := &Proposal{
+		Vote:     core.Vote{Type: core.VoteProposal, Height: 1, BlockHash: block.Hash(core.BlockHasher{})},
+		POLRound: -1,
+		Block:    block,
+	}
+	assert.Nil(t, p.Vote.Sign(privKeys[2]))
+	assert.ErrorIs(t, e.HandleMessage(&Message{Proposal: p}), ErrInvalidMessage)
+
+	// a vote and a proposal without a key, as a peer may send them
+	unsigned := &core.Vote{Type: core.VotePrecommit, Height: 1}
+	assert.Nil(t, unsigned.Sign(privKeys[2]))
+	unsigned.Validator = crypto.PublicKey{}
+	assert.ErrorIs(t, e.HandleMessage(&Message{Vote: unsigned}), ErrInvalidMessage)
+
+	keyless := *p
+	keyless.Vote.Validator = crypto.PublicKey{}
+	assert.ErrorIs(t, e.HandleMessage(&Message{Proposal: &keyless}), ErrInvalidMessage)
+
+	assert.Nil(t, p.Vote.Sign(privKeys[1]))
+	assert.Nil(t, e.HandleMessage(&Message{Proposal: p}))
+}
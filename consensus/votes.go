@@ -0,0 +1,92 @@
+package consensus
+
+import (
+	"go-blockchain/core"
+	"go-blockchain/types"
+)
+
+// voteSet holds the first vote of every validator for one step of a round,
+// later conflicting votes of the same validator are ignored.
+type voteSet struct {
+	validators *core.ValidatorSet
+	votes      map[types.Address]*core.Vote
+	// power sums the voting power per block hash, total over all hashes
+	power map[types.Hash]uint64
+	total uint64
+}
+
+func newVoteSet(validators *core.ValidatorSet) *voteSet {
+	return &voteSet{
+		validators: validators,
+		votes:      map[types.Address]*core.Vote{},
+		power:      map[types.Hash]uint64{},
+	}
+}
+
+// add records a vote and reports whether it was new.
+func (s *voteSet) add(v *core.Vote) bool {
+	addr := v.Validator.Address()
+	if _, ok := s.votes[addr]; ok {
+		return false
+	}
+
+	power := s.validators.Power(addr)
+	s.votes[addr] = v
+	s.power[v.BlockHash] += power
+	s.total += power
+	return true
+}
+
+// hasQuorum reports whether a quorum voted, for any block or none.
+func (s *voteSet) hasQuorum() bool {
+	return s.validators.HasQuorum(s.total)
+}
+
+// hasQuorumFor reports whether a quorum voted for the block hash, a zero hash
+// stands for no block.
+func (s *voteSet) hasQuorumFor(hash types.Hash) bool {
+	return s.validators.HasQuorum(s.power[hash])
+}
+
+// quorumHash returns the hash a quorum voted for.
+func (s *voteSet) quorumHash() (types.Hash, bool) {
+	for hash, power := range s.power {
+		if s.validators.HasQuorum(power) {
+			return hash, true
+		}
+	}
+	return types.Hash{}, false
+}
+
+// votesFor returns the votes for the block hash.
+func (s *voteSet) votesFor(hash types.Hash) []*core.Vote {
+	votes := []*core.Vote{}
+	for _, v := range s.votes {
+		if v.BlockHash == hash {
+			votes = append(votes, v)
+		}
+	}
+	return votes
+}
+
+// roundState holds what was received for a round of the current height and
+// which of the rules that fire once per round already did.
+type roundState struct {
+	proposal   *Proposal
+	prevotes   *voteSet
+	precommits *voteSet
+	// senders are the validators that sent anything for the round
+	senders map[types.Address]bool
+
+	prevoteTimeout   bool
+	precommitTimeout bool
+	polka            bool
+}
+
+func newRoundState(validators *core.ValidatorSet) *roundState {
+	return &roundState{
+		prevotes:   newVoteSet(validators),
+		precommits: newVoteSet(validators),
+		senders:    map[types.Address]bool{},
+	}
+}
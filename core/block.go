@@ -2,8 +2,7 @@ package core
 
 import (
 	"bytes"
-	"crypto/sha256"
-	"encoding/gob"
+	"errors"
 	"fmt"
 	"time"
 
@@ -11,18 +10,41 @@ import (
 	"go-blockchain/types"
 )
 
+const (
+	// HeaderVersionFlat blocks hashed a gob concatenation of all transactions,
+	// they are no longer accepted since transactions and headers are encoded
+	// canonically
+	HeaderVersionFlat uint32 = 1
+	// HeaderVersionMerkle blocks use the Merkle root of the transaction hashes
+	HeaderVersionMerkle uint32 = 2
+	// HeaderVersionPoW blocks use the Merkle root and carry a proof of work
+	// in Bits and Nonce
+	HeaderVersionPoW uint32 = 3
+)
+
+// ErrInvalidSignature is returned for a block or transaction whose signature
+// is missing or does not verify.
+var ErrInvalidSignature = errors.New("invalid signature")
+
 type Header struct {
-	Version       uint32
+	Version uint32
+	// ChainID binds the signature of the validator to one chain, so a
+	// block it signs on another network is no evidence against it here
+	ChainID       uint64
 	DataHash      types.Hash
 	PrevBlockHash types.Hash
 	Height        uint32
 	Timestamp     int64
+	// Bits is the compact target the hash of the header must meet and Nonce
+	// is varied to meet it, both are only part of HeaderVersionPoW headers
+	Bits  uint32
+	Nonce uint64
 }
 
+// Bytes returns the canonical encoding of the header.
 func (h *Header) Bytes() []byte {
 	buf := &bytes.Buffer{}
-	enc := gob.NewEncoder(buf)
-	_ = enc.Encode(h)
+	_ = NewCanonicalHeaderEncoder(buf).Encode(h)
 	return buf.Bytes()
 }
 
@@ -31,6 +53,9 @@ type Block struct {
 	Transactions []Transaction
 	Validator    crypto.PublicKey
 	Signature    *crypto.Signature
+	// Commit certifies that the validators finalized the block, nil for
+	// blocks of chains without BFT consensus
+	Commit *Commit
 	// Cached version of the header hash
 	hash types.Hash
 }
@@ -43,13 +68,14 @@ func NewBlock(h *Header, txx []Transaction) *Block {
 }
 
 func NewBlockFromPrevHeader(prevHeader *Header, txx []Transaction) (*Block, error) {
-	dataHash, err := CalculateDataHash(txx)
+	dataHash, err := CalculateDataHashForVersion(HeaderVersionMerkle, txx)
 	if err != nil {
 		return nil, err
 	}
 
 	header := &Header{
-		Version:       1,
+		Version:       HeaderVersionMerkle,
+		ChainID:       prevHeader.ChainID,
 		DataHash:      dataHash,
 		PrevBlockHash: BlockHasher{}.Hash(prevHeader),
 		Timestamp:     time.Now().UnixNano(),
@@ -62,8 +88,10 @@ func NewBlockFromPrevHeader(prevHeader *Header, txx []Transaction) (*Block, erro
 func (b *Block) AddTransaction(tx *Transaction) {
 	b.Transactions = append(b.Transactions, *tx)
 }
+
+// Sign signs the hash of the canonical header encoding.
 func (b *Block) Sign(privKey crypto.PrivateKey) error {
-	sig, err := privKey.Sign(b.Header.Bytes())
+	sig, err := privKey.Sign(BlockHasher{}.Hash(b.Header).ToSlice())
 	if err != nil {
 		return err
 	}
@@ -72,11 +100,8 @@ func (b *Block) Sign(privKey crypto.PrivateKey) error {
 	return nil
 }
 func (b *Block) Verify() error {
-	if b.Signature == nil {
-		return fmt.Errorf("block has no signature")
-	}
-	if !b.Signature.Verify(b.Validator, b.Header.Bytes()) {
-		return fmt.Errorf("block has invalid signature")
+	if err := b.verifySignature(); err != nil {
+		return err
 	}
 	for _, tx := range b.Transactions {
 		if err := tx.Verify(); err != nil {
@@ -84,18 +109,39 @@ func (b *Block) Verify() error {
 		}
 	}
 
-	dataHash, err := CalculateDataHash(b.Transactions)
+	dataHash, err := CalculateDataHashForVersion(b.Version, b.Transactions)
 	if err != nil {
 		return err
 	}
 
 	if dataHash != b.DataHash {
-		return fmt.Errorf("data hash mismatch: %x, %x", dataHash, b.DataHash)
+		return fmt.Errorf("%w: %x, %x", ErrDataHashMismatch, dataHash, b.DataHash)
 	}
 
 	return nil
 }
 
+// verifySignature checks the signature of the validator over the header.
+func (b *Block) verifySignature() error {
+	if b.Signature == nil {
+		return fmt.Errorf("%w: block has no signature", ErrInvalidSignature)
+	}
+	if b.Validator.Key == nil {
+		return fmt.Errorf("%w: block has no validator", ErrInvalidSignature)
+	}
+	if !b.Signature.Verify(b.Validator, BlockHasher{}.Hash(b.Header).ToSlice()) {
+		return fmt.Errorf("%w of block", ErrInvalidSignature)
+	}
+	return nil
+}
+
+// Size returns the length of the canonical encoding of the block.
+func (b *Block) Size() int {
+	counter := &countingWriter{}
+	_ = NewCanonicalBlockEncoder(counter).Encode(b)
+	return counter.n
+}
+
 func (b *Block) Decode(dec Decoder[*Block]) error {
 	return dec.Decode(b)
 }
@@ -111,15 +157,13 @@ func (b *Block) Hash(hasher Hasher[*Header]) types.Hash {
 	return b.hash
 }
 
-func CalculateDataHash(txx []Transaction) (hash types.Hash, err error) {
-	buf := &bytes.Buffer{}
-
-	for _, tx := range txx {
-		if err = tx.Encode(NewGobTxEncoder(buf)); err != nil {
-			return
-		}
+// CalculateDataHashForVersion returns the data hash of the transactions as
+// defined by the given header version.
+func CalculateDataHashForVersion(version uint32, txx []Transaction) (types.Hash, error) {
+	switch version {
+	case HeaderVersionMerkle, HeaderVersionPoW:
+		return CalculateMerkleRoot(txx), nil
+	default:
+		return types.Hash{}, fmt.Errorf("unknown header version %d", version)
 	}
-
-	hash = sha256.Sum256(buf.Bytes())
-	return
 }
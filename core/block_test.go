@@ -10,19 +10,20 @@ import (
 )
 
 func randomBlock(t *testing.T, height uint32, prevBlockHash types.Hash) *Block {
-	privKey := crypto.GeneratePrivateKey()
+	return randomBlockWithSigner(t, crypto.GeneratePrivateKey(), height, prevBlockHash)
+}
+
+func randomBlockWithSigner(t *testing.T, privKey crypto.PrivateKey, height uint32, prevBlockHash types.Hash) *Block {
 	tx := randomTxWithSignature(t)
 	header := &Header{
-		Version:       1,
+		Version:       HeaderVersionMerkle,
 		PrevBlockHash: prevBlockHash,
 		Height:        height,
 		Timestamp:     time.Now().UnixNano(),
 	}
 
 	b := NewBlock(header, []Transaction{tx})
-	dataHash, err := CalculateDataHash(b.Transactions)
-	assert.Nil(t, err)
-	b.Header.DataHash = dataHash
+	b.Header.DataHash = CalculateMerkleRoot(b.Transactions)
 	assert.Nil(t, b.Sign(privKey))
 
 	return b
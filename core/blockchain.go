@@ -1,51 +1,458 @@
 package core
 
 import (
+	"errors"
 	"fmt"
+	"math/big"
 	"sync"
+	"time"
+
+	"go-blockchain/types"
 
 	"github.com/sirupsen/logrus"
 )
 
+// MaxSideBranchDepth is how far below the tip side branch blocks are kept
+// before they are pruned from the block tree.
+const MaxSideBranchDepth = 1000
+
 type Blockchain struct {
-	store     Storage
-	lock      sync.RWMutex
-	headers   []*Header
-	validator Validator
+	store   Storage
+	lock    sync.RWMutex
+	headers []*Header
+	// weights holds the cumulative fork choice weight of every canonical block
+	weights []*big.Int
+	// undos holds what is needed to revert the state changes of every canonical block
+	undos   []*StateUndo
+	state   *State
+	chainID uint64
+	// blockIndex maps the hash of every canonical block to its height
+	blockIndex map[types.Hash]uint32
+	// txIndex maps the hash of every canonical transaction to its position
+	txIndex map[types.Hash]TxLocation
+	// side holds the known blocks that are not part of the canonical chain,
+	// children links every block to the side blocks built on top of it
+	side           map[types.Hash]*blockNode
+	children       map[types.Hash][]types.Hash
+	forkChoice     ForkChoice
+	reorgHandlers  []ReorgHandler
+	blockHandlers  []BlockHandler
+	orphans        *OrphanPool
+	orphanHandlers []OrphanHandler
+	// evidence detects validators signing two blocks at a height, it is nil
+	// without a validator set
+	evidence         *EvidencePool
+	evidenceHandlers []EvidenceHandler
+	validator        Validator
+	rules            BlockRules
+	authority        *ProofOfAuthority
+	pow              *ProofOfWork
+	requireCommit    bool
+	// finalized is the height of the last committed block, no reorg goes
+	// below it
+	finalized uint32
+}
+
+type BlockchainOpts struct {
+	// Storage persists the canonical chain, defaults to an in memory store
+	Storage Storage
+	// ForkChoice picks the canonical branch, defaults to LongestChain
+	ForkChoice ForkChoice
+	// MaxOrphans and MaxOrphanAge bound the pool of blocks with unknown parents
+	MaxOrphans   int
+	MaxOrphanAge time.Duration
+	// GenesisAlloc is the account state before the genesis block
+	GenesisAlloc GenesisAlloc
+	// ChainID is the chain every transaction must be signed for
+	ChainID uint64
+	// Authority restricts who may propose which block, when nil any signed
+	// block is accepted
+	Authority *ProofOfAuthority
+	// RequireCommit only accepts blocks carrying a commit certificate of the
+	// validators of Authority
+	RequireCommit bool
+	// ProofOfWork only accepts blocks whose hash meets their target
+	ProofOfWork *ProofOfWork
+	// Rules are the limits every block must stay within, unset rules use the
+	// defaults
+	Rules BlockRules
+}
+
+// TxLocation is the position of a transaction inside the chain.
+type TxLocation struct {
+	Height uint32
+	Index  int
+}
+
+type blockNode struct {
+	block  *Block
+	weight *big.Int
+}
+
+// ReorgEvent describes a switch of the canonical chain to another branch.
+type ReorgEvent struct {
+	OldTip types.Hash
+	NewTip types.Hash
+	// CommonAncestor is the height of the last block shared by both branches
+	CommonAncestor uint32
+	Removed        []*Block
+	Added          []*Block
+	// OrphanedTxs are the transactions of removed blocks that the new branch does not include
+	OrphanedTxs []*Transaction
 }
 
+// ReorgHandler is called after every reorg, outside of the blockchain lock.
+type ReorgHandler func(ReorgEvent)
+
+// BlockHandler is called for every block that becomes part of the canonical
+// chain, outside of the blockchain lock.
+type BlockHandler func(*Block)
+
 func NewBlockChain(genesis *Block) (*Blockchain, error) {
+	return NewBlockChainWithOpts(genesis, BlockchainOpts{})
+}
+
+func NewBlockChainWithStore(store Storage, genesis *Block) (*Blockchain, error) {
+	return NewBlockChainWithOpts(genesis, BlockchainOpts{Storage: store})
+}
+
+// NewBlockChainWithOpts creates a blockchain on top of the given store. If the
+// store already holds blocks the headers are rebuilt from it, otherwise the
+// genesis block is added as the first block.
+func NewBlockChainWithOpts(genesis *Block, opts BlockchainOpts) (*Blockchain, error) {
+	if opts.Storage == nil {
+		opts.Storage = NewMemStore()
+	}
+
+	if opts.ForkChoice == nil {
+		opts.ForkChoice = LongestChain{}
+	}
+
+	if opts.MaxOrphans == 0 {
+		opts.MaxOrphans = DefaultMaxOrphans
+	}
+
+	if opts.MaxOrphanAge == 0 {
+		opts.MaxOrphanAge = DefaultMaxOrphanAge
+	}
+
 	bc := &Blockchain{
-		headers: []*Header{},
-		store:   NewMemStore(),
-		lock:    sync.RWMutex{},
+		headers:       []*Header{},
+		weights:       []*big.Int{},
+		undos:         []*StateUndo{},
+		state:         NewState(opts.GenesisAlloc),
+		chainID:       opts.ChainID,
+		blockIndex:    make(map[types.Hash]uint32),
+		txIndex:       make(map[types.Hash]TxLocation),
+		side:          make(map[types.Hash]*blockNode),
+		children:      make(map[types.Hash][]types.Hash),
+		store:         opts.Storage,
+		forkChoice:    opts.ForkChoice,
+		orphans:       NewOrphanPool(opts.MaxOrphans, opts.MaxOrphanAge),
+		rules:         opts.Rules.withDefaults(),
+		authority:     opts.Authority,
+		pow:           opts.ProofOfWork,
+		requireCommit: opts.RequireCommit,
+		lock:          sync.RWMutex{},
 	}
 
 	bc.validator = NewBlockValidator(bc)
 
-	err := bc.addBlockWithoutValidation(genesis)
+	if bc.authority != nil {
+		bc.state.Bond(bc.authority.Validators().Members())
+		bc.evidence = NewEvidencePool(MaxSideBranchDepth)
+	}
+
+	if bc.store.Len() == 0 {
+		return bc, bc.addBlockWithoutValidation(genesis)
+	}
+
+	return bc, bc.loadFromStore(genesis)
+}
+
+// loadFromStore replays the stored canonical chain, every block has to sit at
+// its height and link to the block stored below it.
+func (bc *Blockchain) loadFromStore(genesis *Block) error {
+	weight := big.NewInt(0)
+	prevHash := types.Hash{}
+
+	for height := 0; height < bc.store.Len(); height++ {
+		b, err := bc.store.GetByHeight(uint32(height))
+		if err != nil {
+			return err
+		}
+
+		hash := b.Hash(BlockHasher{})
+		if height == 0 && hash != genesis.Hash(BlockHasher{}) {
+			return fmt.Errorf("stored genesis %s does not match genesis %s", hash, genesis.Hash(BlockHasher{}))
+		}
+		if b.Height != uint32(height) {
+			return fmt.Errorf("stored block %s at height %d has height %d", hash, height, b.Height)
+		}
+		if height > 0 && b.PrevBlockHash != prevHash {
+			return fmt.Errorf("stored block %s at height %d links to %s, expected %s", hash, height, b.PrevBlockHash, prevHash)
+		}
+		prevHash = hash
+
+		undo, err := bc.state.ApplyBlock(b)
+		if err != nil {
+			return err
+		}
+
+		weight = new(big.Int).Add(weight, bc.forkChoice.Weight(b))
+		bc.appendBlock(b, weight, undo)
+	}
+	bc.pruneSideBranches()
+
+	logrus.WithFields(logrus.Fields{
+		"height": bc.Height(),
+	}).Info("loaded blockchain from store")
 
-	return bc, err
+	return nil
 }
 
 func (bc *Blockchain) SetValidator(v Validator) {
 	bc.validator = v
 }
 
+// Authority returns the proposer schedule of the chain, nil if anyone may
+// propose blocks.
+func (bc *Blockchain) Authority() *ProofOfAuthority {
+	return bc.authority
+}
+
+// ProofOfWork returns the mining rules of the chain, nil if blocks need no
+// proof of work.
+func (bc *Blockchain) ProofOfWork() *ProofOfWork {
+	return bc.pow
+}
+
+// NextBits returns the compact target of a block on top of parent, which may
+// be the tip or any block of a side branch.
+func (bc *Blockchain) NextBits(parent *Header) (uint32, error) {
+	if bc.pow == nil {
+		return 0, fmt.Errorf("chain has no proof of work")
+	}
+	return bc.pow.NextBits(parent, bc.lookupHeader)
+}
+
+// RequiresCommit reports whether every block must carry a commit certificate.
+func (bc *Blockchain) RequiresCommit() bool {
+	return bc.requireCommit
+}
+
+// FinalizedHeight returns the height of the last committed block, blocks at
+// or below it are never reorged out.
+func (bc *Blockchain) FinalizedHeight() uint32 {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	return bc.finalized
+}
+
+// OnReorg registers a handler that is called after every reorg.
+func (bc *Blockchain) OnReorg(h ReorgHandler) {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	bc.reorgHandlers = append(bc.reorgHandlers, h)
+}
+
+// OnBlock registers a handler that is called for every new canonical block,
+// the blocks added by a reorg are passed after the reorg handlers ran.
+func (bc *Blockchain) OnBlock(h BlockHandler) {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	bc.blockHandlers = append(bc.blockHandlers, h)
+}
+
+// OnOrphan registers a handler that is called for every new orphan block.
+func (bc *Blockchain) OnOrphan(h OrphanHandler) {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	bc.orphanHandlers = append(bc.orphanHandlers, h)
+}
+
+// OnEvidence registers a handler that is called for every validator caught
+// signing two blocks at the same height.
+func (bc *Blockchain) OnEvidence(h EvidenceHandler) {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	bc.evidenceHandlers = append(bc.evidenceHandlers, h)
+}
+
+// ReportBlock checks a block that was received but not added, like one
+// conflicting with a finalized block, for a double sign of its validator.
+func (bc *Blockchain) ReportBlock(b *Block) {
+	if bc.evidence == nil || b.Verify() != nil {
+		return
+	}
+	bc.observe(b)
+}
+
+// observe records the signed header of a verified block and passes the
+// evidence to the handlers if its validator already signed another block at
+// the same height.
+func (bc *Blockchain) observe(b *Block) {
+	if bc.evidence == nil || b.Validator.Key == nil {
+		return
+	}
+	if validators := bc.authority.ValidatorsAt(b.PrevBlockHash); validators == nil || !validators.Has(b.Validator.Address()) {
+		return
+	}
+
+	e := bc.evidence.Add(b)
+	if e == nil {
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"validator": e.Offender(),
+		"height":    e.Height(),
+		"hash_a":    BlockHasher{}.Hash(e.HeaderA),
+		"hash_b":    BlockHasher{}.Hash(e.HeaderB),
+	}).Warn("detected double sign")
+
+	bc.lock.RLock()
+	handlers := bc.evidenceHandlers
+	bc.lock.RUnlock()
+
+	for _, h := range handlers {
+		h(e)
+	}
+}
+
+// OrphanStats returns metrics about the orphan pool.
+func (bc *Blockchain) OrphanStats() OrphanStats {
+	return bc.orphans.Stats()
+}
+
+// AddBlock validates the block and adds it to the block tree. A block extending
+// the tip becomes the new tip, a block on another branch triggers a reorg once
+// that branch outweighs the canonical chain. A block with an unknown parent is
+// kept as an orphan and an *OrphanError is returned, orphans are connected
+// automatically once their parent is added.
 func (bc *Blockchain) AddBlock(b *Block) error {
+	if err := bc.addBlock(b); err != nil {
+		return err
+	}
+
+	bc.connectOrphans(b.Hash(BlockHasher{}))
+
+	return nil
+}
+
+func (bc *Blockchain) addBlock(b *Block) error {
 	if err := bc.validator.ValidateBlock(b); err != nil {
+		if errors.Is(err, ErrUnknownParent) {
+			return bc.addOrphan(b)
+		}
 		return err
 	}
+	bc.observe(b)
 
-	_ = bc.addBlockWithoutValidation(b)
+	bc.lock.Lock()
+	event, err := bc.connectBlock(b)
+	added := []*Block{}
+	if event != nil {
+		added = event.Added
+	} else if _, ok := bc.blockIndex[b.Hash(BlockHasher{})]; ok {
+		added = append(added, b)
+	}
+	reorgHandlers := bc.reorgHandlers
+	blockHandlers := bc.blockHandlers
+	bc.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if event != nil {
+		for _, h := range reorgHandlers {
+			h(*event)
+		}
+	}
+
+	for _, added := range added {
+		for _, h := range blockHandlers {
+			h(added)
+		}
+	}
 
 	return nil
 }
 
+func (bc *Blockchain) addOrphan(b *Block) error {
+	if err := bc.rules.checkBlock(b, time.Now()); err != nil {
+		return err
+	}
+
+	if err := b.Verify(); err != nil {
+		return err
+	}
+
+	hash := b.Hash(BlockHasher{})
+	isNew := bc.orphans.Add(b)
+	missing := bc.orphans.MissingAncestor(b)
+
+	if isNew {
+		bc.lock.RLock()
+		handlers := bc.orphanHandlers
+		bc.lock.RUnlock()
+
+		logrus.WithFields(logrus.Fields{
+			"height":  b.Height,
+			"hash":    hash,
+			"missing": missing,
+		}).Info("adding orphan block")
+
+		for _, h := range handlers {
+			h(b, missing)
+		}
+	}
+
+	// the parent may have been connected while the block was being validated
+	if bc.HasBlockHash(b.PrevBlockHash) {
+		bc.connectOrphans(b.PrevBlockHash)
+		if bc.HasBlockHash(hash) {
+			return nil
+		}
+	}
+
+	return &OrphanError{Hash: hash, Missing: missing}
+}
+
+// connectOrphans adds every orphan that descends from parent.
+func (bc *Blockchain) connectOrphans(parent types.Hash) {
+	queue := []types.Hash{parent}
+
+	for len(queue) > 0 {
+		hash := queue[0]
+		queue = queue[1:]
+
+		for _, child := range bc.orphans.TakeChildren(hash) {
+			if err := bc.addBlock(child); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"hash": child.Hash(BlockHasher{}),
+					"err":  err,
+				}).Warn("failed to connect orphan block")
+				continue
+			}
+			queue = append(queue, child.Hash(BlockHasher{}))
+		}
+	}
+}
+
 func (bc *Blockchain) HasBlock(height uint32) bool {
 	return height <= bc.Height()
 }
 
+// HasBlockHash reports whether the block is known, either as part of the
+// canonical chain or of a side branch.
+func (bc *Blockchain) HasBlockHash(hash types.Hash) bool {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	return bc.knows(hash)
+}
+
 // 0,1,2,3 => len = 4, height = 3
 func (bc *Blockchain) Height() uint32 {
 	bc.lock.RLock()
@@ -55,25 +462,470 @@ func (bc *Blockchain) Height() uint32 {
 
 func (bc *Blockchain) addBlockWithoutValidation(b *Block) error {
 	bc.lock.Lock()
-	bc.headers = append(bc.headers, b.Header)
-	bc.lock.Unlock()
+	defer bc.lock.Unlock()
+
+	return bc.applyBlock(b, bc.forkChoice.Weight(b))
+}
+
+// connectBlock adds a validated block to the block tree and reorgs if needed,
+// the caller must hold the lock.
+func (bc *Blockchain) connectBlock(b *Block) (*ReorgEvent, error) {
+	hash := b.Hash(BlockHasher{})
+	if bc.knows(hash) {
+		return nil, fmt.Errorf("block at height %d with hash %s already exists", b.Height, hash)
+	}
+
+	parentWeight, ok := bc.weightOf(b.PrevBlockHash)
+	if !ok {
+		return nil, fmt.Errorf("%w %s for block at height %d", ErrUnknownParent, b.PrevBlockHash, b.Height)
+	}
+	weight := new(big.Int).Add(parentWeight, bc.forkChoice.Weight(b))
+
+	if b.PrevBlockHash == bc.tipHash() {
+		if err := bc.applyBlock(b, weight); err != nil {
+			return nil, err
+		}
+		bc.pruneSideBranches()
+		return nil, nil
+	}
+
+	bc.addSideBlock(b, weight)
+
+	// a committed block is final, its branch wins whatever its weight
+	if b.Commit == nil && weight.Cmp(bc.weights[len(bc.weights)-1]) <= 0 {
+		logrus.WithFields(logrus.Fields{
+			"height": b.Height,
+			"hash":   hash,
+		}).Info("adding side branch block")
+		return nil, nil
+	}
+
+	event, err := bc.reorg(hash)
+	if err != nil {
+		return nil, err
+	}
+	bc.pruneSideBranches()
+
+	return event, nil
+}
+
+// reorg switches the canonical chain to the branch ending in newTip. Either the
+// whole branch is applied or the canonical chain is restored.
+func (bc *Blockchain) reorg(newTip types.Hash) (*ReorgEvent, error) {
+	var (
+		branch        = []*blockNode{}
+		ancestor      uint32
+		oldTip        = bc.tipHash()
+		currentHeight = uint32(len(bc.headers) - 1)
+		finalized     = bc.finalized
+	)
+
+	for hash := newTip; ; {
+		if height, ok := bc.blockIndex[hash]; ok {
+			ancestor = height
+			break
+		}
+		node := bc.side[hash]
+		branch = append([]*blockNode{node}, branch...)
+		hash = node.block.PrevBlockHash
+	}
+
+	// a branch forking below the finalized block is dead
+	if ancestor < finalized {
+		bc.removeSideBlock(branch[0].block)
+		bc.dropSubtree(branch[0].block.Hash(BlockHasher{}))
+		return nil, fmt.Errorf("reorg to %s at height %d %w at height %d", newTip, ancestor, ErrFinalized, finalized)
+	}
+
+	removed := []*blockNode{}
+	for height := ancestor + 1; height <= currentHeight; height++ {
+		b, err := bc.store.GetByHeight(height)
+		if err != nil {
+			return nil, err
+		}
+		removed = append(removed, &blockNode{block: b, weight: bc.weights[height]})
+	}
+
+	for i := len(removed) - 1; i >= 0; i-- {
+		bc.disconnectTip(removed[i].block)
+		bc.addSideBlock(removed[i].block, removed[i].weight)
+	}
+
+	for i, node := range branch {
+		bc.removeSideBlock(node.block)
+		if err := bc.applyBlock(node.block, node.weight); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				bc.disconnectTip(branch[j].block)
+				bc.addSideBlock(branch[j].block, branch[j].weight)
+			}
+			bc.dropSubtree(node.block.Hash(BlockHasher{}))
+			bc.finalized = finalized
+
+			for _, rn := range removed {
+				bc.removeSideBlock(rn.block)
+				if rerr := bc.applyBlock(rn.block, rn.weight); rerr != nil {
+					return nil, fmt.Errorf("failed to restore chain after failed reorg: %w", rerr)
+				}
+			}
+
+			return nil, fmt.Errorf("reorg to %s failed at height %d: %w", newTip, node.block.Height, err)
+		}
+	}
+
+	event := &ReorgEvent{
+		OldTip:         oldTip,
+		NewTip:         newTip,
+		CommonAncestor: ancestor,
+		Removed:        make([]*Block, len(removed)),
+		Added:          make([]*Block, len(branch)),
+		OrphanedTxs:    []*Transaction{},
+	}
+
+	included := make(map[types.Hash]struct{})
+	for i, node := range branch {
+		event.Added[i] = node.block
+		for j := range node.block.Transactions {
+			included[node.block.Transactions[j].Hash(TxHasher{})] = struct{}{}
+		}
+	}
+	for i, node := range removed {
+		event.Removed[i] = node.block
+		for j := range node.block.Transactions {
+			tx := &node.block.Transactions[j]
+			if _, ok := included[tx.Hash(TxHasher{})]; !ok {
+				event.OrphanedTxs = append(event.OrphanedTxs, tx)
+			}
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"old_tip":  oldTip,
+		"new_tip":  newTip,
+		"ancestor": ancestor,
+		"removed":  len(removed),
+		"added":    len(branch),
+	}).Info("reorganised chain")
+
+	return event, nil
+}
+
+// applyBlock applies the state transition of the block, stores it and puts it on top of the canonical chain, the
+// caller must hold the lock.
+func (bc *Blockchain) applyBlock(b *Block, weight *big.Int) error {
+	undo, err := bc.state.ApplyBlock(b)
+	if err != nil {
+		return err
+	}
+
+	if err := bc.store.Put(b); err != nil {
+		bc.state.Revert(undo)
+		return err
+	}
+	bc.appendBlock(b, weight, undo)
 
 	logrus.WithFields(logrus.Fields{
 		"height": b.Height,
 		"hash":   b.Hash(BlockHasher{}),
 	}).Info("adding new block")
-	return bc.store.Put(b)
+
+	return nil
+}
+
+// appendBlock adds the block on top of the headers and indexes it, the caller
+// must hold the lock.
+func (bc *Blockchain) appendBlock(b *Block, weight *big.Int, undo *StateUndo) {
+	bc.headers = append(bc.headers, b.Header)
+	bc.weights = append(bc.weights, weight)
+	bc.undos = append(bc.undos, undo)
+	bc.blockIndex[b.Hash(BlockHasher{})] = b.Height
+	if b.Commit != nil {
+		bc.finalized = b.Height
+	}
+
+	for i := range b.Transactions {
+		bc.txIndex[b.Transactions[i].Hash(TxHasher{})] = TxLocation{
+			Height: b.Height,
+			Index:  i,
+		}
+	}
+
+	bc.recordValidators(b, true)
+}
+
+// disconnectTip removes the tip b from the headers and the indexes and reverts
+// its state changes, the caller must hold the lock.
+func (bc *Blockchain) disconnectTip(b *Block) {
+	bc.state.Revert(bc.undos[len(bc.undos)-1])
+
+	bc.headers = bc.headers[:len(bc.headers)-1]
+	bc.weights = bc.weights[:len(bc.weights)-1]
+	bc.undos = bc.undos[:len(bc.undos)-1]
+	delete(bc.blockIndex, b.Hash(BlockHasher{}))
+
+	for i := range b.Transactions {
+		hash := b.Transactions[i].Hash(TxHasher{})
+		if loc, ok := bc.txIndex[hash]; ok && loc.Height == b.Height {
+			delete(bc.txIndex, hash)
+		}
+	}
+
+	if bc.authority != nil {
+		bc.authority.setTip(b.PrevBlockHash)
+	}
+}
+
+// recordValidators hands the authority the validator set of the blocks on top
+// of b, the caller must hold the lock. A canonical block takes it from the
+// state once b is applied. A side block has no state, it takes the set of its
+// parent without the validators its evidence slashes, just as applying it
+// would.
+func (bc *Blockchain) recordValidators(b *Block, canonical bool) {
+	if bc.authority == nil {
+		return
+	}
+
+	validators := bc.authority.ValidatorsAt(b.PrevBlockHash)
+	if validators == nil {
+		validators = bc.state.Validators()
+	}
+
+	for i := range b.Transactions {
+		tx := &b.Transactions[i]
+		if tx.Type != TxTypeEvidence {
+			continue
+		}
+
+		if canonical {
+			validators = bc.state.Validators()
+			break
+		}
+
+		e, err := DecodeDoubleSignEvidence(tx.Data)
+		if err == nil && validators.Len() > 1 {
+			validators = validators.Without(e.Offender())
+		}
+	}
+
+	bc.authority.record(b.Hash(BlockHasher{}), b.Height, validators, canonical)
+}
+
+func (bc *Blockchain) addSideBlock(b *Block, weight *big.Int) {
+	hash := b.Hash(BlockHasher{})
+	bc.side[hash] = &blockNode{block: b, weight: weight}
+	bc.children[b.PrevBlockHash] = append(bc.children[b.PrevBlockHash], hash)
+	bc.recordValidators(b, false)
+}
+
+func (bc *Blockchain) removeSideBlock(b *Block) {
+	hash := b.Hash(BlockHasher{})
+	delete(bc.side, hash)
+	if bc.authority != nil {
+		bc.authority.forget(hash)
+	}
+
+	siblings := bc.children[b.PrevBlockHash]
+	for i, h := range siblings {
+		if h == hash {
+			siblings = append(siblings[:i], siblings[i+1:]...)
+			break
+		}
+	}
+
+	if len(siblings) == 0 {
+		delete(bc.children, b.PrevBlockHash)
+	} else {
+		bc.children[b.PrevBlockHash] = siblings
+	}
+}
+
+// dropSubtree removes every side block built on top of hash.
+func (bc *Blockchain) dropSubtree(hash types.Hash) {
+	for _, child := range bc.children[hash] {
+		bc.dropSubtree(child)
+		delete(bc.side, child)
+		if bc.authority != nil {
+			bc.authority.forget(child)
+		}
+	}
+	delete(bc.children, hash)
+}
+
+// pruneSideBranches drops the side blocks more than MaxSideBranchDepth below
+// the tip, the caller must hold the lock. No block forks below them or the
+// finalized block anymore, so the validator sets recorded there are dropped
+// too.
+func (bc *Blockchain) pruneSideBranches() {
+	tipHeight := uint32(len(bc.headers) - 1)
+	depth := min(tipHeight, MaxSideBranchDepth)
+
+	for _, node := range bc.side {
+		if node.block.Height < tipHeight-depth {
+			bc.removeSideBlock(node.block)
+		}
+	}
+
+	if bc.authority != nil {
+		bc.authority.prune(max(bc.finalized, tipHeight-depth))
+	}
+}
+
+func (bc *Blockchain) knows(hash types.Hash) bool {
+	if _, ok := bc.blockIndex[hash]; ok {
+		return true
+	}
+	_, ok := bc.side[hash]
+	return ok
+}
+
+func (bc *Blockchain) weightOf(hash types.Hash) (*big.Int, bool) {
+	if height, ok := bc.blockIndex[hash]; ok {
+		return bc.weights[height], true
+	}
+	if node, ok := bc.side[hash]; ok {
+		return node.weight, true
+	}
+	return nil, false
+}
+
+func (bc *Blockchain) tipHash() types.Hash {
+	return BlockHasher{}.Hash(bc.headers[len(bc.headers)-1])
+}
+
+// lookupHeader returns the header of a canonical or side branch block.
+func (bc *Blockchain) lookupHeader(hash types.Hash) (*Header, bool) {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+
+	if height, ok := bc.blockIndex[hash]; ok {
+		return bc.headers[height], true
+	}
+	if node, ok := bc.side[hash]; ok {
+		return node.block.Header, true
+	}
+	return nil, false
+}
+
+func (bc *Blockchain) ChainID() uint64 {
+	return bc.chainID
+}
+
+// GetAccount returns the state of the account at the tip of the chain.
+func (bc *Blockchain) GetAccount(addr types.Address) AccountState {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	return bc.state.Account(addr)
+}
+
+// CheckProposal validates a block proposed on top of the tip before it is
+// committed, all of its transactions must apply. The turn of its proposer is
+// left to the consensus engine.
+func (bc *Blockchain) CheckProposal(b *Block) error {
+	bc.lock.RLock()
+	tip := bc.headers[len(bc.headers)-1]
+	bc.lock.RUnlock()
+
+	if b.PrevBlockHash != (BlockHasher{}).Hash(tip) {
+		return fmt.Errorf("proposal at height %d does not extend the tip at height %d", b.Height, tip.Height)
+	}
+
+	if err := validateBlockContent(bc, b, tip); err != nil {
+		return err
+	}
+
+	if bc.authority != nil {
+		if _, err := bc.authority.VerifyMember(b, tip, bc.authority.ValidatorsAt(b.PrevBlockHash), time.Now()); err != nil {
+			return err
+		}
+	}
+
+	transition := bc.NewStateTransition(b.Validator.Address())
+	for i := range b.Transactions {
+		if err := transition.ApplyTransaction(&b.Transactions[i]); err != nil {
+			return fmt.Errorf("proposal at height %d: transaction %d: %w", b.Height, i, err)
+		}
+	}
+
+	return nil
+}
+
+// NewStateTransition returns a transition on top of the current state that
+// can be used to check which transactions would apply in the next block.
+func (bc *Blockchain) NewStateTransition(coinbase types.Address) *StateTransition {
+	return bc.state.NewTransition(coinbase)
+}
+
+// Close closes the underlying store.
+func (bc *Blockchain) Close() error {
+	return bc.store.Close()
 }
 
 func (bc *Blockchain) GetHeader(height uint32) (*Header, error) {
-	if height > bc.Height() {
-		return nil, fmt.Errorf("height %d is greater than blockchain height %d", height, bc.Height())
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+
+	if int(height) >= len(bc.headers) {
+		return nil, fmt.Errorf("height %d is greater than blockchain height %d", height, len(bc.headers)-1)
 	}
 
+	return bc.headers[height], nil
+}
+
+func (bc *Blockchain) GetHeaderByHash(hash types.Hash) (*Header, error) {
 	bc.lock.RLock()
 	defer bc.lock.RUnlock()
 
+	height, ok := bc.blockIndex[hash]
+	if !ok {
+		return nil, fmt.Errorf("block with hash %s not found", hash)
+	}
+
 	return bc.headers[height], nil
 }
 
-func (bc *Blockchain) addGenesisBlock(b *Block) {}
+func (bc *Blockchain) GetBlock(height uint32) (*Block, error) {
+	header, err := bc.GetHeader(height)
+	if err != nil {
+		return nil, err
+	}
+
+	return bc.store.Get(BlockHasher{}.Hash(header))
+}
+
+func (bc *Blockchain) GetBlockByHash(hash types.Hash) (*Block, error) {
+	bc.lock.RLock()
+	_, ok := bc.blockIndex[hash]
+	bc.lock.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("block with hash %s not found", hash)
+	}
+
+	return bc.store.Get(hash)
+}
+
+func (bc *Blockchain) GetTxByHash(hash types.Hash) (*Transaction, error) {
+	loc, err := bc.GetTxLocation(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := bc.GetBlock(loc.Height)
+	if err != nil {
+		return nil, err
+	}
+
+	return &b.Transactions[loc.Index], nil
+}
+
+// GetTxLocation returns the height and index of the block the transaction was included in.
+func (bc *Blockchain) GetTxLocation(hash types.Hash) (TxLocation, error) {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+
+	loc, ok := bc.txIndex[hash]
+	if !ok {
+		return TxLocation{}, fmt.Errorf("transaction with hash %s not found", hash)
+	}
+
+	return loc, nil
+}
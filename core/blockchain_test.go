@@ -2,6 +2,7 @@ package core
 
 import (
 	"go-blockchain/types"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -66,9 +67,271 @@ func TestAddBlockTooHigh(t *testing.T) {
 	assert.NotNil(t, bc.AddBlock(randomBlock(t, 69, types.Hash{})))
 }
 
+func TestGetBlock(t *testing.T) {
+	bc := newBlockchainWithGenesis(t)
+
+	for i := 0; i < 100; i++ {
+		block := randomBlock(t, uint32(i+1), getPrevBlockHash(t, bc, uint32(i+1)))
+		assert.Nil(t, bc.AddBlock(block))
+
+		fetched, err := bc.GetBlock(block.Height)
+		assert.Nil(t, err)
+		assert.Equal(t, block, fetched)
+
+		byHash, err := bc.GetBlockByHash(block.Hash(BlockHasher{}))
+		assert.Nil(t, err)
+		assert.Equal(t, block, byHash)
+
+		header, err := bc.GetHeaderByHash(block.Hash(BlockHasher{}))
+		assert.Nil(t, err)
+		assert.Equal(t, block.Header, header)
+	}
+
+	_, err := bc.GetBlock(101)
+	assert.NotNil(t, err)
+	_, err = bc.GetBlockByHash(types.RandomHash())
+	assert.NotNil(t, err)
+	_, err = bc.GetHeaderByHash(types.RandomHash())
+	assert.NotNil(t, err)
+}
+
+func TestGetTxByHash(t *testing.T) {
+	bc := newBlockchainWithGenesis(t)
+
+	block := randomBlock(t, 1, getPrevBlockHash(t, bc, 1))
+	assert.Nil(t, bc.AddBlock(block))
+
+	txHash := block.Transactions[0].Hash(TxHasher{})
+	tx, err := bc.GetTxByHash(txHash)
+	assert.Nil(t, err)
+	assert.Equal(t, txHash, tx.Hash(TxHasher{}))
+	assert.Equal(t, block.Transactions[0].Signature, tx.Signature)
+
+	loc, err := bc.GetTxLocation(txHash)
+	assert.Nil(t, err)
+	assert.Equal(t, TxLocation{Height: 1, Index: 0}, loc)
+
+	_, err = bc.GetTxByHash(types.RandomHash())
+	assert.NotNil(t, err)
+}
+
 func getPrevBlockHash(t *testing.T, bc *Blockchain, height uint32) types.Hash {
 	prevHeader, err := bc.GetHeader(height - 1)
 	assert.Nil(t, err)
 
 	return BlockHasher{}.Hash(prevHeader)
 }
+
+// buildBranch creates n blocks on top of parent without adding them to a chain.
+func buildBranch(t *testing.T, parent *Header, n int) []*Block {
+	blocks := make([]*Block, n)
+	prevHash := BlockHasher{}.Hash(parent)
+	for i := 0; i < n; i++ {
+		blocks[i] = randomBlock(t, parent.Height+uint32(i+1), prevHash)
+		prevHash = blocks[i].Hash(BlockHasher{})
+	}
+	return blocks
+}
+
+func TestSideBranchDoesNotReorg(t *testing.T) {
+	bc := newBlockchainWithGenesis(t)
+	genesis, err := bc.GetHeader(0)
+	assert.Nil(t, err)
+
+	main := buildBranch(t, genesis, 3)
+	for _, b := range main {
+		assert.Nil(t, bc.AddBlock(b))
+	}
+
+	side := buildBranch(t, genesis, 3)
+	for _, b := range side {
+		assert.Nil(t, bc.AddBlock(b))
+	}
+
+	// equal weight keeps the first seen branch
+	assert.Equal(t, uint32(3), bc.Height())
+	assert.Equal(t, main[2].Hash(BlockHasher{}), bc.tipHash())
+	assert.True(t, bc.HasBlockHash(side[2].Hash(BlockHasher{})))
+	assert.NotNil(t, bc.AddBlock(side[2]))
+}
+
+func TestDeepReorg(t *testing.T) {
+	bc := newBlockchainWithGenesis(t)
+
+	events := []ReorgEvent{}
+	bc.OnReorg(func(e ReorgEvent) {
+		events = append(events, e)
+	})
+
+	genesis, err := bc.GetHeader(0)
+	assert.Nil(t, err)
+
+	main := buildBranch(t, genesis, 50)
+	for _, b := range main {
+		assert.Nil(t, bc.AddBlock(b))
+	}
+
+	fork := buildBranch(t, main[9].Header, 45)
+	for _, b := range fork {
+		assert.Nil(t, bc.AddBlock(b))
+	}
+
+	assert.Equal(t, uint32(55), bc.Height())
+	assert.Equal(t, fork[44].Hash(BlockHasher{}), bc.tipHash())
+	assert.Len(t, events, 1)
+
+	e := events[0]
+	assert.Equal(t, uint32(10), e.CommonAncestor)
+	assert.Equal(t, main[49].Hash(BlockHasher{}), e.OldTip)
+	assert.Len(t, e.Removed, 40)
+	assert.Len(t, e.Added, 41)
+	assert.Len(t, e.OrphanedTxs, 40)
+
+	for _, b := range fork {
+		header, err := bc.GetHeader(b.Height)
+		assert.Nil(t, err)
+		assert.Equal(t, b.Hash(BlockHasher{}), BlockHasher{}.Hash(header))
+
+		_, err = bc.GetTxByHash(b.Transactions[0].Hash(TxHasher{}))
+		assert.Nil(t, err)
+	}
+
+	for _, b := range main[10:] {
+		_, err := bc.GetHeaderByHash(b.Hash(BlockHasher{}))
+		assert.NotNil(t, err)
+		_, err = bc.GetTxByHash(b.Transactions[0].Hash(TxHasher{}))
+		assert.NotNil(t, err)
+		assert.True(t, bc.HasBlockHash(b.Hash(BlockHasher{})))
+	}
+
+	// extending the old branch far enough switches back
+	back := buildBranch(t, main[49].Header, 6)
+	for _, b := range back {
+		assert.Nil(t, bc.AddBlock(b))
+	}
+	assert.Equal(t, uint32(56), bc.Height())
+	assert.Equal(t, back[5].Hash(BlockHasher{}), bc.tipHash())
+	assert.Len(t, events, 2)
+}
+
+type failingStore struct {
+	*MemoryStore
+	fail types.Hash
+}
+
+func (s *failingStore) Put(b *Block) error {
+	if b.Hash(BlockHasher{}) == s.fail {
+		return assert.AnError
+	}
+	return s.MemoryStore.Put(b)
+}
+
+func TestReorgFailureRestoresChain(t *testing.T) {
+	store := &failingStore{MemoryStore: NewMemStore()}
+	bc, err := NewBlockChainWithStore(store, randomBlock(t, 0, types.Hash{}))
+	assert.Nil(t, err)
+
+	genesis, err := bc.GetHeader(0)
+	assert.Nil(t, err)
+
+	main := buildBranch(t, genesis, 5)
+	for _, b := range main {
+		assert.Nil(t, bc.AddBlock(b))
+	}
+
+	fork := buildBranch(t, main[1].Header, 5)
+	store.fail = fork[2].Hash(BlockHasher{})
+	for _, b := range fork[:3] {
+		assert.Nil(t, bc.AddBlock(b))
+	}
+	assert.NotNil(t, bc.AddBlock(fork[3]))
+
+	assert.Equal(t, uint32(5), bc.Height())
+	assert.Equal(t, main[4].Hash(BlockHasher{}), bc.tipHash())
+	for _, b := range main {
+		stored, err := store.GetByHeight(b.Height)
+		assert.Nil(t, err)
+		assert.Equal(t, b.Hash(BlockHasher{}), stored.Hash(BlockHasher{}))
+	}
+	assert.False(t, bc.HasBlockHash(fork[3].Hash(BlockHasher{})))
+}
+
+func TestReorgRacesWithAddBlock(t *testing.T) {
+	bc := newBlockchainWithGenesis(t)
+	genesis, err := bc.GetHeader(0)
+	assert.Nil(t, err)
+
+	branches := [][]*Block{
+		buildBranch(t, genesis, 60),
+		buildBranch(t, genesis, 80),
+		buildBranch(t, genesis, 70),
+	}
+
+	wg := sync.WaitGroup{}
+	for _, branch := range branches {
+		wg.Add(1)
+		go func(branch []*Block) {
+			defer wg.Done()
+			for _, b := range branch {
+				assert.Nil(t, bc.AddBlock(b))
+			}
+		}(branch)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			_, err := bc.GetHeader(bc.Height())
+			assert.Nil(t, err)
+		}
+	}()
+
+	wg.Wait()
+
+	assert.Equal(t, uint32(80), bc.Height())
+	assert.Equal(t, branches[1][79].Hash(BlockHasher{}), bc.tipHash())
+
+	for i := uint32(1); i <= bc.Height(); i++ {
+		header, err := bc.GetHeader(i)
+		assert.Nil(t, err)
+		assert.Equal(t, getPrevBlockHash(t, bc, i), header.PrevBlockHash)
+	}
+}
+
+func TestOnBlock(t *testing.T) {
+	bc := newBlockchainWithGenesis(t)
+
+	calls := []string{}
+	bc.OnReorg(func(e ReorgEvent) {
+		calls = append(calls, "reorg")
+	})
+	bc.OnBlock(func(b *Block) {
+		calls = append(calls, b.Hash(BlockHasher{}).String())
+	})
+
+	genesis, err := bc.GetHeader(0)
+	assert.Nil(t, err)
+
+	main := buildBranch(t, genesis, 2)
+	for _, b := range main {
+		assert.Nil(t, bc.AddBlock(b))
+	}
+	assert.Equal(t, []string{
+		main[0].Hash(BlockHasher{}).String(),
+		main[1].Hash(BlockHasher{}).String(),
+	}, calls)
+
+	// side blocks are only reported once their branch becomes canonical
+	calls = []string{}
+	side := buildBranch(t, genesis, 3)
+	for _, b := range side {
+		assert.Nil(t, bc.AddBlock(b))
+	}
+	assert.Equal(t, []string{
+		"reorg",
+		side[0].Hash(BlockHasher{}).String(),
+		side[1].Hash(BlockHasher{}).String(),
+		side[2].Hash(BlockHasher{}).String(),
+	}, calls)
+}
@@ -0,0 +1,665 @@
+package core
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+
+	"go-blockchain/crypto"
+	"go-blockchain/types"
+)
+
+// Canonical encoding
+//
+// The canonical encoding is the consensus format used for hashing and signing.
+// It is independent of Go and must be reproduced byte for byte by any other
+// implementation:
+//
+//	uint8          1 byte
+//	uint32, uint64 4 and 8 bytes, big-endian
+//	int64          8 bytes, big-endian two's complement
+//	hash           32 raw bytes
+//	address        20 raw bytes
+//	bytes          uint32 length followed by the raw bytes
+//
+//	PublicKey      bytes holding the 33 byte SEC1 compressed P-256 point,
+//	               or the empty bytes (length 0) when there is no key
+//	Signature      R and S as 32 byte big-endian unsigned integers (64 bytes)
+//	OptSignature   0x00 when there is no signature, 0x01 followed by a Signature
+//
+//	Header         Version uint32 | ChainID uint64 | DataHash hash |
+//	               PrevBlockHash hash | Height uint32 | Timestamp int64 |
+//	               Bits uint32 | Nonce uint64
+//	               with Bits and Nonce left out below HeaderVersionPoW
+//	TxPayload      Type uint8 | ChainID uint64 | Data bytes | To address |
+//	               Value uint64 | Fee uint64 | Nonce uint64
+//	Transaction    TxPayload | From PublicKey | Signature OptSignature
+//	Block          Header | uint32 transaction count | Transaction... |
+//	               Validator PublicKey | Signature OptSignature | OptCommit
+//	Commit         Round uint32 | uint32 signature count |
+//	               (PublicKey | Signature)...
+//	OptCommit      0x00 when there is no commit, 0x01 followed by a Commit
+//	Vote           Type uint8 | Height uint32 | Round uint32 | BlockHash hash
+//	SignedVote     Vote | Validator PublicKey | Signature OptSignature
+//	Evidence       Validator PublicKey | Header | Signature | Header | Signature
+//	               with the headers at the same height ordered by hash
+//	Genesis        ChainID uint64 | Timestamp int64 |
+//	               uint32 validator count | (PublicKey | Power uint64)... |
+//	               uint32 allocation count | (address | Balance uint64)... |
+//	               BlockTimeMs uint64 | MaxBlockSize uint64 | Consensus bytes |
+//	               Bits uint32 | RetargetInterval uint32
+//	               with the allocations sorted by address and an empty
+//	               Consensus encoded as ConsensusPoA
+//
+// Transactions sign sha256(TxPayload) and are identified by
+// sha256(TxPayload | From PublicKey). Blocks sign sha256(Header), which is
+// also the block hash, votes sign sha256(Vote).
+//
+// Decoders reject lengths above MaxCanonicalBytesLen and non-minimal optional
+// markers, so every value has exactly one encoding.
+
+const (
+	MaxCanonicalBytesLen = 4 << 20
+	MaxCanonicalBlockTxs = 1 << 16
+	// MaxCanonicalCommitSigs caps the signatures of a commit
+	MaxCanonicalCommitSigs = 1 << 12
+
+	signatureScalarLen = 32
+	publicKeyLen       = 33
+)
+
+// BlockOverhead returns the most bytes the canonical encoding of a signed
+// block takes besides its transactions when it carries a commit of
+// commitSigs signatures, or no commit if commitSigs is zero.
+func BlockOverhead(commitSigs int) int {
+	header := 4 + 8 + 32 + 32 + 4 + 8 + 4 + 8
+	key := 4 + publicKeyLen
+	n := header + 4 + key + 1 + 2*signatureScalarLen + 1
+	if commitSigs > 0 {
+		n += 4 + 4 + commitSigs*(key+2*signatureScalarLen)
+	}
+	return n
+}
+
+// countingWriter discards what is written and counts the bytes.
+type countingWriter struct {
+	n int
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	w.n += len(b)
+	return len(b), nil
+}
+
+type canonicalWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (cw *canonicalWriter) write(b []byte) {
+	if cw.err != nil {
+		return
+	}
+	_, cw.err = cw.w.Write(b)
+}
+
+func (cw *canonicalWriter) uint8(v uint8) {
+	cw.write([]byte{v})
+}
+
+func (cw *canonicalWriter) uint32(v uint32) {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, v)
+	cw.write(buf)
+}
+
+func (cw *canonicalWriter) uint64(v uint64) {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, v)
+	cw.write(buf)
+}
+
+func (cw *canonicalWriter) int64(v int64) {
+	cw.uint64(uint64(v))
+}
+
+func (cw *canonicalWriter) hash(h types.Hash) {
+	cw.write(h[:])
+}
+
+func (cw *canonicalWriter) address(a types.Address) {
+	cw.write(a[:])
+}
+
+func (cw *canonicalWriter) bytes(b []byte) {
+	if len(b) > MaxCanonicalBytesLen {
+		cw.err = fmt.Errorf("bytes of length %d exceed the maximum of %d", len(b), MaxCanonicalBytesLen)
+		return
+	}
+	cw.uint32(uint32(len(b)))
+	cw.write(b)
+}
+
+func (cw *canonicalWriter) publicKey(k crypto.PublicKey) {
+	if k.Key == nil {
+		cw.bytes(nil)
+		return
+	}
+	cw.bytes(k.ToSlice())
+}
+
+func (cw *canonicalWriter) signature(sig *crypto.Signature) {
+	if cw.err != nil {
+		return
+	}
+	if sig.R == nil || sig.S == nil || sig.R.Sign() < 0 || sig.S.Sign() < 0 ||
+		sig.R.BitLen() > 8*signatureScalarLen || sig.S.BitLen() > 8*signatureScalarLen {
+		cw.err = fmt.Errorf("signature scalars do not fit in %d bytes", signatureScalarLen)
+		return
+	}
+
+	buf := make([]byte, 2*signatureScalarLen)
+	sig.R.FillBytes(buf[:signatureScalarLen])
+	sig.S.FillBytes(buf[signatureScalarLen:])
+	cw.write(buf)
+}
+
+func (cw *canonicalWriter) optSignature(sig *crypto.Signature) {
+	if sig == nil {
+		cw.write([]byte{0x00})
+		return
+	}
+	cw.write([]byte{0x01})
+	cw.signature(sig)
+}
+
+func (cw *canonicalWriter) optCommit(c *Commit) {
+	if c == nil {
+		cw.write([]byte{0x00})
+		return
+	}
+	if len(c.Signatures) > MaxCanonicalCommitSigs {
+		cw.err = fmt.Errorf("commit with %d signatures exceeds the maximum of %d", len(c.Signatures), MaxCanonicalCommitSigs)
+		return
+	}
+
+	cw.write([]byte{0x01})
+	cw.uint32(c.Round)
+	cw.uint32(uint32(len(c.Signatures)))
+	for _, sig := range c.Signatures {
+		cw.publicKey(sig.Validator)
+		if sig.Signature == nil {
+			cw.err = fmt.Errorf("commit signature of %s is missing", sig.Validator.Address())
+			return
+		}
+		cw.signature(sig.Signature)
+	}
+}
+
+func (cw *canonicalWriter) txPayload(tx *Transaction) {
+	cw.uint8(uint8(tx.Type))
+	cw.uint64(tx.ChainID)
+	cw.bytes(tx.Data)
+	cw.address(tx.To)
+	cw.uint64(tx.Value)
+	cw.uint64(tx.Fee)
+	cw.uint64(tx.Nonce)
+}
+
+func (cw *canonicalWriter) transaction(tx *Transaction) {
+	cw.txPayload(tx)
+	cw.publicKey(tx.From)
+	cw.optSignature(tx.Signature)
+}
+
+func (cw *canonicalWriter) header(h *Header) {
+	cw.uint32(h.Version)
+	cw.uint64(h.ChainID)
+	cw.hash(h.DataHash)
+	cw.hash(h.PrevBlockHash)
+	cw.uint32(h.Height)
+	cw.int64(h.Timestamp)
+	if h.Version >= HeaderVersionPoW {
+		cw.uint32(h.Bits)
+		cw.uint64(h.Nonce)
+	}
+}
+
+func (cw *canonicalWriter) vote(v *Vote) {
+	cw.uint8(uint8(v.Type))
+	cw.uint32(v.Height)
+	cw.uint32(v.Round)
+	cw.hash(v.BlockHash)
+}
+
+type canonicalReader struct {
+	r   io.Reader
+	err error
+}
+
+func (cr *canonicalReader) read(n int) []byte {
+	if cr.err != nil {
+		return make([]byte, n)
+	}
+	buf := make([]byte, n)
+	_, cr.err = io.ReadFull(cr.r, buf)
+	return buf
+}
+
+func (cr *canonicalReader) uint8() uint8 {
+	return cr.read(1)[0]
+}
+
+func (cr *canonicalReader) uint32() uint32 {
+	return binary.BigEndian.Uint32(cr.read(4))
+}
+
+func (cr *canonicalReader) uint64() uint64 {
+	return binary.BigEndian.Uint64(cr.read(8))
+}
+
+func (cr *canonicalReader) int64() int64 {
+	return int64(cr.uint64())
+}
+
+func (cr *canonicalReader) hash() types.Hash {
+	return types.HashFromBytes(cr.read(32))
+}
+
+func (cr *canonicalReader) address() types.Address {
+	return types.AddressFromBytes(cr.read(20))
+}
+
+func (cr *canonicalReader) bytes() []byte {
+	n := cr.uint32()
+	if cr.err != nil {
+		return nil
+	}
+	if n > MaxCanonicalBytesLen {
+		cr.err = fmt.Errorf("bytes of length %d exceed the maximum of %d", n, MaxCanonicalBytesLen)
+		return nil
+	}
+	return cr.read(int(n))
+}
+
+func (cr *canonicalReader) publicKey() crypto.PublicKey {
+	b := cr.bytes()
+	if cr.err != nil || len(b) == 0 {
+		return crypto.PublicKey{}
+	}
+
+	k, err := crypto.PublicKeyFromBytes(b)
+	if err != nil {
+		cr.err = err
+	}
+	return k
+}
+
+func (cr *canonicalReader) signature() *crypto.Signature {
+	buf := cr.read(2 * signatureScalarLen)
+	if cr.err != nil {
+		return nil
+	}
+
+	return &crypto.Signature{
+		R: new(big.Int).SetBytes(buf[:signatureScalarLen]),
+		S: new(big.Int).SetBytes(buf[signatureScalarLen:]),
+	}
+}
+
+func (cr *canonicalReader) optSignature() *crypto.Signature {
+	marker := cr.read(1)[0]
+	if cr.err != nil {
+		return nil
+	}
+
+	switch marker {
+	case 0x00:
+		return nil
+	case 0x01:
+		return cr.signature()
+	default:
+		cr.err = fmt.Errorf("invalid optional signature marker 0x%02x", marker)
+		return nil
+	}
+}
+
+func (cr *canonicalReader) optCommit() *Commit {
+	marker := cr.read(1)[0]
+	if cr.err != nil {
+		return nil
+	}
+
+	switch marker {
+	case 0x00:
+		return nil
+	case 0x01:
+	default:
+		cr.err = fmt.Errorf("invalid optional commit marker 0x%02x", marker)
+		return nil
+	}
+
+	c := &Commit{Round: cr.uint32()}
+	n := cr.uint32()
+	if cr.err == nil && n > MaxCanonicalCommitSigs {
+		cr.err = fmt.Errorf("commit with %d signatures exceeds the maximum of %d", n, MaxCanonicalCommitSigs)
+	}
+	for i := uint32(0); i < n && cr.err == nil; i++ {
+		c.Signatures = append(c.Signatures, CommitSig{
+			Validator: cr.publicKey(),
+			Signature: cr.signature(),
+		})
+	}
+	return c
+}
+
+func (cr *canonicalReader) transaction() Transaction {
+	tx := Transaction{
+		Type:    TxType(cr.uint8()),
+		ChainID: cr.uint64(),
+		Data:    cr.bytes(),
+		To:      cr.address(),
+		Value:   cr.uint64(),
+		Fee:     cr.uint64(),
+		Nonce:   cr.uint64(),
+		From:    cr.publicKey(),
+	}
+	tx.Signature = cr.optSignature()
+
+	if cr.err == nil && tx.Type > TxTypeEvidence {
+		cr.err = fmt.Errorf("unknown transaction type %d", tx.Type)
+	}
+
+	return tx
+}
+
+func (cr *canonicalReader) header() Header {
+	h := Header{
+		Version:       cr.uint32(),
+		ChainID:       cr.uint64(),
+		DataHash:      cr.hash(),
+		PrevBlockHash: cr.hash(),
+		Height:        cr.uint32(),
+		Timestamp:     cr.int64(),
+	}
+	if h.Version >= HeaderVersionPoW {
+		h.Bits = cr.uint32()
+		h.Nonce = cr.uint64()
+	}
+	return h
+}
+
+func (cr *canonicalReader) signedVote() Vote {
+	v := Vote{
+		Type:      VoteType(cr.uint8()),
+		Height:    cr.uint32(),
+		Round:     cr.uint32(),
+		BlockHash: cr.hash(),
+		Validator: cr.publicKey(),
+	}
+	v.Signature = cr.optSignature()
+
+	if cr.err == nil && (v.Type < VoteProposal || v.Type > VotePrecommit) {
+		cr.err = fmt.Errorf("unknown vote type %d", v.Type)
+	}
+
+	return v
+}
+
+type CanonicalHeaderEncoder struct {
+	w io.Writer
+}
+
+func NewCanonicalHeaderEncoder(w io.Writer) *CanonicalHeaderEncoder {
+	return &CanonicalHeaderEncoder{
+		w: w,
+	}
+}
+
+func (e *CanonicalHeaderEncoder) Encode(h *Header) error {
+	cw := &canonicalWriter{w: e.w}
+	cw.header(h)
+	return cw.err
+}
+
+type CanonicalHeaderDecoder struct {
+	r io.Reader
+}
+
+func NewCanonicalHeaderDecoder(r io.Reader) *CanonicalHeaderDecoder {
+	return &CanonicalHeaderDecoder{
+		r: r,
+	}
+}
+
+func (d *CanonicalHeaderDecoder) Decode(h *Header) error {
+	cr := &canonicalReader{r: d.r}
+	decoded := cr.header()
+	if cr.err != nil {
+		return cr.err
+	}
+
+	*h = decoded
+	return nil
+}
+
+type CanonicalTxEncoder struct {
+	w io.Writer
+}
+
+func NewCanonicalTxEncoder(w io.Writer) *CanonicalTxEncoder {
+	return &CanonicalTxEncoder{
+		w: w,
+	}
+}
+
+func (e *CanonicalTxEncoder) Encode(tx *Transaction) error {
+	cw := &canonicalWriter{w: e.w}
+	cw.transaction(tx)
+	return cw.err
+}
+
+type CanonicalTxDecoder struct {
+	r io.Reader
+}
+
+func NewCanonicalTxDecoder(r io.Reader) *CanonicalTxDecoder {
+	return &CanonicalTxDecoder{
+		r: r,
+	}
+}
+
+func (d *CanonicalTxDecoder) Decode(tx *Transaction) error {
+	cr := &canonicalReader{r: d.r}
+	decoded := cr.transaction()
+	if cr.err != nil {
+		return cr.err
+	}
+
+	*tx = decoded
+	return nil
+}
+
+type CanonicalBlockEncoder struct {
+	w io.Writer
+}
+
+func NewCanonicalBlockEncoder(w io.Writer) *CanonicalBlockEncoder {
+	return &CanonicalBlockEncoder{
+		w: w,
+	}
+}
+
+func (e *CanonicalBlockEncoder) Encode(b *Block) error {
+	if len(b.Transactions) > MaxCanonicalBlockTxs {
+		return fmt.Errorf("block with %d transactions exceeds the maximum of %d", len(b.Transactions), MaxCanonicalBlockTxs)
+	}
+
+	cw := &canonicalWriter{w: e.w}
+	cw.header(b.Header)
+	cw.uint32(uint32(len(b.Transactions)))
+	for i := range b.Transactions {
+		cw.transaction(&b.Transactions[i])
+	}
+	cw.publicKey(b.Validator)
+	cw.optSignature(b.Signature)
+	cw.optCommit(b.Commit)
+	return cw.err
+}
+
+type CanonicalBlockDecoder struct {
+	r io.Reader
+}
+
+func NewCanonicalBlockDecoder(r io.Reader) *CanonicalBlockDecoder {
+	return &CanonicalBlockDecoder{
+		r: r,
+	}
+}
+
+func (d *CanonicalBlockDecoder) Decode(b *Block) error {
+	cr := &canonicalReader{r: d.r}
+	header := cr.header()
+
+	n := cr.uint32()
+	if cr.err == nil && n > MaxCanonicalBlockTxs {
+		return fmt.Errorf("block with %d transactions exceeds the maximum of %d", n, MaxCanonicalBlockTxs)
+	}
+
+	txx := []Transaction{}
+	for i := uint32(0); i < n && cr.err == nil; i++ {
+		txx = append(txx, cr.transaction())
+	}
+
+	validator := cr.publicKey()
+	signature := cr.optSignature()
+	commit := cr.optCommit()
+	if cr.err != nil {
+		return cr.err
+	}
+
+	*b = Block{
+		Header:       &header,
+		Transactions: txx,
+		Validator:    validator,
+		Signature:    signature,
+		Commit:       commit,
+	}
+	return nil
+}
+
+type CanonicalPublicKeyEncoder struct {
+	w io.Writer
+}
+
+func NewCanonicalPublicKeyEncoder(w io.Writer) *CanonicalPublicKeyEncoder {
+	return &CanonicalPublicKeyEncoder{
+		w: w,
+	}
+}
+
+func (e *CanonicalPublicKeyEncoder) Encode(k *crypto.PublicKey) error {
+	cw := &canonicalWriter{w: e.w}
+	cw.publicKey(*k)
+	return cw.err
+}
+
+type CanonicalPublicKeyDecoder struct {
+	r io.Reader
+}
+
+func NewCanonicalPublicKeyDecoder(r io.Reader) *CanonicalPublicKeyDecoder {
+	return &CanonicalPublicKeyDecoder{
+		r: r,
+	}
+}
+
+func (d *CanonicalPublicKeyDecoder) Decode(k *crypto.PublicKey) error {
+	cr := &canonicalReader{r: d.r}
+	decoded := cr.publicKey()
+	if cr.err != nil {
+		return cr.err
+	}
+
+	*k = decoded
+	return nil
+}
+
+type CanonicalSignatureEncoder struct {
+	w io.Writer
+}
+
+func NewCanonicalSignatureEncoder(w io.Writer) *CanonicalSignatureEncoder {
+	return &CanonicalSignatureEncoder{
+		w: w,
+	}
+}
+
+func (e *CanonicalSignatureEncoder) Encode(sig *crypto.Signature) error {
+	cw := &canonicalWriter{w: e.w}
+	cw.signature(sig)
+	return cw.err
+}
+
+type CanonicalSignatureDecoder struct {
+	r io.Reader
+}
+
+func NewCanonicalSignatureDecoder(r io.Reader) *CanonicalSignatureDecoder {
+	return &CanonicalSignatureDecoder{
+		r: r,
+	}
+}
+
+func (d *CanonicalSignatureDecoder) Decode(sig *crypto.Signature) error {
+	cr := &canonicalReader{r: d.r}
+	decoded := cr.signature()
+	if cr.err != nil {
+		return cr.err
+	}
+
+	*sig = *decoded
+	return nil
+}
+
+type CanonicalVoteEncoder struct {
+	w io.Writer
+}
+
+func NewCanonicalVoteEncoder(w io.Writer) *CanonicalVoteEncoder {
+	return &CanonicalVoteEncoder{
+		w: w,
+	}
+}
+
+// Encode writes the SignedVote, the vote along with its validator and
+// signature.
+func (e *CanonicalVoteEncoder) Encode(v *Vote) error {
+	cw := &canonicalWriter{w: e.w}
+	cw.vote(v)
+	cw.publicKey(v.Validator)
+	cw.optSignature(v.Signature)
+	return cw.err
+}
+
+type CanonicalVoteDecoder struct {
+	r io.Reader
+}
+
+func NewCanonicalVoteDecoder(r io.Reader) *CanonicalVoteDecoder {
+	return &CanonicalVoteDecoder{
+		r: r,
+	}
+}
+
+func (d *CanonicalVoteDecoder) Decode(v *Vote) error {
+	cr := &canonicalReader{r: d.r}
+	decoded := cr.signedVote()
+	if cr.err != nil {
+		return cr.err
+	}
+
+	*v = decoded
+	return nil
+}
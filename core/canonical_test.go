@@ -0,0 +1,291 @@
+package core
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/big"
+	"testing"
+
+	"go-blockchain/crypto"
+	"go-blockchain/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// compressed P-256 generator point
+const goldenPublicKey = "036b17d1f2e12c4247f8bce6e563a440f277037d812deb33a0f4a13945d898c296"
+
+func goldenHeader() *Header {
+	dataHash := types.Hash{}
+	prevHash := types.Hash{}
+	for i := 0; i < 32; i++ {
+		dataHash[i] = 0x11
+		prevHash[i] = byte(i)
+	}
+
+	return &Header{
+		Version:       2,
+		ChainID:       3,
+		DataHash:      dataHash,
+		PrevBlockHash: prevHash,
+		Height:        7,
+		Timestamp:     1700000000000000000,
+	}
+}
+
+func goldenTx(t *testing.T) *Transaction {
+	keyBytes, err := hex.DecodeString(goldenPublicKey)
+	assert.Nil(t, err)
+	from, err := crypto.PublicKeyFromBytes(keyBytes)
+	assert.Nil(t, err)
+
+	to := types.Address{}
+	for i := range to {
+		to[i] = 0x22
+	}
+
+	return &Transaction{
+		Type:    TxTypeTransfer,
+		ChainID: 3,
+		Data:    []byte("foo"),
+		To:      to,
+		Value:   1000,
+		Fee:     7,
+		Nonce:   5,
+		From:    from,
+		Signature: &crypto.Signature{
+			R: big.NewInt(1),
+			S: big.NewInt(0x0102),
+		},
+	}
+}
+
+const (
+	goldenHeaderHex = "00000002" +
+		"0000000000000003" +
+		"1111111111111111111111111111111111111111111111111111111111111111" +
+		"000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f" +
+		"00000007" +
+		"17979cfe362a0000"
+	goldenHeaderHash = "27f5ffed609922655c25d6d330526da480b798621d781a32a004838a62529381"
+
+	// sha256 of the transaction up to and including From
+	goldenTxHash = "674702ecee06b180b2ec8ed74a3813387b9671b7414881e003de9dace74ec1d7"
+
+	goldenTxHex = "01" + "0000000000000003" + "00000003" + "666f6f" +
+		"2222222222222222222222222222222222222222" +
+		"00000000000003e8" +
+		"0000000000000007" +
+		"0000000000000005" +
+		"00000021" + goldenPublicKey +
+		"01" +
+		"0000000000000000000000000000000000000000000000000000000000000001" +
+		"0000000000000000000000000000000000000000000000000000000000000102"
+)
+
+func TestCanonicalHeaderGolden(t *testing.T) {
+	h := goldenHeader()
+
+	assert.Equal(t, goldenHeaderHex, hex.EncodeToString(h.Bytes()))
+	assert.Equal(t, goldenHeaderHash, BlockHasher{}.Hash(h).String())
+
+	decoded := new(Header)
+	raw, err := hex.DecodeString(goldenHeaderHex)
+	assert.Nil(t, err)
+	assert.Nil(t, NewCanonicalHeaderDecoder(bytes.NewReader(raw)).Decode(decoded))
+	assert.Equal(t, h, decoded)
+
+	assert.NotNil(t, NewCanonicalHeaderDecoder(bytes.NewReader(raw[:len(raw)-1])).Decode(decoded))
+}
+
+func TestCanonicalTxGolden(t *testing.T) {
+	tx := goldenTx(t)
+
+	buf := &bytes.Buffer{}
+	assert.Nil(t, tx.Encode(NewCanonicalTxEncoder(buf)))
+	assert.Equal(t, goldenTxHex, hex.EncodeToString(buf.Bytes()))
+	assert.Equal(t, goldenTxHash, tx.Hash(TxHasher{}).String())
+
+	decoded := new(Transaction)
+	assert.Nil(t, decoded.Decode(NewCanonicalTxDecoder(bytes.NewReader(buf.Bytes()))))
+	assert.Equal(t, tx.Type, decoded.Type)
+	assert.Equal(t, tx.Data, decoded.Data)
+	assert.Equal(t, tx.To, decoded.To)
+	assert.Equal(t, tx.Value, decoded.Value)
+	assert.Equal(t, tx.Fee, decoded.Fee)
+	assert.Equal(t, tx.Nonce, decoded.Nonce)
+	assert.Equal(t, tx.From.ToSlice(), decoded.From.ToSlice())
+	assert.Equal(t, 0, tx.Signature.R.Cmp(decoded.Signature.R))
+	assert.Equal(t, 0, tx.Signature.S.Cmp(decoded.Signature.S))
+}
+
+func TestCanonicalTxRoundTrip(t *testing.T) {
+	tx := randomTxWithSignature(t)
+
+	buf := &bytes.Buffer{}
+	assert.Nil(t, tx.Encode(NewCanonicalTxEncoder(buf)))
+	encoded := buf.Bytes()
+
+	decoded := new(Transaction)
+	assert.Nil(t, decoded.Decode(NewCanonicalTxDecoder(bytes.NewReader(encoded))))
+	assert.Nil(t, decoded.Verify())
+
+	reencoded := &bytes.Buffer{}
+	assert.Nil(t, decoded.Encode(NewCanonicalTxEncoder(reencoded)))
+	assert.Equal(t, encoded, reencoded.Bytes())
+
+	unsigned := NewTransaction([]byte("bar"))
+	buf.Reset()
+	assert.Nil(t, unsigned.Encode(NewCanonicalTxEncoder(buf)))
+	assert.Equal(t, "00"+zeroChainID+"00000003626172"+emptyTxFields+"00000000"+"00", hex.EncodeToString(buf.Bytes()))
+}
+
+const (
+	zeroChainID = "0000000000000000"
+	// To, Value, Fee and Nonce of a data transaction
+	emptyTxFields = "0000000000000000000000000000000000000000" + "0000000000000000" + "0000000000000000" + "0000000000000000"
+)
+
+func TestCanonicalRejectsMalformed(t *testing.T) {
+	tx := new(Transaction)
+
+	raw, _ := hex.DecodeString("00" + zeroChainID + "00000000" + emptyTxFields + "00000000" + "00")
+	assert.Nil(t, tx.Decode(NewCanonicalTxDecoder(bytes.NewReader(raw))))
+
+	// invalid optional signature marker
+	raw, _ = hex.DecodeString("00" + zeroChainID + "00000000" + emptyTxFields + "00000000" + "02")
+	assert.NotNil(t, tx.Decode(NewCanonicalTxDecoder(bytes.NewReader(raw))))
+
+	// unknown transaction type
+	raw, _ = hex.DecodeString("07" + zeroChainID + "00000000" + emptyTxFields + "00000000" + "00")
+	assert.NotNil(t, tx.Decode(NewCanonicalTxDecoder(bytes.NewReader(raw))))
+
+	// oversized length prefix
+	raw, _ = hex.DecodeString("00" + zeroChainID + "ffffffff")
+	assert.NotNil(t, tx.Decode(NewCanonicalTxDecoder(bytes.NewReader(raw))))
+
+	// public key that is not on the curve
+	raw, _ = hex.DecodeString("00" + zeroChainID + "00000000" + emptyTxFields + "00000021" + "02" + "ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff" + "00")
+	assert.NotNil(t, tx.Decode(NewCanonicalTxDecoder(bytes.NewReader(raw))))
+}
+
+func TestCanonicalPublicKeyAndSignature(t *testing.T) {
+	privKey := crypto.GeneratePrivateKey()
+	pubKey := privKey.PublicKey()
+
+	buf := &bytes.Buffer{}
+	assert.Nil(t, NewCanonicalPublicKeyEncoder(buf).Encode(&pubKey))
+	assert.Equal(t, 4+33, buf.Len())
+
+	decodedKey := crypto.PublicKey{}
+	assert.Nil(t, NewCanonicalPublicKeyDecoder(buf).Decode(&decodedKey))
+	assert.Equal(t, pubKey.Address(), decodedKey.Address())
+
+	sig, err := privKey.Sign([]byte("hello"))
+	assert.Nil(t, err)
+
+	buf.Reset()
+	assert.Nil(t, NewCanonicalSignatureEncoder(buf).Encode(sig))
+	assert.Equal(t, 64, buf.Len())
+
+	decodedSig := crypto.Signature{}
+	assert.Nil(t, NewCanonicalSignatureDecoder(buf).Decode(&decodedSig))
+	assert.True(t, decodedSig.Verify(pubKey, []byte("hello")))
+
+	tooBig := &crypto.Signature{R: new(big.Int).Lsh(big.NewInt(1), 256), S: big.NewInt(1)}
+	assert.NotNil(t, NewCanonicalSignatureEncoder(buf).Encode(tooBig))
+}
+
+func TestBlockSignatureCoversHeader(t *testing.T) {
+	privKey := crypto.GeneratePrivateKey()
+	b := randomBlockWithSigner(t, privKey, 1, types.Hash{})
+	assert.Nil(t, b.Verify())
+
+	b.Timestamp++
+	assert.NotNil(t, b.Verify())
+	b.Timestamp--
+
+	b.Height = 100
+	assert.NotNil(t, b.Verify())
+}
+
+func TestCanonicalBlockRoundTrip(t *testing.T) {
+	b := randomBlock(t, 3, types.RandomHash())
+	b.AddTransaction(signedTransfer(t, crypto.GeneratePrivateKey(), types.Address{}, 10, 0))
+	b.DataHash = CalculateMerkleRoot(b.Transactions)
+	assert.Nil(t, b.Sign(crypto.GeneratePrivateKey()))
+
+	buf := &bytes.Buffer{}
+	assert.Nil(t, b.Encode(NewCanonicalBlockEncoder(buf)))
+	encoded := buf.Bytes()
+
+	decoded := new(Block)
+	assert.Nil(t, decoded.Decode(NewCanonicalBlockDecoder(bytes.NewReader(encoded))))
+	assert.Nil(t, decoded.Verify())
+	assert.Equal(t, b.Hash(BlockHasher{}), decoded.Hash(BlockHasher{}))
+	assert.Len(t, decoded.Transactions, 2)
+
+	reencoded := &bytes.Buffer{}
+	assert.Nil(t, decoded.Encode(NewCanonicalBlockEncoder(reencoded)))
+	assert.Equal(t, encoded, reencoded.Bytes())
+
+	assert.NotNil(t, new(Block).Decode(NewCanonicalBlockDecoder(bytes.NewReader(encoded[:len(encoded)-1]))))
+
+	// an unsigned block without validator
+	unsigned := NewBlock(goldenHeader(), nil)
+	buf.Reset()
+	assert.Nil(t, unsigned.Encode(NewCanonicalBlockEncoder(buf)))
+	assert.Equal(t, goldenHeaderHex+"00000000"+"00000000"+"00"+"00", hex.EncodeToString(buf.Bytes()))
+}
+
+func TestBlockOverhead(t *testing.T) {
+	privKey := crypto.GeneratePrivateKey()
+	b := randomBlockWithSigner(t, privKey, 1, types.RandomHash())
+	b.Version = HeaderVersionPoW
+	assert.Nil(t, b.Sign(privKey))
+
+	txSize := 0
+	for i := range b.Transactions {
+		txSize += b.Transactions[i].Size()
+	}
+	assert.Equal(t, BlockOverhead(0), b.Size()-txSize)
+
+	vote := &Vote{Type: VotePrecommit, Height: 1, BlockHash: b.Hash(BlockHasher{})}
+	assert.Nil(t, vote.Sign(privKey))
+	b.Commit = NewCommit(0, []*Vote{vote, vote, vote})
+	assert.Equal(t, BlockOverhead(3), b.Size()-txSize)
+}
+
+func TestGobBlockRoundTrip(t *testing.T) {
+	b := randomBlock(t, 1, types.RandomHash())
+
+	buf := &bytes.Buffer{}
+	assert.Nil(t, b.Encode(NewGobBlockEncoder(buf)))
+
+	decoded := new(Block)
+	assert.Nil(t, decoded.Decode(NewGobBlockDecoder(buf)))
+	assert.Nil(t, decoded.Verify())
+	assert.Equal(t, b.Hash(BlockHasher{}), decoded.Hash(BlockHasher{}))
+}
+
+func TestCanonicalVoteRoundTrip(t *testing.T) {
+	v := &Vote{Type: VotePrecommit, Height: 7, Round: 2, BlockHash: types.RandomHash()}
+	assert.Nil(t, v.Sign(crypto.GeneratePrivateKey()))
+
+	buf := &bytes.Buffer{}
+	assert.Nil(t, NewCanonicalVoteEncoder(buf).Encode(v))
+	encoded := buf.Bytes()
+
+	decoded := new(Vote)
+	assert.Nil(t, NewCanonicalVoteDecoder(bytes.NewReader(encoded)).Decode(decoded))
+	assert.Nil(t, decoded.Verify())
+	assert.Equal(t, v.Bytes(), decoded.Bytes())
+
+	reencoded := &bytes.Buffer{}
+	assert.Nil(t, NewCanonicalVoteEncoder(reencoded).Encode(decoded))
+	assert.Equal(t, encoded, reencoded.Bytes())
+
+	// unknown vote type
+	raw, _ := hex.DecodeString("00" + "00000007" + "00000002" + hex.EncodeToString(v.BlockHash[:]) + "00000000" + "00")
+	assert.NotNil(t, NewCanonicalVoteDecoder(bytes.NewReader(raw)).Decode(decoded))
+}
@@ -0,0 +1,148 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"go-blockchain/crypto"
+	"go-blockchain/types"
+)
+
+var (
+	ErrMissingCommit = errors.New("missing commit")
+	ErrInvalidCommit = errors.New("invalid commit")
+	ErrFinalized     = errors.New("conflicts with finalized block")
+)
+
+// VoteType is the step of a consensus round a vote is cast in.
+type VoteType uint8
+
+const (
+	// VoteProposal signs the block the proposer of a round proposes
+	VoteProposal VoteType = 0x1
+	// VotePrevote and VotePrecommit are the two voting steps of a round
+	VotePrevote   VoteType = 0x2
+	VotePrecommit VoteType = 0x3
+)
+
+func (t VoteType) String() string {
+	switch t {
+	case VoteProposal:
+		return "proposal"
+	case VotePrevote:
+		return "prevote"
+	case VotePrecommit:
+		return "precommit"
+	default:
+		return fmt.Sprintf("vote type %d", uint8(t))
+	}
+}
+
+// Vote is the signed vote of a validator for a block in a consensus round, a
+// zero BlockHash is a vote for no block.
+type Vote struct {
+	Type      VoteType
+	Height    uint32
+	Round     uint32
+	BlockHash types.Hash
+	Validator crypto.PublicKey
+	Signature *crypto.Signature
+}
+
+// Bytes returns the canonical encoding of the signed fields of the vote.
+func (v *Vote) Bytes() []byte {
+	buf := &bytes.Buffer{}
+	cw := &canonicalWriter{w: buf}
+	cw.vote(v)
+
+	return buf.Bytes()
+}
+
+func (v *Vote) Sign(privKey crypto.PrivateKey) error {
+	hash := sha256.Sum256(v.Bytes())
+	sig, err := privKey.Sign(hash[:])
+	if err != nil {
+		return err
+	}
+	v.Validator = privKey.PublicKey()
+	v.Signature = sig
+	return nil
+}
+
+func (v *Vote) Verify() error {
+	if v.Signature == nil || v.Validator.Key == nil {
+		return fmt.Errorf("%s at height %d round %d is not signed", v.Type, v.Height, v.Round)
+	}
+
+	hash := sha256.Sum256(v.Bytes())
+	if !v.Signature.Verify(v.Validator, hash[:]) {
+		return fmt.Errorf("%s at height %d round %d has invalid signature", v.Type, v.Height, v.Round)
+	}
+	return nil
+}
+
+// CommitSig is the precommit signature of a single validator.
+type CommitSig struct {
+	Validator crypto.PublicKey
+	Signature *crypto.Signature
+}
+
+// Commit is the certificate that validators holding more than two thirds of
+// the voting power precommitted a block in a round. It is stored with the
+// block but not covered by its hash, a committed block is final.
+type Commit struct {
+	Round      uint32
+	Signatures []CommitSig
+}
+
+// NewCommit collects the precommits for the block into a certificate.
+func NewCommit(round uint32, precommits []*Vote) *Commit {
+	c := &Commit{
+		Round:      round,
+		Signatures: make([]CommitSig, len(precommits)),
+	}
+	for i, v := range precommits {
+		c.Signatures[i] = CommitSig{Validator: v.Validator, Signature: v.Signature}
+	}
+	return c
+}
+
+// Verify checks that the signatures are precommits of distinct validators of
+// the set for the block and that they hold a quorum of the voting power.
+func (c *Commit) Verify(b *Block, validators *ValidatorSet) error {
+	hash := b.Hash(BlockHasher{})
+	seen := map[types.Address]bool{}
+	power := uint64(0)
+
+	for i, sig := range c.Signatures {
+		vote := &Vote{
+			Type:      VotePrecommit,
+			Height:    b.Height,
+			Round:     c.Round,
+			BlockHash: hash,
+			Validator: sig.Validator,
+			Signature: sig.Signature,
+		}
+		if err := vote.Verify(); err != nil {
+			return fmt.Errorf("%w %d of block %s: %v", ErrInvalidCommit, i, hash, err)
+		}
+
+		addr := sig.Validator.Address()
+		if !validators.Has(addr) {
+			return fmt.Errorf("%w of block %s: %s is not a validator", ErrInvalidCommit, hash, addr)
+		}
+		if seen[addr] {
+			return fmt.Errorf("%w of block %s: duplicate signature of %s", ErrInvalidCommit, hash, addr)
+		}
+		seen[addr] = true
+		power += validators.Power(addr)
+	}
+
+	if !validators.HasQuorum(power) {
+		return fmt.Errorf("%w of block %s: power %d of %d is no quorum", ErrInvalidCommit, hash, power, validators.TotalPower())
+	}
+
+	return nil
+}
@@ -0,0 +1,145 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"go-blockchain/crypto"
+	"go-blockchain/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVoteSignAndVerify(t *testing.T) {
+	privKey := crypto.GeneratePrivateKey()
+	v := &Vote{Type: VotePrevote, Height: 3, Round: 1, BlockHash: types.RandomHash()}
+
+	assert.NotNil(t, v.Verify())
+	assert.Nil(t, v.Sign(privKey))
+	assert.Nil(t, v.Verify())
+	assert.Equal(t, privKey.PublicKey(), v.Validator)
+
+	// every field is signed
+	v.Type = VotePrecommit
+	assert.NotNil(t, v.Verify())
+}
+
+// bftGenesis returns a genesis with BFT consensus and a validator of power 1
+// per key.
+func bftGenesis(privKeys []crypto.PrivateKey) *Genesis {
+	g := &Genesis{
+		Timestamp: time.Now().Add(-time.Hour).UnixNano(),
+		Params:    GenesisParams{Consensus: ConsensusBFT},
+	}
+	for _, privKey := range privKeys {
+		g.Validators = append(g.Validators, GenesisValidator{PublicKey: privKey.PublicKey(), Power: 1})
+	}
+	return g
+}
+
+// commitBlock attaches the precommits of privKeys for the block.
+func commitBlock(t *testing.T, b *Block, round uint32, privKeys ...crypto.PrivateKey) {
+	precommits := []*Vote{}
+	for _, privKey := range privKeys {
+		v := &Vote{Type: VotePrecommit, Height: b.Height, Round: round, BlockHash: b.Hash(BlockHasher{})}
+		assert.Nil(t, v.Sign(privKey))
+		precommits = append(precommits, v)
+	}
+	b.Commit = NewCommit(round, precommits)
+}
+
+func TestCommitVerify(t *testing.T) {
+	privKeys := []crypto.PrivateKey{crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey()}
+	validators := bftGenesis(privKeys).ValidatorSet()
+	b := randomBlockWithSigner(t, privKeys[0], 1, types.RandomHash())
+
+	commitBlock(t, b, 2, privKeys[:3]...)
+	assert.Nil(t, b.Commit.Verify(b, validators))
+
+	// two of four validators are no quorum, neither is a validator signing twice
+	commitBlock(t, b, 2, privKeys[:2]...)
+	assert.True(t, errors.Is(b.Commit.Verify(b, validators), ErrInvalidCommit))
+	commitBlock(t, b, 2, privKeys[0], privKeys[1], privKeys[1])
+	assert.True(t, errors.Is(b.Commit.Verify(b, validators), ErrInvalidCommit))
+	commitBlock(t, b, 2, privKeys[0], privKeys[1], crypto.GeneratePrivateKey())
+	assert.True(t, errors.Is(b.Commit.Verify(b, validators), ErrInvalidCommit))
+
+	// the signatures are bound to the round
+	commitBlock(t, b, 2, privKeys[:3]...)
+	b.Commit.Round = 1
+	assert.True(t, errors.Is(b.Commit.Verify(b, validators), ErrInvalidCommit))
+}
+
+func TestCanonicalBlockWithCommit(t *testing.T) {
+	privKeys := []crypto.PrivateKey{crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey()}
+	b := randomBlockWithSigner(t, privKeys[0], 1, types.RandomHash())
+	commitBlock(t, b, 4, privKeys...)
+
+	buf := &bytes.Buffer{}
+	assert.Nil(t, b.Encode(NewCanonicalBlockEncoder(buf)))
+
+	decoded := new(Block)
+	assert.Nil(t, decoded.Decode(NewCanonicalBlockDecoder(bytes.NewReader(buf.Bytes()))))
+	assert.Equal(t, b.Hash(BlockHasher{}), decoded.Hash(BlockHasher{}))
+	assert.Nil(t, decoded.Commit.Verify(decoded, bftGenesis(privKeys).ValidatorSet()))
+}
+
+func TestBlockchainRequiresCommit(t *testing.T) {
+	privKeys := []crypto.PrivateKey{crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey()}
+	bc, err := NewBlockChainFromGenesis(bftGenesis(privKeys), BlockchainOpts{})
+	assert.Nil(t, err)
+	genesis, err := bc.GetHeader(0)
+	assert.Nil(t, err)
+
+	// any validator may propose in any round, but only committed blocks are added
+	b := proposedBlock(t, privKeys[2], genesis, time.Millisecond)
+	assert.Nil(t, bc.CheckProposal(b))
+	assert.True(t, errors.Is(bc.AddBlock(b), ErrMissingCommit))
+
+	commitBlock(t, b, 0, privKeys[:1]...)
+	assert.True(t, errors.Is(bc.AddBlock(b), ErrInvalidCommit))
+
+	commitBlock(t, b, 0, privKeys...)
+	assert.Nil(t, bc.AddBlock(b))
+	assert.Equal(t, uint32(1), bc.FinalizedHeight())
+
+	// a block conflicting with a committed one is rejected even with a commit
+	other := proposedBlock(t, privKeys[1], genesis, 2*time.Millisecond)
+	commitBlock(t, other, 1, privKeys...)
+	assert.True(t, errors.Is(bc.AddBlock(other), ErrFinalized))
+	assert.NotNil(t, bc.CheckProposal(other))
+}
+
+func TestCommittedBlockIsFinal(t *testing.T) {
+	// on a proof of authority chain a committed block wins over a heavier
+	// branch and is never reorged out
+	privKeys := []crypto.PrivateKey{crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey()}
+	g := bftGenesis(privKeys)
+	g.Params = GenesisParams{BlockTimeMs: 1}
+
+	bc, err := NewBlockChainFromGenesis(g, BlockchainOpts{})
+	assert.Nil(t, err)
+	genesis, err := bc.GetHeader(0)
+	assert.Nil(t, err)
+
+	heavy := []*Block{proposedBlock(t, privKeys[1], genesis, time.Millisecond)}
+	heavy = append(heavy, proposedBlock(t, privKeys[2], heavy[0].Header, time.Millisecond))
+	for _, b := range heavy {
+		assert.Nil(t, bc.AddBlock(b))
+	}
+
+	committed := proposedBlock(t, privKeys[2], genesis, 2*time.Millisecond)
+	commitBlock(t, committed, 0, privKeys...)
+	assert.Nil(t, bc.AddBlock(committed))
+	assert.Equal(t, uint32(1), bc.Height())
+	assert.Equal(t, uint32(1), bc.FinalizedHeight())
+	assert.Equal(t, committed.Hash(BlockHasher{}), bc.tipHash())
+
+	// the old branch cannot come back and is dropped
+	next := proposedBlock(t, privKeys[0], heavy[1].Header, time.Millisecond)
+	assert.True(t, errors.Is(bc.AddBlock(next), ErrFinalized))
+	assert.Equal(t, committed.Hash(BlockHasher{}), bc.tipHash())
+	assert.False(t, bc.HasBlockHash(heavy[0].Hash(BlockHasher{})))
+}
@@ -43,3 +43,33 @@ func NewGobTxDecoder(r io.Reader) *GobTxDecoder {
 func (e *GobTxDecoder) Decode(tx *Transaction) error {
 	return gob.NewDecoder(e.r).Decode(tx)
 }
+
+type GobBlockEncoder struct {
+	w io.Writer
+}
+
+func NewGobBlockEncoder(w io.Writer) *GobBlockEncoder {
+	gob.Register(elliptic.P256())
+	return &GobBlockEncoder{
+		w: w,
+	}
+}
+
+func (e *GobBlockEncoder) Encode(b *Block) error {
+	return gob.NewEncoder(e.w).Encode(b)
+}
+
+type GobBlockDecoder struct {
+	r io.Reader
+}
+
+func NewGobBlockDecoder(r io.Reader) *GobBlockDecoder {
+	gob.Register(elliptic.P256())
+	return &GobBlockDecoder{
+		r: r,
+	}
+}
+
+func (d *GobBlockDecoder) Decode(b *Block) error {
+	return gob.NewDecoder(d.r).Decode(b)
+}
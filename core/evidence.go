@@ -0,0 +1,201 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+
+	"go-blockchain/crypto"
+	"go-blockchain/types"
+)
+
+var ErrInvalidEvidence = errors.New("invalid evidence")
+
+// DoubleSignEvidence proves that a validator signed two different headers at
+// the same height. The headers are ordered by hash so every double sign has
+// exactly one encoding.
+type DoubleSignEvidence struct {
+	Validator  crypto.PublicKey
+	HeaderA    *Header
+	SignatureA *crypto.Signature
+	HeaderB    *Header
+	SignatureB *crypto.Signature
+}
+
+// NewDoubleSignEvidence returns the evidence that the validator of both
+// blocks signed them at the same height.
+func NewDoubleSignEvidence(a, b *Block) (*DoubleSignEvidence, error) {
+	if bytes.Compare(a.Hash(BlockHasher{}).ToSlice(), b.Hash(BlockHasher{}).ToSlice()) > 0 {
+		a, b = b, a
+	}
+
+	if a.Validator.Key == nil || b.Validator.Key == nil || a.Validator.Address() != b.Validator.Address() {
+		return nil, fmt.Errorf("%w: blocks at height %d are not signed by the same validator", ErrInvalidEvidence, a.Height)
+	}
+
+	e := &DoubleSignEvidence{
+		Validator:  a.Validator,
+		HeaderA:    a.Header,
+		SignatureA: a.Signature,
+		HeaderB:    b.Header,
+		SignatureB: b.Signature,
+	}
+
+	return e, e.Verify(a.ChainID)
+}
+
+// DecodeDoubleSignEvidence decodes the canonical encoding of the evidence, it
+// does not verify it.
+func DecodeDoubleSignEvidence(data []byte) (*DoubleSignEvidence, error) {
+	r := bytes.NewReader(data)
+	cr := &canonicalReader{r: r}
+
+	e := &DoubleSignEvidence{Validator: cr.publicKey()}
+	headerA := cr.header()
+	e.HeaderA, e.SignatureA = &headerA, cr.signature()
+	headerB := cr.header()
+	e.HeaderB, e.SignatureB = &headerB, cr.signature()
+
+	if cr.err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEvidence, cr.err)
+	}
+	if r.Len() > 0 {
+		return nil, fmt.Errorf("%w: %d trailing bytes", ErrInvalidEvidence, r.Len())
+	}
+
+	return e, nil
+}
+
+// Bytes returns the canonical encoding of the evidence.
+func (e *DoubleSignEvidence) Bytes() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	cw := &canonicalWriter{w: buf}
+
+	cw.publicKey(e.Validator)
+	cw.header(e.HeaderA)
+	cw.signature(e.SignatureA)
+	cw.header(e.HeaderB)
+	cw.signature(e.SignatureB)
+
+	return buf.Bytes(), cw.err
+}
+
+// Offender returns the address of the validator that signed both headers.
+func (e *DoubleSignEvidence) Offender() types.Address {
+	return e.Validator.Address()
+}
+
+func (e *DoubleSignEvidence) Height() uint32 {
+	return e.HeaderA.Height
+}
+
+// Verify checks that both headers belong to the chain, are at the same
+// height, differ and carry valid signatures of the validator.
+func (e *DoubleSignEvidence) Verify(chainID uint64) error {
+	if e.Validator.Key == nil || e.HeaderA == nil || e.HeaderB == nil || e.SignatureA == nil || e.SignatureB == nil {
+		return fmt.Errorf("%w: incomplete double sign evidence", ErrInvalidEvidence)
+	}
+
+	if e.HeaderA.ChainID != chainID || e.HeaderB.ChainID != chainID {
+		return fmt.Errorf("%w: headers of chains %d and %d, expected %d", ErrInvalidEvidence, e.HeaderA.ChainID, e.HeaderB.ChainID, chainID)
+	}
+
+	if e.HeaderA.Height != e.HeaderB.Height {
+		return fmt.Errorf("%w: headers at heights %d and %d", ErrInvalidEvidence, e.HeaderA.Height, e.HeaderB.Height)
+	}
+
+	hashA, hashB := BlockHasher{}.Hash(e.HeaderA), BlockHasher{}.Hash(e.HeaderB)
+	if bytes.Compare(hashA.ToSlice(), hashB.ToSlice()) >= 0 {
+		return fmt.Errorf("%w: headers %s and %s are not distinct and ordered by hash", ErrInvalidEvidence, hashA, hashB)
+	}
+
+	if !e.SignatureA.Verify(e.Validator, hashA.ToSlice()) || !e.SignatureB.Verify(e.Validator, hashB.ToSlice()) {
+		return fmt.Errorf("%w: headers at height %d are not both signed by %s", ErrInvalidEvidence, e.HeaderA.Height, e.Offender())
+	}
+
+	return nil
+}
+
+// EvidenceHandler is called for every double sign the chain detects, outside
+// of the blockchain lock.
+type EvidenceHandler func(*DoubleSignEvidence)
+
+type signedHeight struct {
+	validator types.Address
+	height    uint32
+}
+
+// EvidencePool remembers the first block every validator signed at a height
+// and turns a second, different one into evidence. Heights more than maxDepth
+// below the highest block seen are forgotten.
+type EvidencePool struct {
+	lock     sync.Mutex
+	maxDepth uint32
+	highest  uint32
+	signed   map[signedHeight]*Block
+	reported map[signedHeight]bool
+}
+
+func NewEvidencePool(maxDepth uint32) *EvidencePool {
+	return &EvidencePool{
+		maxDepth: maxDepth,
+		signed:   make(map[signedHeight]*Block),
+		reported: make(map[signedHeight]bool),
+	}
+}
+
+// Add records a block whose signature was verified. It returns the evidence
+// the first time a validator is seen signing a second block at a height, nil
+// otherwise.
+func (p *EvidencePool) Add(b *Block) *DoubleSignEvidence {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if b.Height+p.maxDepth < p.highest {
+		return nil
+	}
+	if b.Height > p.highest {
+		p.highest = b.Height
+		p.prune()
+	}
+
+	key := signedHeight{validator: b.Validator.Address(), height: b.Height}
+	first, ok := p.signed[key]
+	if !ok {
+		// only what the evidence needs is kept
+		p.signed[key] = &Block{Header: b.Header, Validator: b.Validator, Signature: b.Signature}
+		return nil
+	}
+
+	if p.reported[key] || first.Hash(BlockHasher{}) == b.Hash(BlockHasher{}) {
+		return nil
+	}
+
+	e, err := NewDoubleSignEvidence(first, b)
+	if err != nil {
+		return nil
+	}
+	p.reported[key] = true
+
+	return e
+}
+
+func (p *EvidencePool) Len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.signed)
+}
+
+func (p *EvidencePool) prune() {
+	if p.highest < p.maxDepth {
+		return
+	}
+
+	for key := range p.signed {
+		if key.height < p.highest-p.maxDepth {
+			delete(p.signed, key)
+			delete(p.reported, key)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"go-blockchain/crypto"
+	"go-blockchain/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDoubleSignEvidence(t *testing.T) {
+	privKey := crypto.GeneratePrivateKey()
+	parent := &Header{Height: 4, Timestamp: time.Now().UnixNano()}
+	a := proposedBlock(t, privKey, parent, time.Millisecond)
+	b := proposedBlock(t, privKey, parent, time.Millisecond)
+
+	e, err := NewDoubleSignEvidence(a, b)
+	assert.Nil(t, err)
+	assert.Equal(t, privKey.PublicKey().Address(), e.Offender())
+	assert.Equal(t, uint32(5), e.Height())
+
+	// the order of the blocks does not change the encoding
+	reversed, err := NewDoubleSignEvidence(b, a)
+	assert.Nil(t, err)
+	data, err := e.Bytes()
+	assert.Nil(t, err)
+	reversedData, err := reversed.Bytes()
+	assert.Nil(t, err)
+	assert.Equal(t, data, reversedData)
+
+	decoded, err := DecodeDoubleSignEvidence(data)
+	assert.Nil(t, err)
+	assert.Nil(t, decoded.Verify(0))
+
+	// headers signed for another chain are no evidence on this one
+	assert.True(t, errors.Is(decoded.Verify(2), ErrInvalidEvidence))
+	assert.Equal(t, e.Offender(), decoded.Offender())
+
+	_, err = DecodeDoubleSignEvidence(append(data, 0x00))
+	assert.True(t, errors.Is(err, ErrInvalidEvidence))
+
+	// the same block twice, blocks of two validators and blocks at two
+	// heights prove nothing
+	_, err = NewDoubleSignEvidence(a, a)
+	assert.True(t, errors.Is(err, ErrInvalidEvidence))
+	_, err = NewDoubleSignEvidence(a, proposedBlock(t, crypto.GeneratePrivateKey(), parent, time.Millisecond))
+	assert.True(t, errors.Is(err, ErrInvalidEvidence))
+	_, err = NewDoubleSignEvidence(a, proposedBlock(t, privKey, a.Header, time.Millisecond))
+	assert.True(t, errors.Is(err, ErrInvalidEvidence))
+
+	decoded.SignatureA = decoded.SignatureB
+	assert.True(t, errors.Is(decoded.Verify(0), ErrInvalidEvidence))
+}
+
+func TestEvidencePool(t *testing.T) {
+	privKey := crypto.GeneratePrivateKey()
+	parent := &Header{Height: 4, Timestamp: time.Now().UnixNano()}
+	a := proposedBlock(t, privKey, parent, time.Millisecond)
+	b := proposedBlock(t, privKey, parent, time.Millisecond)
+
+	pool := NewEvidencePool(2)
+	assert.Nil(t, pool.Add(a))
+	assert.Nil(t, pool.Add(a))
+	assert.Nil(t, pool.Add(proposedBlock(t, crypto.GeneratePrivateKey(), parent, time.Millisecond)))
+
+	e := pool.Add(b)
+	assert.NotNil(t, e)
+	assert.Equal(t, privKey.PublicKey().Address(), e.Offender())
+
+	// a double sign is reported once
+	assert.Nil(t, pool.Add(proposedBlock(t, privKey, parent, time.Millisecond)))
+
+	// heights too far below the highest block are forgotten
+	assert.Nil(t, pool.Add(proposedBlock(t, privKey, &Header{Height: 9}, time.Millisecond)))
+	assert.Equal(t, 1, pool.Len())
+	assert.Nil(t, pool.Add(proposedBlock(t, privKey, parent, time.Millisecond)))
+}
+
+// evidenceTx returns a transaction of the reporter with evidence that privKey
+// signed two blocks on top of parent.
+func evidenceTx(t *testing.T, reporter, privKey crypto.PrivateKey, parent *Header, nonce uint64) *Transaction {
+	e, err := NewDoubleSignEvidence(
+		proposedBlock(t, privKey, parent, time.Millisecond),
+		proposedBlock(t, privKey, parent, time.Millisecond),
+	)
+	assert.Nil(t, err)
+
+	tx, err := NewEvidenceTransaction(e, nonce)
+	assert.Nil(t, err)
+	assert.Nil(t, tx.Sign(reporter))
+	return tx
+}
+
+func TestSlashDoubleSigner(t *testing.T) {
+	privKeys := []crypto.PrivateKey{crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey()}
+	g := &Genesis{
+		Timestamp: time.Now().Add(-time.Hour).UnixNano(),
+		Params:    GenesisParams{BlockTimeMs: 1000},
+	}
+	for _, privKey := range privKeys {
+		g.Validators = append(g.Validators, GenesisValidator{PublicKey: privKey.PublicKey(), Power: 10})
+	}
+
+	bc, err := NewBlockChainFromGenesis(g, BlockchainOpts{})
+	assert.Nil(t, err)
+	genesis, err := bc.GetHeader(0)
+	assert.Nil(t, err)
+	offender := privKeys[1].PublicKey().Address()
+	assert.Equal(t, uint64(10), bc.GetAccount(offender).Stake)
+
+	detected := []*DoubleSignEvidence{}
+	bc.OnEvidence(func(e *DoubleSignEvidence) {
+		detected = append(detected, e)
+	})
+
+	// the proposer of block 1 signs a second block, it lands on a side branch
+	first := proposedBlock(t, privKeys[1], genesis, time.Millisecond)
+	assert.Nil(t, bc.AddBlock(first))
+	assert.Nil(t, bc.AddBlock(proposedBlock(t, privKeys[1], genesis, time.Millisecond)))
+	assert.Equal(t, 1, len(detected))
+	assert.Equal(t, offender, detected[0].Offender())
+
+	tx, err := NewEvidenceTransaction(detected[0], 0)
+	assert.Nil(t, err)
+	assert.Nil(t, tx.Sign(privKeys[0]))
+	b, err := NewBlockFromPrevHeader(first.Header, []Transaction{*tx})
+	assert.Nil(t, err)
+	b.Timestamp = first.Timestamp + int64(time.Millisecond)
+	assert.Nil(t, b.Sign(privKeys[2]))
+	assert.Nil(t, bc.AddBlock(b))
+
+	assert.Equal(t, uint64(0), bc.GetAccount(offender).Stake)
+	assert.Equal(t, 2, bc.Authority().Validators().Len())
+	assert.False(t, bc.Authority().Validators().Has(offender))
+
+	// the same offense is not punished twice and the offender may no longer
+	// propose
+	transition := bc.NewStateTransition(privKeys[0].PublicKey().Address())
+	err = transition.ApplyTransaction(evidenceTx(t, privKeys[0], privKeys[1], genesis, 1))
+	assert.True(t, errors.Is(err, ErrInvalidEvidence))
+	err = bc.AddBlock(proposedBlock(t, privKeys[1], b.Header, 2*time.Second))
+	assert.True(t, errors.Is(err, ErrUnknownProposer))
+
+	// blocks that do not build on the slashing are still checked against the
+	// set of their parent
+	assert.Equal(t, 3, bc.Authority().ValidatorsAt(first.Hash(BlockHasher{})).Len())
+	assert.Nil(t, bc.AddBlock(proposedBlock(t, privKeys[1], first.Header, 2*time.Second)))
+	assert.Equal(t, b.Hash(BlockHasher{}), bc.tipHash())
+}
+
+func TestRevertSlashing(t *testing.T) {
+	privKeys := []crypto.PrivateKey{crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey()}
+	reporter := crypto.GeneratePrivateKey()
+	parent := &Header{Height: 1, Timestamp: time.Now().UnixNano()}
+
+	s := NewState(nil)
+	s.Bond([]GenesisValidator{
+		{PublicKey: privKeys[0].PublicKey(), Power: 1},
+		{PublicKey: privKeys[1].PublicKey(), Power: 2},
+	})
+	assert.Equal(t, uint64(3), s.Validators().TotalPower())
+
+	b := proposedBlock(t, reporter, parent, time.Millisecond)
+	b.Transactions = []Transaction{*evidenceTx(t, reporter, privKeys[1], parent, 0)}
+	undo, err := s.ApplyBlock(b)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, s.Validators().Len())
+	assert.Equal(t, uint64(1), s.Validators().TotalPower())
+
+	// the last validator holding stake is never slashed
+	err = s.NewTransition(types.Address{}).ApplyTransaction(evidenceTx(t, reporter, privKeys[0], parent, 1))
+	assert.True(t, errors.Is(err, ErrInvalidEvidence))
+
+	s.Revert(undo)
+	assert.Equal(t, 2, s.Validators().Len())
+	assert.Equal(t, uint64(2), s.Account(privKeys[1].PublicKey().Address()).Stake)
+}
@@ -0,0 +1,355 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"go-blockchain/types"
+)
+
+const (
+	DefaultMaxSegmentSize = 64 << 20
+
+	indexFileName  = "index"
+	indexEntrySize = 60
+)
+
+// blockLocation points to an encoded block inside a segment file.
+//
+// On disk an index entry is laid out as (big-endian):
+// hash[32] height[4] segment[4] offset[8] size[4] checksum[4] entryChecksum[4]
+type blockLocation struct {
+	hash     types.Hash
+	height   uint32
+	segment  uint32
+	offset   int64
+	size     uint32
+	checksum uint32
+}
+
+func (l blockLocation) bytes() []byte {
+	buf := make([]byte, indexEntrySize)
+	copy(buf[0:32], l.hash[:])
+	binary.BigEndian.PutUint32(buf[32:36], l.height)
+	binary.BigEndian.PutUint32(buf[36:40], l.segment)
+	binary.BigEndian.PutUint64(buf[40:48], uint64(l.offset))
+	binary.BigEndian.PutUint32(buf[48:52], l.size)
+	binary.BigEndian.PutUint32(buf[52:56], l.checksum)
+	binary.BigEndian.PutUint32(buf[56:60], crc32.ChecksumIEEE(buf[:56]))
+	return buf
+}
+
+func blockLocationFromBytes(buf []byte) (blockLocation, error) {
+	if crc32.ChecksumIEEE(buf[:56]) != binary.BigEndian.Uint32(buf[56:60]) {
+		return blockLocation{}, fmt.Errorf("index entry checksum mismatch")
+	}
+
+	return blockLocation{
+		hash:     types.HashFromBytes(buf[0:32]),
+		height:   binary.BigEndian.Uint32(buf[32:36]),
+		segment:  binary.BigEndian.Uint32(buf[36:40]),
+		offset:   int64(binary.BigEndian.Uint64(buf[40:48])),
+		size:     binary.BigEndian.Uint32(buf[48:52]),
+		checksum: binary.BigEndian.Uint32(buf[52:56]),
+	}, nil
+}
+
+// FileStore is an append-only Storage backed by segment files plus an index.
+// Blocks are appended to the current segment in their canonical encoding and
+// a fixed size entry pointing to them is appended to the index, both are
+// fsynced before Put returns, as is the directory when a file is created. On
+// reopen every indexed block is verified against its checksum and anything
+// written after the last complete index entry is truncated.
+type FileStore struct {
+	lock           sync.RWMutex
+	dir            string
+	maxSegmentSize int64
+	index          *os.File
+	segments       []*os.File
+	segmentSize    int64
+	blocks         map[types.Hash]blockLocation
+	byHeight       []types.Hash
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	return NewFileStoreWithSegmentSize(dir, DefaultMaxSegmentSize)
+}
+
+func NewFileStoreWithSegmentSize(dir string, maxSegmentSize int64) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	index, err := os.OpenFile(filepath.Join(dir, indexFileName), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syncDir(dir); err != nil {
+		_ = index.Close()
+		return nil, err
+	}
+
+	s := &FileStore{
+		dir:            dir,
+		maxSegmentSize: maxSegmentSize,
+		index:          index,
+		segments:       []*os.File{},
+		blocks:         make(map[types.Hash]blockLocation),
+		byHeight:       []types.Hash{},
+	}
+
+	if err := s.load(); err != nil {
+		_ = s.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func segmentFileName(n uint32) string {
+	return fmt.Sprintf("%06d.seg", n)
+}
+
+// load replays the index, verifies the checksum of every block it points to
+// and truncates torn writes left behind by a crash.
+func (s *FileStore) load() error {
+	data, err := io.ReadAll(s.index)
+	if err != nil {
+		return err
+	}
+
+	valid := 0
+	for ; valid+indexEntrySize <= len(data); valid += indexEntrySize {
+		loc, err := blockLocationFromBytes(data[valid : valid+indexEntrySize])
+		if err != nil {
+			break
+		}
+
+		if err := s.openSegmentsUpTo(loc.segment); err != nil {
+			return err
+		}
+
+		buf, err := s.readLocation(loc)
+		if err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(buf) != loc.checksum {
+			break
+		}
+
+		if int(loc.height) > len(s.byHeight) {
+			return fmt.Errorf("corrupt index: block at height %d stored before height %d", loc.height, len(s.byHeight))
+		}
+
+		s.blocks[loc.hash] = loc
+		s.byHeight = append(s.byHeight[:loc.height], loc.hash)
+	}
+
+	if err := s.index.Truncate(int64(valid)); err != nil {
+		return err
+	}
+	if _, err := s.index.Seek(int64(valid), io.SeekStart); err != nil {
+		return err
+	}
+
+	return s.truncateSegments()
+}
+
+func (s *FileStore) openSegmentsUpTo(n uint32) error {
+	if uint32(len(s.segments)) > n {
+		return nil
+	}
+
+	for uint32(len(s.segments)) <= n {
+		f, err := os.OpenFile(filepath.Join(s.dir, segmentFileName(uint32(len(s.segments)))), os.O_RDWR|os.O_CREATE, 0o644)
+		if err != nil {
+			return err
+		}
+		s.segments = append(s.segments, f)
+	}
+
+	// the entries of created segments must be durable before the index
+	// points into them
+	return syncDir(s.dir)
+}
+
+// syncDir fsyncs the directory so the files created in it survive a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	if err := d.Sync(); err != nil {
+		_ = d.Close()
+		return err
+	}
+	return d.Close()
+}
+
+// truncateSegments drops the bytes of the last segment that no index entry
+// points to and removes segments created after it.
+func (s *FileStore) truncateSegments() error {
+	var (
+		last uint32
+		end  int64
+	)
+	for _, loc := range s.blocks {
+		if loc.segment > last || (loc.segment == last && loc.offset+int64(loc.size) > end) {
+			last = loc.segment
+			end = loc.offset + int64(loc.size)
+		}
+	}
+
+	if err := s.openSegmentsUpTo(last); err != nil {
+		return err
+	}
+
+	if err := s.segments[last].Truncate(end); err != nil {
+		return err
+	}
+	s.segments = s.segments[:last+1]
+	s.segmentSize = end
+
+	for n := last + 1; ; n++ {
+		err := os.Remove(filepath.Join(s.dir, segmentFileName(n)))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *FileStore) readLocation(loc blockLocation) ([]byte, error) {
+	if int(loc.segment) >= len(s.segments) {
+		return nil, fmt.Errorf("segment %d does not exist", loc.segment)
+	}
+
+	buf := make([]byte, loc.size)
+	if _, err := s.segments[loc.segment].ReadAt(buf, loc.offset); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+func (s *FileStore) Put(b *Block) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if int(b.Height) > len(s.byHeight) {
+		return fmt.Errorf("cannot store block at height %d, store height is %d", b.Height, len(s.byHeight)-1)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := b.Encode(NewCanonicalBlockEncoder(buf)); err != nil {
+		return err
+	}
+
+	if s.segmentSize > 0 && s.segmentSize+int64(buf.Len()) > s.maxSegmentSize {
+		if err := s.openSegmentsUpTo(uint32(len(s.segments))); err != nil {
+			return err
+		}
+		s.segmentSize = 0
+	}
+
+	segment := s.segments[len(s.segments)-1]
+	if _, err := segment.WriteAt(buf.Bytes(), s.segmentSize); err != nil {
+		return err
+	}
+	if err := segment.Sync(); err != nil {
+		return err
+	}
+
+	loc := blockLocation{
+		hash:     b.Hash(BlockHasher{}),
+		height:   b.Height,
+		segment:  uint32(len(s.segments) - 1),
+		offset:   s.segmentSize,
+		size:     uint32(buf.Len()),
+		checksum: crc32.ChecksumIEEE(buf.Bytes()),
+	}
+
+	if _, err := s.index.Write(loc.bytes()); err != nil {
+		return err
+	}
+	if err := s.index.Sync(); err != nil {
+		return err
+	}
+
+	s.segmentSize += int64(loc.size)
+	s.blocks[loc.hash] = loc
+	s.byHeight = append(s.byHeight[:b.Height], loc.hash)
+
+	return nil
+}
+
+func (s *FileStore) Get(hash types.Hash) (*Block, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	loc, ok := s.blocks[hash]
+	if !ok {
+		return nil, fmt.Errorf("block with hash %s not found", hash)
+	}
+
+	return s.decodeLocation(loc)
+}
+
+func (s *FileStore) GetByHeight(height uint32) (*Block, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if int(height) >= len(s.byHeight) {
+		return nil, fmt.Errorf("block at height %d not found", height)
+	}
+
+	return s.decodeLocation(s.blocks[s.byHeight[height]])
+}
+
+func (s *FileStore) decodeLocation(loc blockLocation) (*Block, error) {
+	buf, err := s.readLocation(loc)
+	if err != nil {
+		return nil, err
+	}
+
+	if crc32.ChecksumIEEE(buf) != loc.checksum {
+		return nil, fmt.Errorf("checksum mismatch for block %s", loc.hash)
+	}
+
+	b := new(Block)
+	if err := b.Decode(NewCanonicalBlockDecoder(bytes.NewReader(buf))); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (s *FileStore) Len() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.byHeight)
+}
+
+func (s *FileStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var firstErr error
+	for _, f := range append(s.segments, s.index) {
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.segments = nil
+
+	return firstErr
+}
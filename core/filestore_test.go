@@ -0,0 +1,207 @@
+package core
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go-blockchain/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newFileStoreWithBlocks(t *testing.T, dir string, n int) (*FileStore, []*Block) {
+	s, err := NewFileStoreWithSegmentSize(dir, 4096)
+	assert.Nil(t, err)
+
+	blocks := []*Block{}
+	prevHash := types.Hash{}
+	for i := 0; i < n; i++ {
+		b := randomBlock(t, uint32(i), prevHash)
+		assert.Nil(t, s.Put(b))
+		blocks = append(blocks, b)
+		prevHash = b.Hash(BlockHasher{})
+	}
+
+	return s, blocks
+}
+
+func TestFileStorePutGet(t *testing.T) {
+	s, blocks := newFileStoreWithBlocks(t, t.TempDir(), 50)
+	defer s.Close()
+
+	assert.Equal(t, 50, s.Len())
+	assert.Greater(t, len(s.segments), 1)
+
+	for i, b := range blocks {
+		byHash, err := s.Get(b.Hash(BlockHasher{}))
+		assert.Nil(t, err)
+		assert.Equal(t, b.Hash(BlockHasher{}), byHash.Hash(BlockHasher{}))
+		assert.Nil(t, byHash.Verify())
+
+		byHeight, err := s.GetByHeight(uint32(i))
+		assert.Nil(t, err)
+		assert.Equal(t, b.Hash(BlockHasher{}), byHeight.Hash(BlockHasher{}))
+	}
+
+	_, err := s.Get(types.RandomHash())
+	assert.NotNil(t, err)
+	_, err = s.GetByHeight(50)
+	assert.NotNil(t, err)
+	assert.NotNil(t, s.Put(randomBlock(t, 52, types.Hash{})))
+}
+
+func TestFileStoreCanonicalFormat(t *testing.T) {
+	dir := t.TempDir()
+	s, blocks := newFileStoreWithBlocks(t, dir, 1)
+	defer s.Close()
+
+	// the segment holds the canonical encoding, independent of Go types
+	data, err := os.ReadFile(filepath.Join(dir, segmentFileName(0)))
+	assert.Nil(t, err)
+	decoded := new(Block)
+	assert.Nil(t, decoded.Decode(NewCanonicalBlockDecoder(bytes.NewReader(data))))
+	assert.Equal(t, blocks[0].Hash(BlockHasher{}), decoded.Hash(BlockHasher{}))
+}
+
+func TestFileStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+	s, blocks := newFileStoreWithBlocks(t, dir, 30)
+	assert.Nil(t, s.Close())
+
+	s, err := NewFileStoreWithSegmentSize(dir, 4096)
+	assert.Nil(t, err)
+	defer s.Close()
+
+	assert.Equal(t, 30, s.Len())
+	for i, b := range blocks {
+		stored, err := s.GetByHeight(uint32(i))
+		assert.Nil(t, err)
+		assert.Equal(t, b.Hash(BlockHasher{}), stored.Hash(BlockHasher{}))
+	}
+
+	// the store keeps appending after reopen
+	b := randomBlock(t, 30, blocks[29].Hash(BlockHasher{}))
+	assert.Nil(t, s.Put(b))
+	assert.Equal(t, 31, s.Len())
+}
+
+func TestFileStoreReplaceHeight(t *testing.T) {
+	dir := t.TempDir()
+	s, blocks := newFileStoreWithBlocks(t, dir, 10)
+
+	fork := randomBlock(t, 5, blocks[4].Hash(BlockHasher{}))
+	assert.Nil(t, s.Put(fork))
+	assert.Equal(t, 6, s.Len())
+	assert.Nil(t, s.Close())
+
+	s, err := NewFileStoreWithSegmentSize(dir, 4096)
+	assert.Nil(t, err)
+	defer s.Close()
+
+	assert.Equal(t, 6, s.Len())
+	tip, err := s.GetByHeight(5)
+	assert.Nil(t, err)
+	assert.Equal(t, fork.Hash(BlockHasher{}), tip.Hash(BlockHasher{}))
+
+	// replaced blocks can still be fetched by hash
+	_, err = s.Get(blocks[7].Hash(BlockHasher{}))
+	assert.Nil(t, err)
+}
+
+func TestFileStoreTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := newFileStoreWithBlocks(t, dir, 5)
+	assert.Nil(t, s.Close())
+
+	// simulate a crash halfway through writing the next index entry
+	index, err := os.OpenFile(filepath.Join(dir, indexFileName), os.O_WRONLY|os.O_APPEND, 0o644)
+	assert.Nil(t, err)
+	_, err = index.Write(make([]byte, indexEntrySize/2))
+	assert.Nil(t, err)
+	assert.Nil(t, index.Close())
+
+	s, err = NewFileStoreWithSegmentSize(dir, 4096)
+	assert.Nil(t, err)
+	defer s.Close()
+
+	assert.Equal(t, 5, s.Len())
+	info, err := os.Stat(filepath.Join(dir, indexFileName))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5*indexEntrySize), info.Size())
+}
+
+func TestFileStoreCorruptBlock(t *testing.T) {
+	dir := t.TempDir()
+	s, blocks := newFileStoreWithBlocks(t, dir, 5)
+	last := s.blocks[blocks[4].Hash(BlockHasher{})]
+	assert.Nil(t, s.Close())
+
+	// flip a byte inside the last block
+	seg, err := os.OpenFile(filepath.Join(dir, segmentFileName(last.segment)), os.O_RDWR, 0o644)
+	assert.Nil(t, err)
+	_, err = seg.WriteAt([]byte{0xff}, last.offset+int64(last.size)-1)
+	assert.Nil(t, err)
+	assert.Nil(t, seg.Close())
+
+	s, err = NewFileStoreWithSegmentSize(dir, 4096)
+	assert.Nil(t, err)
+	defer s.Close()
+
+	assert.Equal(t, 4, s.Len())
+	_, err = s.Get(blocks[4].Hash(BlockHasher{}))
+	assert.NotNil(t, err)
+}
+
+func TestBlockchainReopenFromStore(t *testing.T) {
+	dir := t.TempDir()
+	genesis := randomBlock(t, 0, types.Hash{})
+
+	store, err := NewFileStore(dir)
+	assert.Nil(t, err)
+	bc, err := NewBlockChainWithStore(store, genesis)
+	assert.Nil(t, err)
+
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, bc.AddBlock(randomBlock(t, uint32(i+1), getPrevBlockHash(t, bc, uint32(i+1)))))
+	}
+	tip, err := bc.GetHeader(bc.Height())
+	assert.Nil(t, err)
+	assert.Nil(t, bc.Close())
+
+	store, err = NewFileStore(dir)
+	assert.Nil(t, err)
+	bc, err = NewBlockChainWithStore(store, genesis)
+	assert.Nil(t, err)
+	defer bc.Close()
+
+	assert.Equal(t, uint32(20), bc.Height())
+	reopenedTip, err := bc.GetHeader(bc.Height())
+	assert.Nil(t, err)
+	assert.Equal(t, BlockHasher{}.Hash(tip), BlockHasher{}.Hash(reopenedTip))
+	assert.Nil(t, bc.AddBlock(randomBlock(t, 21, getPrevBlockHash(t, bc, 21))))
+
+	otherStore, err := NewFileStore(dir)
+	assert.Nil(t, err)
+	_, err = NewBlockChainWithStore(otherStore, randomBlock(t, 0, types.Hash{}))
+	assert.NotNil(t, err)
+	assert.Nil(t, otherStore.Close())
+}
+
+func TestBlockchainRejectsBrokenStore(t *testing.T) {
+	genesis := randomBlock(t, 0, types.Hash{})
+	b1 := randomBlock(t, 1, genesis.Hash(BlockHasher{}))
+
+	store := NewMemStore()
+	assert.Nil(t, store.Put(genesis))
+	assert.Nil(t, store.Put(b1))
+	assert.Nil(t, store.Put(randomBlock(t, 2, types.RandomHash())))
+
+	_, err := NewBlockChainWithStore(store, genesis)
+	assert.ErrorContains(t, err, "links to")
+
+	assert.Nil(t, store.Put(randomBlock(t, 2, b1.Hash(BlockHasher{}))))
+	_, err = NewBlockChainWithStore(store, genesis)
+	assert.Nil(t, err)
+}
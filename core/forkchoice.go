@@ -0,0 +1,41 @@
+package core
+
+import (
+	"math/big"
+
+	"go-blockchain/types"
+)
+
+// ForkChoice decides which branch of the block tree is canonical. The branch
+// with the greatest cumulative weight wins, ties keep the current branch.
+type ForkChoice interface {
+	// Weight returns the weight a block adds to the branch it extends.
+	Weight(*Block) *big.Int
+}
+
+// LongestChain prefers the branch with the most blocks.
+type LongestChain struct{}
+
+func (LongestChain) Weight(*Block) *big.Int {
+	return big.NewInt(1)
+}
+
+// HeaviestChain prefers the branch whose blocks were signed by the validators
+// with the greatest combined weight. Blocks from unknown validators weigh nothing.
+type HeaviestChain struct {
+	weights map[types.Address]uint64
+}
+
+func NewHeaviestChain(weights map[types.Address]uint64) *HeaviestChain {
+	return &HeaviestChain{
+		weights: weights,
+	}
+}
+
+func (c *HeaviestChain) Weight(b *Block) *big.Int {
+	if b.Validator.Key == nil {
+		return big.NewInt(0)
+	}
+
+	return new(big.Int).SetUint64(c.weights[b.Validator.Address()])
+}
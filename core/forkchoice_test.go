@@ -0,0 +1,41 @@
+package core
+
+import (
+	"testing"
+
+	"go-blockchain/crypto"
+	"go-blockchain/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeaviestChain(t *testing.T) {
+	heavy := crypto.GeneratePrivateKey()
+	light := crypto.GeneratePrivateKey()
+
+	forkChoice := NewHeaviestChain(map[types.Address]uint64{
+		heavy.PublicKey().Address(): 10,
+		light.PublicKey().Address(): 1,
+	})
+
+	bc, err := NewBlockChainWithOpts(randomBlock(t, 0, types.Hash{}), BlockchainOpts{ForkChoice: forkChoice})
+	assert.Nil(t, err)
+
+	prevHash := getPrevBlockHash(t, bc, 1)
+	for i := uint32(1); i <= 5; i++ {
+		b := randomBlockWithSigner(t, light, i, prevHash)
+		assert.Nil(t, bc.AddBlock(b))
+		prevHash = b.Hash(BlockHasher{})
+	}
+
+	prevHash = getPrevBlockHash(t, bc, 1)
+	for i := uint32(1); i <= 2; i++ {
+		b := randomBlockWithSigner(t, heavy, i, prevHash)
+		assert.Nil(t, bc.AddBlock(b))
+		prevHash = b.Hash(BlockHasher{})
+	}
+
+	// two heavy blocks outweigh five light ones
+	assert.Equal(t, uint32(2), bc.Height())
+	assert.Equal(t, prevHash, bc.tipHash())
+}
@@ -0,0 +1,223 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"go-blockchain/crypto"
+	"go-blockchain/types"
+)
+
+const (
+	// ConsensusPoA rotates the proposers of the validator set, it is the
+	// default for a genesis with validators
+	ConsensusPoA = "poa"
+	// ConsensusBFT only accepts blocks carrying a commit certificate of the
+	// validator set, every block is final
+	ConsensusBFT = "bft"
+	// ConsensusPoW lets anyone mine blocks, the branch with the most work is
+	// canonical
+	ConsensusPoW = "pow"
+)
+
+// GenesisValidator is a member of the initial validator set.
+type GenesisValidator struct {
+	PublicKey crypto.PublicKey `json:"publicKey"`
+	Power     uint64           `json:"power"`
+}
+
+// GenesisParams are the protocol parameters fixed at genesis, zero values
+// leave the node defaults in place.
+type GenesisParams struct {
+	BlockTimeMs  uint64 `json:"blockTimeMs"`
+	MaxBlockSize uint64 `json:"maxBlockSize"`
+	// Consensus is ConsensusPoA, ConsensusBFT or ConsensusPoW
+	Consensus string `json:"consensus"`
+	// Bits is the compact target of the first mined block and
+	// RetargetInterval the number of blocks between difficulty adjustments,
+	// both only apply to ConsensusPoW
+	Bits             uint32 `json:"bits"`
+	RetargetInterval uint32 `json:"retargetInterval"`
+}
+
+// Genesis describes the start of a chain. Every node loading the same spec
+// produces the same genesis block, the spec itself is committed to by the
+// DataHash of that block.
+type Genesis struct {
+	ChainID    uint64             `json:"chainId"`
+	Timestamp  int64              `json:"timestamp"`
+	Validators []GenesisValidator `json:"validators"`
+	Alloc      GenesisAlloc       `json:"alloc"`
+	Params     GenesisParams      `json:"params"`
+}
+
+// LoadGenesis reads a JSON genesis spec from a file.
+func LoadGenesis(path string) (*Genesis, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseGenesis(data)
+}
+
+// ParseGenesis decodes and validates a JSON genesis spec, unknown fields are rejected.
+func ParseGenesis(data []byte) (*Genesis, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	g := &Genesis{}
+	if err := dec.Decode(g); err != nil {
+		return nil, fmt.Errorf("invalid genesis: %w", err)
+	}
+
+	if err := g.Validate(); err != nil {
+		return nil, err
+	}
+
+	return g, nil
+}
+
+func (g *Genesis) Validate() error {
+	seen := map[types.Address]bool{}
+	for i, v := range g.Validators {
+		if v.PublicKey.Key == nil {
+			return fmt.Errorf("invalid genesis: validator %d has no public key", i)
+		}
+		if v.Power == 0 {
+			return fmt.Errorf("invalid genesis: validator %s has no power", v.PublicKey.Address())
+		}
+		if seen[v.PublicKey.Address()] {
+			return fmt.Errorf("invalid genesis: duplicate validator %s", v.PublicKey.Address())
+		}
+		seen[v.PublicKey.Address()] = true
+	}
+
+	switch g.Params.Consensus {
+	case "", ConsensusPoA:
+	case ConsensusBFT:
+		if len(g.Validators) == 0 {
+			return fmt.Errorf("invalid genesis: %s consensus without validators", ConsensusBFT)
+		}
+	case ConsensusPoW:
+		if len(g.Validators) > 0 {
+			return fmt.Errorf("invalid genesis: %s consensus with validators", ConsensusPoW)
+		}
+		if g.Params.Bits != 0 {
+			target, err := CompactToTarget(g.Params.Bits)
+			if err != nil {
+				return fmt.Errorf("invalid genesis: %w", err)
+			}
+			if target.Cmp(powLimit) > 0 {
+				return fmt.Errorf("invalid genesis: bits 0x%08x are easier than the limit 0x%08x", g.Params.Bits, PowLimitBits)
+			}
+		}
+	default:
+		return fmt.Errorf("invalid genesis: unknown consensus %q", g.Params.Consensus)
+	}
+
+	return nil
+}
+
+// Bytes returns the canonical encoding of the spec. Allocations are sorted by
+// address, validators keep their order and every param is encoded.
+func (g *Genesis) Bytes() []byte {
+	buf := &bytes.Buffer{}
+	cw := &canonicalWriter{w: buf}
+
+	cw.uint64(g.ChainID)
+	cw.int64(g.Timestamp)
+
+	cw.uint32(uint32(len(g.Validators)))
+	for _, v := range g.Validators {
+		cw.publicKey(v.PublicKey)
+		cw.uint64(v.Power)
+	}
+
+	addrs := make([]types.Address, 0, len(g.Alloc))
+	for addr := range g.Alloc {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		return bytes.Compare(addrs[i][:], addrs[j][:]) < 0
+	})
+
+	cw.uint32(uint32(len(addrs)))
+	for _, addr := range addrs {
+		cw.address(addr)
+		cw.uint64(g.Alloc[addr])
+	}
+
+	// no consensus is proof of authority, both specs are the same chain
+	consensus := g.Params.Consensus
+	if consensus == "" {
+		consensus = ConsensusPoA
+	}
+
+	cw.uint64(g.Params.BlockTimeMs)
+	cw.uint64(g.Params.MaxBlockSize)
+	cw.bytes([]byte(consensus))
+	cw.uint32(g.Params.Bits)
+	cw.uint32(g.Params.RetargetInterval)
+
+	return buf.Bytes()
+}
+
+// Hash returns the hash of the canonical encoding of the spec.
+func (g *Genesis) Hash() types.Hash {
+	return sha256.Sum256(g.Bytes())
+}
+
+// Block returns the genesis block, its DataHash is the hash of the spec.
+func (g *Genesis) Block() *Block {
+	header := &Header{
+		Version:   HeaderVersionMerkle,
+		ChainID:   g.ChainID,
+		DataHash:  g.Hash(),
+		Height:    0,
+		Timestamp: g.Timestamp,
+	}
+
+	return NewBlock(header, nil)
+}
+
+// ValidatorSet returns the validators of the spec in their order.
+func (g *Genesis) ValidatorSet() *ValidatorSet {
+	return NewValidatorSet(g.Validators)
+}
+
+// NewBlockChainFromGenesis creates a blockchain starting at the genesis block
+// of the spec, the chain id and allocations of opts are taken from it. A spec
+// with validators makes them the only proposers, waiting one block time for a
+// missing one, and unless set otherwise the fork choice follows their schedule.
+// With proof of work anyone may mine blocks and the most work wins, without
+// either anyone may propose blocks.
+func NewBlockChainFromGenesis(g *Genesis, opts BlockchainOpts) (*Blockchain, error) {
+	opts.ChainID = g.ChainID
+	opts.GenesisAlloc = g.Alloc
+	opts.RequireCommit = g.Params.Consensus == ConsensusBFT
+	if opts.Rules.MaxBlockSize == 0 {
+		opts.Rules.MaxBlockSize = int(g.Params.MaxBlockSize)
+	}
+	blockTime := time.Duration(g.Params.BlockTimeMs) * time.Millisecond
+
+	if len(g.Validators) > 0 && opts.Authority == nil {
+		opts.Authority = NewProofOfAuthority(g.ValidatorSet(), blockTime)
+	}
+	if opts.Authority != nil && opts.ForkChoice == nil {
+		opts.ForkChoice = opts.Authority
+	}
+
+	if g.Params.Consensus == ConsensusPoW && opts.ProofOfWork == nil {
+		opts.ProofOfWork = NewProofOfWork(g.Params.Bits, g.Params.RetargetInterval, blockTime)
+	}
+	if opts.ProofOfWork != nil && opts.ForkChoice == nil {
+		opts.ForkChoice = opts.ProofOfWork
+	}
+
+	return NewBlockChainWithOpts(g.Block(), opts)
+}
@@ -0,0 +1,116 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go-blockchain/crypto"
+	"go-blockchain/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func genesisJSON(t *testing.T, validator crypto.PublicKey, alloc string) []byte {
+	key, err := validator.MarshalText()
+	assert.Nil(t, err)
+
+	return []byte(fmt.Sprintf(`{
+		"chainId": 7,
+		"timestamp": 1700000000000000000,
+		"validators": [{"publicKey": "%s", "power": 10}],
+		"alloc": {%s},
+		"params": {"blockTimeMs": 2000, "maxBlockSize": 65536}
+	}`, key, alloc))
+}
+
+func TestParseGenesis(t *testing.T) {
+	validator := crypto.GeneratePrivateKey().PublicKey()
+	alloc := `"1111111111111111111111111111111111111111": 100, "0x2222222222222222222222222222222222222222": 200`
+
+	g, err := ParseGenesis(genesisJSON(t, validator, alloc))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(7), g.ChainID)
+	assert.Equal(t, int64(1700000000000000000), g.Timestamp)
+	assert.Len(t, g.Validators, 1)
+	assert.Equal(t, validator.Address(), g.Validators[0].PublicKey.Address())
+	assert.Equal(t, uint64(2000), g.Params.BlockTimeMs)
+
+	addr := types.Address{}
+	assert.Nil(t, addr.UnmarshalText([]byte("2222222222222222222222222222222222222222")))
+	assert.Equal(t, uint64(200), g.Alloc[addr])
+
+	// the order of the allocations does not change the genesis block
+	reordered := `"2222222222222222222222222222222222222222": 200, "1111111111111111111111111111111111111111": 100`
+	other, err := ParseGenesis(genesisJSON(t, validator, reordered))
+	assert.Nil(t, err)
+	assert.Equal(t, g.Block().Hash(BlockHasher{}), other.Block().Hash(BlockHasher{}))
+
+	// every field is committed to
+	changed, err := ParseGenesis(genesisJSON(t, validator, `"1111111111111111111111111111111111111111": 101`))
+	assert.Nil(t, err)
+	assert.NotEqual(t, g.Block().Hash(BlockHasher{}), changed.Block().Hash(BlockHasher{}))
+
+	other.Params.MaxBlockSize++
+	assert.NotEqual(t, g.Block().Hash(BlockHasher{}), other.Block().Hash(BlockHasher{}))
+
+	// no consensus is proof of authority, the other params count either way
+	poa := *g
+	poa.Params.Consensus = ConsensusPoA
+	assert.Equal(t, g.Hash(), poa.Hash())
+	poa.Params.RetargetInterval = 10
+	assert.NotEqual(t, g.Hash(), poa.Hash())
+}
+
+func TestParseGenesisRejectsInvalid(t *testing.T) {
+	_, err := ParseGenesis([]byte(`{"chainId": 1, "unknown": true}`))
+	assert.NotNil(t, err)
+
+	_, err = ParseGenesis([]byte(`{"alloc": {"xyz": 1}}`))
+	assert.NotNil(t, err)
+
+	validator := crypto.GeneratePrivateKey().PublicKey()
+	key, err := validator.MarshalText()
+	assert.Nil(t, err)
+
+	_, err = ParseGenesis([]byte(fmt.Sprintf(`{"validators": [{"publicKey": "%s", "power": 1}, {"publicKey": "%s", "power": 2}]}`, key, key)))
+	assert.NotNil(t, err)
+
+	_, err = ParseGenesis([]byte(fmt.Sprintf(`{"validators": [{"publicKey": "%s", "power": 0}]}`, key)))
+	assert.NotNil(t, err)
+
+	_, err = ParseGenesis([]byte(`{"params": {"consensus": "bft"}}`))
+	assert.NotNil(t, err)
+
+	_, err = ParseGenesis([]byte(fmt.Sprintf(`{"validators": [{"publicKey": "%s", "power": 1}], "params": {"consensus": "pow"}}`, key)))
+	assert.NotNil(t, err)
+
+	_, err = ParseGenesis([]byte(`{"params": {"consensus": "pow", "bits": 545259520}}`))
+	assert.NotNil(t, err)
+
+	_, err = ParseGenesis([]byte(`{"params": {"consensus": "pos"}}`))
+	assert.NotNil(t, err)
+}
+
+func TestLoadGenesis(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "genesis.json")
+	addr := crypto.GeneratePrivateKey().PublicKey().Address()
+	data := genesisJSON(t, crypto.GeneratePrivateKey().PublicKey(), fmt.Sprintf(`"%s": 500`, addr))
+	assert.Nil(t, os.WriteFile(path, data, 0o644))
+
+	g, err := LoadGenesis(path)
+	assert.Nil(t, err)
+
+	bc, err := NewBlockChainFromGenesis(g, BlockchainOpts{})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(7), bc.ChainID())
+	assert.Equal(t, uint64(500), bc.GetAccount(addr).Balance)
+
+	header, err := bc.GetHeader(0)
+	assert.Nil(t, err)
+	assert.Equal(t, g.Block().Hash(BlockHasher{}), BlockHasher{}.Hash(header))
+
+	_, err = LoadGenesis(filepath.Join(t.TempDir(), "missing.json"))
+	assert.NotNil(t, err)
+}
@@ -18,6 +18,8 @@ func (BlockHasher) Hash(b *Header) types.Hash {
 
 type TxHasher struct{}
 
+// Hash hashes the signed fields and the sender of the transaction, so equal
+// payloads from different senders never collide.
 func (TxHasher) Hash(tx *Transaction) types.Hash {
-	return types.Hash(sha256.Sum256(tx.Data))
+	return types.Hash(sha256.Sum256(tx.HashBytes()))
 }
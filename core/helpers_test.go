@@ -0,0 +1,36 @@
+package core
+
+import (
+	"testing"
+
+	"go-blockchain/crypto"
+	"go-blockchain/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// signedTransfer returns a transfer of value to to, signed by privKey.
+func signedTransfer(t *testing.T, privKey crypto.PrivateKey, to types.Address, value, nonce uint64) *Transaction {
+	tx := NewTransferTransaction(to, value, nonce)
+	assert.Nil(t, tx.Sign(privKey))
+	return tx
+}
+
+// blockWithTxs returns a block of txx on top of the tip of bc, signed by a
+// new key.
+func blockWithTxs(t *testing.T, bc *Blockchain, txx ...Transaction) *Block {
+	prevHeader, err := bc.GetHeader(bc.Height())
+	assert.Nil(t, err)
+
+	b, err := NewBlockFromPrevHeader(prevHeader, txx)
+	assert.Nil(t, err)
+	assert.Nil(t, b.Sign(crypto.GeneratePrivateKey()))
+
+	return b
+}
+
+func newFundedBlockchain(t *testing.T, alloc GenesisAlloc) *Blockchain {
+	bc, err := NewBlockChainWithOpts(randomBlock(t, 0, types.Hash{}), BlockchainOpts{GenesisAlloc: alloc})
+	assert.Nil(t, err)
+	return bc
+}
@@ -0,0 +1,128 @@
+package core
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"go-blockchain/types"
+)
+
+// Merkle tree nodes are domain separated so an inner node can never be passed
+// off as a transaction: leaf = sha256(0x00 || txHash) and
+// node = sha256(0x01 || left || right). A node without a sibling is promoted
+// to the next level unchanged and the root of an empty tree is the zero hash.
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+// MerkleStep is one level of a MerkleProof, Left tells whether the sibling
+// is on the left side of the path.
+type MerkleStep struct {
+	Hash types.Hash
+	Left bool
+}
+
+// MerkleProof proves that a transaction is part of a block's DataHash.
+type MerkleProof struct {
+	Index int
+	Path  []MerkleStep
+}
+
+func merkleLeaf(txHash types.Hash) types.Hash {
+	return sha256.Sum256(append([]byte{merkleLeafPrefix}, txHash[:]...))
+}
+
+func merkleNode(left, right types.Hash) types.Hash {
+	buf := make([]byte, 0, 1+2*len(left))
+	buf = append(buf, merkleNodePrefix)
+	buf = append(buf, left[:]...)
+	buf = append(buf, right[:]...)
+	return sha256.Sum256(buf)
+}
+
+func merkleLeaves(txx []Transaction) []types.Hash {
+	leaves := make([]types.Hash, len(txx))
+	for i := range txx {
+		leaves[i] = merkleLeaf(txx[i].Hash(TxHasher{}))
+	}
+	return leaves
+}
+
+func merkleNextLevel(level []types.Hash) []types.Hash {
+	next := make([]types.Hash, 0, (len(level)+1)/2)
+	for i := 0; i < len(level); i += 2 {
+		if i+1 == len(level) {
+			next = append(next, level[i])
+			continue
+		}
+		next = append(next, merkleNode(level[i], level[i+1]))
+	}
+	return next
+}
+
+// CalculateMerkleRoot returns the root of the binary Merkle tree over the
+// hashes of the transactions.
+func CalculateMerkleRoot(txx []Transaction) types.Hash {
+	if len(txx) == 0 {
+		return types.Hash{}
+	}
+
+	level := merkleLeaves(txx)
+	for len(level) > 1 {
+		level = merkleNextLevel(level)
+	}
+
+	return level[0]
+}
+
+// BuildProof returns the Merkle proof for the transaction with the given hash.
+func BuildProof(b *Block, txHash types.Hash) (*MerkleProof, error) {
+	if b.Version < HeaderVersionMerkle {
+		return nil, fmt.Errorf("block version %d has no merkle data hash", b.Version)
+	}
+
+	index := -1
+	for i := range b.Transactions {
+		if b.Transactions[i].Hash(TxHasher{}) == txHash {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return nil, fmt.Errorf("transaction %s is not part of block %s", txHash, b.Hash(BlockHasher{}))
+	}
+
+	proof := &MerkleProof{Index: index, Path: []MerkleStep{}}
+	level := merkleLeaves(b.Transactions)
+	for pos := index; len(level) > 1; pos /= 2 {
+		sibling := pos ^ 1
+		if sibling < len(level) {
+			proof.Path = append(proof.Path, MerkleStep{
+				Hash: level[sibling],
+				Left: sibling < pos,
+			})
+		}
+		level = merkleNextLevel(level)
+	}
+
+	return proof, nil
+}
+
+// VerifyProof reports whether proof shows that txHash is part of the tree with the given root.
+func VerifyProof(root types.Hash, txHash types.Hash, proof *MerkleProof) bool {
+	if proof == nil || root.IsZero() {
+		return false
+	}
+
+	hash := merkleLeaf(txHash)
+	for _, step := range proof.Path {
+		if step.Left {
+			hash = merkleNode(step.Hash, hash)
+		} else {
+			hash = merkleNode(hash, step.Hash)
+		}
+	}
+
+	return hash == root
+}
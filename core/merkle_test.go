@@ -0,0 +1,97 @@
+package core
+
+import (
+	"testing"
+
+	"go-blockchain/crypto"
+	"go-blockchain/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func randomMerkleBlock(t *testing.T, n int) *Block {
+	txx := make([]Transaction, n)
+	for i := range txx {
+		txx[i] = randomTxWithSignature(t)
+	}
+
+	b, err := NewBlockFromPrevHeader(&Header{Version: HeaderVersionMerkle}, txx)
+	assert.Nil(t, err)
+	assert.Nil(t, b.Sign(crypto.GeneratePrivateKey()))
+
+	return b
+}
+
+func TestMerkleRoot(t *testing.T) {
+	assert.True(t, CalculateMerkleRoot(nil).IsZero())
+
+	tx := randomTxWithSignature(t)
+	assert.Equal(t, merkleLeaf(tx.Hash(TxHasher{})), CalculateMerkleRoot([]Transaction{tx}))
+
+	txx := []Transaction{randomTxWithSignature(t), randomTxWithSignature(t), randomTxWithSignature(t)}
+	left := merkleNode(merkleLeaf(txx[0].Hash(TxHasher{})), merkleLeaf(txx[1].Hash(TxHasher{})))
+	expected := merkleNode(left, merkleLeaf(txx[2].Hash(TxHasher{})))
+	assert.Equal(t, expected, CalculateMerkleRoot(txx))
+
+	txx[0], txx[1] = txx[1], txx[0]
+	assert.NotEqual(t, expected, CalculateMerkleRoot(txx))
+}
+
+func TestMerkleProof(t *testing.T) {
+	for n := 1; n <= 17; n++ {
+		b := randomMerkleBlock(t, n)
+		assert.Nil(t, b.Verify())
+
+		for i := range b.Transactions {
+			txHash := b.Transactions[i].Hash(TxHasher{})
+			proof, err := BuildProof(b, txHash)
+			assert.Nil(t, err)
+			assert.Equal(t, i, proof.Index)
+			assert.True(t, VerifyProof(b.DataHash, txHash, proof))
+			assert.False(t, VerifyProof(b.DataHash, types.RandomHash(), proof))
+
+			if len(proof.Path) > 0 {
+				proof.Path[0].Hash = types.RandomHash()
+				assert.False(t, VerifyProof(b.DataHash, txHash, proof))
+			}
+		}
+	}
+
+	b := randomMerkleBlock(t, 4)
+	_, err := BuildProof(b, types.RandomHash())
+	assert.NotNil(t, err)
+	assert.False(t, VerifyProof(b.DataHash, types.RandomHash(), nil))
+}
+
+func TestMerkleProofRejectsInnerNode(t *testing.T) {
+	b := randomMerkleBlock(t, 4)
+
+	// an inner node with a shortened path must not verify as a transaction
+	proof, err := BuildProof(b, b.Transactions[0].Hash(TxHasher{}))
+	assert.Nil(t, err)
+
+	inner := merkleNode(merkleLeaf(b.Transactions[0].Hash(TxHasher{})), proof.Path[0].Hash)
+	forged := &MerkleProof{Path: proof.Path[1:]}
+	assert.False(t, VerifyProof(b.DataHash, inner, forged))
+}
+
+func TestBuildProofFlatVersion(t *testing.T) {
+	b := randomBlock(t, 1, types.Hash{})
+	b.Version = HeaderVersionFlat
+
+	_, err := BuildProof(b, b.Transactions[0].Hash(TxHasher{}))
+	assert.NotNil(t, err)
+}
+
+func TestVerifyBlockVersionMismatch(t *testing.T) {
+	b := randomMerkleBlock(t, 3)
+	privKey := crypto.GeneratePrivateKey()
+
+	b.Version = HeaderVersionFlat
+	assert.Nil(t, b.Sign(privKey))
+	assert.NotNil(t, b.Verify())
+
+	b.Version = 99
+	assert.Nil(t, b.Sign(privKey))
+	assert.NotNil(t, b.Verify())
+}
@@ -0,0 +1,201 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go-blockchain/types"
+)
+
+const (
+	DefaultMaxOrphans   = 256
+	DefaultMaxOrphanAge = 10 * time.Minute
+)
+
+var ErrOrphanBlock = errors.New("orphan block")
+
+// OrphanError is returned by AddBlock when the parent of a block is unknown.
+// The block is kept in the orphan pool and connected once Missing is added.
+type OrphanError struct {
+	Hash types.Hash
+	// Missing is the oldest unknown ancestor of the block
+	Missing types.Hash
+}
+
+func (e *OrphanError) Error() string {
+	return fmt.Sprintf("orphan block %s, missing ancestor %s", e.Hash, e.Missing)
+}
+
+func (e *OrphanError) Is(target error) bool {
+	return target == ErrOrphanBlock
+}
+
+// OrphanHandler is called for every new orphan with the hash of the oldest
+// unknown ancestor, so it can be requested from the network.
+type OrphanHandler func(orphan *Block, missing types.Hash)
+
+type OrphanStats struct {
+	Count     int
+	Added     uint64
+	Connected uint64
+	Evicted   uint64
+	Expired   uint64
+}
+
+type orphan struct {
+	block    *Block
+	received time.Time
+}
+
+// OrphanPool holds blocks whose parent is unknown, bounded by count and age.
+type OrphanPool struct {
+	lock     sync.Mutex
+	maxCount int
+	maxAge   time.Duration
+	orphans  map[types.Hash]*orphan
+	byParent map[types.Hash][]types.Hash
+	stats    OrphanStats
+}
+
+func NewOrphanPool(maxCount int, maxAge time.Duration) *OrphanPool {
+	return &OrphanPool{
+		maxCount: maxCount,
+		maxAge:   maxAge,
+		orphans:  make(map[types.Hash]*orphan),
+		byParent: make(map[types.Hash][]types.Hash),
+	}
+}
+
+// Add adds the block to the pool and returns false if it was already there.
+// When the pool is full the oldest orphan is evicted.
+func (p *OrphanPool) Add(b *Block) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	hash := b.Hash(BlockHasher{})
+	if _, ok := p.orphans[hash]; ok {
+		return false
+	}
+
+	p.prune()
+
+	for len(p.orphans) >= p.maxCount && len(p.orphans) > 0 {
+		p.remove(p.oldest())
+		p.stats.Evicted++
+	}
+
+	p.orphans[hash] = &orphan{block: b, received: time.Now()}
+	p.byParent[b.PrevBlockHash] = append(p.byParent[b.PrevBlockHash], hash)
+	p.stats.Added++
+
+	return true
+}
+
+func (p *OrphanPool) Has(hash types.Hash) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	_, ok := p.orphans[hash]
+	return ok
+}
+
+// TakeChildren removes and returns the orphans built on top of parent.
+func (p *OrphanPool) TakeChildren(parent types.Hash) []*Block {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.prune()
+
+	children := []*Block{}
+	for _, hash := range p.byParent[parent] {
+		children = append(children, p.orphans[hash].block)
+		p.stats.Connected++
+	}
+
+	for _, b := range children {
+		p.remove(b.Hash(BlockHasher{}))
+	}
+
+	return children
+}
+
+// MissingAncestor follows the orphans back from b and returns the hash of the
+// first block that is not in the pool.
+func (p *OrphanPool) MissingAncestor(b *Block) types.Hash {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	missing := b.PrevBlockHash
+	for {
+		o, ok := p.orphans[missing]
+		if !ok {
+			return missing
+		}
+		missing = o.block.PrevBlockHash
+	}
+}
+
+func (p *OrphanPool) Len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.orphans)
+}
+
+func (p *OrphanPool) Stats() OrphanStats {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.prune()
+
+	stats := p.stats
+	stats.Count = len(p.orphans)
+	return stats
+}
+
+// prune drops expired orphans, the caller must hold the lock.
+func (p *OrphanPool) prune() {
+	for hash, o := range p.orphans {
+		if time.Since(o.received) > p.maxAge {
+			p.remove(hash)
+			p.stats.Expired++
+		}
+	}
+}
+
+func (p *OrphanPool) oldest() types.Hash {
+	var (
+		oldest   types.Hash
+		received time.Time
+	)
+	for hash, o := range p.orphans {
+		if received.IsZero() || o.received.Before(received) {
+			oldest = hash
+			received = o.received
+		}
+	}
+	return oldest
+}
+
+func (p *OrphanPool) remove(hash types.Hash) {
+	o, ok := p.orphans[hash]
+	if !ok {
+		return
+	}
+	delete(p.orphans, hash)
+
+	parent := o.block.PrevBlockHash
+	siblings := p.byParent[parent]
+	for i, h := range siblings {
+		if h == hash {
+			siblings = append(siblings[:i], siblings[i+1:]...)
+			break
+		}
+	}
+
+	if len(siblings) == 0 {
+		delete(p.byParent, parent)
+	} else {
+		p.byParent[parent] = siblings
+	}
+}
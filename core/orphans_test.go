@@ -0,0 +1,99 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"go-blockchain/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrphansConnectOutOfOrder(t *testing.T) {
+	bc := newBlockchainWithGenesis(t)
+	genesis, err := bc.GetHeader(0)
+	assert.Nil(t, err)
+
+	type missingParent struct {
+		orphan  types.Hash
+		missing types.Hash
+	}
+	requested := []missingParent{}
+	bc.OnOrphan(func(b *Block, missing types.Hash) {
+		requested = append(requested, missingParent{b.Hash(BlockHasher{}), missing})
+	})
+
+	blocks := buildBranch(t, genesis, 10)
+
+	// deliver everything but the first block in reverse order
+	for i := len(blocks) - 1; i > 0; i-- {
+		err := bc.AddBlock(blocks[i])
+		assert.True(t, errors.Is(err, ErrOrphanBlock))
+
+		var orphanErr *OrphanError
+		assert.True(t, errors.As(err, &orphanErr))
+		assert.Equal(t, blocks[i].PrevBlockHash, orphanErr.Missing)
+	}
+
+	assert.Equal(t, uint32(0), bc.Height())
+	assert.Equal(t, 9, bc.OrphanStats().Count)
+	assert.Len(t, requested, 9)
+	assert.Equal(t, blocks[9].PrevBlockHash, requested[0].missing)
+	assert.Equal(t, blocks[0].Hash(BlockHasher{}), requested[8].missing)
+
+	// once the descendants are known the oldest missing ancestor is reported
+	var orphanErr *OrphanError
+	assert.True(t, errors.As(bc.AddBlock(blocks[5]), &orphanErr))
+	assert.Equal(t, blocks[0].Hash(BlockHasher{}), orphanErr.Missing)
+	// a duplicate orphan does not call the handler again
+	assert.Len(t, requested, 9)
+
+	assert.Nil(t, bc.AddBlock(blocks[0]))
+	assert.Equal(t, uint32(10), bc.Height())
+	assert.Equal(t, blocks[9].Hash(BlockHasher{}), bc.tipHash())
+
+	stats := bc.OrphanStats()
+	assert.Equal(t, 0, stats.Count)
+	assert.Equal(t, uint64(9), stats.Added)
+	assert.Equal(t, uint64(9), stats.Connected)
+}
+
+func TestOrphanInvalidSignature(t *testing.T) {
+	bc := newBlockchainWithGenesis(t)
+
+	b := randomBlock(t, 5, types.RandomHash())
+	b.Transactions = nil
+	assert.False(t, errors.Is(bc.AddBlock(b), ErrOrphanBlock))
+	assert.Equal(t, 0, bc.OrphanStats().Count)
+}
+
+func TestOrphanPoolMaxCount(t *testing.T) {
+	p := NewOrphanPool(5, time.Minute)
+
+	blocks := []*Block{}
+	for i := 0; i < 8; i++ {
+		b := randomBlock(t, uint32(i+1), types.RandomHash())
+		blocks = append(blocks, b)
+		assert.True(t, p.Add(b))
+	}
+	assert.False(t, p.Add(blocks[7]))
+
+	assert.Equal(t, 5, p.Len())
+	assert.False(t, p.Has(blocks[0].Hash(BlockHasher{})))
+	assert.True(t, p.Has(blocks[7].Hash(BlockHasher{})))
+	assert.Equal(t, uint64(3), p.Stats().Evicted)
+}
+
+func TestOrphanPoolMaxAge(t *testing.T) {
+	p := NewOrphanPool(10, 20*time.Millisecond)
+
+	b := randomBlock(t, 1, types.RandomHash())
+	assert.True(t, p.Add(b))
+	time.Sleep(40 * time.Millisecond)
+
+	assert.Len(t, p.TakeChildren(b.PrevBlockHash), 0)
+	stats := p.Stats()
+	assert.Equal(t, 0, stats.Count)
+	assert.Equal(t, uint64(1), stats.Expired)
+}
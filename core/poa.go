@@ -0,0 +1,295 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"go-blockchain/crypto"
+	"go-blockchain/types"
+)
+
+const (
+	// DefaultProposerTimeout is how long the next validator in line waits for
+	// a missing proposer when the genesis sets no block time
+	DefaultProposerTimeout = 5 * time.Second
+	// MaxClockDrift is how far the timestamp of a block may lie in the future
+	MaxClockDrift = 15 * time.Second
+)
+
+var (
+	ErrUnknownProposer = errors.New("unknown proposer")
+	ErrWrongProposer   = errors.New("wrong proposer")
+)
+
+// ValidatorSet is the ordered set of validators allowed to propose blocks.
+type ValidatorSet struct {
+	validators []GenesisValidator
+	index      map[types.Address]uint32
+	total      uint64
+}
+
+func NewValidatorSet(validators []GenesisValidator) *ValidatorSet {
+	s := &ValidatorSet{
+		validators: validators,
+		index:      make(map[types.Address]uint32, len(validators)),
+	}
+	for i, v := range validators {
+		s.index[v.PublicKey.Address()] = uint32(i)
+		s.total += v.Power
+	}
+
+	return s
+}
+
+// Members returns the validators in their order.
+func (s *ValidatorSet) Members() []GenesisValidator {
+	return append([]GenesisValidator{}, s.validators...)
+}
+
+func (s *ValidatorSet) Len() int {
+	return len(s.validators)
+}
+
+func (s *ValidatorSet) Has(addr types.Address) bool {
+	_, ok := s.index[addr]
+	return ok
+}
+
+// Power returns the voting power of a validator, zero if addr is not in the set.
+func (s *ValidatorSet) Power(addr types.Address) uint64 {
+	i, ok := s.index[addr]
+	if !ok {
+		return 0
+	}
+	return s.validators[i].Power
+}
+
+func (s *ValidatorSet) TotalPower() uint64 {
+	return s.total
+}
+
+// HasQuorum reports whether power is more than two thirds of the total power.
+func (s *ValidatorSet) HasQuorum(power uint64) bool {
+	return 3*power > 2*s.total
+}
+
+// HasThird reports whether power is more than a third of the total power, so
+// at least one honest validator is part of it.
+func (s *ValidatorSet) HasThird(power uint64) bool {
+	return 3*power > s.total
+}
+
+// Proposer returns the validator in line for the block at height after
+// round proposers were passed over, the set must not be empty.
+func (s *ValidatorSet) Proposer(height, round uint32) crypto.PublicKey {
+	n := uint32(len(s.validators))
+	return s.validators[(height%n+round%n)%n].PublicKey
+}
+
+// Round returns how many proposers are in line before addr for the block at
+// height, ok is false if addr is not in the set.
+func (s *ValidatorSet) Round(height uint32, addr types.Address) (uint32, bool) {
+	i, ok := s.index[addr]
+	if !ok {
+		return 0, false
+	}
+
+	n := uint32(len(s.validators))
+	return (i + n - height%n) % n, true
+}
+
+// Without returns the set without the validator, the order of the others is
+// kept.
+func (s *ValidatorSet) Without(addr types.Address) *ValidatorSet {
+	i, ok := s.index[addr]
+	if !ok {
+		return s
+	}
+
+	validators := append([]GenesisValidator{}, s.validators[:i]...)
+	return NewValidatorSet(append(validators, s.validators[i+1:]...))
+}
+
+// ProofOfAuthority schedules the proposers of a permissioned validator set
+// round-robin, validator h mod n proposes the block at height h. If it does
+// not deliver, the next validator in line may propose once Timeout passed
+// since the parent, the one after it after twice the Timeout and so on.
+//
+// As a ForkChoice blocks proposed in turn weigh the most, so when a late
+// proposer and its fallback both deliver the branch of the scheduled one wins.
+//
+// The validator set follows the state of the chain, slashed validators are
+// removed from it. The chain records the set every known block leaves behind,
+// so a block is always checked against the set of its parent whether it
+// extends the tip, a side branch or an old block. The sets of blocks too deep
+// to fork from are pruned.
+type ProofOfAuthority struct {
+	Timeout time.Duration
+
+	lock       sync.RWMutex
+	validators *ValidatorSet
+	sets       map[types.Hash]recordedSet
+}
+
+// recordedSet is the validator set left behind by the block at height.
+type recordedSet struct {
+	validators *ValidatorSet
+	height     uint32
+}
+
+func NewProofOfAuthority(validators *ValidatorSet, timeout time.Duration) *ProofOfAuthority {
+	if timeout == 0 {
+		timeout = DefaultProposerTimeout
+	}
+
+	return &ProofOfAuthority{
+		Timeout:    timeout,
+		validators: validators,
+		sets:       make(map[types.Hash]recordedSet),
+	}
+}
+
+// Validators returns the validator set of the next block on top of the tip.
+func (p *ProofOfAuthority) Validators() *ValidatorSet {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.validators
+}
+
+// ValidatorsAt returns the validator set of the blocks on top of the block
+// with the given hash, nil if the block is unknown.
+func (p *ProofOfAuthority) ValidatorsAt(hash types.Hash) *ValidatorSet {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.sets[hash].validators
+}
+
+// record sets the validator set of the blocks on top of the block with the
+// given hash and height, tip marks it as the set of the next block on top of
+// the tip.
+func (p *ProofOfAuthority) record(hash types.Hash, height uint32, validators *ValidatorSet, tip bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.sets[hash] = recordedSet{validators: validators, height: height}
+	if tip {
+		p.validators = validators
+	}
+}
+
+// setTip marks the set of the block with the given hash as the set of the
+// next block on top of the tip.
+func (p *ProofOfAuthority) setTip(hash types.Hash) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if set, ok := p.sets[hash]; ok {
+		p.validators = set.validators
+	}
+}
+
+// forget drops the validator set recorded for the block with the given hash.
+func (p *ProofOfAuthority) forget(hash types.Hash) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.sets, hash)
+}
+
+// prune drops the validator sets recorded for blocks below height.
+func (p *ProofOfAuthority) prune(height uint32) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for hash, set := range p.sets {
+		if set.height < height {
+			delete(p.sets, hash)
+		}
+	}
+}
+
+// Earliest returns the earliest timestamp of a block proposed in round on
+// top of parent.
+func (p *ProofOfAuthority) Earliest(parent *Header, round uint32) time.Time {
+	return time.Unix(0, parent.Timestamp).Add(time.Duration(round) * p.Timeout)
+}
+
+// VerifyMember checks that the block was signed by a member of validators,
+// the set of its parent, and that its timestamp lies after its parent and not
+// too far in the future. It returns the round in which the signer is in line.
+func (p *ProofOfAuthority) VerifyMember(b *Block, parent *Header, validators *ValidatorSet, now time.Time) (uint32, error) {
+	if b.Validator.Key == nil {
+		return 0, fmt.Errorf("%w: block at height %d is not signed", ErrUnknownProposer, b.Height)
+	}
+
+	addr := b.Validator.Address()
+	round, ok := validators.Round(b.Height, addr)
+	if !ok {
+		return 0, fmt.Errorf("%w %s for block at height %d", ErrUnknownProposer, addr, b.Height)
+	}
+
+	if b.Timestamp <= parent.Timestamp {
+		return 0, fmt.Errorf("block at height %d has timestamp %d, not after its parent %d", b.Height, b.Timestamp, parent.Timestamp)
+	}
+
+	if at := time.Unix(0, b.Timestamp); at.After(now.Add(MaxClockDrift)) {
+		return 0, fmt.Errorf("block at height %d has timestamp %s in the future", b.Height, at)
+	}
+
+	return round, nil
+}
+
+// TurnDrift returns how far the clock of a proposer may run ahead of the
+// local one, a fallback proposer is rejected until its turn started this
+// close to now. It is kept well below the Timeout so the validators in line
+// after the scheduled one cannot skip the wait by dating their blocks ahead.
+func (p *ProofOfAuthority) TurnDrift() time.Duration {
+	return p.Timeout / 4
+}
+
+// VerifyProposer checks that the block was signed by a member of validators
+// whose turn it was at the timestamp of the block and has started by now.
+func (p *ProofOfAuthority) VerifyProposer(b *Block, parent *Header, validators *ValidatorSet, now time.Time) error {
+	round, err := p.VerifyMember(b, parent, validators, now)
+	if err != nil {
+		return err
+	}
+
+	earliest := p.Earliest(parent, round)
+	if b.Timestamp < earliest.UnixNano() {
+		return fmt.Errorf("%w %s for block at height %d, its turn starts at %s, expected %s",
+			ErrWrongProposer, b.Validator.Address(), b.Height, earliest, validators.Proposer(b.Height, 0).Address())
+	}
+	if earliest.After(now.Add(p.TurnDrift())) {
+		return fmt.Errorf("%w %s for block at height %d, its turn starts at %s, not yet",
+			ErrWrongProposer, b.Validator.Address(), b.Height, earliest)
+	}
+
+	return nil
+}
+
+// VerifyCommit checks a block signed by a member of validators that carries
+// their commit certificate, the certificate replaces the schedule.
+func (p *ProofOfAuthority) VerifyCommit(b *Block, parent *Header, validators *ValidatorSet, now time.Time) error {
+	if _, err := p.VerifyMember(b, parent, validators, now); err != nil {
+		return err
+	}
+
+	return b.Commit.Verify(b, validators)
+}
+
+func (p *ProofOfAuthority) Weight(b *Block) *big.Int {
+	validators := p.ValidatorsAt(b.PrevBlockHash)
+	if b.Validator.Key == nil || validators == nil {
+		return big.NewInt(0)
+	}
+
+	round, ok := validators.Round(b.Height, b.Validator.Address())
+	if !ok {
+		return big.NewInt(0)
+	}
+
+	return big.NewInt(int64(validators.Len()) - int64(round))
+}
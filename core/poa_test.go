@@ -0,0 +1,151 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"go-blockchain/crypto"
+	"go-blockchain/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidatorSetSchedule(t *testing.T) {
+	keys := []crypto.PublicKey{
+		crypto.GeneratePrivateKey().PublicKey(),
+		crypto.GeneratePrivateKey().PublicKey(),
+		crypto.GeneratePrivateKey().PublicKey(),
+	}
+	validators := []GenesisValidator{}
+	for _, key := range keys {
+		validators = append(validators, GenesisValidator{PublicKey: key, Power: 1})
+	}
+	s := NewValidatorSet(validators)
+
+	assert.Equal(t, keys[1], s.Proposer(1, 0))
+	assert.Equal(t, keys[2], s.Proposer(1, 1))
+	assert.Equal(t, keys[0], s.Proposer(1, 2))
+	assert.Equal(t, keys[0], s.Proposer(3, 0))
+
+	for height := uint32(0); height < 6; height++ {
+		for round := uint32(0); round < 3; round++ {
+			r, ok := s.Round(height, s.Proposer(height, round).Address())
+			assert.True(t, ok)
+			assert.Equal(t, round, r)
+		}
+	}
+
+	_, ok := s.Round(1, crypto.GeneratePrivateKey().PublicKey().Address())
+	assert.False(t, ok)
+}
+
+// proposedBlock returns a block on top of parent signed by privKey with a
+// timestamp delay after the parent.
+func proposedBlock(t *testing.T, privKey crypto.PrivateKey, parent *Header, delay time.Duration) *Block {
+	b := randomBlockWithSigner(t, privKey, parent.Height+1, BlockHasher{}.Hash(parent))
+	b.Timestamp = parent.Timestamp + int64(delay)
+	assert.Nil(t, b.Sign(privKey))
+	return b
+}
+
+func TestProofOfAuthority(t *testing.T) {
+	privKeys := []crypto.PrivateKey{crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey()}
+	g := &Genesis{
+		Timestamp: time.Now().Add(-time.Hour).UnixNano(),
+		Params:    GenesisParams{BlockTimeMs: 1000},
+	}
+	for _, privKey := range privKeys {
+		g.Validators = append(g.Validators, GenesisValidator{PublicKey: privKey.PublicKey(), Power: 1})
+	}
+
+	bc, err := NewBlockChainFromGenesis(g, BlockchainOpts{})
+	assert.Nil(t, err)
+	assert.Equal(t, time.Second, bc.Authority().Timeout)
+	genesis, err := bc.GetHeader(0)
+	assert.Nil(t, err)
+
+	// only validator 1 may propose block 1 right away
+	err = bc.AddBlock(proposedBlock(t, crypto.GeneratePrivateKey(), genesis, time.Millisecond))
+	assert.True(t, errors.Is(err, ErrUnknownProposer))
+	err = bc.AddBlock(proposedBlock(t, privKeys[2], genesis, time.Millisecond))
+	assert.True(t, errors.Is(err, ErrWrongProposer))
+	err = bc.AddBlock(proposedBlock(t, privKeys[1], genesis, 0))
+	assert.NotNil(t, err)
+	err = bc.AddBlock(proposedBlock(t, privKeys[1], genesis, 2*time.Hour))
+	assert.NotNil(t, err)
+
+	// the next validator in line takes over after the timeout
+	late := proposedBlock(t, privKeys[2], genesis, time.Second)
+	assert.Nil(t, bc.AddBlock(late))
+	assert.Equal(t, uint32(1), bc.Height())
+
+	// a block of the scheduled proposer outweighs the one of its fallback
+	inTurn := proposedBlock(t, privKeys[1], genesis, time.Millisecond)
+	assert.Nil(t, bc.AddBlock(inTurn))
+	assert.Equal(t, inTurn.Hash(BlockHasher{}), bc.tipHash())
+
+	assert.Nil(t, bc.AddBlock(proposedBlock(t, privKeys[2], inTurn.Header, time.Millisecond)))
+	assert.Equal(t, uint32(2), bc.Height())
+}
+
+func TestProofOfAuthorityFallbackWaitsForTurn(t *testing.T) {
+	privKeys := []crypto.PrivateKey{crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey()}
+	validators := NewValidatorSet([]GenesisValidator{
+		{PublicKey: privKeys[0].PublicKey(), Power: 1},
+		{PublicKey: privKeys[1].PublicKey(), Power: 1},
+		{PublicKey: privKeys[2].PublicKey(), Power: 1},
+	})
+	authority := NewProofOfAuthority(validators, 5*time.Second)
+
+	now := time.Now()
+	parent := &Header{Timestamp: now.UnixNano()}
+
+	// the round 1 validator dates its block to its turn but sends it right
+	// away, the timestamp is within the clock drift
+	early := proposedBlock(t, privKeys[2], parent, authority.Timeout)
+	assert.ErrorIs(t, authority.VerifyProposer(early, parent, validators, now), ErrWrongProposer)
+	assert.ErrorIs(t, authority.VerifyProposer(early, parent, validators, now.Add(authority.Timeout/2)), ErrWrongProposer)
+
+	// once its turn started the block is accepted, a clock running slightly
+	// behind is tolerated
+	assert.Nil(t, authority.VerifyProposer(early, parent, validators, now.Add(authority.Timeout)))
+	assert.Nil(t, authority.VerifyProposer(early, parent, validators, now.Add(authority.Timeout-authority.TurnDrift())))
+
+	// the scheduled proposer is not held back
+	inTurn := proposedBlock(t, privKeys[1], parent, time.Millisecond)
+	assert.Nil(t, authority.VerifyProposer(inTurn, parent, validators, now))
+}
+
+func TestProofOfAuthorityPrunesSets(t *testing.T) {
+	privKey := crypto.GeneratePrivateKey()
+	g := &Genesis{
+		Timestamp:  time.Now().Add(-time.Hour).UnixNano(),
+		Validators: []GenesisValidator{{PublicKey: privKey.PublicKey(), Power: 1}},
+	}
+	bc, err := NewBlockChainFromGenesis(g, BlockchainOpts{})
+	assert.Nil(t, err)
+
+	hashes := []types.Hash{bc.tipHash()}
+	for i := 0; i < MaxSideBranchDepth+5; i++ {
+		tip, err := bc.GetHeader(bc.Height())
+		assert.Nil(t, err)
+		b := proposedBlock(t, privKey, tip, time.Millisecond)
+		assert.Nil(t, bc.AddBlock(b))
+		hashes = append(hashes, b.Hash(BlockHasher{}))
+	}
+
+	// only the blocks a new block may still fork from keep their set
+	authority := bc.Authority()
+	assert.Len(t, authority.sets, MaxSideBranchDepth+1)
+	assert.Nil(t, authority.ValidatorsAt(hashes[4]))
+	assert.NotNil(t, authority.ValidatorsAt(hashes[5]))
+	assert.NotNil(t, authority.ValidatorsAt(bc.tipHash()))
+
+	// a block forking below is rejected rather than kept as an orphan
+	deep, err := bc.GetHeader(4)
+	assert.Nil(t, err)
+	err = bc.AddBlock(proposedBlock(t, privKey, deep, time.Millisecond))
+	assert.NotNil(t, err)
+	assert.False(t, errors.Is(err, ErrOrphanBlock))
+}
@@ -0,0 +1,219 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"go-blockchain/types"
+)
+
+const (
+	// PowLimitBits is the easiest target a block may have, about every
+	// second hash meets it
+	PowLimitBits uint32 = 0x207fffff
+	// DefaultRetargetInterval is the number of blocks between difficulty
+	// adjustments when the genesis sets none
+	DefaultRetargetInterval = 64
+	// DefaultTargetBlockTime is the time between blocks the difficulty aims
+	// for when the genesis sets no block time
+	DefaultTargetBlockTime = 5 * time.Second
+	// maxRetargetFactor bounds how much a single adjustment changes the target
+	maxRetargetFactor = 4
+)
+
+var ErrInvalidProofOfWork = errors.New("invalid proof of work")
+
+var (
+	powLimit = mustCompactToTarget(PowLimitBits)
+	// hashSpace is 2^256, the number of possible block hashes
+	hashSpace = new(big.Int).Lsh(big.NewInt(1), 256)
+)
+
+// CompactToTarget expands the compact representation of a target. Like in
+// Bitcoin the high byte of bits is the length of the target in bytes and the
+// low three bytes are its most significant digits, the sign bit must be unset.
+func CompactToTarget(bits uint32) (*big.Int, error) {
+	size := bits >> 24
+	mantissa := bits & 0x007fffff
+
+	if bits&0x00800000 != 0 {
+		return nil, fmt.Errorf("%w: negative target in bits 0x%08x", ErrInvalidProofOfWork, bits)
+	}
+	if size > 32 {
+		return nil, fmt.Errorf("%w: target of bits 0x%08x exceeds 256 bits", ErrInvalidProofOfWork, bits)
+	}
+
+	target := big.NewInt(int64(mantissa))
+	if size <= 3 {
+		target.Rsh(target, 8*uint(3-size))
+	} else {
+		target.Lsh(target, 8*uint(size-3))
+	}
+
+	if target.Sign() == 0 {
+		return nil, fmt.Errorf("%w: zero target in bits 0x%08x", ErrInvalidProofOfWork, bits)
+	}
+	return target, nil
+}
+
+// TargetToCompact returns the compact representation of a target, digits
+// beyond the first three bytes are dropped.
+func TargetToCompact(target *big.Int) uint32 {
+	size := uint32((target.BitLen() + 7) / 8)
+
+	var mantissa uint32
+	if size <= 3 {
+		mantissa = uint32(new(big.Int).Lsh(target, 8*uint(3-size)).Uint64())
+	} else {
+		mantissa = uint32(new(big.Int).Rsh(target, 8*uint(size-3)).Uint64())
+	}
+
+	// the sign bit must stay unset
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		size++
+	}
+
+	return size<<24 | mantissa
+}
+
+func mustCompactToTarget(bits uint32) *big.Int {
+	target, err := CompactToTarget(bits)
+	if err != nil {
+		panic(err)
+	}
+	return target
+}
+
+// MeetsTarget reports whether a block hash, read as a big-endian number, does
+// not exceed the target.
+func MeetsTarget(hash types.Hash, target *big.Int) bool {
+	return new(big.Int).SetBytes(hash[:]).Cmp(target) <= 0
+}
+
+// Work returns the expected number of hashes needed to meet the target of bits.
+func Work(bits uint32) *big.Int {
+	target, err := CompactToTarget(bits)
+	if err != nil {
+		return big.NewInt(0)
+	}
+
+	return new(big.Int).Div(hashSpace, target.Add(target, big.NewInt(1)))
+}
+
+// ProofOfWork lets anyone extend the chain who finds a nonce for which the
+// block hash meets the target of the block. Every RetargetInterval blocks the
+// target is scaled by how long the last RetargetInterval blocks took compared
+// to the BlockTime they should have taken.
+//
+// As a ForkChoice the branch with the most cumulative work wins.
+type ProofOfWork struct {
+	InitialBits      uint32
+	RetargetInterval uint32
+	BlockTime        time.Duration
+}
+
+func NewProofOfWork(initialBits uint32, retargetInterval uint32, blockTime time.Duration) *ProofOfWork {
+	if initialBits == 0 {
+		initialBits = PowLimitBits
+	}
+
+	if retargetInterval == 0 {
+		retargetInterval = DefaultRetargetInterval
+	}
+
+	if blockTime == 0 {
+		blockTime = DefaultTargetBlockTime
+	}
+
+	return &ProofOfWork{
+		InitialBits:      initialBits,
+		RetargetInterval: retargetInterval,
+		BlockTime:        blockTime,
+	}
+}
+
+// NextBits returns the bits a block on top of parent must carry. lookup
+// returns the header of a known block by hash, it is used to find the start of
+// the retarget window on the branch of parent.
+func (p *ProofOfWork) NextBits(parent *Header, lookup func(types.Hash) (*Header, bool)) (uint32, error) {
+	if parent.Version < HeaderVersionPoW {
+		return p.InitialBits, nil
+	}
+
+	if parent.Height < p.RetargetInterval || parent.Height%p.RetargetInterval != 0 {
+		return parent.Bits, nil
+	}
+
+	first := parent
+	for i := uint32(0); i < p.RetargetInterval; i++ {
+		prev, ok := lookup(first.PrevBlockHash)
+		if !ok {
+			return 0, fmt.Errorf("%w %s of block at height %d", ErrUnknownParent, first.PrevBlockHash, first.Height)
+		}
+		first = prev
+	}
+
+	return p.Retarget(parent.Bits, time.Duration(parent.Timestamp-first.Timestamp))
+}
+
+// Retarget scales the target of bits by the time the last window of blocks
+// took. The change is bounded by a factor of four and the target never
+// exceeds PowLimitBits.
+func (p *ProofOfWork) Retarget(bits uint32, timespan time.Duration) (uint32, error) {
+	target, err := CompactToTarget(bits)
+	if err != nil {
+		return 0, err
+	}
+
+	expected := time.Duration(p.RetargetInterval) * p.BlockTime
+	if timespan < expected/maxRetargetFactor {
+		timespan = expected / maxRetargetFactor
+	}
+	if timespan > expected*maxRetargetFactor {
+		timespan = expected * maxRetargetFactor
+	}
+
+	target.Mul(target, big.NewInt(int64(timespan)))
+	target.Div(target, big.NewInt(int64(expected)))
+	if target.Cmp(powLimit) > 0 {
+		target.Set(powLimit)
+	}
+
+	return TargetToCompact(target), nil
+}
+
+// VerifyWork checks that the block carries the expected bits and that its hash
+// meets their target.
+func (p *ProofOfWork) VerifyWork(b *Block, bits uint32) error {
+	if b.Version < HeaderVersionPoW {
+		return fmt.Errorf("%w: block at height %d has header version %d without proof of work", ErrInvalidProofOfWork, b.Height, b.Version)
+	}
+
+	if b.Bits != bits {
+		return fmt.Errorf("%w: block at height %d has bits 0x%08x, expected 0x%08x", ErrInvalidProofOfWork, b.Height, b.Bits, bits)
+	}
+
+	target, err := CompactToTarget(b.Bits)
+	if err != nil {
+		return err
+	}
+
+	if hash := b.Hash(BlockHasher{}); !MeetsTarget(hash, target) {
+		return fmt.Errorf("%w: hash %s of block at height %d does not meet its target", ErrInvalidProofOfWork, hash, b.Height)
+	}
+
+	return nil
+}
+
+// Weight returns the work of the block, blocks without proof of work weigh
+// nothing.
+func (p *ProofOfWork) Weight(b *Block) *big.Int {
+	if b.Version < HeaderVersionPoW {
+		return big.NewInt(0)
+	}
+
+	return Work(b.Bits)
+}
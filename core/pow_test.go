@@ -0,0 +1,192 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"go-blockchain/crypto"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompactTarget(t *testing.T) {
+	for _, bits := range []uint32{PowLimitBits, 0x1d00ffff, 0x1b0404cb, 0x03123456} {
+		target, err := CompactToTarget(bits)
+		assert.Nil(t, err)
+		assert.Equal(t, bits, TargetToCompact(target))
+	}
+
+	target, err := CompactToTarget(0x1d00ffff)
+	assert.Nil(t, err)
+	assert.Equal(t, new(big.Int).Lsh(big.NewInt(0xffff), 208), target)
+
+	// a mantissa with the sign bit set moves into the next byte
+	assert.Equal(t, uint32(0x04008000), TargetToCompact(big.NewInt(0x800000)))
+
+	for _, bits := range []uint32{0x20800000, 0x1d000000, 0x21010000} {
+		_, err := CompactToTarget(bits)
+		assert.True(t, errors.Is(err, ErrInvalidProofOfWork))
+	}
+}
+
+func TestRetarget(t *testing.T) {
+	p := NewProofOfWork(0x1d00ffff, 10, time.Second)
+	target := mustCompactToTarget(0x1d00ffff)
+
+	// twice as slow as expected doubles the target
+	bits, err := p.Retarget(0x1d00ffff, 20*time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, TargetToCompact(new(big.Int).Mul(target, big.NewInt(2))), bits)
+
+	// a window of one block is treated like a quarter of the expected time
+	bits, err = p.Retarget(0x1d00ffff, time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, TargetToCompact(new(big.Int).Div(target, big.NewInt(4))), bits)
+
+	// the target never exceeds the limit
+	bits, err = p.Retarget(PowLimitBits, time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, PowLimitBits, bits)
+}
+
+func powGenesis(retargetInterval uint32) *Genesis {
+	return &Genesis{
+		Timestamp: time.Now().Add(-time.Hour).UnixNano(),
+		Params: GenesisParams{
+			BlockTimeMs:      1000,
+			Consensus:        ConsensusPoW,
+			RetargetInterval: retargetInterval,
+		},
+	}
+}
+
+// minedBlock returns a block on top of parent with its timestamp delay after
+// the parent and a nonce meeting the target the chain expects.
+func minedBlock(t *testing.T, bc *Blockchain, privKey crypto.PrivateKey, parent *Header, delay time.Duration) *Block {
+	b, err := NewBlockFromPrevHeader(parent, nil)
+	assert.Nil(t, err)
+	b.Version = HeaderVersionPoW
+	b.Timestamp = parent.Timestamp + int64(delay)
+
+	b.Bits, err = bc.NextBits(parent)
+	assert.Nil(t, err)
+	target, err := CompactToTarget(b.Bits)
+	assert.Nil(t, err)
+	for !MeetsTarget(BlockHasher{}.Hash(b.Header), target) {
+		b.Nonce++
+	}
+
+	assert.Nil(t, b.Sign(privKey))
+	return b
+}
+
+func TestProofOfWork(t *testing.T) {
+	privKey := crypto.GeneratePrivateKey()
+	bc, err := NewBlockChainFromGenesis(powGenesis(2), BlockchainOpts{})
+	assert.Nil(t, err)
+	genesis, err := bc.GetHeader(0)
+	assert.Nil(t, err)
+
+	b := minedBlock(t, bc, privKey, genesis, time.Millisecond)
+	assert.Equal(t, PowLimitBits, b.Bits)
+
+	// a nonce that misses the target, an easier target and a block without
+	// proof of work are rejected
+	missed := *b.Header
+	for MeetsTarget(BlockHasher{}.Hash(&missed), mustCompactToTarget(missed.Bits)) {
+		missed.Nonce++
+	}
+	invalid := NewBlock(&missed, nil)
+	assert.Nil(t, invalid.Sign(privKey))
+	assert.True(t, errors.Is(bc.AddBlock(invalid), ErrInvalidProofOfWork))
+
+	easier := NewBlock(&Header{}, nil)
+	*easier.Header = *b.Header
+	easier.Bits = 0x2100ffff
+	assert.Nil(t, easier.Sign(privKey))
+	assert.True(t, errors.Is(bc.AddBlock(easier), ErrInvalidProofOfWork))
+
+	unmined := proposedBlock(t, privKey, genesis, time.Millisecond)
+	assert.True(t, errors.Is(bc.AddBlock(unmined), ErrInvalidProofOfWork))
+
+	assert.Nil(t, bc.AddBlock(b))
+
+	// the nonce and bits are part of the canonical header
+	buf := &bytes.Buffer{}
+	assert.Nil(t, b.Encode(NewCanonicalBlockEncoder(buf)))
+	decoded := new(Block)
+	assert.Nil(t, decoded.Decode(NewCanonicalBlockDecoder(bytes.NewReader(buf.Bytes()))))
+	assert.Equal(t, b.Nonce, decoded.Nonce)
+	assert.Equal(t, b.Hash(BlockHasher{}), decoded.Hash(BlockHasher{}))
+}
+
+func TestValidateHeaders(t *testing.T) {
+	privKey := crypto.GeneratePrivateKey()
+	bc, err := NewBlockChainFromGenesis(powGenesis(64), BlockchainOpts{})
+	assert.Nil(t, err)
+	genesis, err := bc.GetHeader(0)
+	assert.Nil(t, err)
+
+	headers := []*Block{}
+	prev := genesis
+	for i := 0; i < 3; i++ {
+		b := minedBlock(t, bc, privKey, prev, time.Millisecond)
+		headers = append(headers, b)
+		prev = b.Header
+	}
+	assert.Nil(t, bc.ValidateHeaders(headers))
+
+	// the proof of work, the signature and the link to the parent are checked
+	// on every header
+	missed := NewBlock(&Header{}, nil)
+	*missed.Header = *headers[1].Header
+	for MeetsTarget(BlockHasher{}.Hash(missed.Header), mustCompactToTarget(missed.Bits)) {
+		missed.Nonce++
+	}
+	assert.Nil(t, missed.Sign(privKey))
+	assert.True(t, errors.Is(bc.ValidateHeaders([]*Block{headers[0], missed}), ErrInvalidProofOfWork))
+
+	unsigned := NewBlock(headers[1].Header, nil)
+	assert.NotNil(t, bc.ValidateHeaders([]*Block{headers[0], unsigned}))
+	assert.NotNil(t, bc.ValidateHeaders([]*Block{headers[0], headers[2]}))
+	assert.NotNil(t, bc.ValidateHeaders([]*Block{headers[0], nil}))
+	assert.True(t, errors.Is(bc.ValidateHeaders(headers[1:]), ErrUnknownParent))
+
+	// so are the timestamp rules
+	old := minedBlock(t, bc, privKey, headers[0].Header, 0)
+	assert.True(t, errors.Is(bc.ValidateHeaders([]*Block{headers[0], old}), ErrTimestampTooOld))
+}
+
+func TestProofOfWorkRetargetsAndPrefersMostWork(t *testing.T) {
+	privKey := crypto.GeneratePrivateKey()
+	bc, err := NewBlockChainFromGenesis(powGenesis(2), BlockchainOpts{})
+	assert.Nil(t, err)
+	genesis, err := bc.GetHeader(0)
+	assert.Nil(t, err)
+
+	// a slow branch keeps the easiest target
+	parent := genesis
+	for i := 0; i < 4; i++ {
+		b := minedBlock(t, bc, privKey, parent, 4*time.Second)
+		assert.Equal(t, PowLimitBits, b.Bits)
+		assert.Nil(t, bc.AddBlock(b))
+		parent = b.Header
+	}
+	assert.Equal(t, uint32(4), bc.Height())
+
+	// a fast branch gets a harder target after two blocks, its third block
+	// brings more work than the four blocks of the slow branch
+	parent = genesis
+	for i := 0; i < 3; i++ {
+		b := minedBlock(t, bc, privKey, parent, time.Millisecond)
+		assert.Nil(t, bc.AddBlock(b))
+		parent = b.Header
+	}
+
+	assert.Equal(t, uint32(3), bc.Height())
+	assert.Equal(t, BlockHasher{}.Hash(parent), bc.tipHash())
+	assert.Equal(t, TargetToCompact(new(big.Int).Div(powLimit, big.NewInt(4))), parent.Bits)
+}
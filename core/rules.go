@@ -0,0 +1,183 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"go-blockchain/types"
+)
+
+const (
+	// DefaultMedianTimeBlocks is the number of blocks the median time past
+	// is taken over
+	DefaultMedianTimeBlocks = 11
+	// DefaultMaxBlockSize caps the canonical size of a block when the genesis
+	// sets no limit
+	DefaultMaxBlockSize = 1 << 20
+)
+
+var (
+	// ErrBlockRule is matched by every RuleError
+	ErrBlockRule = errors.New("block rule violated")
+
+	ErrTimestampTooOld      = errors.New("timestamp not after median time past")
+	ErrTimestampTooNew      = errors.New("timestamp too far in the future")
+	ErrUnsupportedVersion   = errors.New("unsupported header version")
+	ErrBlockTooLarge        = errors.New("block too large")
+	ErrTooManyTransactions  = errors.New("too many transactions")
+	ErrDuplicateTransaction = errors.New("duplicate transaction")
+	ErrDataHashMismatch     = errors.New("data hash mismatch")
+)
+
+// RuleError is returned when a block breaks one of the BlockRules, it matches
+// ErrBlockRule and the sentinel error of the rule.
+type RuleError struct {
+	Hash   types.Hash
+	Height uint32
+	Rule   error
+	Detail string
+}
+
+func (e *RuleError) Error() string {
+	return fmt.Sprintf("block %s at height %d: %v: %s", e.Hash, e.Height, e.Rule, e.Detail)
+}
+
+func (e *RuleError) Unwrap() []error {
+	return []error{e.Rule, ErrBlockRule}
+}
+
+func ruleError(b *Block, rule error, format string, args ...any) *RuleError {
+	return &RuleError{
+		Hash:   b.Hash(BlockHasher{}),
+		Height: b.Height,
+		Rule:   rule,
+		Detail: fmt.Sprintf(format, args...),
+	}
+}
+
+// BlockRules are the consensus rules every block but the genesis block must
+// follow, zero values are replaced by the defaults.
+type BlockRules struct {
+	// MedianTimeBlocks is the number of blocks up to the parent whose median
+	// timestamp a block must be newer than
+	MedianTimeBlocks int
+	// MaxFutureDrift is how far the timestamp of a block may lie ahead of the
+	// local clock, defaults to MaxClockDrift
+	MaxFutureDrift time.Duration
+	// Versions are the accepted header versions, defaults to all known ones
+	Versions []uint32
+	// MaxBlockSize caps the size of the canonical block encoding, header,
+	// signature and commit included
+	MaxBlockSize int
+	// MaxBlockTxs caps the number of transactions, defaults to
+	// MaxCanonicalBlockTxs
+	MaxBlockTxs int
+}
+
+func (r BlockRules) withDefaults() BlockRules {
+	if r.MedianTimeBlocks == 0 {
+		r.MedianTimeBlocks = DefaultMedianTimeBlocks
+	}
+
+	if r.MaxFutureDrift == 0 {
+		r.MaxFutureDrift = MaxClockDrift
+	}
+
+	if len(r.Versions) == 0 {
+		r.Versions = []uint32{HeaderVersionMerkle, HeaderVersionPoW}
+	}
+
+	if r.MaxBlockSize == 0 {
+		r.MaxBlockSize = DefaultMaxBlockSize
+	}
+
+	if r.MaxBlockTxs == 0 {
+		r.MaxBlockTxs = MaxCanonicalBlockTxs
+	}
+
+	return r
+}
+
+// checkHeader checks the rules that need neither another block nor the
+// transactions.
+func (r *BlockRules) checkHeader(b *Block, now time.Time) error {
+	supported := false
+	for _, v := range r.Versions {
+		supported = supported || v == b.Version
+	}
+	if !supported {
+		return ruleError(b, ErrUnsupportedVersion, "version %d, expected one of %v", b.Version, r.Versions)
+	}
+
+	if at := time.Unix(0, b.Timestamp); at.After(now.Add(r.MaxFutureDrift)) {
+		return ruleError(b, ErrTimestampTooNew, "timestamp %s is more than %s ahead", at, r.MaxFutureDrift)
+	}
+
+	return nil
+}
+
+// checkBlock checks the rules that need no other block, they also apply to
+// orphans.
+func (r *BlockRules) checkBlock(b *Block, now time.Time) error {
+	if err := r.checkHeader(b, now); err != nil {
+		return err
+	}
+
+	if len(b.Transactions) > r.MaxBlockTxs {
+		return ruleError(b, ErrTooManyTransactions, "%d transactions exceed the maximum of %d", len(b.Transactions), r.MaxBlockTxs)
+	}
+
+	if size := b.Size(); size > r.MaxBlockSize {
+		return ruleError(b, ErrBlockTooLarge, "%d bytes exceed the maximum of %d", size, r.MaxBlockSize)
+	}
+
+	// an empty Merkle tree has the zero root
+	if (len(b.Transactions) == 0) != b.DataHash.IsZero() {
+		return ruleError(b, ErrDataHashMismatch, "data hash %s for %d transactions", b.DataHash, len(b.Transactions))
+	}
+
+	seen := make(map[types.Hash]bool, len(b.Transactions))
+	for i := range b.Transactions {
+		hash := b.Transactions[i].Hash(TxHasher{})
+		if seen[hash] {
+			return ruleError(b, ErrDuplicateTransaction, "transaction %s at index %d", hash, i)
+		}
+		seen[hash] = true
+	}
+
+	return nil
+}
+
+// checkTimestamp checks that the block is newer than the median time past of
+// its parent.
+func (r *BlockRules) checkTimestamp(b *Block, medianTimePast int64) error {
+	if b.Timestamp <= medianTimePast {
+		return ruleError(b, ErrTimestampTooOld, "timestamp %d, median time past %d", b.Timestamp, medianTimePast)
+	}
+	return nil
+}
+
+// medianTime returns the median of the timestamps of parent and its
+// ancestors, at most n of them.
+func medianTime(parent *Header, n int, lookup func(types.Hash) (*Header, bool)) int64 {
+	timestamps := []int64{}
+	for h := parent; ; {
+		timestamps = append(timestamps, h.Timestamp)
+		if len(timestamps) == n || h.Height == 0 {
+			break
+		}
+
+		prev, ok := lookup(h.PrevBlockHash)
+		if !ok {
+			break
+		}
+		h = prev
+	}
+
+	sort.Slice(timestamps, func(i, j int) bool {
+		return timestamps[i] < timestamps[j]
+	})
+	return timestamps[len(timestamps)/2]
+}
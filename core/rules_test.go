@@ -0,0 +1,89 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"go-blockchain/crypto"
+	"go-blockchain/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlockRules(t *testing.T) {
+	privKey := crypto.GeneratePrivateKey()
+	g := &Genesis{Timestamp: time.Now().Add(-time.Hour).UnixNano()}
+	bc, err := NewBlockChainFromGenesis(g, BlockchainOpts{
+		Rules: BlockRules{MedianTimeBlocks: 3, Versions: []uint32{HeaderVersionMerkle}, MaxBlockTxs: 2, MaxBlockSize: 1024},
+	})
+	assert.Nil(t, err)
+
+	// block builds a block on top of the tip with the timestamp delay after
+	// the genesis block
+	block := func(delay time.Duration, txx ...Transaction) *Block {
+		tip, err := bc.GetHeader(bc.Height())
+		assert.Nil(t, err)
+		b, err := NewBlockFromPrevHeader(tip, txx)
+		assert.Nil(t, err)
+		b.Timestamp = g.Timestamp + int64(delay)
+		return b
+	}
+	assertRule := func(b *Block, rule error) {
+		assert.Nil(t, b.Sign(privKey))
+		err := bc.AddBlock(b)
+		assert.True(t, errors.Is(err, rule), "%v", err)
+		assert.True(t, errors.Is(err, ErrBlockRule), "%v", err)
+
+		var ruleErr *RuleError
+		assert.True(t, errors.As(err, &ruleErr))
+	}
+
+	// timestamps of 10s, 20s and 15s leave a median time past of 15s
+	for _, delay := range []time.Duration{10 * time.Second, 20 * time.Second, 15 * time.Second} {
+		b := block(delay)
+		assert.Nil(t, b.Sign(privKey))
+		assert.Nil(t, bc.AddBlock(b))
+	}
+	assertRule(block(15*time.Second), ErrTimestampTooOld)
+	assertRule(block(2*time.Hour), ErrTimestampTooNew)
+
+	flat := block(16 * time.Second)
+	flat.Version = HeaderVersionFlat
+	assertRule(flat, ErrUnsupportedVersion)
+
+	tx := randomTxWithSignature(t)
+	assertRule(block(16*time.Second, tx, tx), ErrDuplicateTransaction)
+	assertRule(block(16*time.Second, tx, randomTxWithSignature(t), randomTxWithSignature(t)), ErrTooManyTransactions)
+
+	large := randomTxWithSignature(t)
+	large.Data = make([]byte, 1024)
+	assertRule(block(16*time.Second, large), ErrBlockTooLarge)
+
+	// the header and signatures count as well
+	fits := randomTxWithSignature(t)
+	fits.Data = nil
+	fits.Data = make([]byte, 1024-fits.Size())
+	assert.Equal(t, 1024, fits.Size())
+	assertRule(block(16*time.Second, fits), ErrBlockTooLarge)
+
+	empty := block(16 * time.Second)
+	empty.DataHash = types.RandomHash()
+	assertRule(empty, ErrDataHashMismatch)
+	missing := block(16*time.Second, tx)
+	missing.DataHash = types.Hash{}
+	assertRule(missing, ErrDataHashMismatch)
+
+	// an orphan breaking a rule is not kept
+	orphan := randomBlockWithSigner(t, privKey, 10, types.RandomHash())
+	orphan.Version = HeaderVersionFlat
+	assert.Nil(t, orphan.Sign(privKey))
+	assert.True(t, errors.Is(bc.AddBlock(orphan), ErrUnsupportedVersion))
+	assert.Equal(t, 0, bc.OrphanStats().Count)
+
+	assert.Nil(t, bc.AddBlock(func() *Block {
+		b := block(16*time.Second, tx)
+		assert.Nil(t, b.Sign(privKey))
+		return b
+	}()))
+}
@@ -0,0 +1,313 @@
+package core
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	"go-blockchain/types"
+)
+
+// GenesisAlloc assigns the initial balance of accounts.
+type GenesisAlloc map[types.Address]uint64
+
+type AccountState struct {
+	Balance uint64
+	Nonce   uint64
+	// Stake is the voting power bonded by a validator, slashing burns it
+	Stake uint64
+}
+
+// State holds the account state of the canonical chain.
+type State struct {
+	lock     sync.RWMutex
+	accounts map[types.Address]*AccountState
+	// validators are the bonded validators in their genesis order, it does
+	// not change after the state was created
+	validators []GenesisValidator
+}
+
+// StateUndo holds the previous values of the accounts changed by a block.
+// A nil entry means the account did not exist.
+type StateUndo struct {
+	accounts map[types.Address]*AccountState
+}
+
+func NewState(alloc GenesisAlloc) *State {
+	s := &State{
+		accounts: make(map[types.Address]*AccountState),
+	}
+
+	for addr, balance := range alloc {
+		s.accounts[addr] = &AccountState{Balance: balance}
+	}
+
+	return s
+}
+
+// Account returns a copy of the account, unknown accounts are empty.
+func (s *State) Account(addr types.Address) AccountState {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if acc, ok := s.accounts[addr]; ok {
+		return *acc
+	}
+	return AccountState{}
+}
+
+// Bond stakes the power of every validator on its account, it must be called
+// before the first block is applied.
+func (s *State) Bond(validators []GenesisValidator) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.validators = append([]GenesisValidator{}, validators...)
+	for _, v := range validators {
+		addr := v.PublicKey.Address()
+		acc, ok := s.accounts[addr]
+		if !ok {
+			acc = &AccountState{}
+			s.accounts[addr] = acc
+		}
+		acc.Stake = v.Power
+	}
+}
+
+// Validators returns the bonded validators that still hold stake, with their
+// stake as their power.
+func (s *State) Validators() *ValidatorSet {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	validators := []GenesisValidator{}
+	for _, v := range s.validators {
+		if acc, ok := s.accounts[v.PublicKey.Address()]; ok && acc.Stake > 0 {
+			validators = append(validators, GenesisValidator{PublicKey: v.PublicKey, Power: acc.Stake})
+		}
+	}
+
+	return NewValidatorSet(validators)
+}
+
+func (s *State) Balance(addr types.Address) uint64 {
+	return s.Account(addr).Balance
+}
+
+func (s *State) Nonce(addr types.Address) uint64 {
+	return s.Account(addr).Nonce
+}
+
+// NewTransition starts applying transactions on top of the state, fees are
+// credited to the coinbase address.
+func (s *State) NewTransition(coinbase types.Address) *StateTransition {
+	return &StateTransition{
+		base:     s,
+		coinbase: coinbase,
+		dirty:    make(map[types.Address]*AccountState),
+	}
+}
+
+// ApplyBlock applies all transactions of the block. Either every transaction
+// applies and the undo needed to revert the block is returned, or the state
+// is left untouched.
+func (s *State) ApplyBlock(b *Block) (*StateUndo, error) {
+	coinbase := types.Address{}
+	if b.Validator.Key != nil {
+		coinbase = b.Validator.Address()
+	}
+
+	t := s.NewTransition(coinbase)
+
+	for i := range b.Transactions {
+		if err := t.ApplyTransaction(&b.Transactions[i]); err != nil {
+			return nil, fmt.Errorf("block %s: transaction %d: %w", b.Hash(BlockHasher{}), i, err)
+		}
+	}
+
+	return t.Commit(), nil
+}
+
+// Revert restores the accounts changed by the block the undo was created for.
+func (s *State) Revert(undo *StateUndo) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for addr, acc := range undo.accounts {
+		if acc == nil {
+			delete(s.accounts, addr)
+			continue
+		}
+		s.accounts[addr] = acc
+	}
+}
+
+// StateTransition applies transactions on top of a State without changing it
+// until Commit is called.
+type StateTransition struct {
+	base     *State
+	coinbase types.Address
+	dirty    map[types.Address]*AccountState
+}
+
+func (t *StateTransition) Account(addr types.Address) AccountState {
+	if acc, ok := t.dirty[addr]; ok {
+		return *acc
+	}
+	return t.base.Account(addr)
+}
+
+func (t *StateTransition) account(addr types.Address) *AccountState {
+	acc, ok := t.dirty[addr]
+	if !ok {
+		base := t.base.Account(addr)
+		acc = &base
+		t.dirty[addr] = acc
+	}
+	return acc
+}
+
+// ApplyTransaction applies a single transaction, a failing transaction leaves
+// the transition untouched. Every transaction must carry the next nonce of its
+// sender, which makes an included transaction impossible to replay.
+func (t *StateTransition) ApplyTransaction(tx *Transaction) error {
+	from := tx.Sender()
+	sender := t.Account(from)
+
+	if tx.Nonce != sender.Nonce {
+		return fmt.Errorf("invalid nonce %d for %s, expected %d", tx.Nonce, from, sender.Nonce)
+	}
+
+	if tx.Fee > sender.Balance {
+		return fmt.Errorf("insufficient balance %d for %s to pay fee %d", sender.Balance, from, tx.Fee)
+	}
+
+	var offender types.Address
+	switch tx.Type {
+	case TxTypeData:
+	case TxTypeTransfer:
+		if err := t.checkTransfer(tx, from, sender); err != nil {
+			return err
+		}
+	case TxTypeEvidence:
+		addr, err := t.checkEvidence(tx)
+		if err != nil {
+			return err
+		}
+		offender = addr
+	default:
+		return fmt.Errorf("unknown transaction type %d", tx.Type)
+	}
+
+	if err := t.checkCredits(tx, from); err != nil {
+		return err
+	}
+
+	t.account(from).Balance -= tx.Fee
+	t.account(t.coinbase).Balance += tx.Fee
+	if tx.Type == TxTypeTransfer {
+		t.account(from).Balance -= tx.Value
+		t.account(tx.To).Balance += tx.Value
+	}
+	if tx.Type == TxTypeEvidence {
+		t.account(offender).Stake = 0
+	}
+	t.account(from).Nonce++
+
+	return nil
+}
+
+func (t *StateTransition) checkTransfer(tx *Transaction, from types.Address, sender AccountState) error {
+	if tx.Value > sender.Balance-tx.Fee {
+		return fmt.Errorf("insufficient balance %d for %s to transfer %d with fee %d", sender.Balance, from, tx.Value, tx.Fee)
+	}
+
+	return nil
+}
+
+// checkEvidence checks that the transaction proves a double sign on this chain
+// of a validator that still holds stake and returns the address of the offender.
+// The last validator holding stake is never slashed.
+func (t *StateTransition) checkEvidence(tx *Transaction) (types.Address, error) {
+	if tx.Value != 0 {
+		return types.Address{}, fmt.Errorf("%w: evidence transaction carries value %d", ErrInvalidEvidence, tx.Value)
+	}
+
+	e, err := DecodeDoubleSignEvidence(tx.Data)
+	if err != nil {
+		return types.Address{}, err
+	}
+	// the chain id of the transaction is checked against the chain before
+	// it is applied, the headers must be signed for the same chain
+	if err := e.Verify(tx.ChainID); err != nil {
+		return types.Address{}, err
+	}
+
+	offender := e.Offender()
+	if t.Account(offender).Stake == 0 {
+		return types.Address{}, fmt.Errorf("%w: %s holds no stake", ErrInvalidEvidence, offender)
+	}
+
+	bonded := 0
+	for _, v := range t.base.validators {
+		if t.Account(v.PublicKey.Address()).Stake > 0 {
+			bonded++
+		}
+	}
+	if bonded <= 1 {
+		return types.Address{}, fmt.Errorf("%w: slashing %s would leave no validator", ErrInvalidEvidence, offender)
+	}
+
+	return offender, nil
+}
+
+// checkCredits checks that no account the transaction pays overflows, a
+// transfer to the coinbase credits it with the value and the fee together.
+// The sender is left out, it is never credited more than it pays.
+func (t *StateTransition) checkCredits(tx *Transaction, from types.Address) error {
+	fee, value := tx.Fee, uint64(0)
+	if tx.Type == TxTypeTransfer {
+		value = tx.Value
+	}
+
+	if tx.To == t.coinbase && value > 0 {
+		if fee > math.MaxUint64-value {
+			return fmt.Errorf("balance of %s overflows", t.coinbase)
+		}
+		fee, value = fee+value, 0
+	}
+
+	if from != t.coinbase {
+		if err := t.checkCredit(t.coinbase, fee); err != nil {
+			return err
+		}
+	}
+	if from != tx.To && value > 0 {
+		return t.checkCredit(tx.To, value)
+	}
+	return nil
+}
+
+func (t *StateTransition) checkCredit(addr types.Address, value uint64) error {
+	if t.Account(addr).Balance > math.MaxUint64-value {
+		return fmt.Errorf("balance of %s overflows", addr)
+	}
+	return nil
+}
+
+// Commit writes the changes to the base state and returns the undo.
+func (t *StateTransition) Commit() *StateUndo {
+	s := t.base
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	undo := &StateUndo{accounts: make(map[types.Address]*AccountState)}
+	for addr, acc := range t.dirty {
+		undo.accounts[addr] = s.accounts[addr]
+		s.accounts[addr] = acc
+	}
+
+	t.dirty = make(map[types.Address]*AccountState)
+
+	return undo
+}
@@ -0,0 +1,216 @@
+package core
+
+import (
+	"math"
+	"testing"
+
+	"go-blockchain/crypto"
+	"go-blockchain/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateTransfer(t *testing.T) {
+	alice := crypto.GeneratePrivateKey()
+	bob := crypto.GeneratePrivateKey().PublicKey().Address()
+
+	s := NewState(GenesisAlloc{alice.PublicKey().Address(): 100})
+	tr := s.NewTransition(types.Address{})
+
+	assert.Nil(t, tr.ApplyTransaction(signedTransfer(t, alice, bob, 30, 0)))
+	assert.Nil(t, tr.ApplyTransaction(signedTransfer(t, alice, bob, 70, 1)))
+
+	// nothing changes before commit
+	assert.Equal(t, uint64(100), s.Balance(alice.PublicKey().Address()))
+	assert.Equal(t, uint64(0), tr.Account(alice.PublicKey().Address()).Balance)
+
+	undo := tr.Commit()
+	assert.Equal(t, uint64(0), s.Balance(alice.PublicKey().Address()))
+	assert.Equal(t, uint64(2), s.Nonce(alice.PublicKey().Address()))
+	assert.Equal(t, uint64(100), s.Balance(bob))
+
+	s.Revert(undo)
+	assert.Equal(t, AccountState{Balance: 100}, s.Account(alice.PublicKey().Address()))
+	assert.Equal(t, AccountState{}, s.Account(bob))
+}
+
+func TestStateRejectsOverdraftAndReplay(t *testing.T) {
+	alice := crypto.GeneratePrivateKey()
+	bob := crypto.GeneratePrivateKey().PublicKey().Address()
+
+	s := NewState(GenesisAlloc{alice.PublicKey().Address(): 100})
+	tr := s.NewTransition(types.Address{})
+
+	assert.NotNil(t, tr.ApplyTransaction(signedTransfer(t, alice, bob, 101, 0)))
+	assert.NotNil(t, tr.ApplyTransaction(signedTransfer(t, alice, bob, 1, 1)))
+
+	tx := signedTransfer(t, alice, bob, 10, 0)
+	assert.Nil(t, tr.ApplyTransaction(tx))
+	assert.NotNil(t, tr.ApplyTransaction(tx))
+
+	// data transactions do not touch the state
+	data := randomTxWithSignature(t)
+	assert.Nil(t, tr.ApplyTransaction(&data))
+
+	tr.Commit()
+	assert.Equal(t, uint64(90), s.Balance(alice.PublicKey().Address()))
+}
+
+func TestBlockchainAppliesTransfers(t *testing.T) {
+	alice := crypto.GeneratePrivateKey()
+	bob := crypto.GeneratePrivateKey()
+	aliceAddr := alice.PublicKey().Address()
+	bobAddr := bob.PublicKey().Address()
+
+	bc := newFundedBlockchain(t, GenesisAlloc{aliceAddr: 1000})
+
+	b := blockWithTxs(t, bc,
+		*signedTransfer(t, alice, bobAddr, 400, 0),
+		*signedTransfer(t, alice, bobAddr, 100, 1),
+	)
+	assert.Nil(t, bc.AddBlock(b))
+	assert.Equal(t, AccountState{Balance: 500, Nonce: 2}, bc.GetAccount(aliceAddr))
+	assert.Equal(t, AccountState{Balance: 500}, bc.GetAccount(bobAddr))
+
+	// overdraw
+	assert.NotNil(t, bc.AddBlock(blockWithTxs(t, bc, *signedTransfer(t, bob, aliceAddr, 501, 0))))
+	// replay of an included transaction
+	assert.NotNil(t, bc.AddBlock(blockWithTxs(t, bc, b.Transactions[0])))
+	// a failing transaction rejects the whole block
+	assert.NotNil(t, bc.AddBlock(blockWithTxs(t, bc,
+		*signedTransfer(t, bob, aliceAddr, 100, 0),
+		*signedTransfer(t, bob, aliceAddr, 500, 1),
+	)))
+
+	assert.Equal(t, uint32(1), bc.Height())
+	assert.Equal(t, AccountState{Balance: 500}, bc.GetAccount(bobAddr))
+
+	assert.Nil(t, bc.AddBlock(blockWithTxs(t, bc, *signedTransfer(t, bob, aliceAddr, 500, 0))))
+	assert.Equal(t, AccountState{Balance: 1000, Nonce: 2}, bc.GetAccount(aliceAddr))
+	assert.Equal(t, AccountState{Balance: 0, Nonce: 1}, bc.GetAccount(bobAddr))
+}
+
+func TestReorgRevertsState(t *testing.T) {
+	alice := crypto.GeneratePrivateKey()
+	aliceAddr := alice.PublicKey().Address()
+	bob := crypto.GeneratePrivateKey().PublicKey().Address()
+	carol := crypto.GeneratePrivateKey().PublicKey().Address()
+
+	bc := newFundedBlockchain(t, GenesisAlloc{aliceAddr: 100})
+	genesis, err := bc.GetHeader(0)
+	assert.Nil(t, err)
+
+	toBob := blockWithTxs(t, bc, *signedTransfer(t, alice, bob, 100, 0))
+	assert.Nil(t, bc.AddBlock(toBob))
+	assert.Equal(t, uint64(100), bc.GetAccount(bob).Balance)
+
+	// a competing branch spends the same funds to carol
+	toCarol, err := NewBlockFromPrevHeader(genesis, []Transaction{*signedTransfer(t, alice, carol, 100, 0)})
+	assert.Nil(t, err)
+	assert.Nil(t, toCarol.Sign(crypto.GeneratePrivateKey()))
+	assert.Nil(t, bc.AddBlock(toCarol))
+
+	next := buildBranch(t, toCarol.Header, 1)[0]
+	assert.Nil(t, bc.AddBlock(next))
+
+	assert.Equal(t, uint32(2), bc.Height())
+	assert.Equal(t, uint64(0), bc.GetAccount(bob).Balance)
+	assert.Equal(t, uint64(100), bc.GetAccount(carol).Balance)
+	assert.Equal(t, AccountState{Balance: 0, Nonce: 1}, bc.GetAccount(aliceAddr))
+}
+
+func TestReorgToOverdrawingBranchFails(t *testing.T) {
+	alice := crypto.GeneratePrivateKey()
+	aliceAddr := alice.PublicKey().Address()
+	bob := crypto.GeneratePrivateKey().PublicKey().Address()
+
+	bc := newFundedBlockchain(t, GenesisAlloc{aliceAddr: 100})
+	genesis, err := bc.GetHeader(0)
+	assert.Nil(t, err)
+
+	assert.Nil(t, bc.AddBlock(blockWithTxs(t, bc, *signedTransfer(t, alice, bob, 60, 0))))
+
+	overdraw, err := NewBlockFromPrevHeader(genesis, []Transaction{*signedTransfer(t, alice, bob, 200, 0)})
+	assert.Nil(t, err)
+	assert.Nil(t, overdraw.Sign(crypto.GeneratePrivateKey()))
+	assert.Nil(t, bc.AddBlock(overdraw))
+
+	child := buildBranch(t, overdraw.Header, 1)[0]
+	assert.NotNil(t, bc.AddBlock(child))
+
+	assert.Equal(t, uint32(1), bc.Height())
+	assert.Equal(t, AccountState{Balance: 40, Nonce: 1}, bc.GetAccount(aliceAddr))
+	assert.False(t, bc.HasBlockHash(overdraw.Hash(BlockHasher{})))
+}
+
+func TestStateFees(t *testing.T) {
+	alice := crypto.GeneratePrivateKey()
+	aliceAddr := alice.PublicKey().Address()
+	bob := crypto.GeneratePrivateKey().PublicKey().Address()
+	coinbase := crypto.GeneratePrivateKey().PublicKey().Address()
+
+	s := NewState(GenesisAlloc{aliceAddr: 100})
+	tr := s.NewTransition(coinbase)
+
+	// value and fee together exceed the balance
+	tx := NewTransferTransaction(bob, 95, 0)
+	tx.Fee = 10
+	assert.Nil(t, tx.Sign(alice))
+	assert.NotNil(t, tr.ApplyTransaction(tx))
+
+	tx = NewTransferTransaction(bob, 90, 0)
+	tx.Fee = 10
+	assert.Nil(t, tx.Sign(alice))
+	assert.Nil(t, tr.ApplyTransaction(tx))
+
+	tr.Commit()
+	assert.Equal(t, AccountState{Balance: 0, Nonce: 1}, s.Account(aliceAddr))
+	assert.Equal(t, uint64(90), s.Balance(bob))
+	assert.Equal(t, uint64(10), s.Balance(coinbase))
+}
+
+func TestStateRejectsCoinbaseOverflow(t *testing.T) {
+	alice := crypto.GeneratePrivateKey()
+	aliceAddr := alice.PublicKey().Address()
+	coinbase := crypto.GeneratePrivateKey().PublicKey().Address()
+
+	s := NewState(GenesisAlloc{aliceAddr: 100, coinbase: math.MaxUint64 - 15})
+	tr := s.NewTransition(coinbase)
+
+	// the value and the fee fit on their own but not together
+	tx := NewTransferTransaction(coinbase, 10, 0)
+	tx.Fee = 10
+	assert.Nil(t, tx.Sign(alice))
+	assert.NotNil(t, tr.ApplyTransaction(tx))
+
+	tx = NewTransferTransaction(coinbase, 10, 0)
+	tx.Fee = 5
+	assert.Nil(t, tx.Sign(alice))
+	assert.Nil(t, tr.ApplyTransaction(tx))
+
+	tr.Commit()
+	assert.Equal(t, uint64(math.MaxUint64), s.Balance(coinbase))
+	assert.Equal(t, uint64(85), s.Balance(aliceAddr))
+}
+
+func TestBlockchainPaysFeesToValidator(t *testing.T) {
+	alice := crypto.GeneratePrivateKey()
+	aliceAddr := alice.PublicKey().Address()
+	validator := crypto.GeneratePrivateKey()
+
+	bc := newFundedBlockchain(t, GenesisAlloc{aliceAddr: 100})
+
+	data := NewTransaction([]byte("foo"))
+	data.Fee = 3
+	assert.Nil(t, data.Sign(alice))
+
+	prevHeader, err := bc.GetHeader(bc.Height())
+	assert.Nil(t, err)
+	b, err := NewBlockFromPrevHeader(prevHeader, []Transaction{*data})
+	assert.Nil(t, err)
+	assert.Nil(t, b.Sign(validator))
+
+	assert.Nil(t, bc.AddBlock(b))
+	assert.Equal(t, AccountState{Balance: 97, Nonce: 1}, bc.GetAccount(aliceAddr))
+	assert.Equal(t, uint64(3), bc.GetAccount(validator.PublicKey().Address()).Balance)
+}
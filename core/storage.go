@@ -1,16 +1,80 @@
 package core
 
+import (
+	"fmt"
+	"sync"
+
+	"go-blockchain/types"
+)
+
+// Storage persists blocks of the canonical chain. Put makes the block the
+// canonical block at its height, discarding any canonical blocks above it.
 type Storage interface {
 	Put(*Block) error
+	Get(types.Hash) (*Block, error)
+	GetByHeight(uint32) (*Block, error)
+	// Len returns the number of canonical blocks, i.e. height + 1
+	Len() int
+	Close() error
 }
 
 type MemoryStore struct {
+	lock     sync.RWMutex
+	blocks   map[types.Hash]*Block
+	byHeight []types.Hash
 }
 
 func NewMemStore() *MemoryStore {
-	return &MemoryStore{}
+	return &MemoryStore{
+		blocks:   make(map[types.Hash]*Block),
+		byHeight: []types.Hash{},
+	}
 }
 
 func (s *MemoryStore) Put(b *Block) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if int(b.Height) > len(s.byHeight) {
+		return fmt.Errorf("cannot store block at height %d, store height is %d", b.Height, len(s.byHeight)-1)
+	}
+
+	hash := b.Hash(BlockHasher{})
+	s.blocks[hash] = b
+	s.byHeight = append(s.byHeight[:b.Height], hash)
+
+	return nil
+}
+
+func (s *MemoryStore) Get(hash types.Hash) (*Block, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	b, ok := s.blocks[hash]
+	if !ok {
+		return nil, fmt.Errorf("block with hash %s not found", hash)
+	}
+
+	return b, nil
+}
+
+func (s *MemoryStore) GetByHeight(height uint32) (*Block, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if int(height) >= len(s.byHeight) {
+		return nil, fmt.Errorf("block at height %d not found", height)
+	}
+
+	return s.blocks[s.byHeight[height]], nil
+}
+
+func (s *MemoryStore) Len() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.byHeight)
+}
+
+func (s *MemoryStore) Close() error {
 	return nil
 }
@@ -1,6 +1,8 @@
 package core
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
 
 	"go-blockchain/crypto"
@@ -8,12 +10,33 @@ import (
 	"go-blockchain/types"
 )
 
+type TxType byte
+
+const (
+	// TxTypeData carries opaque data and does not touch the state
+	TxTypeData TxType = iota
+	// TxTypeTransfer moves Value from the sender to To
+	TxTypeTransfer
+	// TxTypeEvidence carries a DoubleSignEvidence in Data, it burns the stake
+	// of the offender and removes it from the validator set
+	TxTypeEvidence
+)
+
 type Transaction struct {
-	Data      []byte
+	Type TxType
+	// ChainID binds the transaction to a single chain so it cannot be replayed on another one
+	ChainID uint64
+	Data    []byte
+	To      types.Address
+	Value   uint64
+	// Fee is paid by the sender to the validator of the block including the transaction
+	Fee uint64
+	// Nonce is the number of transactions the sender included before this one
+	Nonce     uint64
 	From      crypto.PublicKey
 	Signature *crypto.Signature
 
-	// cached version of the tx data hash
+	// cached version of the tx hash
 	hash types.Hash
 	// firstSeen is the timestamp of when this tx is first seen locally
 	firstSeen int64
@@ -25,14 +48,80 @@ func NewTransaction(data []byte) *Transaction {
 	}
 }
 
+// NewTransferTransaction returns an unsigned transfer of value to the given
+// address, nonce must be the next nonce of the sender account.
+func NewTransferTransaction(to types.Address, value uint64, nonce uint64) *Transaction {
+	return &Transaction{
+		Type:  TxTypeTransfer,
+		To:    to,
+		Value: value,
+		Nonce: nonce,
+	}
+}
+
+// NewEvidenceTransaction returns an unsigned transaction reporting the
+// evidence, nonce must be the next nonce of the sender account.
+func NewEvidenceTransaction(e *DoubleSignEvidence, nonce uint64) (*Transaction, error) {
+	data, err := e.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Transaction{
+		Type:  TxTypeEvidence,
+		Data:  data,
+		Nonce: nonce,
+	}, nil
+}
+
+// SigningBytes returns the canonical encoding of the signed fields.
+func (tx *Transaction) SigningBytes() []byte {
+	buf := &bytes.Buffer{}
+	cw := &canonicalWriter{w: buf}
+	cw.txPayload(tx)
+	return buf.Bytes()
+}
+
+// HashBytes returns the bytes the transaction hash is computed over, the
+// signed fields followed by the sender.
+func (tx *Transaction) HashBytes() []byte {
+	buf := &bytes.Buffer{}
+	cw := &canonicalWriter{w: buf}
+	cw.txPayload(tx)
+	cw.publicKey(tx.From)
+	return buf.Bytes()
+}
+
+// Sender returns the address of the signer, or the zero address if the
+// transaction is not signed.
+func (tx *Transaction) Sender() types.Address {
+	if tx.From.Key == nil {
+		return types.Address{}
+	}
+	return tx.From.Address()
+}
+
+// Size returns the length of the canonical encoding of the transaction.
+func (tx *Transaction) Size() int {
+	counter := &countingWriter{}
+	_ = NewCanonicalTxEncoder(counter).Encode(tx)
+	return counter.n
+}
+
+func (tx *Transaction) signingHash() []byte {
+	h := sha256.Sum256(tx.SigningBytes())
+	return h[:]
+}
+
 func (tx *Transaction) Hash(hasher Hasher[*Transaction]) types.Hash {
 	if tx.hash.IsZero() {
 		tx.hash = hasher.Hash(tx)
 	}
 	return tx.hash
 }
+
 func (tx *Transaction) Sign(privKey crypto.PrivateKey) error {
-	sig, err := privKey.Sign(tx.Data)
+	sig, err := privKey.Sign(tx.signingHash())
 	if err != nil {
 		return err
 	}
@@ -40,12 +129,16 @@ func (tx *Transaction) Sign(privKey crypto.PrivateKey) error {
 	tx.Signature = sig
 	return nil
 }
+
 func (tx *Transaction) Verify() error {
 	if tx.Signature == nil {
-		return fmt.Errorf("transaction has no signature")
+		return fmt.Errorf("%w: transaction has no signature", ErrInvalidSignature)
+	}
+	if tx.From.Key == nil {
+		return fmt.Errorf("%w: transaction has no sender", ErrInvalidSignature)
 	}
-	if !tx.Signature.Verify(tx.From, tx.Data) {
-		return fmt.Errorf("invalid transaction signature")
+	if !tx.Signature.Verify(tx.From, tx.signingHash()) {
+		return fmt.Errorf("%w of transaction", ErrInvalidSignature)
 	}
 
 	return nil
@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"go-blockchain/crypto"
+	"go-blockchain/types"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -42,8 +43,64 @@ func TestTxEncodeDecode(t *testing.T) {
 func randomTxWithSignature(t *testing.T) Transaction {
 	privKey := crypto.GeneratePrivateKey()
 	tx := Transaction{
-		Data: []byte("foo"),
+		Data: types.RandomBytes(16),
 	}
 	assert.Nil(t, tx.Sign(privKey))
 	return tx
 }
+
+func TestTransactionReplayAcrossChains(t *testing.T) {
+	privKey := crypto.GeneratePrivateKey()
+	alloc := GenesisAlloc{privKey.PublicKey().Address(): 100}
+
+	genesisA, genesisB := randomBlock(t, 0, types.Hash{}), randomBlock(t, 0, types.Hash{})
+	genesisA.ChainID, genesisB.ChainID = 1, 2
+
+	chainA, err := NewBlockChainWithOpts(genesisA, BlockchainOpts{ChainID: 1, GenesisAlloc: alloc})
+	assert.Nil(t, err)
+	chainB, err := NewBlockChainWithOpts(genesisB, BlockchainOpts{ChainID: 2, GenesisAlloc: alloc})
+	assert.Nil(t, err)
+
+	tx := NewTransferTransaction(types.Address{}, 10, 0)
+	tx.ChainID = 1
+	assert.Nil(t, tx.Sign(privKey))
+
+	assert.Nil(t, chainA.AddBlock(blockWithTxs(t, chainA, *tx)))
+	assert.NotNil(t, chainB.AddBlock(blockWithTxs(t, chainB, *tx)))
+
+	// rewriting the chain id breaks the signature
+	replayed := *tx
+	replayed.ChainID = 2
+	assert.NotNil(t, replayed.Verify())
+	assert.NotNil(t, chainB.AddBlock(blockWithTxs(t, chainB, replayed)))
+	assert.Equal(t, uint32(0), chainB.Height())
+}
+
+func TestTransactionReplayAcrossBlocks(t *testing.T) {
+	privKey := crypto.GeneratePrivateKey()
+	bc := newFundedBlockchain(t, GenesisAlloc{privKey.PublicKey().Address(): 100})
+
+	tx := randomTxWithSignature(t)
+	assert.Nil(t, bc.AddBlock(blockWithTxs(t, bc, tx)))
+	assert.NotNil(t, bc.AddBlock(blockWithTxs(t, bc, tx)))
+
+	// nonces must increase by one within a block as well
+	first := *signedTransfer(t, privKey, types.Address{}, 1, 0)
+	assert.NotNil(t, bc.AddBlock(blockWithTxs(t, bc, first, first)))
+	assert.NotNil(t, bc.AddBlock(blockWithTxs(t, bc, first, *signedTransfer(t, privKey, types.Address{}, 1, 2))))
+	assert.Nil(t, bc.AddBlock(blockWithTxs(t, bc, first, *signedTransfer(t, privKey, types.Address{}, 1, 1))))
+	assert.Equal(t, uint32(2), bc.Height())
+}
+
+func TestTransactionHashIncludesSender(t *testing.T) {
+	a := NewTransaction([]byte("foo"))
+	b := NewTransaction([]byte("foo"))
+	assert.Nil(t, a.Sign(crypto.GeneratePrivateKey()))
+	assert.Nil(t, b.Sign(crypto.GeneratePrivateKey()))
+	assert.NotEqual(t, a.Hash(TxHasher{}), b.Hash(TxHasher{}))
+
+	c := NewTransaction([]byte("foo"))
+	c.Nonce = 1
+	assert.Nil(t, c.Sign(crypto.GeneratePrivateKey()))
+	assert.NotEqual(t, TxHasher{}.Hash(a), TxHasher{}.Hash(c))
+}
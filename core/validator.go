@@ -1,6 +1,14 @@
 package core
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"go-blockchain/types"
+)
+
+var ErrUnknownParent = errors.New("unknown parent block")
 
 type Validator interface {
 	ValidateBlock(block *Block) error
@@ -16,28 +24,161 @@ func NewBlockValidator(bc *Blockchain) *BlockValidator {
 	}
 }
 
+// ValidateBlock checks the block against its parent, which may be the tip or
+// any block of a side branch.
 func (v *BlockValidator) ValidateBlock(b *Block) error {
-	if v.bc.HasBlock(b.Height) {
-		return fmt.Errorf("block at height %d with hash %s already exists", b.Height, b.Hash(BlockHasher{}))
+	hash := b.Hash(BlockHasher{})
+	if v.bc.HasBlockHash(hash) {
+		return fmt.Errorf("block at height %d with hash %s already exists", b.Height, hash)
 	}
 
-	if b.Height != v.bc.Height()+1 {
-		return fmt.Errorf("invalid block height %d, expected %d", b.Height, v.bc.Height()+1)
+	prevHeader, ok := v.bc.lookupHeader(b.PrevBlockHash)
+	if !ok {
+		return fmt.Errorf("%w %s for block at height %d", ErrUnknownParent, b.PrevBlockHash, b.Height)
 	}
 
-	prevHeader, err := v.bc.GetHeader(b.Height - 1)
-	if err != nil {
+	if b.Height <= v.bc.FinalizedHeight() {
+		return fmt.Errorf("block at height %d %w at height %d", b.Height, ErrFinalized, v.bc.FinalizedHeight())
+	}
+
+	if err := validateBlockContent(v.bc, b, prevHeader); err != nil {
 		return err
 	}
 
-	hash := BlockHasher{}.Hash(prevHeader)
-	if b.PrevBlockHash != hash {
-		return fmt.Errorf("invalid prev block hash %s, expected %s", b.PrevBlockHash, hash)
+	var validators *ValidatorSet
+	if authority := v.bc.Authority(); authority != nil {
+		// the set of a known parent is only pruned once it lies too deep
+		if validators = authority.ValidatorsAt(b.PrevBlockHash); validators == nil {
+			return fmt.Errorf("parent %s of block at height %d is too deep to fork from", b.PrevBlockHash, b.Height)
+		}
 	}
 
-	if err := b.Verify(); err != nil {
-		return err
+	return validateSeal(v.bc, b, prevHeader, validators, v.bc.lookupHeader)
+}
+
+// ValidateHeaders checks blocks stripped of their transactions, as a sync
+// fetches them before the bodies. The first one must extend a known block and
+// every other one the block before it. Each is held to the parts of
+// ValidateBlock the transactions are not needed for: the header rules, the
+// signature and the commit, the turn of the proposer or the proof of work.
+//
+// Only the validator set of the known block is known, the evidence in the
+// bodies of the fetched blocks may shrink it. The headers after the first are
+// therefore only checked to be signed by a member of that set, the full check
+// is left to ValidateBlock once the bodies arrive.
+func (bc *Blockchain) ValidateHeaders(headers []*Block) error {
+	var validators *ValidatorSet
+	if bc.authority != nil && len(headers) > 0 && headers[0] != nil && headers[0].Header != nil {
+		if validators = bc.authority.ValidatorsAt(headers[0].PrevBlockHash); validators == nil {
+			return fmt.Errorf("%w %s for header at height %d", ErrUnknownParent, headers[0].PrevBlockHash, headers[0].Height)
+		}
+	}
+
+	fetched := make(map[types.Hash]*Header, len(headers))
+	lookup := func(hash types.Hash) (*Header, bool) {
+		if h, ok := fetched[hash]; ok {
+			return h, true
+		}
+		return bc.lookupHeader(hash)
+	}
+
+	for i, b := range headers {
+		if b == nil || b.Header == nil {
+			return fmt.Errorf("missing header at index %d", i)
+		}
+
+		if i > 0 && b.PrevBlockHash != headers[i-1].Hash(BlockHasher{}) {
+			return fmt.Errorf("header at height %d does not link to its parent", b.Height)
+		}
+
+		prevHeader, ok := lookup(b.PrevBlockHash)
+		if !ok {
+			return fmt.Errorf("%w %s for header at height %d", ErrUnknownParent, b.PrevBlockHash, b.Height)
+		}
+
+		if b.Height != prevHeader.Height+1 {
+			return fmt.Errorf("invalid header height %d, expected %d", b.Height, prevHeader.Height+1)
+		}
+
+		if b.ChainID != bc.ChainID() {
+			return fmt.Errorf("header at height %d has chain id %d, expected %d", b.Height, b.ChainID, bc.ChainID())
+		}
+
+		if err := bc.rules.checkHeader(b, time.Now()); err != nil {
+			return err
+		}
+
+		if err := bc.rules.checkTimestamp(b, medianTime(prevHeader, bc.rules.MedianTimeBlocks, lookup)); err != nil {
+			return err
+		}
+
+		if err := b.verifySignature(); err != nil {
+			return fmt.Errorf("header at height %d: %w", b.Height, err)
+		}
+
+		if i > 0 && bc.authority != nil {
+			if _, err := bc.authority.VerifyMember(b, prevHeader, validators, time.Now()); err != nil {
+				return err
+			}
+		} else if err := validateSeal(bc, b, prevHeader, validators, lookup); err != nil {
+			return err
+		}
+
+		fetched[b.Hash(BlockHasher{})] = b.Header
 	}
 
 	return nil
 }
+
+// validateSeal checks what entitles the block to extend its parent: the
+// commit certificate, the turn of its proposer in validators or its proof of
+// work.
+func validateSeal(bc *Blockchain, b *Block, prevHeader *Header, validators *ValidatorSet, lookup func(types.Hash) (*Header, bool)) error {
+	authority := bc.Authority()
+	switch {
+	case b.Commit != nil && authority == nil:
+		return fmt.Errorf("%w: block at height %d has a commit but the chain has no validators", ErrInvalidCommit, b.Height)
+	case b.Commit != nil:
+		return authority.VerifyCommit(b, prevHeader, validators, time.Now())
+	case bc.RequiresCommit():
+		return fmt.Errorf("%w for block at height %d", ErrMissingCommit, b.Height)
+	case authority != nil:
+		return authority.VerifyProposer(b, prevHeader, validators, time.Now())
+	case bc.ProofOfWork() != nil:
+		bits, err := bc.ProofOfWork().NextBits(prevHeader, lookup)
+		if err != nil {
+			return err
+		}
+		return bc.ProofOfWork().VerifyWork(b, bits)
+	}
+
+	return nil
+}
+
+// validateBlockContent checks the height, the chain id, the block rules, the
+// transactions and the signature of a block on top of its parent.
+func validateBlockContent(bc *Blockchain, b *Block, prevHeader *Header) error {
+	if b.Height != prevHeader.Height+1 {
+		return fmt.Errorf("invalid block height %d, expected %d", b.Height, prevHeader.Height+1)
+	}
+
+	if b.ChainID != bc.ChainID() {
+		return fmt.Errorf("block at height %d has chain id %d, expected %d", b.Height, b.ChainID, bc.ChainID())
+	}
+
+	if err := bc.rules.checkBlock(b, time.Now()); err != nil {
+		return err
+	}
+
+	if err := bc.rules.checkTimestamp(b, medianTime(prevHeader, bc.rules.MedianTimeBlocks, bc.lookupHeader)); err != nil {
+		return err
+	}
+
+	for i := range b.Transactions {
+		if b.Transactions[i].ChainID != bc.ChainID() {
+			return fmt.Errorf("transaction %d has chain id %d, expected %d", i, b.Transactions[i].ChainID, bc.ChainID())
+		}
+	}
+
+	return b.Verify()
+}
@@ -7,7 +7,10 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/gob"
+	"encoding/hex"
+	"fmt"
 	"math/big"
+	"strings"
 
 	"go-blockchain/types"
 )
@@ -52,6 +55,74 @@ func (k PublicKey) ToSlice() []byte {
 	return elliptic.MarshalCompressed(k.Key, k.Key.X, k.Key.Y)
 }
 
+// PublicKeyFromBytes parses a compressed P-256 public key as returned by ToSlice.
+func PublicKeyFromBytes(b []byte) (PublicKey, error) {
+	x, y := elliptic.UnmarshalCompressed(elliptic.P256(), b)
+	if x == nil {
+		return PublicKey{}, fmt.Errorf("invalid compressed public key of length %d", len(b))
+	}
+
+	return PublicKey{
+		Key: &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     x,
+			Y:     y,
+		},
+	}, nil
+}
+
+// publicKeyFromPoint returns the key of an affine point, it is rejected
+// unless it lies on P-256.
+func publicKeyFromPoint(x, y *big.Int) (PublicKey, error) {
+	if x.BitLen() > 256 || y.BitLen() > 256 {
+		return PublicKey{}, fmt.Errorf("public key coordinates exceed 256 bits")
+	}
+
+	// the compressed form carries x and the parity of y, parsing it checks
+	// that x is on the curve and yields the only y of that parity
+	compressed := make([]byte, 33)
+	compressed[0] = byte(2 + y.Bit(0))
+	x.FillBytes(compressed[1:])
+
+	key, err := PublicKeyFromBytes(compressed)
+	if err != nil {
+		return PublicKey{}, err
+	}
+	if key.Key.Y.Cmp(y) != 0 {
+		return PublicKey{}, fmt.Errorf("public key is not on P-256")
+	}
+
+	return key, nil
+}
+
+// MarshalText encodes the compressed key as hex, a missing key is empty.
+func (k PublicKey) MarshalText() ([]byte, error) {
+	if k.Key == nil {
+		return []byte{}, nil
+	}
+	return []byte(hex.EncodeToString(k.ToSlice())), nil
+}
+
+func (k *PublicKey) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*k = PublicKey{}
+		return nil
+	}
+
+	b, err := hex.DecodeString(strings.TrimPrefix(string(text), "0x"))
+	if err != nil {
+		return fmt.Errorf("invalid public key %q: %w", text, err)
+	}
+
+	key, err := PublicKeyFromBytes(b)
+	if err != nil {
+		return err
+	}
+
+	*k = key
+	return nil
+}
+
 func (k PublicKey) Address() types.Address {
 	h := sha256.Sum256(k.ToSlice())
 	return types.AddressFromBytes(h[len(h)-20:])
@@ -61,7 +132,12 @@ type Signature struct {
 	S, R *big.Int
 }
 
+// Verify reports whether the signature over data is valid for the key, a
+// missing key or scalar never verifies.
 func (sig Signature) Verify(pubKey PublicKey, data []byte) bool {
+	if pubKey.Key == nil || sig.R == nil || sig.S == nil {
+		return false
+	}
 	return ecdsa.Verify(pubKey.Key, data, sig.R, sig.S)
 }
 
@@ -91,21 +167,30 @@ func (k *PrivateKey) GobDecode(data []byte) error {
 }
 
 func (k PublicKey) GobEncode() ([]byte, error) {
+	// blocks without a validator (genesis) carry an empty public key
+	if k.Key == nil {
+		return []byte{}, nil
+	}
 	x := k.Key.X.Bytes()
 	y := k.Key.Y.Bytes()
 	return encodePublicKey(x, y)
 }
 
 func (k *PublicKey) GobDecode(data []byte) error {
+	if len(data) == 0 {
+		k.Key = nil
+		return nil
+	}
 	x, y, err := decodePublicKey(data)
 	if err != nil {
 		return err
 	}
-	k.Key = &ecdsa.PublicKey{
-		Curve: elliptic.P256(),
-		X:     x,
-		Y:     y,
+
+	key, err := publicKeyFromPoint(x, y)
+	if err != nil {
+		return err
 	}
+	k.Key = key.Key
 	return nil
 }
 
@@ -1,6 +1,9 @@
 package crypto
 
 import (
+	"bytes"
+	"encoding/gob"
+	"math/big"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -29,3 +32,55 @@ func TestKeypairSignVerify(t *testing.T) {
 
 	assert.False(t, sig.Verify(pubKey, []byte("wrong message")))
 }
+
+func TestPublicKeyFromBytes(t *testing.T) {
+	pubKey := GeneratePrivateKey().PublicKey()
+
+	parsed, err := PublicKeyFromBytes(pubKey.ToSlice())
+	assert.Nil(t, err)
+	assert.Equal(t, pubKey.ToSlice(), parsed.ToSlice())
+	assert.Equal(t, pubKey.Address(), parsed.Address())
+
+	_, err = PublicKeyFromBytes([]byte{0x02, 0x01})
+	assert.NotNil(t, err)
+}
+
+func TestPublicKeyText(t *testing.T) {
+	pubKey := GeneratePrivateKey().PublicKey()
+
+	text, err := pubKey.MarshalText()
+	assert.Nil(t, err)
+
+	decoded := PublicKey{}
+	assert.Nil(t, decoded.UnmarshalText(text))
+	assert.Equal(t, pubKey.Address(), decoded.Address())
+
+	assert.NotNil(t, decoded.UnmarshalText([]byte("zz")))
+	assert.NotNil(t, decoded.UnmarshalText([]byte("0102")))
+
+	empty, err := PublicKey{}.MarshalText()
+	assert.Nil(t, err)
+	assert.Empty(t, empty)
+}
+
+func TestPublicKeyGob(t *testing.T) {
+	pubKey := GeneratePrivateKey().PublicKey()
+
+	buf := &bytes.Buffer{}
+	assert.Nil(t, gob.NewEncoder(buf).Encode(pubKey))
+	decoded := PublicKey{}
+	assert.Nil(t, gob.NewDecoder(buf).Decode(&decoded))
+	assert.Equal(t, pubKey.Address(), decoded.Address())
+
+	// a point that is not on the curve is rejected
+	data, err := encodePublicKey(pubKey.Key.X.Bytes(), new(big.Int).Add(pubKey.Key.Y, big.NewInt(1)).Bytes())
+	assert.Nil(t, err)
+	assert.NotNil(t, decoded.GobDecode(data))
+
+	// a missing key decodes to the empty key, it never verifies
+	assert.Nil(t, decoded.GobDecode([]byte{}))
+	assert.Nil(t, decoded.Key)
+	sig, err := GeneratePrivateKey().Sign([]byte("hello"))
+	assert.Nil(t, err)
+	assert.False(t, sig.Verify(decoded, []byte("hello")))
+}
@@ -2,11 +2,14 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"go-blockchain/core"
 	"go-blockchain/crypto"
 	"go-blockchain/network"
 	"math/rand"
-	"strconv"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -17,48 +20,104 @@ func main() {
 		ForceColors: true,
 	})
 
+	// the nodes shut down gracefully on ctrl-c or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	trLocal := network.NewLocalTransport("LOCAL")
 	trRemote := network.NewLocalTransport("REMOTE")
 
-	_ = trLocal.Connect(trRemote)
-	_ = trRemote.Connect(trLocal)
+	faucet := crypto.GeneratePrivateKey()
 
 	go func() {
-		for {
-			if err := sendTransaction(trRemote, trLocal.Addr()); err != nil {
+		// the nonce only advances once the nodes are connected and a
+		// transaction went out
+		for nonce := uint64(0); ; {
+			if err := sendTransaction(trRemote, trLocal.Addr(), faucet, nonce); err != nil {
 				logrus.Error(err)
+			} else {
+				nonce++
 			}
 
-			time.Sleep(50 * time.Millisecond)
+			select {
+			case <-time.After(50 * time.Millisecond):
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 
 	privKey := crypto.GeneratePrivateKey()
 
+	// both nodes start from the same genesis so they share a chain, the local
+	// node is its only validator
+	genesis := &core.Genesis{
+		ChainID: 1,
+		Validators: []core.GenesisValidator{
+			{PublicKey: privKey.PublicKey(), Power: 1},
+		},
+		Alloc: core.GenesisAlloc{
+			faucet.PublicKey().Address(): 1_000_000_000,
+		},
+		Params: core.GenesisParams{
+			BlockTimeMs: 5000,
+		},
+	}
+
+	// the remote node follows the chain produced by the local validator, it
+	// finds it through the bootstrap list
+	remote, err := network.NewServer(network.ServerOpts{
+		ID:         "REMOTE",
+		Transports: []network.Transport{trRemote},
+		Genesis:    genesis,
+		PeerOpts: network.PeerManagerOpts{
+			Bootstrap: []network.NetAddr{trLocal.Addr()},
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	remoteErrCh := make(chan error, 1)
+	go func() {
+		remoteErrCh <- remote.Start(ctx)
+	}()
+
 	opts := network.ServerOpts{
 		PrivateKey: &privKey,
 		ID:         "LOCAL",
 		Transports: []network.Transport{trLocal},
+		Genesis:    genesis,
 	}
 
 	s, err := network.NewServer(opts)
 	if err != nil {
 		panic(err)
 	}
-	s.Start()
+
+	code := 0
+	if err := s.Start(ctx); err != nil {
+		logrus.Error(err)
+		code = 1
+	}
+	if err := <-remoteErrCh; err != nil {
+		logrus.Error(err)
+		code = 1
+	}
+	os.Exit(code)
 }
 
-func sendTransaction(tr network.Transport, to network.NetAddr) error {
-	privKey := crypto.GeneratePrivateKey()
-	data := []byte(strconv.FormatInt(int64(rand.Intn(100)), 10))
-	tx := core.NewTransaction(data)
+func sendTransaction(tr network.Transport, to network.NetAddr, privKey crypto.PrivateKey, nonce uint64) error {
+	recipient := crypto.GeneratePrivateKey().PublicKey().Address()
+	tx := core.NewTransferTransaction(recipient, uint64(rand.Intn(100)+1), nonce)
+	tx.ChainID = 1
+	tx.Fee = uint64(rand.Intn(10))
 
 	if err := tx.Sign(privKey); err != nil {
 		return err
 	}
 
 	buf := &bytes.Buffer{}
-	if err := tx.Encode(core.NewGobTxEncoder(buf)); err != nil {
+	if err := tx.Encode(core.NewCanonicalTxEncoder(buf)); err != nil {
 		return err
 	}
 
@@ -0,0 +1,286 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMaxAddrBookSize = 1024
+	// MaxAddrFailures is the number of failed dials in a row after which an
+	// address is dropped, bootstrap addresses are kept
+	MaxAddrFailures = 8
+)
+
+// KnownAddr is an address in the AddrBook together with its dial history.
+type KnownAddr struct {
+	Addr        NetAddr   `json:"addr"`
+	Bootstrap   bool      `json:"bootstrap,omitempty"`
+	LastSeen    time.Time `json:"lastSeen"`
+	LastAttempt time.Time `json:"lastAttempt"`
+	Failures    int       `json:"failures"`
+}
+
+// retryAt returns when the address may be dialed again, the delay doubles
+// with every failure up to maxDelay.
+func (a *KnownAddr) retryAt(baseDelay, maxDelay time.Duration) time.Time {
+	if a.Failures == 0 {
+		return a.LastAttempt
+	}
+
+	delay := baseDelay
+	for i := 1; i < a.Failures && delay < maxDelay; i++ {
+		delay *= 2
+	}
+
+	return a.LastAttempt.Add(min(delay, maxDelay))
+}
+
+// AddrBook keeps the addresses of the peers learned from the bootstrap list
+// and the peer exchange. It is persisted as JSON when a path is given.
+type AddrBook struct {
+	path    string
+	maxSize int
+
+	lock  sync.Mutex
+	addrs map[NetAddr]*KnownAddr
+	dirty bool
+}
+
+// NewAddrBook loads the address book stored at path, an empty path keeps the
+// book in memory only.
+func NewAddrBook(path string, maxSize int) (*AddrBook, error) {
+	if maxSize == 0 {
+		maxSize = DefaultMaxAddrBookSize
+	}
+
+	b := &AddrBook{
+		path:    path,
+		maxSize: maxSize,
+		addrs:   make(map[NetAddr]*KnownAddr),
+	}
+
+	if path == "" {
+		return b, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	known := []*KnownAddr{}
+	if err := json.Unmarshal(data, &known); err != nil {
+		return nil, err
+	}
+	for _, a := range known {
+		if a.Addr != "" {
+			b.addrs[a.Addr] = a
+		}
+	}
+
+	return b, nil
+}
+
+// Add inserts unknown addresses while the book has room and returns the
+// number added.
+func (b *AddrBook) Add(addrs ...NetAddr) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	added := 0
+	for _, addr := range addrs {
+		if _, ok := b.addrs[addr]; ok || addr == "" || len(b.addrs) >= b.maxSize {
+			continue
+		}
+		b.addrs[addr] = &KnownAddr{Addr: addr}
+		added++
+	}
+
+	if added > 0 {
+		b.dirty = true
+	}
+	return added
+}
+
+// AddBootstrap inserts addresses that are never dropped.
+func (b *AddrBook) AddBootstrap(addrs ...NetAddr) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, addr := range addrs {
+		a, ok := b.addrs[addr]
+		if !ok {
+			a = &KnownAddr{Addr: addr}
+			b.addrs[addr] = a
+		}
+		a.Bootstrap = true
+	}
+	b.dirty = true
+}
+
+func (b *AddrBook) Remove(addr NetAddr) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, ok := b.addrs[addr]; ok {
+		delete(b.addrs, addr)
+		b.dirty = true
+	}
+}
+
+func (b *AddrBook) Has(addr NetAddr) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	_, ok := b.addrs[addr]
+	return ok
+}
+
+func (b *AddrBook) Len() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return len(b.addrs)
+}
+
+// MarkAttempt records a dial of the address.
+func (b *AddrBook) MarkAttempt(addr NetAddr, now time.Time) {
+	b.update(addr, func(a *KnownAddr) {
+		a.LastAttempt = now
+	})
+}
+
+// MarkConnected records a connection to the address and resets its failures.
+func (b *AddrBook) MarkConnected(addr NetAddr, now time.Time) {
+	b.Add(addr)
+	b.update(addr, func(a *KnownAddr) {
+		a.LastSeen = now
+		a.Failures = 0
+	})
+}
+
+// MarkFailed records a failed dial, addresses failing too often are dropped.
+func (b *AddrBook) MarkFailed(addr NetAddr) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	a, ok := b.addrs[addr]
+	if !ok {
+		return
+	}
+
+	a.Failures++
+	if a.Failures >= MaxAddrFailures && !a.Bootstrap {
+		delete(b.addrs, addr)
+	}
+	b.dirty = true
+}
+
+func (b *AddrBook) update(addr NetAddr, fn func(*KnownAddr)) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if a, ok := b.addrs[addr]; ok {
+		fn(a)
+		b.dirty = true
+	}
+}
+
+// Candidates returns up to n addresses that may be dialed at now in random
+// order, skip filters out addresses that are connected or unwanted.
+func (b *AddrBook) Candidates(n int, now time.Time, baseDelay, maxDelay time.Duration, skip func(NetAddr) bool) []NetAddr {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	candidates := []NetAddr{}
+	for addr, a := range b.addrs {
+		if skip(addr) || a.retryAt(baseDelay, maxDelay).After(now) {
+			continue
+		}
+		candidates = append(candidates, addr)
+	}
+
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+
+	return candidates[:min(n, len(candidates))]
+}
+
+// Recent returns up to n addresses, the most recently seen first.
+func (b *AddrBook) Recent(n int) []NetAddr {
+	b.lock.Lock()
+	known := make([]KnownAddr, 0, len(b.addrs))
+	for _, a := range b.addrs {
+		known = append(known, *a)
+	}
+	b.lock.Unlock()
+
+	sort.Slice(known, func(i, j int) bool {
+		if !known[i].LastSeen.Equal(known[j].LastSeen) {
+			return known[i].LastSeen.After(known[j].LastSeen)
+		}
+		return known[i].Addr < known[j].Addr
+	})
+
+	addrs := make([]NetAddr, 0, min(n, len(known)))
+	for _, a := range known[:min(n, len(known))] {
+		addrs = append(addrs, a.Addr)
+	}
+	return addrs
+}
+
+// Save writes the book to its path if it changed since the last save.
+func (b *AddrBook) Save() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.path == "" || !b.dirty {
+		return nil
+	}
+
+	known := make([]*KnownAddr, 0, len(b.addrs))
+	for _, a := range b.addrs {
+		known = append(known, a)
+	}
+	sort.Slice(known, func(i, j int) bool {
+		return known[i].Addr < known[j].Addr
+	})
+
+	data, err := json.MarshalIndent(known, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write a temporary file first so a crash never leaves a partial book
+	tmp, err := os.CreateTemp(filepath.Dir(b.path), filepath.Base(b.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), b.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	b.dirty = false
+	return nil
+}
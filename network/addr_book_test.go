@@ -0,0 +1,60 @@
+package network
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddrBookPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers.json")
+
+	book, err := NewAddrBook(path, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, book.Add("A", "B", "A"))
+	book.AddBootstrap("C")
+	book.MarkConnected("B", time.Unix(100, 0))
+	assert.Nil(t, book.Save())
+
+	loaded, err := NewAddrBook(path, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, loaded.Len())
+	assert.Equal(t, NetAddr("B"), loaded.Recent(1)[0])
+
+	// bootstrap addresses survive failures
+	for i := 0; i < MaxAddrFailures; i++ {
+		loaded.MarkFailed("A")
+		loaded.MarkFailed("C")
+	}
+	assert.False(t, loaded.Has("A"))
+	assert.True(t, loaded.Has("C"))
+}
+
+func TestAddrBookBacksOffFailedAddrs(t *testing.T) {
+	book, err := NewAddrBook("", 0)
+	assert.Nil(t, err)
+	book.Add("A", "B")
+
+	now := time.Unix(1000, 0)
+	skipNone := func(NetAddr) bool { return false }
+	assert.Len(t, book.Candidates(10, now, time.Second, time.Minute, skipNone), 2)
+
+	book.MarkAttempt("A", now)
+	book.MarkFailed("A")
+	book.MarkFailed("A")
+	assert.Equal(t, []NetAddr{"B"}, book.Candidates(10, now.Add(time.Second), time.Second, time.Minute, skipNone))
+	assert.Len(t, book.Candidates(10, now.Add(2*time.Second), time.Second, time.Minute, skipNone), 2)
+
+	skipB := func(addr NetAddr) bool { return addr == "B" }
+	assert.Equal(t, []NetAddr{"A"}, book.Candidates(10, now.Add(time.Hour), time.Second, time.Minute, skipB))
+}
+
+func TestAddrBookMaxSize(t *testing.T) {
+	book, err := NewAddrBook("", 2)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 2, book.Add("A", "B", "C"))
+	assert.False(t, book.Has("C"))
+}
@@ -0,0 +1,105 @@
+package network
+
+import (
+	"container/heap"
+	"go-blockchain/core"
+	"go-blockchain/types"
+	"sort"
+)
+
+const (
+	DefaultMaxBlockSize = core.DefaultMaxBlockSize
+)
+
+// BlockBuilder selects the transactions of a new block. Transactions of the
+// same sender are always taken in nonce order, between senders the ordering
+// policy decides which transaction goes next.
+type BlockBuilder struct {
+	Ordering TxOrdering
+	// MaxBlockSize caps the canonical size of the block
+	MaxBlockSize int
+}
+
+func NewBlockBuilder(ordering TxOrdering, maxBlockSize int) *BlockBuilder {
+	if ordering == nil {
+		ordering = FeeOrdering{}
+	}
+	if maxBlockSize == 0 {
+		maxBlockSize = DefaultMaxBlockSize
+	}
+
+	return &BlockBuilder{
+		Ordering:     ordering,
+		MaxBlockSize: maxBlockSize,
+	}
+}
+
+// Select returns the transactions to include, each of them is applied to the
+// transition. A transaction that does not apply drops the remaining
+// transactions of its sender since their nonces can no longer match, the same
+// happens when the next transaction of a sender does not fit in the block.
+// overhead is the room left for the rest of the block, see core.BlockOverhead.
+func (b *BlockBuilder) Select(txx []*core.Transaction, transition *core.StateTransition, overhead int) []core.Transaction {
+	queues := map[types.Address][]*core.Transaction{}
+	for _, tx := range txx {
+		sender := tx.Sender()
+		queues[sender] = append(queues[sender], tx)
+	}
+
+	heads := &txHeap{ordering: b.Ordering}
+	for sender, queue := range queues {
+		sort.SliceStable(queue, func(i, j int) bool {
+			return queue[i].Nonce < queue[j].Nonce
+		})
+		heads.txx = append(heads.txx, queue[0])
+		queues[sender] = queue[1:]
+	}
+	heap.Init(heads)
+
+	selected := []core.Transaction{}
+	size := overhead
+	for heads.Len() > 0 {
+		tx := heap.Pop(heads).(*core.Transaction)
+
+		txSize := tx.Size()
+		if size+txSize > b.MaxBlockSize {
+			continue
+		}
+
+		if err := transition.ApplyTransaction(tx); err != nil {
+			continue
+		}
+
+		selected = append(selected, *tx)
+		size += txSize
+
+		sender := tx.Sender()
+		if queue := queues[sender]; len(queue) > 0 {
+			heap.Push(heads, queue[0])
+			queues[sender] = queue[1:]
+		}
+	}
+
+	return selected
+}
+
+// txHeap holds the next transaction of every sender.
+type txHeap struct {
+	txx      []*core.Transaction
+	ordering TxOrdering
+}
+
+func (h *txHeap) Len() int           { return len(h.txx) }
+func (h *txHeap) Less(i, j int) bool { return h.ordering.Less(h.txx[i], h.txx[j]) }
+func (h *txHeap) Swap(i, j int)      { h.txx[i], h.txx[j] = h.txx[j], h.txx[i] }
+
+func (h *txHeap) Push(x any) {
+	h.txx = append(h.txx, x.(*core.Transaction))
+}
+
+func (h *txHeap) Pop() any {
+	n := len(h.txx)
+	tx := h.txx[n-1]
+	h.txx = h.txx[:n-1]
+	return tx
+}
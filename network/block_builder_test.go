@@ -0,0 +1,87 @@
+package network
+
+import (
+	"go-blockchain/core"
+	"go-blockchain/crypto"
+	"go-blockchain/types"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newBuilderState(keys ...crypto.PrivateKey) *core.State {
+	alloc := core.GenesisAlloc{}
+	for _, k := range keys {
+		alloc[k.PublicKey().Address()] = 1000
+	}
+	return core.NewState(alloc)
+}
+
+func TestBlockBuilderOrdersByFeeAndNonce(t *testing.T) {
+	alice := crypto.GeneratePrivateKey()
+	bob := crypto.GeneratePrivateKey()
+
+	a0 := feeTransfer(t, alice, 1, 1, 0)
+	a1 := feeTransfer(t, alice, 1, 100, 1)
+	b0 := feeTransfer(t, bob, 1, 50, 0)
+
+	state := newBuilderState(alice, bob)
+	builder := NewBlockBuilder(FeeOrdering{}, 0)
+
+	// a1 pays the most but has to wait for a0
+	txx := builder.Select([]*core.Transaction{a1, a0, b0}, state.NewTransition(crypto.GeneratePrivateKey().PublicKey().Address()), 0)
+	assert.Equal(t, 3, len(txx))
+	assert.Equal(t, b0.Hash(core.TxHasher{}), txx[0].Hash(core.TxHasher{}))
+	assert.Equal(t, a0.Hash(core.TxHasher{}), txx[1].Hash(core.TxHasher{}))
+	assert.Equal(t, a1.Hash(core.TxHasher{}), txx[2].Hash(core.TxHasher{}))
+}
+
+func TestBlockBuilderFirstSeenOrdering(t *testing.T) {
+	alice := crypto.GeneratePrivateKey()
+	bob := crypto.GeneratePrivateKey()
+
+	a0 := feeTransfer(t, alice, 1, 1, 0)
+	a0.SetFirstSeen(1)
+	b0 := feeTransfer(t, bob, 1, 50, 0)
+	b0.SetFirstSeen(2)
+
+	state := newBuilderState(alice, bob)
+	txx := NewBlockBuilder(FirstSeenOrdering{}, 0).Select([]*core.Transaction{b0, a0}, state.NewTransition(types.Address{}), 0)
+	assert.Equal(t, 2, len(txx))
+	assert.Equal(t, a0.Hash(core.TxHasher{}), txx[0].Hash(core.TxHasher{}))
+}
+
+func TestBlockBuilderMaxBlockSize(t *testing.T) {
+	alice := crypto.GeneratePrivateKey()
+	bob := crypto.GeneratePrivateKey()
+
+	a0 := feeTransfer(t, alice, 1, 10, 0)
+	a1 := feeTransfer(t, alice, 1, 10, 1)
+	b0 := feeTransfer(t, bob, 1, 5, 0)
+
+	state := newBuilderState(alice, bob)
+	builder := NewBlockBuilder(FeeOrdering{}, core.BlockOverhead(0)+2*a0.Size())
+
+	txx := builder.Select([]*core.Transaction{a0, a1, b0}, state.NewTransition(types.Address{}), core.BlockOverhead(0))
+	assert.Equal(t, 2, len(txx))
+	assert.Equal(t, a0.Hash(core.TxHasher{}), txx[0].Hash(core.TxHasher{}))
+	assert.Equal(t, a1.Hash(core.TxHasher{}), txx[1].Hash(core.TxHasher{}))
+}
+
+func TestBlockBuilderSkipsInvalidTransactions(t *testing.T) {
+	alice := crypto.GeneratePrivateKey()
+	bob := crypto.GeneratePrivateKey()
+
+	// overdraws, which leaves a1 with a nonce gap
+	a0 := feeTransfer(t, alice, 2000, 10, 0)
+	a1 := feeTransfer(t, alice, 1, 10, 1)
+	// nonce gap
+	b1 := feeTransfer(t, bob, 1, 10, 1)
+	b0 := feeTransfer(t, bob, 1, 1, 0)
+
+	state := newBuilderState(alice, bob)
+	txx := NewBlockBuilder(FeeOrdering{}, 0).Select([]*core.Transaction{a0, a1, b1, b0}, state.NewTransition(types.Address{}), 0)
+	assert.Equal(t, 2, len(txx))
+	assert.Equal(t, b0.Hash(core.TxHasher{}), txx[0].Hash(core.TxHasher{}))
+	assert.Equal(t, b1.Hash(core.TxHasher{}), txx[1].Hash(core.TxHasher{}))
+}
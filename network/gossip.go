@@ -0,0 +1,282 @@
+package network
+
+import (
+	"context"
+	"go-blockchain/types"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+const (
+	DefaultSeenCacheSize  = 1 << 16
+	DefaultInvInterval    = 100 * time.Millisecond
+	DefaultGetDataTimeout = 5 * time.Second
+	// MaxInvPerMessage caps the items of a single InvMessage or GetDataMessage
+	MaxInvPerMessage = 256
+)
+
+type GossipOpts struct {
+	// SeenCacheSize is the number of hashes remembered to stop echo loops, it
+	// also caps the number of outstanding GetData requests
+	SeenCacheSize int
+	// InvInterval is how long transaction announcements are batched, blocks
+	// are announced right away
+	InvInterval time.Duration
+	// GetDataTimeout is how long to wait for a requested item before it is
+	// requested from the next peer announcing it
+	GetDataTimeout time.Duration
+}
+
+// SeenCache remembers a bounded number of hashes, the oldest one is evicted
+// when the cache is full.
+type SeenCache struct {
+	lock   sync.Mutex
+	hashes map[types.Hash]struct{}
+	ring   []types.Hash
+	next   int
+}
+
+func NewSeenCache(size int) *SeenCache {
+	if size <= 0 {
+		size = DefaultSeenCacheSize
+	}
+
+	return &SeenCache{
+		hashes: make(map[types.Hash]struct{}, size),
+		ring:   make([]types.Hash, 0, size),
+	}
+}
+
+// Add remembers a hash and reports whether it was new.
+func (c *SeenCache) Add(hash types.Hash) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.hashes[hash]; ok {
+		return false
+	}
+
+	if len(c.ring) < cap(c.ring) {
+		c.ring = append(c.ring, hash)
+	} else {
+		delete(c.hashes, c.ring[c.next])
+		c.ring[c.next] = hash
+		c.next = (c.next + 1) % len(c.ring)
+	}
+	c.hashes[hash] = struct{}{}
+
+	return true
+}
+
+func (c *SeenCache) Has(hash types.Hash) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	_, ok := c.hashes[hash]
+	return ok
+}
+
+func (c *SeenCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return len(c.hashes)
+}
+
+// GossipManager relays transactions and blocks by announcing their hashes in
+// InvMessages, peers fetch only the items they are missing with a
+// GetDataMessage. Hashes seen before are neither announced nor requested
+// again, which stops items from circling the network.
+type GossipManager struct {
+	opts   GossipOpts
+	send   SyncSendFunc
+	peers  func() []PeerInfo
+	has    func(InvVect) bool
+	logger log.Logger
+
+	seen *SeenCache
+
+	lock sync.Mutex
+	// requested holds the items asked for and when, queued the announcements
+	// waiting for the next flush per peer
+	requested map[types.Hash]time.Time
+	queued    map[NetAddr][]InvVect
+
+	triggerCh chan struct{}
+}
+
+// NewGossipManager announces to the peers returned by peers, has reports
+// whether the node already holds an item.
+func NewGossipManager(send SyncSendFunc, peers func() []PeerInfo, has func(InvVect) bool, opts GossipOpts, logger log.Logger) *GossipManager {
+	if opts.SeenCacheSize == 0 {
+		opts.SeenCacheSize = DefaultSeenCacheSize
+	}
+	if opts.InvInterval == 0 {
+		opts.InvInterval = DefaultInvInterval
+	}
+	if opts.GetDataTimeout == 0 {
+		opts.GetDataTimeout = DefaultGetDataTimeout
+	}
+
+	return &GossipManager{
+		opts:      opts,
+		send:      send,
+		peers:     peers,
+		has:       has,
+		logger:    logger,
+		seen:      NewSeenCache(opts.SeenCacheSize),
+		requested: map[types.Hash]time.Time{},
+		queued:    map[NetAddr][]InvVect{},
+		triggerCh: make(chan struct{}, 1),
+	}
+}
+
+// Loop flushes the queued announcements every InvInterval or when triggered
+// until ctx is done.
+func (m *GossipManager) Loop(ctx context.Context) {
+	ticker := time.NewTicker(m.opts.InvInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.triggerCh:
+		case <-ctx.Done():
+			return
+		}
+
+		m.Flush()
+	}
+}
+
+// Seen reports whether the item with the hash was already received.
+func (m *GossipManager) Seen(hash types.Hash) bool {
+	return m.seen.Has(hash)
+}
+
+// MarkSeen records a received item and reports whether it was new.
+func (m *GossipManager) MarkSeen(hash types.Hash) bool {
+	m.lock.Lock()
+	delete(m.requested, hash)
+	m.lock.Unlock()
+
+	return m.seen.Add(hash)
+}
+
+// Announce queues the item for every peer except the one it came from.
+// Only the newest block is announced, a peer missing its parents syncs them,
+// and blocks are flushed right away.
+func (m *GossipManager) Announce(item InvVect, except NetAddr) {
+	m.seen.Add(item.Hash)
+
+	full := map[NetAddr][]InvVect{}
+
+	m.lock.Lock()
+	for _, peer := range m.peers() {
+		if peer.Addr == except {
+			continue
+		}
+		m.queued[peer.Addr] = queueInv(m.queued[peer.Addr], item)
+		if len(m.queued[peer.Addr]) >= MaxInvPerMessage {
+			full[peer.Addr] = m.queued[peer.Addr]
+			delete(m.queued, peer.Addr)
+		}
+	}
+	m.lock.Unlock()
+
+	for addr, items := range full {
+		m.sendInv(addr, items)
+	}
+
+	if item.Type == InvTypeBlock {
+		m.Trigger()
+	}
+}
+
+// queueInv appends an item to the queue of a peer, a queued block is replaced.
+func queueInv(queue []InvVect, item InvVect) []InvVect {
+	if item.Type == InvTypeBlock {
+		for i := range queue {
+			if queue[i].Type == InvTypeBlock {
+				queue[i] = item
+				return queue
+			}
+		}
+	}
+	return append(queue, item)
+}
+
+// Trigger flushes the queued announcements soon.
+func (m *GossipManager) Trigger() {
+	select {
+	case m.triggerCh <- struct{}{}:
+	default:
+	}
+}
+
+// Flush sends the queued announcements.
+func (m *GossipManager) Flush() {
+	m.lock.Lock()
+	queued := m.queued
+	m.queued = map[NetAddr][]InvVect{}
+	m.lock.Unlock()
+
+	for addr, items := range queued {
+		m.sendInv(addr, items)
+	}
+}
+
+// Missing returns the announced items that are neither known nor requested
+// from another peer recently and marks them as requested.
+func (m *GossipManager) Missing(items []InvVect, now time.Time) []InvVect {
+	if len(items) > MaxInvPerMessage {
+		items = items[:MaxInvPerMessage]
+	}
+
+	missing := []InvVect{}
+	for _, item := range items {
+		if m.seen.Has(item.Hash) || m.has(item) {
+			continue
+		}
+
+		m.lock.Lock()
+		if len(m.requested) >= m.opts.SeenCacheSize {
+			m.expireRequests(now)
+		}
+		at, requested := m.requested[item.Hash]
+		wanted := requested && now.Sub(at) >= m.opts.GetDataTimeout ||
+			!requested && len(m.requested) < m.opts.SeenCacheSize
+		if wanted {
+			m.requested[item.Hash] = now
+		}
+		m.lock.Unlock()
+
+		if wanted {
+			missing = append(missing, item)
+		}
+	}
+
+	return missing
+}
+
+// expireRequests drops the requests that timed out, the caller must hold the
+// lock.
+func (m *GossipManager) expireRequests(now time.Time) {
+	for hash, at := range m.requested {
+		if now.Sub(at) >= m.opts.GetDataTimeout {
+			delete(m.requested, hash)
+		}
+	}
+}
+
+func (m *GossipManager) sendInv(to NetAddr, items []InvVect) {
+	msg, err := NewGobMessage(MessageTypeInv, &InvMessage{Items: items})
+	if err != nil {
+		return
+	}
+	if err := m.send(to, msg); err != nil {
+		_ = m.logger.Log("msg", "failed to announce inventory", "peer", to, "err", err)
+	}
+}
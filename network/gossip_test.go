@@ -0,0 +1,306 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go-blockchain/core"
+	"go-blockchain/crypto"
+	"go-blockchain/types"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeenCacheEvictsOldest(t *testing.T) {
+	c := NewSeenCache(3)
+
+	hashes := []types.Hash{{1}, {2}, {3}, {4}}
+	for _, h := range hashes[:3] {
+		assert.True(t, c.Add(h))
+	}
+	assert.False(t, c.Add(hashes[0]))
+
+	assert.True(t, c.Add(hashes[3]))
+	assert.Equal(t, 3, c.Len())
+	assert.False(t, c.Has(hashes[0]))
+	assert.True(t, c.Has(hashes[1]))
+	assert.True(t, c.Has(hashes[3]))
+}
+
+type sentInv struct {
+	to    NetAddr
+	items []InvVect
+}
+
+func newTestGossipManager(peers []PeerInfo, has func(InvVect) bool) (*GossipManager, *[]sentInv) {
+	lock := sync.Mutex{}
+	sent := []sentInv{}
+
+	send := func(to NetAddr, msg *Message) error {
+		inv := new(InvMessage)
+		if err := gob.NewDecoder(bytes.NewReader(msg.Data)).Decode(inv); err != nil {
+			return err
+		}
+		lock.Lock()
+		sent = append(sent, sentInv{to: to, items: inv.Items})
+		lock.Unlock()
+		return nil
+	}
+	peersFunc := func() []PeerInfo { return peers }
+
+	return NewGossipManager(send, peersFunc, has, GossipOpts{SeenCacheSize: 16}, log.NewNopLogger()), &sent
+}
+
+func TestGossipManagerAnnounce(t *testing.T) {
+	peers := []PeerInfo{{Addr: "A"}, {Addr: "B"}}
+	m, sent := newTestGossipManager(peers, func(InvVect) bool { return false })
+
+	tx1 := InvVect{Type: InvTypeTx, Hash: types.Hash{1}}
+	tx2 := InvVect{Type: InvTypeTx, Hash: types.Hash{2}}
+	block1 := InvVect{Type: InvTypeBlock, Hash: types.Hash{3}}
+	block2 := InvVect{Type: InvTypeBlock, Hash: types.Hash{4}}
+
+	// announcements are batched, the source of an item is skipped and only
+	// the newest block is sent
+	m.Announce(tx1, "A")
+	m.Announce(tx2, "")
+	m.Announce(block1, "")
+	m.Announce(block2, "")
+	assert.Empty(t, *sent)
+
+	m.Flush()
+	assert.ElementsMatch(t, []sentInv{
+		{to: "A", items: []InvVect{tx2, block2}},
+		{to: "B", items: []InvVect{tx1, tx2, block2}},
+	}, *sent)
+
+	m.Flush()
+	assert.Len(t, *sent, 2)
+	assert.True(t, m.Seen(tx1.Hash))
+}
+
+func TestGossipManagerMissing(t *testing.T) {
+	held := InvVect{Type: InvTypeTx, Hash: types.Hash{1}}
+	seen := InvVect{Type: InvTypeTx, Hash: types.Hash{2}}
+	missing := InvVect{Type: InvTypeBlock, Hash: types.Hash{3}}
+
+	m, _ := newTestGossipManager(nil, func(item InvVect) bool { return item == held })
+	m.MarkSeen(seen.Hash)
+
+	now := time.Now()
+	assert.Equal(t, []InvVect{missing}, m.Missing([]InvVect{held, seen, missing}, now))
+
+	// an item is requested from one peer at a time until the request times out
+	assert.Empty(t, m.Missing([]InvVect{missing}, now))
+	assert.Equal(t, []InvVect{missing}, m.Missing([]InvVect{missing}, now.Add(DefaultGetDataTimeout)))
+
+	m.MarkSeen(missing.Hash)
+	assert.Empty(t, m.Missing([]InvVect{missing}, now.Add(2*DefaultGetDataTimeout)))
+
+	// outstanding requests are capped by the size of the seen cache
+	items := make([]InvVect, 32)
+	for i := range items {
+		items[i] = InvVect{Type: InvTypeTx, Hash: types.Hash{0xff, byte(i)}}
+	}
+	assert.Len(t, m.Missing(items, now), 16)
+}
+
+// countingTransport counts the bytes and messages sent through a transport.
+type countingTransport struct {
+	Transport
+	bytes    *atomic.Int64
+	lock     sync.Mutex
+	messages map[MessageType]int
+}
+
+func newCountingTransport(tr Transport, bytes *atomic.Int64) *countingTransport {
+	return &countingTransport{Transport: tr, bytes: bytes, messages: map[MessageType]int{}}
+}
+
+func (t *countingTransport) SendMessage(to NetAddr, payload []byte) error {
+	msg := Message{}
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&msg); err == nil {
+		t.lock.Lock()
+		t.messages[msg.Header]++
+		t.lock.Unlock()
+	}
+
+	t.bytes.Add(int64(len(payload)))
+	return t.Transport.SendMessage(to, payload)
+}
+
+func (t *countingTransport) Broadcast(payload []byte) error {
+	for _, peer := range t.Peers() {
+		if err := t.SendMessage(peer.Addr, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *countingTransport) sent(mt MessageType) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.messages[mt]
+}
+
+func TestServersGossipTransactions(t *testing.T) {
+	// A - B - C, transactions of A reach C through B and never come back
+	sent := atomic.Int64{}
+	trs := make([]*countingTransport, 3)
+	servers := make([]*Server, 3)
+	for i, name := range []string{"gossip-A", "gossip-B", "gossip-C"} {
+		tr := NewLocalTransport(NetAddr(name))
+		t.Cleanup(func() { _ = tr.Close() })
+
+		trs[i] = newCountingTransport(tr, &sent)
+		servers[i] = newLocalServer(t, trs[i], false, ServerOpts{
+			// the outer nodes must not find each other through B
+			PeerOpts:   PeerManagerOpts{MaxOutbound: 1},
+			GossipOpts: GossipOpts{InvInterval: 10 * time.Millisecond},
+		})
+	}
+	assert.Nil(t, trs[0].Dial("gossip-B"))
+	assert.Nil(t, trs[2].Dial("gossip-B"))
+
+	for _, s := range servers {
+		startServer(t, s)
+	}
+
+	privKey := crypto.GeneratePrivateKey()
+	for nonce := uint64(0); nonce < 10; nonce++ {
+		assert.Nil(t, servers[0].proccessTransaction("", signedTransfer(t, privKey, 0, 10, nonce)))
+	}
+
+	for _, s := range servers {
+		assert.Eventually(t, func() bool {
+			return s.memPool.Len() == 10
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// every transaction crosses each link once
+	assert.Equal(t, 10, trs[0].sent(MessageTypeTx))
+	assert.Equal(t, 10, trs[1].sent(MessageTypeTx))
+	assert.Equal(t, 0, trs[2].sent(MessageTypeTx))
+	assert.Equal(t, 0, trs[2].sent(MessageTypeInv))
+}
+
+// floodingProccesor relays transactions the way the node did before the
+// inventory gossip, every new transaction is sent in full to every peer.
+type floodingProccesor struct {
+	*Server
+}
+
+func (p floodingProccesor) ProccessMessage(msg *DecodedMessage) error {
+	tx, ok := msg.Data.(*core.Transaction)
+	if !ok {
+		return p.Server.ProccessMessage(msg)
+	}
+
+	if p.memPool.Has(tx.Hash(core.TxHasher{})) {
+		return nil
+	}
+	if err := p.memPool.Add(tx); err != nil {
+		return err
+	}
+
+	out, err := newTxMessage(tx)
+	if err != nil {
+		return err
+	}
+	return p.broadcast(out.Bytes())
+}
+
+var meshBenchmarks atomic.Int32
+
+// benchmarkMeshRelay spreads transactions over a mesh of 20 nodes connected
+// to 8 peers each and reports the bytes sent per transaction.
+func benchmarkMeshRelay(b *testing.B, flooding bool) {
+	const (
+		nodes     = 20
+		txsPerRun = 100
+	)
+
+	prefix := fmt.Sprintf("bench-%d", meshBenchmarks.Add(1))
+	sent := atomic.Int64{}
+
+	servers := make([]*Server, nodes)
+	for i := range servers {
+		tr := NewLocalTransport(NetAddr(fmt.Sprintf("%s-%d", prefix, i)))
+		defer tr.Close()
+
+		s := newLocalServer(b, newCountingTransport(tr, &sent), false, ServerOpts{
+			PeerOpts: PeerManagerOpts{MaxOutbound: 4},
+			// the relay is measured, not the rate limits
+			PeerScoreOpts: PeerScoreOpts{RateLimits: map[MessageType]RateLimit{
+				MessageTypeTx:      {Rate: 1e6, Burst: 1e6},
+				MessageTypeInv:     {Rate: 1e6, Burst: 1e6},
+				MessageTypeGetData: {Rate: 1e6, Burst: 1e6},
+			}},
+			Logger: log.NewNopLogger(),
+		})
+		if flooding {
+			s.RPCProccesor = floodingProccesor{s}
+		}
+		servers[i] = s
+	}
+
+	for i := range servers {
+		for j := 1; j <= 4; j++ {
+			to := NetAddr(fmt.Sprintf("%s-%d", prefix, (i+j)%nodes))
+			if err := servers[i].Transports[0].Dial(to); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	for _, s := range servers {
+		startServer(b, s)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	b.ResetTimer()
+	sent.Store(0)
+
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		txs := make([]*core.Transaction, txsPerRun)
+		for i := range txs {
+			tx := core.NewTransferTransaction(types.Address{}, 10, 0)
+			if err := tx.Sign(crypto.GeneratePrivateKey()); err != nil {
+				b.Fatal(err)
+			}
+			txs[i] = tx
+		}
+		b.StartTimer()
+
+		for _, tx := range txs {
+			if err := servers[0].RPCProccesor.ProccessMessage(&DecodedMessage{Data: tx}); err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		want := (n + 1) * txsPerRun
+		for _, s := range servers {
+			for s.memPool.Len() < want {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+
+	b.ReportMetric(float64(sent.Load())/float64(b.N*txsPerRun), "bytes/tx")
+}
+
+func BenchmarkMeshRelayFlooding(b *testing.B) {
+	benchmarkMeshRelay(b, true)
+}
+
+func BenchmarkMeshRelayInventory(b *testing.B) {
+	benchmarkMeshRelay(b, false)
+}
@@ -0,0 +1,140 @@
+package network
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go-blockchain/core"
+	"go-blockchain/crypto"
+	"go-blockchain/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testSyncOpts = SyncOpts{
+	MaxHeadersPerRequest: 16,
+	MaxBlocksPerRequest:  4,
+	RequestTimeout:       200 * time.Millisecond,
+}
+
+func newTestServer(tb testing.TB, opts ServerOpts) *Server {
+	s, err := NewServer(opts)
+	assert.Nil(tb, err)
+	return s
+}
+
+// newLocalServer creates a server named after tr that only produces blocks
+// when the test calls produceBlock, a validator gets a key of its own. The
+// rest of the options are taken from opts.
+func newLocalServer(tb testing.TB, tr Transport, validator bool, opts ServerOpts) *Server {
+	opts.ID = string(tr.Addr())
+	opts.Transports = []Transport{tr}
+	opts.BlockTime = 1 << 62
+	if validator {
+		privKey := crypto.GeneratePrivateKey()
+		opts.PrivateKey = &privKey
+	}
+	return newTestServer(tb, opts)
+}
+
+func newSyncServer(t *testing.T, tr Transport, validator bool) *Server {
+	return newLocalServer(t, tr, validator, ServerOpts{SyncOpts: testSyncOpts})
+}
+
+// newAttackedServer starts a server and connects an attacking peer to it.
+func newAttackedServer(t *testing.T, name string, opts PeerScoreOpts) (*Server, Transport) {
+	tr := NewLocalTransport(NetAddr(name))
+	attacker := NewLocalTransport(NetAddr(name + "-attacker"))
+	t.Cleanup(func() {
+		_ = tr.Close()
+		_ = attacker.Close()
+	})
+
+	s := newLocalServer(t, tr, false, ServerOpts{PeerScoreOpts: opts})
+	startServer(t, s)
+
+	assert.Nil(t, attacker.Dial(tr.Addr()))
+	return s, attacker
+}
+
+// startServer runs the server until the test ends, it has to shut down
+// without an error.
+func startServer(tb testing.TB, s *Server) {
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Start(ctx)
+	}()
+
+	tb.Cleanup(func() {
+		cancel()
+		assert.Nil(tb, <-errCh)
+	})
+}
+
+func connect(t *testing.T, a, b Transport) {
+	assert.Nil(t, a.Connect(b))
+	assert.Nil(t, b.Connect(a))
+}
+
+// produceBlock signs a block of the mempool transactions on top of the tip
+// with the key of the server and adds it to its chain.
+func produceBlock(s *Server) error {
+	parent, err := s.chain.GetHeader(s.chain.Height())
+	if err != nil {
+		return err
+	}
+
+	block, err := s.BuildBlock(parent, s.PrivateKey.PublicKey().Address())
+	if err != nil {
+		return err
+	}
+	if err := block.Sign(*s.PrivateKey); err != nil {
+		return err
+	}
+
+	return s.chain.AddBlock(block)
+}
+
+// produceBlocks creates n blocks and waits for their broadcasts to finish, so
+// peers connected afterwards only learn about them through sync.
+func produceBlocks(t *testing.T, s *Server, n int) {
+	for i := 0; i < n; i++ {
+		assert.Nil(t, produceBlock(s))
+	}
+	time.Sleep(100 * time.Millisecond)
+}
+
+func tipHash(t *testing.T, s *Server) types.Hash {
+	header, err := s.chain.GetHeader(s.chain.Height())
+	assert.Nil(t, err)
+	return core.BlockHasher{}.Hash(header)
+}
+
+func assertSynced(t *testing.T, s *Server, height uint32, tip types.Hash) {
+	assert.Eventually(t, func() bool {
+		if s.chain.Height() != height {
+			return false
+		}
+		h, err := s.chain.GetHeader(height)
+		return err == nil && core.BlockHasher{}.Hash(h) == tip
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+// signedTransfer returns a transfer of value to a new address, signed by
+// privKey for the chain chainID.
+func signedTransfer(tb testing.TB, privKey crypto.PrivateKey, chainID, value, nonce uint64) *core.Transaction {
+	tx := core.NewTransferTransaction(crypto.GeneratePrivateKey().PublicKey().Address(), value, nonce)
+	tx.ChainID = chainID
+	assert.Nil(tb, tx.Sign(privKey))
+	return tx
+}
+
+// feeTransfer is a signedTransfer paying fee.
+func feeTransfer(tb testing.TB, privKey crypto.PrivateKey, value, fee, nonce uint64) *core.Transaction {
+	tx := signedTransfer(tb, privKey, 0, value, nonce)
+	tx.Fee = fee
+	assert.Nil(tb, tx.Sign(privKey))
+	return tx
+}
@@ -3,24 +3,46 @@ package network
 import (
 	"bytes"
 	"fmt"
+	"sort"
 	"sync"
 )
 
+// localTransports holds every open LocalTransport so they can be dialed by address
+var localTransports = struct {
+	lock       sync.RWMutex
+	transports map[NetAddr]*LocalTransport
+}{
+	transports: make(map[NetAddr]*LocalTransport),
+}
+
 // LocalTransport implements Transport interface and is being used as a temporary local solution
 type LocalTransport struct {
 	addr      NetAddr
 	peers     map[NetAddr]*LocalTransport
+	outbound  map[NetAddr]bool
 	lock      sync.RWMutex
 	consumeCh chan RPC
+	closed    bool
+	quitCh    chan struct{}
+	closeOnce sync.Once
 }
 
-// NewLocalTransport returns a new instance of LocalTransport
+// NewLocalTransport returns a new instance of LocalTransport, it replaces an
+// open transport with the same address for dialing
 func NewLocalTransport(addr NetAddr) Transport {
-	return &LocalTransport{
+	t := &LocalTransport{
 		addr:      addr,
 		peers:     make(map[NetAddr]*LocalTransport),
+		outbound:  make(map[NetAddr]bool),
 		consumeCh: make(chan RPC, 1024),
+		quitCh:    make(chan struct{}),
 	}
+
+	localTransports.lock.Lock()
+	localTransports.transports[addr] = t
+	localTransports.lock.Unlock()
+
+	return t
 }
 
 // Consume returns a channel that can be used to consume RPC messages
@@ -30,36 +52,127 @@ func (t *LocalTransport) Consume() <-chan RPC {
 
 // Connect adds a peer to the list of connected peers
 func (t *LocalTransport) Connect(tr Transport) error {
+	peer, ok := tr.(*LocalTransport)
+	if !ok {
+		return fmt.Errorf("%s: cannot connect to %T", t.addr, tr)
+	}
+
 	t.lock.Lock()
 	defer t.lock.Unlock()
 
-	t.peers[tr.Addr()] = tr.(*LocalTransport)
+	t.peers[tr.Addr()] = peer
+	t.outbound[tr.Addr()] = true
 
 	return nil
 }
 
-// SendMessage sends a message to a peer by address
-func (t *LocalTransport) SendMessage(to NetAddr, payload []byte) error {
+// Dial connects to the open local transport with the given address in both
+// directions, like a connection over a socket
+func (t *LocalTransport) Dial(addr NetAddr) error {
+	localTransports.lock.RLock()
+	peer, ok := localTransports.transports[addr]
+	localTransports.lock.RUnlock()
+
+	if !ok || peer == t {
+		return fmt.Errorf("%s: could not dial %s", t.addr, addr)
+	}
+
+	if err := t.Connect(peer); err != nil {
+		return err
+	}
+
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+
+	if peer.closed {
+		return fmt.Errorf("%s: could not dial %s: %w", t.addr, addr, ErrTransportClosed)
+	}
+	peer.peers[t.addr] = t
+
+	return nil
+}
+
+// Disconnect removes the peer on both sides
+func (t *LocalTransport) Disconnect(addr NetAddr) error {
+	t.lock.Lock()
+	peer, ok := t.peers[addr]
+	delete(t.peers, addr)
+	delete(t.outbound, addr)
+	t.lock.Unlock()
+
+	if !ok {
+		return fmt.Errorf("%s: not connected to %s", t.addr, addr)
+	}
+
+	peer.lock.Lock()
+	if peer.peers[t.addr] == t {
+		delete(peer.peers, t.addr)
+		delete(peer.outbound, t.addr)
+	}
+	peer.lock.Unlock()
+
+	return nil
+}
+
+// Peers returns the connected peers sorted by address
+func (t *LocalTransport) Peers() []PeerInfo {
 	t.lock.RLock()
 	defer t.lock.RUnlock()
 
+	peers := make([]PeerInfo, 0, len(t.peers))
+	for addr := range t.peers {
+		peers = append(peers, PeerInfo{Addr: addr, Outbound: t.outbound[addr]})
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Addr < peers[j].Addr
+	})
+
+	return peers
+}
+
+// SendMessage sends a message to a peer by address
+func (t *LocalTransport) SendMessage(to NetAddr, payload []byte) error {
+	t.lock.RLock()
 	peer, ok := t.peers[to]
+	t.lock.RUnlock()
+
 	if !ok {
 		return fmt.Errorf("%s: could not send message to %s", t.addr, to)
 	}
 
-	peer.consumeCh <- RPC{
+	return peer.deliver(RPC{
 		From:    t.addr,
 		Payload: bytes.NewReader(payload),
+	})
+}
+
+func (t *LocalTransport) deliver(rpc RPC) error {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	if t.closed {
+		return fmt.Errorf("%s: %w", t.addr, ErrTransportClosed)
 	}
 
-	return nil
+	select {
+	case t.consumeCh <- rpc:
+		return nil
+	case <-t.quitCh:
+		return fmt.Errorf("%s: %w", t.addr, ErrTransportClosed)
+	}
 }
 
 // Broadcast sends a message to all connected peers
 func (t *LocalTransport) Broadcast(payload []byte) error {
-	for _, peer := range t.peers {
-		if err := t.SendMessage(peer.addr, payload); err != nil {
+	t.lock.RLock()
+	peers := make([]NetAddr, 0, len(t.peers))
+	for addr := range t.peers {
+		peers = append(peers, addr)
+	}
+	t.lock.RUnlock()
+
+	for _, addr := range peers {
+		if err := t.SendMessage(addr, payload); err != nil {
 			return err
 		}
 	}
@@ -71,3 +184,28 @@ func (t *LocalTransport) Broadcast(payload []byte) error {
 func (t *LocalTransport) Addr() NetAddr {
 	return t.addr
 }
+
+// Close closes the consume channel and disconnects all peers, messages sent
+// to a closed transport fail.
+func (t *LocalTransport) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.quitCh)
+
+		localTransports.lock.Lock()
+		if localTransports.transports[t.addr] == t {
+			delete(localTransports.transports, t.addr)
+		}
+		localTransports.lock.Unlock()
+
+		for _, peer := range t.Peers() {
+			_ = t.Disconnect(peer.Addr)
+		}
+
+		t.lock.Lock()
+		t.closed = true
+		close(t.consumeCh)
+		t.lock.Unlock()
+	})
+
+	return nil
+}
@@ -0,0 +1,381 @@
+package network
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+const (
+	DefaultMaxOutboundPeers  = 8
+	DefaultMaxInboundPeers   = 32
+	DefaultPeerCheckInterval = 5 * time.Second
+	DefaultMaxDialBackoff    = 10 * time.Minute
+	MaxPeersPerMessage       = 64
+)
+
+type PeerManagerOpts struct {
+	// Bootstrap addresses are dialed first and never dropped from the book
+	Bootstrap []NetAddr
+	// AddrBookPath persists the address book, it is kept in memory if empty
+	AddrBookPath    string
+	MaxAddrBookSize int
+	// MaxOutbound is the number of peers dialed, MaxInbound the number of
+	// accepted peers kept
+	MaxOutbound int
+	MaxInbound  int
+	// CheckInterval is how often peers are counted and dialed, it is also the
+	// backoff after the first failed dial of an address
+	CheckInterval  time.Duration
+	MaxDialBackoff time.Duration
+}
+
+// PeerHandler is called when a peer connects or disconnects, tr is the
+// transport the peer is connected on.
+type PeerHandler func(addr NetAddr, tr Transport)
+
+// PeerManager keeps the node connected to the network. It dials addresses
+// from the AddrBook until MaxOutbound peers are connected, drops inbound
+// peers above MaxInbound and fills the book by asking peers for theirs.
+// Connections made and lost by the transports are noticed by polling their
+// Peers.
+type PeerManager struct {
+	opts       PeerManagerOpts
+	transports []Transport
+	book       *AddrBook
+	send       SyncSendFunc
+	logger     log.Logger
+
+	lock         sync.Mutex
+	connected    map[NetAddr]Transport
+	excluded     []func(NetAddr) bool
+	onConnect    []PeerHandler
+	onDisconnect []PeerHandler
+
+	triggerCh chan struct{}
+}
+
+// NewPeerManager manages the peers of the transports, new peers are dialed
+// on the first one. send is used for the peer exchange.
+func NewPeerManager(transports []Transport, send SyncSendFunc, opts PeerManagerOpts, logger log.Logger) (*PeerManager, error) {
+	if opts.MaxOutbound == 0 {
+		opts.MaxOutbound = DefaultMaxOutboundPeers
+	}
+	if opts.MaxInbound == 0 {
+		opts.MaxInbound = DefaultMaxInboundPeers
+	}
+	if opts.CheckInterval == 0 {
+		opts.CheckInterval = DefaultPeerCheckInterval
+	}
+	if opts.MaxDialBackoff == 0 {
+		opts.MaxDialBackoff = DefaultMaxDialBackoff
+	}
+
+	book, err := NewAddrBook(opts.AddrBookPath, opts.MaxAddrBookSize)
+	if err != nil {
+		return nil, err
+	}
+	book.AddBootstrap(opts.Bootstrap...)
+
+	return &PeerManager{
+		opts:       opts,
+		transports: transports,
+		book:       book,
+		send:       send,
+		logger:     logger,
+		connected:  map[NetAddr]Transport{},
+		triggerCh:  make(chan struct{}, 1),
+	}, nil
+}
+
+// OnConnect registers a handler called for every new peer.
+func (m *PeerManager) OnConnect(h PeerHandler) {
+	m.onConnect = append(m.onConnect, h)
+}
+
+// Exclude registers a filter for addresses that must not be learned or dialed.
+func (m *PeerManager) Exclude(fn func(NetAddr) bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.excluded = append(m.excluded, fn)
+}
+
+// OnDisconnect registers a handler called for every lost peer.
+func (m *PeerManager) OnDisconnect(h PeerHandler) {
+	m.onDisconnect = append(m.onDisconnect, h)
+}
+
+func (m *PeerManager) AddrBook() *AddrBook {
+	return m.book
+}
+
+// Peers returns the connected peers of all transports.
+func (m *PeerManager) Peers() []PeerInfo {
+	peers := []PeerInfo{}
+	for _, tr := range m.transports {
+		peers = append(peers, tr.Peers()...)
+	}
+	return peers
+}
+
+// Loop checks the peers every CheckInterval or when triggered until ctx is
+// done, the address book is saved one last time on the way out.
+func (m *PeerManager) Loop(ctx context.Context) {
+	ticker := time.NewTicker(m.opts.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		m.check()
+
+		select {
+		case <-ticker.C:
+		case <-m.triggerCh:
+		case <-ctx.Done():
+			if err := m.book.Save(); err != nil {
+				_ = m.logger.Log("msg", "failed to save address book", "err", err)
+			}
+			return
+		}
+	}
+}
+
+// Trigger runs a check of the peers soon.
+func (m *PeerManager) Trigger() {
+	select {
+	case m.triggerCh <- struct{}{}:
+	default:
+	}
+}
+
+// AddAddrs adds the addresses a peer sent in a PeersMessage to the book,
+// the own and excluded addresses are skipped.
+func (m *PeerManager) AddAddrs(from NetAddr, addrs []NetAddr) int {
+	if len(addrs) > MaxPeersPerMessage {
+		addrs = addrs[:MaxPeersPerMessage]
+	}
+
+	m.lock.Lock()
+	wanted := make([]NetAddr, 0, len(addrs))
+	for _, addr := range addrs {
+		if !m.isSelf(addr) && !m.isExcluded(addr) {
+			wanted = append(wanted, addr)
+		}
+	}
+	m.lock.Unlock()
+
+	added := m.book.Add(wanted...)
+	if added > 0 {
+		_ = m.logger.Log("msg", "learned peer addresses", "from", from, "added", added)
+		m.Trigger()
+	}
+	return added
+}
+
+// PeerAddrs returns the addresses to answer a GetPeersMessage of a peer with,
+// the connected peers first, then the most recently seen ones from the book.
+func (m *PeerManager) PeerAddrs(to NetAddr) []NetAddr {
+	seen := map[NetAddr]bool{to: true}
+	addrs := []NetAddr{}
+
+	add := func(addr NetAddr) {
+		if !seen[addr] && len(addrs) < MaxPeersPerMessage {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+
+	for _, peer := range m.Peers() {
+		add(peer.Addr)
+	}
+	for _, addr := range m.book.Recent(MaxPeersPerMessage) {
+		add(addr)
+	}
+
+	return addrs
+}
+
+// Disconnect closes the connection to a peer, the address stays in the book.
+func (m *PeerManager) Disconnect(addr NetAddr) {
+	for _, tr := range m.transports {
+		_ = tr.Disconnect(addr)
+	}
+	m.Trigger()
+}
+
+// Forget disconnects a peer and removes it from the address book.
+func (m *PeerManager) Forget(addr NetAddr) {
+	m.book.Remove(addr)
+	m.Disconnect(addr)
+}
+
+func (m *PeerManager) check() {
+	m.refresh()
+	m.dropInbound()
+	m.dialOutbound()
+	m.exchange()
+
+	if err := m.book.Save(); err != nil {
+		_ = m.logger.Log("msg", "failed to save address book", "err", err)
+	}
+}
+
+// refresh compares the peers of the transports with the known ones and calls
+// the handlers for the difference.
+func (m *PeerManager) refresh() {
+	current := map[NetAddr]Transport{}
+	for _, tr := range m.transports {
+		for _, peer := range tr.Peers() {
+			current[peer.Addr] = tr
+		}
+	}
+
+	m.lock.Lock()
+	connected, disconnected := map[NetAddr]Transport{}, map[NetAddr]Transport{}
+	for addr, tr := range current {
+		if _, ok := m.connected[addr]; !ok {
+			connected[addr] = tr
+		}
+	}
+	for addr, tr := range m.connected {
+		if _, ok := current[addr]; !ok {
+			disconnected[addr] = tr
+		}
+	}
+	m.connected = current
+	m.lock.Unlock()
+
+	now := time.Now()
+	for addr, tr := range connected {
+		m.book.MarkConnected(addr, now)
+		_ = m.logger.Log("msg", "peer connected", "peer", addr)
+		for _, h := range m.onConnect {
+			h(addr, tr)
+		}
+	}
+	for addr, tr := range disconnected {
+		_ = m.logger.Log("msg", "peer disconnected", "peer", addr)
+		for _, h := range m.onDisconnect {
+			h(addr, tr)
+		}
+	}
+}
+
+func (m *PeerManager) dropInbound() {
+	for _, tr := range m.transports {
+		inbound := []NetAddr{}
+		for _, peer := range tr.Peers() {
+			if !peer.Outbound {
+				inbound = append(inbound, peer.Addr)
+			}
+		}
+
+		for len(inbound) > m.opts.MaxInbound {
+			i := rand.Intn(len(inbound))
+			_ = m.logger.Log("msg", "dropping inbound peer", "peer", inbound[i])
+			_ = tr.Disconnect(inbound[i])
+			inbound = append(inbound[:i], inbound[i+1:]...)
+		}
+	}
+
+	m.refresh()
+}
+
+// dialOutbound dials addresses from the book in parallel until the outbound
+// peers reach the target.
+func (m *PeerManager) dialOutbound() {
+	if len(m.transports) == 0 {
+		return
+	}
+
+	outbound := 0
+	for _, peer := range m.Peers() {
+		if peer.Outbound {
+			outbound++
+		}
+	}
+	if outbound >= m.opts.MaxOutbound {
+		return
+	}
+
+	now := time.Now()
+	m.lock.Lock()
+	candidates := m.book.Candidates(m.opts.MaxOutbound-outbound, now, m.opts.CheckInterval, m.opts.MaxDialBackoff, func(addr NetAddr) bool {
+		_, ok := m.connected[addr]
+		return ok || m.isSelf(addr) || m.isExcluded(addr)
+	})
+	m.lock.Unlock()
+
+	if len(candidates) == 0 {
+		return
+	}
+
+	tr := m.transports[0]
+	wg := sync.WaitGroup{}
+	for _, addr := range candidates {
+		m.book.MarkAttempt(addr, now)
+
+		wg.Add(1)
+		go func(addr NetAddr) {
+			defer wg.Done()
+			if err := tr.Dial(addr); err != nil {
+				m.book.MarkFailed(addr)
+				_ = m.logger.Log("msg", "failed to dial peer", "peer", addr, "err", err)
+			}
+		}(addr)
+	}
+	wg.Wait()
+
+	m.refresh()
+}
+
+// exchange asks a random peer for more addresses while the node is below its
+// outbound target.
+func (m *PeerManager) exchange() {
+	outbound, peers := 0, m.Peers()
+	for _, peer := range peers {
+		if peer.Outbound {
+			outbound++
+		}
+	}
+
+	if len(peers) == 0 || outbound >= m.opts.MaxOutbound {
+		return
+	}
+
+	peer := peers[rand.Intn(len(peers))].Addr
+	if err := m.RequestPeers(peer); err != nil {
+		_ = m.logger.Log("msg", "failed to request peers", "peer", peer, "err", err)
+	}
+}
+
+// RequestPeers sends a GetPeersMessage to a peer.
+func (m *PeerManager) RequestPeers(peer NetAddr) error {
+	msg, err := NewGobMessage(MessageTypeGetPeers, &GetPeersMessage{})
+	if err != nil {
+		return err
+	}
+	return m.send(peer, msg)
+}
+
+// isExcluded applies the filters, the caller must hold the lock.
+func (m *PeerManager) isExcluded(addr NetAddr) bool {
+	for _, fn := range m.excluded {
+		if fn(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSelf reports whether addr is the address of one of the transports.
+func (m *PeerManager) isSelf(addr NetAddr) bool {
+	for _, tr := range m.transports {
+		if tr.Addr() == addr {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,168 @@
+package network
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestPeerManager(t *testing.T, tr Transport, opts PeerManagerOpts) *PeerManager {
+	send := func(to NetAddr, msg *Message) error {
+		return tr.SendMessage(to, msg.Bytes())
+	}
+	m, err := NewPeerManager([]Transport{tr}, send, opts, log.NewNopLogger())
+	assert.Nil(t, err)
+	return m
+}
+
+func countPeers(peers []PeerInfo) (inbound, outbound int) {
+	for _, peer := range peers {
+		if peer.Outbound {
+			outbound++
+		} else {
+			inbound++
+		}
+	}
+	return inbound, outbound
+}
+
+func TestLocalTransportDial(t *testing.T) {
+	tra := NewLocalTransport("dial-A")
+	trb := NewLocalTransport("dial-B")
+
+	assert.NotNil(t, tra.Dial("dial-unknown"))
+	assert.Nil(t, tra.Dial(trb.Addr()))
+	assert.Equal(t, []PeerInfo{{Addr: "dial-B", Outbound: true}}, tra.Peers())
+	assert.Equal(t, []PeerInfo{{Addr: "dial-A", Outbound: false}}, trb.Peers())
+
+	assert.Nil(t, trb.Disconnect(tra.Addr()))
+	assert.Empty(t, tra.Peers())
+	assert.Empty(t, trb.Peers())
+
+	assert.Nil(t, tra.Dial(trb.Addr()))
+	assert.Nil(t, trb.Close())
+	assert.Empty(t, tra.Peers())
+	assert.NotNil(t, tra.Dial(trb.Addr()))
+}
+
+func TestTCPTransportPeers(t *testing.T) {
+	tra := newTCPTransport(t, TCPTransportOpts{})
+	trb := newTCPTransport(t, TCPTransportOpts{})
+
+	assert.Nil(t, tra.Dial(trb.Addr()))
+	assert.Equal(t, []PeerInfo{{Addr: trb.Addr(), ID: "127.0.0.1", Outbound: true}}, tra.Peers())
+	assert.Equal(t, []PeerInfo{{Addr: tra.Addr(), ID: "127.0.0.1", Outbound: false}}, trb.Peers())
+
+	// a disconnected peer is not redialed
+	assert.Nil(t, tra.Disconnect(trb.Addr()))
+	assert.Empty(t, tra.Peers())
+	assert.Eventually(t, func() bool {
+		return len(trb.Peers()) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	time.Sleep(3 * DefaultMinReconnectDelay)
+	assert.Empty(t, tra.Peers())
+}
+
+func TestPeerManagerDialsBootstrapAndRedials(t *testing.T) {
+	tra := NewLocalTransport("redial-A")
+	trb := NewLocalTransport("redial-B")
+
+	m := newTestPeerManager(t, tra, PeerManagerOpts{Bootstrap: []NetAddr{"redial-B"}})
+
+	var connects, disconnects atomic.Int32
+	m.OnConnect(func(NetAddr, Transport) { connects.Add(1) })
+	m.OnDisconnect(func(NetAddr, Transport) { disconnects.Add(1) })
+
+	m.check()
+	assert.Equal(t, []PeerInfo{{Addr: "redial-B", Outbound: true}}, tra.Peers())
+	assert.Equal(t, int32(1), connects.Load())
+
+	// the peer drops the connection, it is noticed and dialed again
+	assert.Nil(t, trb.Disconnect(tra.Addr()))
+	m.check()
+	assert.Equal(t, int32(1), disconnects.Load())
+	assert.Equal(t, int32(2), connects.Load())
+	assert.Len(t, tra.Peers(), 1)
+}
+
+func TestPeerManagerLimitsInbound(t *testing.T) {
+	tr := NewLocalTransport("inbound-hub")
+	m := newTestPeerManager(t, tr, PeerManagerOpts{MaxInbound: 2})
+
+	for i := 0; i < 5; i++ {
+		peer := NewLocalTransport(NetAddr(fmt.Sprintf("inbound-%d", i)))
+		assert.Nil(t, peer.Dial(tr.Addr()))
+	}
+
+	inbound, _ := countPeers(tr.Peers())
+	assert.Equal(t, 5, inbound)
+
+	m.check()
+	inbound, _ = countPeers(tr.Peers())
+	assert.Equal(t, 2, inbound)
+}
+
+func TestPeerManagerAddAddrs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers.json")
+	tr := NewLocalTransport("book-A")
+	m := newTestPeerManager(t, tr, PeerManagerOpts{AddrBookPath: path})
+
+	addrs := []NetAddr{tr.Addr(), "book-B", "book-C"}
+	for i := 0; i < 2*MaxPeersPerMessage; i++ {
+		addrs = append(addrs, NetAddr(fmt.Sprintf("book-%d", i)))
+	}
+
+	// the own address is skipped and the message is capped
+	assert.Equal(t, MaxPeersPerMessage-1, m.AddAddrs("book-B", addrs))
+	assert.False(t, m.AddrBook().Has(tr.Addr()))
+
+	m.Exclude(func(addr NetAddr) bool { return addr == "book-C" })
+	m.Forget("book-C")
+	assert.Equal(t, 0, m.AddAddrs("book-B", []NetAddr{"book-C"}))
+
+	m.check()
+	reloaded := newTestPeerManager(t, tr, PeerManagerOpts{AddrBookPath: path})
+	assert.Equal(t, MaxPeersPerMessage-2, reloaded.AddrBook().Len())
+}
+
+// TestServersFormMesh starts nodes that only know a single bootstrap node,
+// the peer exchange has to connect them into a mesh that relays blocks.
+func TestServersFormMesh(t *testing.T) {
+	const nodes = 20
+
+	peerOpts := PeerManagerOpts{
+		Bootstrap:     []NetAddr{"mesh-0"},
+		MaxOutbound:   4,
+		CheckInterval: 20 * time.Millisecond,
+	}
+
+	servers := make([]*Server, nodes)
+	for i := range servers {
+		tr := NewLocalTransport(NetAddr(fmt.Sprintf("mesh-%d", i)))
+		t.Cleanup(func() { _ = tr.Close() })
+
+		servers[i] = newLocalServer(t, tr, i == nodes-1, ServerOpts{SyncOpts: testSyncOpts, PeerOpts: peerOpts})
+		startServer(t, servers[i])
+	}
+
+	// every node learns about others through the peer exchange, the
+	// bootstrap node itself is only dialed
+	for _, s := range servers[1:] {
+		assert.Eventually(t, func() bool {
+			_, outbound := countPeers(s.peerManager.Peers())
+			return outbound >= peerOpts.MaxOutbound
+		}, 10*time.Second, 10*time.Millisecond, "node %s", s.ID)
+	}
+
+	validator := servers[nodes-1]
+	produceBlocks(t, validator, 3)
+	for _, s := range servers {
+		assertSynced(t, s, 3, tipHash(t, validator))
+	}
+}
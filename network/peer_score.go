@@ -0,0 +1,364 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultBanThreshold          = 100
+	DefaultBanDuration           = time.Hour
+	DefaultMaxTempBans           = 3
+	DefaultScoreRecoveryInterval = time.Minute
+)
+
+var (
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrInvalidBlock     = errors.New("invalid block")
+)
+
+// Offense is a misbehaviour of a peer that lowers its score.
+type Offense byte
+
+const (
+	OffenseUndecodable Offense = iota + 1
+	OffenseInvalidSignature
+	OffenseInvalidBlock
+	OffenseOversize
+	OffenseRateLimited
+	OffenseFutureBlock
+)
+
+func (o Offense) String() string {
+	switch o {
+	case OffenseUndecodable:
+		return "undecodable message"
+	case OffenseInvalidSignature:
+		return "invalid signature"
+	case OffenseInvalidBlock:
+		return "invalid block"
+	case OffenseOversize:
+		return "oversize message"
+	case OffenseRateLimited:
+		return "rate limited"
+	case OffenseFutureBlock:
+		return "block from the future"
+	default:
+		return fmt.Sprintf("offense %d", o)
+	}
+}
+
+// DefaultPenalties is how much each offense lowers the score of a peer.
+var DefaultPenalties = map[Offense]int{
+	OffenseUndecodable:      20,
+	OffenseInvalidSignature: 25,
+	OffenseInvalidBlock:     50,
+	OffenseOversize:         50,
+	OffenseRateLimited:      2,
+	OffenseFutureBlock:      5,
+}
+
+// RateLimit is a token bucket refilled with Rate tokens per second up to Burst.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// DefaultRateLimits limits the messages a single peer may send per type.
+var DefaultRateLimits = map[MessageType]RateLimit{
+	MessageTypeTx:         {Rate: 200, Burst: 1000},
+	MessageTypeBlock:      {Rate: 20, Burst: 100},
+	MessageTypeGetStatus:  {Rate: 5, Burst: 20},
+	MessageTypeStatus:     {Rate: 5, Burst: 20},
+	MessageTypeGetHeaders: {Rate: 20, Burst: 50},
+	MessageTypeHeaders:    {Rate: 20, Burst: 50},
+	MessageTypeGetBlocks:  {Rate: 50, Burst: 100},
+	MessageTypeBlocks:     {Rate: 50, Burst: 100},
+	MessageTypeGetPeers:   {Rate: 2, Burst: 10},
+	MessageTypePeers:      {Rate: 2, Burst: 10},
+	MessageTypeInv:        {Rate: 100, Burst: 400},
+	MessageTypeGetData:    {Rate: 100, Burst: 400},
+	MessageTypeConsensus:  {Rate: 200, Burst: 1000},
+}
+
+type PeerScoreOpts struct {
+	// BanThreshold is the negative score at which a peer is banned
+	BanThreshold int
+	// BanDuration is the length of a temporary ban, a peer banned more than
+	// MaxTempBans times is banned permanently
+	BanDuration time.Duration
+	MaxTempBans int
+	// ScoreRecoveryInterval is the time after which one point of a lowered
+	// score is restored
+	ScoreRecoveryInterval time.Duration
+	// MaxMessageSize caps the size of a single message
+	MaxMessageSize int
+	// Penalties and RateLimits replace the defaults per offense and message type
+	Penalties  map[Offense]int
+	RateLimits map[MessageType]RateLimit
+}
+
+// Ban is a banned peer, a zero Until means the ban is permanent. The ban
+// applies to the identity ID of the peer, see PeerInfo, Addr is the address it
+// was banned under.
+type Ban struct {
+	Addr   NetAddr
+	ID     string
+	Until  time.Time
+	Reason string
+}
+
+func (b Ban) Permanent() bool {
+	return b.Until.IsZero()
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type peerScore struct {
+	score   int
+	updated time.Time
+	buckets map[MessageType]*tokenBucket
+}
+
+// PeerScorer keeps a reputation score per peer. Offenses lower the score and
+// a peer whose score reaches -BanThreshold is banned, the score slowly
+// recovers over time. It also rate limits the messages of every peer per
+// message type.
+//
+// Scores are kept per connected peer and dropped when it disconnects. Bans
+// and the number of temporary bans are kept per identity, so a peer cannot
+// escape them by reconnecting under another address.
+type PeerScorer struct {
+	opts PeerScoreOpts
+
+	lock     sync.Mutex
+	scores   map[NetAddr]*peerScore
+	bans     map[string]Ban
+	tempBans map[string]int
+}
+
+func NewPeerScorer(opts PeerScoreOpts) *PeerScorer {
+	if opts.BanThreshold == 0 {
+		opts.BanThreshold = DefaultBanThreshold
+	}
+	if opts.BanDuration == 0 {
+		opts.BanDuration = DefaultBanDuration
+	}
+	if opts.MaxTempBans == 0 {
+		opts.MaxTempBans = DefaultMaxTempBans
+	}
+	if opts.ScoreRecoveryInterval == 0 {
+		opts.ScoreRecoveryInterval = DefaultScoreRecoveryInterval
+	}
+	if opts.MaxMessageSize == 0 {
+		opts.MaxMessageSize = DefaultMaxMessageSize
+	}
+
+	penalties := make(map[Offense]int, len(DefaultPenalties))
+	for o, p := range DefaultPenalties {
+		penalties[o] = p
+	}
+	for o, p := range opts.Penalties {
+		penalties[o] = p
+	}
+	opts.Penalties = penalties
+
+	limits := make(map[MessageType]RateLimit, len(DefaultRateLimits))
+	for t, l := range DefaultRateLimits {
+		limits[t] = l
+	}
+	for t, l := range opts.RateLimits {
+		limits[t] = l
+	}
+	opts.RateLimits = limits
+
+	return &PeerScorer{
+		opts:     opts,
+		scores:   map[NetAddr]*peerScore{},
+		bans:     map[string]Ban{},
+		tempBans: map[string]int{},
+	}
+}
+
+// Penalize lowers the score of the peer at addr with the identity id for an
+// offense, it returns the ban if the peer got banned.
+func (s *PeerScorer) Penalize(addr NetAddr, id string, offense Offense, now time.Time) (Ban, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if ban, ok := s.activeBan(id, now); ok {
+		return ban, false
+	}
+
+	ps := s.peer(addr, now)
+	ps.score -= s.opts.Penalties[offense]
+	if ps.score > -s.opts.BanThreshold {
+		return Ban{}, false
+	}
+
+	s.tempBans[id]++
+	ps.score = 0
+	reason := fmt.Sprintf("score reached %d after %s", -s.opts.BanThreshold, offense)
+	if s.tempBans[id] > s.opts.MaxTempBans {
+		return s.ban(addr, id, 0, reason, now), true
+	}
+	return s.ban(addr, id, s.opts.BanDuration, reason, now), true
+}
+
+// Allow takes a token from the bucket of the peer for the message type, types
+// without a limit are always allowed.
+func (s *PeerScorer) Allow(addr NetAddr, t MessageType, now time.Time) bool {
+	limit, ok := s.opts.RateLimits[t]
+	if !ok {
+		return true
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ps := s.peer(addr, now)
+	bucket, ok := ps.buckets[t]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), last: now}
+		ps.buckets[t] = bucket
+	}
+
+	elapsed := now.Sub(bucket.last).Seconds()
+	if elapsed > 0 {
+		bucket.tokens = min(float64(limit.Burst), bucket.tokens+elapsed*limit.Rate)
+		bucket.last = now
+	}
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// Score returns the current score of a peer, zero is the best score.
+func (s *PeerScorer) Score(addr NetAddr, now time.Time) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.scores[addr]; !ok {
+		return 0
+	}
+	return s.peer(addr, now).score
+}
+
+// Retain drops the scores of the peers that are no longer connected, their
+// bans are kept.
+func (s *PeerScorer) Retain(connected []PeerInfo) {
+	keep := make(map[NetAddr]bool, len(connected))
+	for _, peer := range connected {
+		keep[peer.Addr] = true
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for addr := range s.scores {
+		if !keep[addr] {
+			delete(s.scores, addr)
+		}
+	}
+}
+
+// Ban bans the peer at addr with the identity id for a duration, zero bans
+// it permanently.
+func (s *PeerScorer) Ban(addr NetAddr, id string, d time.Duration, reason string, now time.Time) Ban {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.ban(addr, id, d, reason, now)
+}
+
+func (s *PeerScorer) ban(addr NetAddr, id string, d time.Duration, reason string, now time.Time) Ban {
+	ban := Ban{Addr: addr, ID: id, Reason: reason}
+	if d > 0 {
+		ban.Until = now.Add(d)
+	}
+	s.bans[id] = ban
+	return ban
+}
+
+// Unban lifts the bans of the identity id and those issued under addr, and
+// resets the score of the peer.
+func (s *PeerScorer) Unban(addr NetAddr, id string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ok := false
+	for banned, ban := range s.bans {
+		if banned == id || ban.Addr == addr {
+			delete(s.bans, banned)
+			delete(s.tempBans, banned)
+			ok = true
+		}
+	}
+	delete(s.scores, addr)
+	return ok
+}
+
+// IsBanned reports whether the identity id is banned.
+func (s *PeerScorer) IsBanned(id string, now time.Time) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, ok := s.activeBan(id, now)
+	return ok
+}
+
+// Bans returns the active bans sorted by address.
+func (s *PeerScorer) Bans(now time.Time) []Ban {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	bans := make([]Ban, 0, len(s.bans))
+	for id := range s.bans {
+		if ban, ok := s.activeBan(id, now); ok {
+			bans = append(bans, ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Addr < bans[j].Addr
+	})
+
+	return bans
+}
+
+// activeBan returns the ban of an identity, expired bans are removed.
+func (s *PeerScorer) activeBan(id string, now time.Time) (Ban, bool) {
+	ban, ok := s.bans[id]
+	if !ok {
+		return Ban{}, false
+	}
+	if !ban.Permanent() && !now.Before(ban.Until) {
+		delete(s.bans, id)
+		return Ban{}, false
+	}
+	return ban, true
+}
+
+// peer returns the score of a peer after recovering the points due since its
+// last update.
+func (s *PeerScorer) peer(addr NetAddr, now time.Time) *peerScore {
+	ps, ok := s.scores[addr]
+	if !ok {
+		ps = &peerScore{updated: now, buckets: map[MessageType]*tokenBucket{}}
+		s.scores[addr] = ps
+	}
+
+	if recovered := int(now.Sub(ps.updated) / s.opts.ScoreRecoveryInterval); recovered > 0 {
+		ps.score = min(0, ps.score+recovered)
+		ps.updated = ps.updated.Add(time.Duration(recovered) * s.opts.ScoreRecoveryInterval)
+	}
+
+	return ps
+}
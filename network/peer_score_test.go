@@ -0,0 +1,275 @@
+package network
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"go-blockchain/core"
+	"go-blockchain/crypto"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerScorerBans(t *testing.T) {
+	s := NewPeerScorer(PeerScoreOpts{})
+	now := time.Now()
+
+	for i := 0; i < 4; i++ {
+		_, banned := s.Penalize("A", "A", OffenseUndecodable, now)
+		assert.False(t, banned)
+	}
+	ban, banned := s.Penalize("A", "A", OffenseUndecodable, now)
+	assert.True(t, banned)
+	assert.Equal(t, now.Add(DefaultBanDuration), ban.Until)
+	assert.True(t, s.IsBanned("A", now))
+	assert.False(t, s.IsBanned("B", now))
+	assert.Equal(t, []Ban{ban}, s.Bans(now))
+
+	// offenses during a ban don't count
+	_, banned = s.Penalize("A", "A", OffenseInvalidBlock, now)
+	assert.False(t, banned)
+	assert.Equal(t, 0, s.Score("A", now))
+
+	// a ban expires, a peer banned too often is banned permanently
+	for i := 1; i <= DefaultMaxTempBans; i++ {
+		now = now.Add(DefaultBanDuration)
+		assert.False(t, s.IsBanned("A", now))
+
+		_, _ = s.Penalize("A", "A", OffenseInvalidBlock, now)
+		ban, banned = s.Penalize("A", "A", OffenseInvalidBlock, now)
+		assert.True(t, banned)
+		assert.Equal(t, i == DefaultMaxTempBans, ban.Permanent())
+	}
+	assert.True(t, s.IsBanned("A", now.Add(100*DefaultBanDuration)))
+
+	assert.True(t, s.Unban("A", "A"))
+	assert.False(t, s.IsBanned("A", now))
+	assert.Empty(t, s.Bans(now))
+}
+
+func TestPeerScorerBansIdentity(t *testing.T) {
+	s := NewPeerScorer(PeerScoreOpts{})
+	now := time.Now()
+
+	s.Penalize("A", "host", OffenseInvalidBlock, now)
+	ban, banned := s.Penalize("A", "host", OffenseInvalidBlock, now)
+	assert.True(t, banned)
+	assert.Equal(t, "host", ban.ID)
+
+	// the peer cannot shed its ban or its score under another address
+	assert.True(t, s.IsBanned("host", now))
+	_, banned = s.Penalize("B", "host", OffenseInvalidBlock, now)
+	assert.False(t, banned)
+	assert.Equal(t, 0, s.Score("B", now))
+
+	// the score of a peer is gone once it disconnects
+	s.Penalize("C", "other", OffenseInvalidBlock, now)
+	s.Retain([]PeerInfo{{Addr: "C"}})
+	assert.Equal(t, -50, s.Score("C", now))
+	s.Retain(nil)
+	assert.Equal(t, 0, s.Score("C", now))
+	assert.Empty(t, s.scores)
+
+	assert.True(t, s.Unban("B", "host"))
+	assert.False(t, s.IsBanned("host", now))
+}
+
+func TestPeerScorerRecovers(t *testing.T) {
+	s := NewPeerScorer(PeerScoreOpts{})
+	now := time.Now()
+
+	s.Penalize("A", "A", OffenseInvalidBlock, now)
+	assert.Equal(t, -50, s.Score("A", now))
+	assert.Equal(t, -40, s.Score("A", now.Add(10*DefaultScoreRecoveryInterval)))
+	assert.Equal(t, 0, s.Score("A", now.Add(time.Hour)))
+}
+
+func TestPeerScorerRateLimits(t *testing.T) {
+	s := NewPeerScorer(PeerScoreOpts{
+		RateLimits: map[MessageType]RateLimit{MessageTypeTx: {Rate: 1, Burst: 3}},
+	})
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		assert.True(t, s.Allow("A", MessageTypeTx, now))
+	}
+	assert.False(t, s.Allow("A", MessageTypeTx, now))
+	assert.True(t, s.Allow("B", MessageTypeTx, now))
+
+	// the bucket refills over time and the defaults of other types are kept
+	assert.True(t, s.Allow("A", MessageTypeTx, now.Add(time.Second)))
+	assert.False(t, s.Allow("A", MessageTypeTx, now.Add(time.Second)))
+	assert.True(t, s.Allow("A", MessageTypeBlock, now))
+	assert.True(t, s.Allow("A", MessageType(0xff), now))
+}
+
+func assertBanned(t *testing.T, s *Server, attacker Transport) {
+	assert.Eventually(t, func() bool {
+		return s.isBanned(attacker.Addr()) && len(attacker.Peers()) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	bans := s.Bans()
+	assert.Len(t, bans, 1)
+	assert.Equal(t, attacker.Addr(), bans[0].Addr)
+	assert.False(t, bans[0].Permanent())
+}
+
+func TestServerBansPeerSendingGarbage(t *testing.T) {
+	s, attacker := newAttackedServer(t, "garbage", PeerScoreOpts{})
+
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, attacker.SendMessage("garbage", []byte{0xff, 0x01, 0x02}))
+	}
+	assertBanned(t, s, attacker)
+
+	// a banned peer that reconnects is dropped on its next message
+	assert.Nil(t, attacker.Dial("garbage"))
+	assert.Nil(t, attacker.SendMessage("garbage", []byte{0xff}))
+	assert.Eventually(t, func() bool {
+		return len(attacker.Peers()) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.True(t, s.UnbanPeer(attacker.Addr()))
+	assert.Empty(t, s.Bans())
+	assert.Equal(t, 0, s.PeerScore(attacker.Addr()))
+}
+
+func TestServerForgetsScoreOfDisconnectedPeer(t *testing.T) {
+	tr := NewLocalTransport("forget")
+	attacker := NewLocalTransport("forget-attacker")
+	t.Cleanup(func() {
+		_ = tr.Close()
+		_ = attacker.Close()
+	})
+
+	s := newLocalServer(t, tr, false, ServerOpts{PeerOpts: PeerManagerOpts{CheckInterval: 20 * time.Millisecond}})
+	startServer(t, s)
+	assert.Nil(t, attacker.Dial(tr.Addr()))
+
+	assert.Nil(t, attacker.SendMessage("forget", []byte{0xff}))
+	assert.Eventually(t, func() bool {
+		return s.PeerScore(attacker.Addr()) == -DefaultPenalties[OffenseUndecodable]
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Nil(t, attacker.Disconnect("forget"))
+	assert.Eventually(t, func() bool {
+		return s.PeerScore(attacker.Addr()) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestServerBansHostOfPlainTCPPeer(t *testing.T) {
+	tr := newTCPTransport(t, TCPTransportOpts{})
+	s := newLocalServer(t, tr, false, ServerOpts{PeerOpts: PeerManagerOpts{CheckInterval: 20 * time.Millisecond}})
+	startServer(t, s)
+
+	opts := TCPTransportOpts{MinReconnectDelay: time.Hour, MaxReconnectDelay: time.Hour}
+	attacker := newTCPTransport(t, opts)
+	assert.Nil(t, attacker.Dial(tr.Addr()))
+	assert.Eventually(t, func() bool {
+		return len(tr.Peers()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	s.BanPeer(attacker.Addr(), time.Hour, "manual")
+	assert.Equal(t, "127.0.0.1", s.Bans()[0].ID)
+
+	// the same host claiming another address is still banned
+	other := newTCPTransport(t, opts)
+	assert.True(t, s.isBanned(other.Addr()))
+	assert.Nil(t, other.Dial(tr.Addr()))
+	assert.Eventually(t, func() bool {
+		return len(other.Peers()) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestServerBansPeerSendingInvalidSignatures(t *testing.T) {
+	s, attacker := newAttackedServer(t, "badsig", PeerScoreOpts{})
+	privKey := crypto.GeneratePrivateKey()
+
+	for i := 0; i < 4; i++ {
+		tx := signedTransfer(t, privKey, 0, 10, uint64(i))
+		tx.Value = 1_000_000
+
+		buf := &bytes.Buffer{}
+		assert.Nil(t, tx.Encode(core.NewCanonicalTxEncoder(buf)))
+		msg := NewMessage(MessageTypeTx, buf.Bytes())
+		assert.Nil(t, attacker.SendMessage("badsig", msg.Bytes()))
+	}
+	assertBanned(t, s, attacker)
+	assert.Equal(t, 0, s.memPool.Len())
+}
+
+func TestServerBansPeerSendingOversizeMessages(t *testing.T) {
+	s, attacker := newAttackedServer(t, "oversize", PeerScoreOpts{MaxMessageSize: 1024})
+
+	msg := NewMessage(MessageTypeTx, make([]byte, 1024))
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, attacker.SendMessage("oversize", msg.Bytes()))
+	}
+	assertBanned(t, s, attacker)
+}
+
+func TestServerBansFloodingPeer(t *testing.T) {
+	s, attacker := newAttackedServer(t, "flood", PeerScoreOpts{
+		RateLimits: map[MessageType]RateLimit{MessageTypeGetPeers: {Rate: 0.1, Burst: 5}},
+	})
+
+	msg, err := NewGobMessage(MessageTypeGetPeers, &GetPeersMessage{})
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		_ = attacker.SendMessage("flood", msg.Bytes())
+	}
+	assertBanned(t, s, attacker)
+}
+
+func TestServerBanPeer(t *testing.T) {
+	s, attacker := newAttackedServer(t, "manual", PeerScoreOpts{})
+
+	assert.Eventually(t, func() bool {
+		return len(attacker.Peers()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	s.BanPeer(attacker.Addr(), 0, "manual")
+	assert.True(t, s.Bans()[0].Permanent())
+	assert.Empty(t, attacker.Peers())
+	assert.False(t, s.peerManager.AddrBook().Has(attacker.Addr()))
+	assert.NotNil(t, s.sendMessage(attacker.Addr(), NewMessage(MessageTypeGetStatus, nil)))
+}
+
+func TestServerPenalizesBlockRulesPrecisely(t *testing.T) {
+	s, attacker := newAttackedServer(t, "rules", PeerScoreOpts{})
+	genesis, err := s.chain.GetHeader(0)
+	assert.Nil(t, err)
+
+	sendBlock := func(b *core.Block) {
+		assert.Nil(t, b.Sign(crypto.GeneratePrivateKey()))
+		buf := &bytes.Buffer{}
+		assert.Nil(t, b.Encode(core.NewCanonicalBlockEncoder(buf)))
+		assert.Nil(t, attacker.SendMessage("rules", NewMessage(MessageTypeBlock, buf.Bytes()).Bytes()))
+	}
+
+	// a clock running ahead costs little
+	future, err := core.NewBlockFromPrevHeader(genesis, nil)
+	assert.Nil(t, err)
+	future.Timestamp = time.Now().Add(time.Hour).UnixNano()
+	sendBlock(future)
+	assert.Eventually(t, func() bool {
+		return s.PeerScore(attacker.Addr()) == -DefaultPenalties[OffenseFutureBlock]
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// a block that does not apply to the state of its parent may come from
+	// a peer that raced another block, it costs nothing
+	overdraft, err := core.NewBlockFromPrevHeader(genesis, []core.Transaction{*signedTransfer(t, crypto.GeneratePrivateKey(), 0, 1, 0)})
+	assert.Nil(t, err)
+	sendBlock(overdraft)
+
+	// a transaction included twice makes the block invalid
+	tx := signedTransfer(t, crypto.GeneratePrivateKey(), 0, 1, 0)
+	duplicate, err := core.NewBlockFromPrevHeader(genesis, []core.Transaction{*tx, *tx})
+	assert.Nil(t, err)
+	sendBlock(duplicate)
+	assert.Eventually(t, func() bool {
+		return s.PeerScore(attacker.Addr()) == -DefaultPenalties[OffenseFutureBlock]-DefaultPenalties[OffenseInvalidBlock]
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, uint32(0), s.chain.Height())
+}
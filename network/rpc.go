@@ -2,9 +2,12 @@ package network
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
 	"fmt"
+	"go-blockchain/consensus"
 	"go-blockchain/core"
+	"go-blockchain/types"
 	"io"
 
 	"github.com/sirupsen/logrus"
@@ -18,10 +21,99 @@ type RPC struct {
 type MessageType byte
 
 const (
-	MessageTypeTx MessageType = 0x1
-	MessageTypeBlock
+	MessageTypeTx         MessageType = 0x1
+	MessageTypeBlock      MessageType = 0x2
+	MessageTypeGetStatus  MessageType = 0x3
+	MessageTypeStatus     MessageType = 0x4
+	MessageTypeGetHeaders MessageType = 0x5
+	MessageTypeHeaders    MessageType = 0x6
+	MessageTypeGetBlocks  MessageType = 0x7
+	MessageTypeBlocks     MessageType = 0x8
+	MessageTypeGetPeers   MessageType = 0x9
+	MessageTypePeers      MessageType = 0xa
+	MessageTypeInv        MessageType = 0xb
+	MessageTypeGetData    MessageType = 0xc
+	// MessageTypeConsensus carries the proposals and votes of the validators
+	MessageTypeConsensus MessageType = 0xd
 )
 
+// MaxBlocksPerMessage caps the blocks of a single HeadersMessage or
+// BlocksMessage.
+const MaxBlocksPerMessage = 1 << 12
+
+// GetStatusMessage asks a peer for its StatusMessage.
+type GetStatusMessage struct{}
+
+// StatusMessage describes the chain of a peer, it is exchanged when peers
+// meet and used to decide whether to sync.
+type StatusMessage struct {
+	GenesisHash types.Hash
+	Height      uint32
+	TipHash     types.Hash
+}
+
+// GetHeadersMessage requests the canonical headers from height From to To,
+// ID is echoed in the response.
+type GetHeadersMessage struct {
+	ID   uint64
+	From uint32
+	To   uint32
+}
+
+// HeadersMessage answers a GetHeadersMessage with the blocks stripped of
+// their transactions, the signatures and commits are kept so the headers can
+// be checked before their bodies are fetched.
+type HeadersMessage struct {
+	ID      uint64
+	Headers []*core.Block
+}
+
+// GetBlocksMessage requests the canonical blocks from height From to To,
+// ID is echoed in the response.
+type GetBlocksMessage struct {
+	ID   uint64
+	From uint32
+	To   uint32
+}
+
+type BlocksMessage struct {
+	ID     uint64
+	Blocks []*core.Block
+}
+
+// GetPeersMessage asks a peer for addresses of other nodes.
+type GetPeersMessage struct{}
+
+// PeersMessage answers a GetPeersMessage with at most MaxPeersPerMessage addresses.
+type PeersMessage struct {
+	Addrs []NetAddr
+}
+
+// InvType is the kind of item an InvVect refers to.
+type InvType byte
+
+const (
+	InvTypeTx    InvType = 0x1
+	InvTypeBlock InvType = 0x2
+)
+
+// InvVect identifies a transaction or block by its hash.
+type InvVect struct {
+	Type InvType
+	Hash types.Hash
+}
+
+// InvMessage announces items a peer holds, at most MaxInvPerMessage.
+type InvMessage struct {
+	Items []InvVect
+}
+
+// GetDataMessage requests announced items, they are answered with a Tx or
+// Block message each.
+type GetDataMessage struct {
+	Items []InvVect
+}
+
 type Message struct {
 	Header MessageType
 	Data   []byte
@@ -40,6 +132,111 @@ func (msg *Message) Bytes() []byte {
 	return buf.Bytes()
 }
 
+// NewGobMessage returns a message holding the gob encoding of payload.
+func NewGobMessage(t MessageType, payload any) (*Message, error) {
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(payload); err != nil {
+		return nil, err
+	}
+	return NewMessage(t, buf.Bytes()), nil
+}
+
+// Every message carrying transactions or blocks uses the canonical encoding
+// of core, the Headers and Blocks messages are laid out as
+// ID uint64 | uint32 block count | Block...
+
+func newTxMessage(tx *core.Transaction) (*Message, error) {
+	buf := &bytes.Buffer{}
+	if err := tx.Encode(core.NewCanonicalTxEncoder(buf)); err != nil {
+		return nil, err
+	}
+
+	return NewMessage(MessageTypeTx, buf.Bytes()), nil
+}
+
+func newBlockMessage(b *core.Block) (*Message, error) {
+	buf := &bytes.Buffer{}
+	if err := b.Encode(core.NewCanonicalBlockEncoder(buf)); err != nil {
+		return nil, err
+	}
+
+	return NewMessage(MessageTypeBlock, buf.Bytes()), nil
+}
+
+func newHeadersMessage(resp *HeadersMessage) (*Message, error) {
+	return newBlockListMessage(MessageTypeHeaders, resp.ID, resp.Headers)
+}
+
+func newBlocksMessage(resp *BlocksMessage) (*Message, error) {
+	return newBlockListMessage(MessageTypeBlocks, resp.ID, resp.Blocks)
+}
+
+func newBlockListMessage(t MessageType, id uint64, blocks []*core.Block) (*Message, error) {
+	if len(blocks) > MaxBlocksPerMessage {
+		return nil, fmt.Errorf("%d blocks exceed the maximum of %d per message", len(blocks), MaxBlocksPerMessage)
+	}
+
+	buf := &bytes.Buffer{}
+	_ = binary.Write(buf, binary.BigEndian, id)
+	_ = binary.Write(buf, binary.BigEndian, uint32(len(blocks)))
+	for _, b := range blocks {
+		if err := b.Encode(core.NewCanonicalBlockEncoder(buf)); err != nil {
+			return nil, err
+		}
+	}
+
+	return NewMessage(t, buf.Bytes()), nil
+}
+
+func newConsensusMessage(msg *consensus.Message) (*Message, error) {
+	buf := &bytes.Buffer{}
+	if err := consensus.NewCanonicalMessageEncoder(buf).Encode(msg); err != nil {
+		return nil, err
+	}
+
+	return NewMessage(MessageTypeConsensus, buf.Bytes()), nil
+}
+
+func decodeBlockList(data []byte) (uint64, []*core.Block, error) {
+	r := bytes.NewReader(data)
+
+	var (
+		id uint64
+		n  uint32
+	)
+	if err := binary.Read(r, binary.BigEndian, &id); err != nil {
+		return 0, nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return 0, nil, err
+	}
+	if n > MaxBlocksPerMessage {
+		return 0, nil, fmt.Errorf("%d blocks exceed the maximum of %d per message", n, MaxBlocksPerMessage)
+	}
+
+	blocks := []*core.Block{}
+	for i := uint32(0); i < n; i++ {
+		b := new(core.Block)
+		if err := b.Decode(core.NewCanonicalBlockDecoder(r)); err != nil {
+			return 0, nil, err
+		}
+		blocks = append(blocks, b)
+	}
+
+	return id, blocks, nil
+}
+
+func decodeGobPayload[T any](rpc RPC, data []byte) (*DecodedMessage, error) {
+	payload := new(T)
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(payload); err != nil {
+		return nil, fmt.Errorf("failed to decode message from %s: %w", rpc.From, err)
+	}
+	return &DecodedMessage{
+		From: rpc.From,
+		Data: payload,
+	}, nil
+}
+
 type RPCDecodeFunc func(RPC) (*DecodedMessage, error)
 
 func DefaultRPCDecodeFunc(rpc RPC) (*DecodedMessage, error) {
@@ -53,10 +250,20 @@ func DefaultRPCDecodeFunc(rpc RPC) (*DecodedMessage, error) {
 		"type": msg.Header,
 	}).Debug("new incoming message")
 
+	decoded, err := decodeMessage(rpc, msg)
+	if err != nil {
+		return nil, err
+	}
+	decoded.Type = msg.Header
+
+	return decoded, nil
+}
+
+func decodeMessage(rpc RPC, msg Message) (*DecodedMessage, error) {
 	switch msg.Header {
 	case MessageTypeTx:
 		tx := new(core.Transaction)
-		if err := tx.Decode(core.NewGobTxDecoder(bytes.NewReader(msg.Data))); err != nil {
+		if err := tx.Decode(core.NewCanonicalTxDecoder(bytes.NewReader(msg.Data))); err != nil {
 			return nil, fmt.Errorf("failed to decode message from %s: %w", rpc.From, err)
 		}
 		return &DecodedMessage{
@@ -64,6 +271,62 @@ func DefaultRPCDecodeFunc(rpc RPC) (*DecodedMessage, error) {
 			Data: tx,
 		}, nil
 
+	case MessageTypeBlock:
+		b := new(core.Block)
+		if err := b.Decode(core.NewCanonicalBlockDecoder(bytes.NewReader(msg.Data))); err != nil {
+			return nil, fmt.Errorf("failed to decode message from %s: %w", rpc.From, err)
+		}
+		return &DecodedMessage{
+			From: rpc.From,
+			Data: b,
+		}, nil
+
+	case MessageTypeGetStatus:
+		return decodeGobPayload[GetStatusMessage](rpc, msg.Data)
+	case MessageTypeStatus:
+		return decodeGobPayload[StatusMessage](rpc, msg.Data)
+	case MessageTypeGetHeaders:
+		return decodeGobPayload[GetHeadersMessage](rpc, msg.Data)
+	case MessageTypeHeaders:
+		id, blocks, err := decodeBlockList(msg.Data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode message from %s: %w", rpc.From, err)
+		}
+		return &DecodedMessage{
+			From: rpc.From,
+			Data: &HeadersMessage{ID: id, Headers: blocks},
+		}, nil
+
+	case MessageTypeGetBlocks:
+		return decodeGobPayload[GetBlocksMessage](rpc, msg.Data)
+	case MessageTypeBlocks:
+		id, blocks, err := decodeBlockList(msg.Data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode message from %s: %w", rpc.From, err)
+		}
+		return &DecodedMessage{
+			From: rpc.From,
+			Data: &BlocksMessage{ID: id, Blocks: blocks},
+		}, nil
+
+	case MessageTypeGetPeers:
+		return decodeGobPayload[GetPeersMessage](rpc, msg.Data)
+	case MessageTypePeers:
+		return decodeGobPayload[PeersMessage](rpc, msg.Data)
+	case MessageTypeInv:
+		return decodeGobPayload[InvMessage](rpc, msg.Data)
+	case MessageTypeGetData:
+		return decodeGobPayload[GetDataMessage](rpc, msg.Data)
+	case MessageTypeConsensus:
+		m := new(consensus.Message)
+		if err := consensus.NewCanonicalMessageDecoder(bytes.NewReader(msg.Data)).Decode(m); err != nil {
+			return nil, fmt.Errorf("failed to decode message from %s: %w", rpc.From, err)
+		}
+		return &DecodedMessage{
+			From: rpc.From,
+			Data: m,
+		}, nil
+
 	default:
 		return nil, fmt.Errorf("invalid message header %v", msg.Header)
 	}
@@ -71,6 +334,7 @@ func DefaultRPCDecodeFunc(rpc RPC) (*DecodedMessage, error) {
 
 type DecodedMessage struct {
 	From NetAddr
+	Type MessageType
 	Data any
 }
 
@@ -0,0 +1,71 @@
+package network
+
+import (
+	"bytes"
+	"testing"
+
+	"go-blockchain/consensus"
+	"go-blockchain/core"
+	"go-blockchain/crypto"
+	"go-blockchain/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// decodeSent decodes msg the way a peer receiving it would.
+func decodeSent(t *testing.T, msg *Message) *DecodedMessage {
+	decoded, err := DefaultRPCDecodeFunc(RPC{From: "peer", Payload: bytes.NewReader(msg.Bytes())})
+	assert.Nil(t, err)
+	return decoded
+}
+
+func TestCanonicalMessages(t *testing.T) {
+	privKey := crypto.GeneratePrivateKey()
+
+	tx := core.NewTransaction([]byte("foo"))
+	assert.Nil(t, tx.Sign(privKey))
+	msg, err := newTxMessage(tx)
+	assert.Nil(t, err)
+	decodedTx := decodeSent(t, msg).Data.(*core.Transaction)
+	assert.Equal(t, tx.Hash(core.TxHasher{}), decodedTx.Hash(core.TxHasher{}))
+
+	header := &core.Header{Version: core.HeaderVersionMerkle, Height: 1, PrevBlockHash: types.RandomHash()}
+	b := core.NewBlock(header, nil)
+	assert.Nil(t, b.Sign(privKey))
+
+	msg, err = newHeadersMessage(&HeadersMessage{ID: 5, Headers: []*core.Block{b, b}})
+	assert.Nil(t, err)
+	headers := decodeSent(t, msg).Data.(*HeadersMessage)
+	assert.Equal(t, uint64(5), headers.ID)
+	assert.Len(t, headers.Headers, 2)
+	assert.Equal(t, b.Hash(core.BlockHasher{}), headers.Headers[1].Hash(core.BlockHasher{}))
+
+	msg, err = newBlocksMessage(&BlocksMessage{ID: 6, Blocks: []*core.Block{}})
+	assert.Nil(t, err)
+	blocks := decodeSent(t, msg).Data.(*BlocksMessage)
+	assert.Equal(t, uint64(6), blocks.ID)
+	assert.Empty(t, blocks.Blocks)
+
+	p := &consensus.Proposal{
+		Vote:     core.Vote{Type: core.VoteProposal, Height: 1, Round: 3, BlockHash: b.Hash(core.BlockHasher{})},
+		POLRound: -1,
+		Block:    b,
+	}
+	assert.Nil(t, p.Vote.Sign(privKey))
+	msg, err = newConsensusMessage(&consensus.Message{Proposal: p})
+	assert.Nil(t, err)
+	proposal := decodeSent(t, msg).Data.(*consensus.Message).Proposal
+	assert.Nil(t, proposal.Vote.Verify())
+	assert.Equal(t, int32(-1), proposal.POLRound)
+	assert.Equal(t, b.Hash(core.BlockHasher{}), proposal.Block.Hash(core.BlockHasher{}))
+
+	// a message with both a proposal and a vote is not sent
+	_, err = newConsensusMessage(&consensus.Message{Proposal: p, Vote: &p.Vote})
+	assert.ErrorIs(t, err, consensus.ErrInvalidMessage)
+
+	// a gob payload is not accepted for a canonical message
+	gobMsg, err := NewGobMessage(MessageTypeHeaders, &HeadersMessage{ID: 5, Headers: []*core.Block{b}})
+	assert.Nil(t, err)
+	_, err = DefaultRPCDecodeFunc(RPC{From: "peer", Payload: bytes.NewReader(gobMsg.Bytes())})
+	assert.NotNil(t, err)
+}
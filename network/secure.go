@@ -0,0 +1,336 @@
+package network
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+
+	"go-blockchain/crypto"
+)
+
+const (
+	secureEphemeralKeySize = 32
+	secureNodeKeySize      = 33
+	secureSignatureSize    = 64
+
+	// MaxSecureRecordSize caps the plaintext carried by one encrypted record
+	MaxSecureRecordSize = 64 << 10
+)
+
+var secureHandshakeLabel = []byte("go-blockchain secure handshake v1")
+
+var ErrSecureHandshake = errors.New("secure handshake failed")
+
+// ConnUpgrader upgrades the connections of a stream transport before any
+// message is exchanged.
+type ConnUpgrader interface {
+	// ID returns the node id peers verify when connecting to this node
+	ID() string
+	// Upgrade runs on both ends of a new connection and returns the upgraded
+	// connection together with the verified node id of the peer
+	Upgrade(conn net.Conn, initiator bool) (net.Conn, string, error)
+}
+
+// SecureUpgrader authenticates connections with the node key and encrypts
+// them, see SecureHandshake.
+type SecureUpgrader struct {
+	PrivateKey crypto.PrivateKey
+}
+
+func NewSecureUpgrader(privKey crypto.PrivateKey) *SecureUpgrader {
+	return &SecureUpgrader{
+		PrivateKey: privKey,
+	}
+}
+
+func (u *SecureUpgrader) ID() string {
+	return hex.EncodeToString(u.PrivateKey.PublicKey().ToSlice())
+}
+
+func (u *SecureUpgrader) Upgrade(conn net.Conn, initiator bool) (net.Conn, string, error) {
+	sc, err := SecureHandshake(conn, u.PrivateKey, initiator)
+	if err != nil {
+		return nil, "", err
+	}
+	return sc, hex.EncodeToString(sc.RemoteKey().ToSlice()), nil
+}
+
+// SecureConn is a connection encrypted with AES-GCM. Every record is written
+// as its big-endian uint32 length followed by the sealed plaintext, the nonce
+// is the number of records sent before in that direction.
+type SecureConn struct {
+	net.Conn
+
+	remoteKey crypto.PublicKey
+
+	writeLock  sync.Mutex
+	sendAEAD   cipher.AEAD
+	sendNonce  uint64
+	readLock   sync.Mutex
+	recvAEAD   cipher.AEAD
+	recvNonce  uint64
+	recvBuffer []byte
+}
+
+// SecureHandshake authenticates both ends of conn and returns the encrypted
+// connection. Both sides exchange ephemeral X25519 keys, then each signs the
+// hash of both ephemeral keys and its role with its node key. Since every
+// signature covers the fresh key of the other side, a recorded handshake
+// cannot be replayed and a man in the middle replacing the ephemeral keys
+// cannot produce valid signatures. The traffic keys of both directions are
+// derived from the shared X25519 secret and the handshake transcript.
+func SecureHandshake(conn net.Conn, privKey crypto.PrivateKey, initiator bool) (*SecureConn, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	local := ephemeral.PublicKey().Bytes()
+	remote := make([]byte, secureEphemeralKeySize)
+	if err := exchange(conn, initiator, local, remote); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSecureHandshake, err)
+	}
+
+	initKey, respKey := local, remote
+	if !initiator {
+		initKey, respKey = remote, local
+	}
+	transcript := secureTranscript(initKey, respKey)
+
+	remoteKey, err := authenticate(conn, privKey, transcript, initiator)
+	if err != nil {
+		return nil, err
+	}
+
+	remotePub, err := ecdh.X25519().NewPublicKey(remote)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSecureHandshake, err)
+	}
+	secret, err := ephemeral.ECDH(remotePub)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSecureHandshake, err)
+	}
+
+	initAEAD, err := newSecureAEAD(secret, transcript, "initiator")
+	if err != nil {
+		return nil, err
+	}
+	respAEAD, err := newSecureAEAD(secret, transcript, "responder")
+	if err != nil {
+		return nil, err
+	}
+
+	sc := &SecureConn{
+		Conn:      conn,
+		remoteKey: remoteKey,
+		sendAEAD:  initAEAD,
+		recvAEAD:  respAEAD,
+	}
+	if !initiator {
+		sc.sendAEAD, sc.recvAEAD = respAEAD, initAEAD
+	}
+
+	return sc, nil
+}
+
+// exchange sends local and reads remote, the initiator writes first.
+func exchange(conn net.Conn, initiator bool, local, remote []byte) error {
+	if initiator {
+		if _, err := conn.Write(local); err != nil {
+			return err
+		}
+		_, err := io.ReadFull(conn, remote)
+		return err
+	}
+
+	if _, err := io.ReadFull(conn, remote); err != nil {
+		return err
+	}
+	_, err := conn.Write(local)
+	return err
+}
+
+// authenticate exchanges the signed node keys. The initiator proves its
+// identity first, the responder only answers once that proof is valid.
+func authenticate(conn net.Conn, privKey crypto.PrivateKey, transcript []byte, initiator bool) (crypto.PublicKey, error) {
+	auth, err := signHandshake(privKey, transcript, initiator)
+	if err != nil {
+		return crypto.PublicKey{}, err
+	}
+
+	remoteAuth := make([]byte, secureNodeKeySize+secureSignatureSize)
+	if initiator {
+		if _, err := conn.Write(auth); err != nil {
+			return crypto.PublicKey{}, fmt.Errorf("%w: %v", ErrSecureHandshake, err)
+		}
+	}
+
+	if _, err := io.ReadFull(conn, remoteAuth); err != nil {
+		return crypto.PublicKey{}, fmt.Errorf("%w: %v", ErrSecureHandshake, err)
+	}
+
+	remoteKey, err := verifyHandshake(remoteAuth, transcript, !initiator)
+	if err != nil {
+		return crypto.PublicKey{}, fmt.Errorf("%w: %v", ErrSecureHandshake, err)
+	}
+
+	if !initiator {
+		if _, err := conn.Write(auth); err != nil {
+			return crypto.PublicKey{}, fmt.Errorf("%w: %v", ErrSecureHandshake, err)
+		}
+	}
+
+	return remoteKey, nil
+}
+
+func secureTranscript(initKey, respKey []byte) []byte {
+	h := sha256.New()
+	h.Write(secureHandshakeLabel)
+	h.Write(initKey)
+	h.Write(respKey)
+	return h.Sum(nil)
+}
+
+func secureRoleDigest(transcript []byte, initiator bool) []byte {
+	role := "responder"
+	if initiator {
+		role = "initiator"
+	}
+	h := sha256.Sum256(append(append([]byte{}, transcript...), role...))
+	return h[:]
+}
+
+// signHandshake returns the node key followed by the signature of the role
+// digest with R and S as 32 byte big-endian integers.
+func signHandshake(privKey crypto.PrivateKey, transcript []byte, initiator bool) ([]byte, error) {
+	sig, err := privKey.Sign(secureRoleDigest(transcript, initiator))
+	if err != nil {
+		return nil, err
+	}
+
+	auth := make([]byte, secureNodeKeySize+secureSignatureSize)
+	copy(auth, privKey.PublicKey().ToSlice())
+	sig.R.FillBytes(auth[secureNodeKeySize : secureNodeKeySize+32])
+	sig.S.FillBytes(auth[secureNodeKeySize+32:])
+
+	return auth, nil
+}
+
+func verifyHandshake(auth, transcript []byte, initiator bool) (crypto.PublicKey, error) {
+	key, err := crypto.PublicKeyFromBytes(auth[:secureNodeKeySize])
+	if err != nil {
+		return crypto.PublicKey{}, err
+	}
+
+	sig := crypto.Signature{
+		R: new(big.Int).SetBytes(auth[secureNodeKeySize : secureNodeKeySize+32]),
+		S: new(big.Int).SetBytes(auth[secureNodeKeySize+32:]),
+	}
+	if !sig.Verify(key, secureRoleDigest(transcript, initiator)) {
+		return crypto.PublicKey{}, fmt.Errorf("invalid signature of node %x", auth[:secureNodeKeySize])
+	}
+
+	return key, nil
+}
+
+func newSecureAEAD(secret, transcript []byte, direction string) (cipher.AEAD, error) {
+	h := sha256.New()
+	h.Write(secret)
+	h.Write(transcript)
+	h.Write([]byte(direction))
+
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// RemoteKey returns the authenticated node key of the peer.
+func (c *SecureConn) RemoteKey() crypto.PublicKey {
+	return c.remoteKey
+}
+
+func (c *SecureConn) Write(p []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	n := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), MaxSecureRecordSize)]
+		if err := c.writeRecord(chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+
+	return n, nil
+}
+
+func (c *SecureConn) writeRecord(plaintext []byte) error {
+	record := make([]byte, 4, 4+len(plaintext)+c.sendAEAD.Overhead())
+	record = c.sendAEAD.Seal(record, secureNonce(c.sendAEAD, c.sendNonce), plaintext, nil)
+	binary.BigEndian.PutUint32(record, uint32(len(record)-4))
+	c.sendNonce++
+
+	_, err := c.Conn.Write(record)
+	return err
+}
+
+func (c *SecureConn) Read(p []byte) (int, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	for len(c.recvBuffer) == 0 {
+		plaintext, err := c.readRecord()
+		if err != nil {
+			return 0, err
+		}
+		c.recvBuffer = plaintext
+	}
+
+	n := copy(p, c.recvBuffer)
+	c.recvBuffer = c.recvBuffer[n:]
+	return n, nil
+}
+
+func (c *SecureConn) readRecord() ([]byte, error) {
+	var size uint32
+	if err := binary.Read(c.Conn, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+
+	if size < uint32(c.recvAEAD.Overhead()) || size > uint32(MaxSecureRecordSize+c.recvAEAD.Overhead()) {
+		return nil, fmt.Errorf("invalid record size %d", size)
+	}
+
+	record := make([]byte, size)
+	if _, err := io.ReadFull(c.Conn, record); err != nil {
+		return nil, err
+	}
+
+	plaintext, err := c.recvAEAD.Open(record[:0], secureNonce(c.recvAEAD, c.recvNonce), record, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt record %d: %w", c.recvNonce, err)
+	}
+	c.recvNonce++
+
+	return plaintext, nil
+}
+
+func secureNonce(aead cipher.AEAD, counter uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], counter)
+	return nonce
+}
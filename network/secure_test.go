@@ -0,0 +1,270 @@
+package network
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"go-blockchain/crypto"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type handshakeResult struct {
+	conn *SecureConn
+	err  error
+}
+
+func secureHandshakeAsync(conn net.Conn, privKey crypto.PrivateKey, initiator bool) <-chan handshakeResult {
+	ch := make(chan handshakeResult, 1)
+	go func() {
+		sc, err := SecureHandshake(conn, privKey, initiator)
+		if err != nil {
+			_ = conn.Close()
+		}
+		ch <- handshakeResult{sc, err}
+	}()
+	return ch
+}
+
+func securePair(t *testing.T) (*SecureConn, *SecureConn, crypto.PrivateKey, crypto.PrivateKey) {
+	keyA := crypto.GeneratePrivateKey()
+	keyB := crypto.GeneratePrivateKey()
+	connA, connB := net.Pipe()
+
+	resB := secureHandshakeAsync(connB, keyB, false)
+	a, err := SecureHandshake(connA, keyA, true)
+	assert.Nil(t, err)
+	b := <-resB
+	assert.Nil(t, b.err)
+
+	return a, b.conn, keyA, keyB
+}
+
+// recordingConn keeps a copy of everything written to the connection.
+type recordingConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.written.Write(p)
+	return c.Conn.Write(p)
+}
+
+func TestSecureHandshake(t *testing.T) {
+	a, b, keyA, keyB := securePair(t)
+
+	assert.Equal(t, keyB.PublicKey().ToSlice(), a.RemoteKey().ToSlice())
+	assert.Equal(t, keyA.PublicKey().ToSlice(), b.RemoteKey().ToSlice())
+
+	// larger than a record in both directions
+	msg := make([]byte, 3*MaxSecureRecordSize+17)
+	_, _ = rand.Read(msg)
+
+	go func() {
+		_, _ = a.Write(msg)
+		_, _ = b.Write(msg)
+	}()
+
+	got := make([]byte, len(msg))
+	_, err := io.ReadFull(b, got)
+	assert.Nil(t, err)
+	assert.Equal(t, msg, got)
+
+	_, err = io.ReadFull(a, got)
+	assert.Nil(t, err)
+	assert.Equal(t, msg, got)
+}
+
+func TestSecureHandshakeRejectsReplay(t *testing.T) {
+	keyA := crypto.GeneratePrivateKey()
+	keyB := crypto.GeneratePrivateKey()
+
+	// record the handshake of A with B
+	connA, connB := net.Pipe()
+	recorder := &recordingConn{Conn: connA}
+	resB := secureHandshakeAsync(connB, keyB, false)
+	_, err := SecureHandshake(recorder, keyA, true)
+	assert.Nil(t, err)
+	assert.Nil(t, (<-resB).err)
+
+	recorded := recorder.written.Bytes()
+	assert.Len(t, recorded, secureEphemeralKeySize+secureNodeKeySize+secureSignatureSize)
+
+	// an attacker replays it to B to pose as A
+	attacker, connB := net.Pipe()
+	resB = secureHandshakeAsync(connB, keyB, false)
+
+	_, err = attacker.Write(recorded[:secureEphemeralKeySize])
+	assert.Nil(t, err)
+	_, err = io.ReadFull(attacker, make([]byte, secureEphemeralKeySize))
+	assert.Nil(t, err)
+	_, err = attacker.Write(recorded[secureEphemeralKeySize:])
+	assert.Nil(t, err)
+
+	res := <-resB
+	assert.ErrorIs(t, res.err, ErrSecureHandshake)
+
+	// B never answers with its own signature
+	_, err = attacker.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+}
+
+func TestSecureHandshakeRejectsMITM(t *testing.T) {
+	keyA := crypto.GeneratePrivateKey()
+	keyB := crypto.GeneratePrivateKey()
+
+	connA, mitmA := net.Pipe()
+	mitmB, connB := net.Pipe()
+
+	resA := secureHandshakeAsync(connA, keyA, true)
+	resB := secureHandshakeAsync(connB, keyB, false)
+
+	// the man in the middle swaps the ephemeral keys for its own and relays
+	// the signatures
+	go func() {
+		defer mitmA.Close()
+		defer mitmB.Close()
+
+		eph := make([]byte, secureEphemeralKeySize)
+		if _, err := io.ReadFull(mitmA, eph); err != nil {
+			return
+		}
+		_, _ = rand.Read(eph)
+		if _, err := mitmB.Write(eph); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(mitmB, eph); err != nil {
+			return
+		}
+		_, _ = rand.Read(eph)
+		if _, err := mitmA.Write(eph); err != nil {
+			return
+		}
+
+		auth := make([]byte, secureNodeKeySize+secureSignatureSize)
+		if _, err := io.ReadFull(mitmA, auth); err != nil {
+			return
+		}
+		_, _ = mitmB.Write(auth)
+		_, _ = io.ReadFull(mitmB, auth)
+	}()
+
+	assert.ErrorIs(t, (<-resB).err, ErrSecureHandshake)
+	assert.ErrorIs(t, (<-resA).err, ErrSecureHandshake)
+}
+
+// sealRecord returns the next record c would send for plaintext.
+func sealRecord(t *testing.T, c *SecureConn, plaintext []byte) []byte {
+	buf := &bufferConn{}
+	sealer := &SecureConn{Conn: buf, sendAEAD: c.sendAEAD, sendNonce: c.sendNonce}
+	assert.Nil(t, sealer.writeRecord(plaintext))
+	return buf.buf.Bytes()
+}
+
+// bufferConn collects everything written to it.
+type bufferConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *bufferConn) Write(p []byte) (int, error) {
+	return c.buf.Write(p)
+}
+
+func TestSecureConnRejectsReplayedRecords(t *testing.T) {
+	a, b, _, _ := securePair(t)
+	record := sealRecord(t, a, []byte("hello"))
+
+	go func() {
+		_, _ = a.Conn.Write(record)
+		_, _ = a.Conn.Write(record)
+	}()
+
+	buf := make([]byte, 5)
+	_, err := io.ReadFull(b, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), buf)
+
+	_, err = b.Read(buf)
+	assert.NotNil(t, err)
+}
+
+func TestSecureConnRejectsTamperedRecords(t *testing.T) {
+	a, b, _, _ := securePair(t)
+	record := sealRecord(t, a, []byte("hello"))
+	record[len(record)-1] ^= 1
+
+	go func() {
+		_, _ = a.Conn.Write(record)
+	}()
+
+	_, err := b.Read(make([]byte, 5))
+	assert.NotNil(t, err)
+}
+
+func newSecureTCPTransport(t *testing.T, privKey crypto.PrivateKey) *TCPTransport {
+	return newTCPTransport(t, TCPTransportOpts{
+		Upgrader: NewSecureUpgrader(privKey),
+	})
+}
+
+func TestSecureTCPTransport(t *testing.T) {
+	testTransports(t, func(t *testing.T) Transport {
+		return newSecureTCPTransport(t, crypto.GeneratePrivateKey())
+	})
+}
+
+func TestSecureTCPTransportAuthenticatesPeers(t *testing.T) {
+	keyA := crypto.GeneratePrivateKey()
+	tra := newSecureTCPTransport(t, keyA)
+	trb := newSecureTCPTransport(t, crypto.GeneratePrivateKey())
+
+	assert.Equal(t, NodeAddr(keyA.PublicKey(), tra.Addr().HostPort()), tra.Addr())
+	assert.Nil(t, tra.Connect(trb))
+	assert.Nil(t, tra.SendMessage(trb.Addr(), []byte("hello")))
+
+	rpc := receive(t, trb)
+	key, err := rpc.From.NodeKey()
+	assert.Nil(t, err)
+	assert.Equal(t, keyA.PublicKey().Address(), key.Address())
+}
+
+func TestSecureTCPTransportRejectsWrongNodeKey(t *testing.T) {
+	tra := newSecureTCPTransport(t, crypto.GeneratePrivateKey())
+	trb := newSecureTCPTransport(t, crypto.GeneratePrivateKey())
+
+	// whoever listens at the address of B cannot pose as another node
+	impostor := NodeAddr(crypto.GeneratePrivateKey().PublicKey(), trb.Addr().HostPort())
+	assert.NotNil(t, tra.Dial(impostor))
+	assert.NotNil(t, tra.SendMessage(impostor, []byte("hello")))
+}
+
+func TestSecureTCPTransportRejectsPlainPeers(t *testing.T) {
+	secure := newSecureTCPTransport(t, crypto.GeneratePrivateKey())
+	plain := newTCPTransport(t, TCPTransportOpts{DialTimeout: 500 * time.Millisecond})
+
+	assert.NotNil(t, plain.Dial(secure.Addr()))
+	assert.NotNil(t, plain.Dial(NetAddr(secure.Addr().HostPort())))
+	assert.NotNil(t, secure.Dial(plain.Addr()))
+}
+
+func TestNetAddr(t *testing.T) {
+	key := crypto.GeneratePrivateKey().PublicKey()
+	addr := NodeAddr(key, "127.0.0.1:3000")
+
+	assert.Equal(t, "127.0.0.1:3000", addr.HostPort())
+	parsed, err := addr.NodeKey()
+	assert.Nil(t, err)
+	assert.Equal(t, key.ToSlice(), parsed.ToSlice())
+
+	plain := NetAddr("127.0.0.1:3000")
+	assert.Equal(t, "", plain.NodeID())
+	assert.Equal(t, "127.0.0.1:3000", plain.HostPort())
+	_, err = plain.NodeKey()
+	assert.NotNil(t, err)
+}
@@ -2,10 +2,16 @@ package network
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"go-blockchain/consensus"
 	"go-blockchain/core"
 	"go-blockchain/crypto"
 	"go-blockchain/types"
+	"io"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/go-kit/log"
@@ -16,6 +22,11 @@ const (
 	DefaultBlockTime = 5 * time.Second
 )
 
+var (
+	ErrServerStarted    = errors.New("server already started")
+	ErrServerNotStarted = errors.New("server not started")
+)
+
 type ServerOpts struct {
 	ID            string
 	Logger        log.Logger
@@ -24,6 +35,43 @@ type ServerOpts struct {
 	Transports    []Transport
 	PrivateKey    *crypto.PrivateKey
 	BlockTime     time.Duration
+	// Storage persists the chain, defaults to an in memory store
+	Storage core.Storage
+	// Genesis is the spec of the chain, its params fill in unset options.
+	// When nil a genesis with ChainID and GenesisAlloc is used.
+	Genesis *core.Genesis
+	// GenesisAlloc sets the initial account balances when Genesis is nil
+	GenesisAlloc core.GenesisAlloc
+	// ChainID is the chain transactions must be signed for when Genesis is nil
+	ChainID uint64
+	// MaxBlockSize caps the canonical size of a created block
+	MaxBlockSize int
+	// TxOrdering decides which transactions go into a block first, defaults to FeeOrdering
+	TxOrdering TxOrdering
+	// TxPoolOpts bounds the mempool, unset limits use the pool defaults
+	TxPoolOpts TxPoolOpts
+	// SyncOpts tunes the chain synchronisation with peers
+	SyncOpts SyncOpts
+	// PeerOpts configures the bootstrap nodes, address book and peer counts
+	PeerOpts PeerManagerOpts
+	// PeerScoreOpts configures the bans and rate limits of misbehaving peers
+	PeerScoreOpts PeerScoreOpts
+	// GossipOpts configures how transactions and blocks are announced
+	GossipOpts GossipOpts
+	// Consensus creates the engine producing the blocks of a validator,
+	// defaults to Tendermint for chains with BFT consensus, a Miner for chains
+	// with proof of work and Solo otherwise
+	Consensus consensus.Factory
+	// ConsensusOpts tunes the Tendermint engine, its TimeoutCommit defaults
+	// to the block time
+	ConsensusOpts consensus.TendermintOpts
+	// MinerWorkers is the number of goroutines searching nonces on chains
+	// with proof of work, defaults to the number of CPUs
+	MinerWorkers int
+	// SignStateFile keeps the last block the validator signed across
+	// restarts, so it never signs a second one at a height. When empty it is
+	// kept in memory only.
+	SignStateFile string
 }
 
 type Server struct {
@@ -31,12 +79,46 @@ type Server struct {
 	chain       *core.Blockchain
 	blockTime   time.Duration
 	memPool     *TxPool
+	builder     *BlockBuilder
+	sync        *SyncManager
+	peerManager *PeerManager
+	gossip      *GossipManager
+	scores      *PeerScorer
 	isValidator bool
-	rpcCh       chan RPC
-	quitCh      chan struct{}
+	engine      consensus.Engine
+	// peers maps every peer that sent a message to the transport it came from
+	peerLock sync.RWMutex
+	peers    map[NetAddr]Transport
+	rpcCh    chan RPC
+	// senders holds the peers of the blocks being added, the parent of an
+	// orphan is requested from the peer that sent it
+	senderLock sync.Mutex
+	senders    map[types.Hash]NetAddr
+
+	// cancel stops a started server, doneCh is closed and stopErr set once
+	// Start returns
+	lifecycleLock sync.Mutex
+	cancel        context.CancelFunc
+	doneCh        chan struct{}
+	stopErr       error
 }
 
 func NewServer(opts ServerOpts) (*Server, error) {
+	if opts.Genesis == nil {
+		opts.Genesis = &core.Genesis{
+			ChainID: opts.ChainID,
+			Alloc:   opts.GenesisAlloc,
+		}
+	}
+
+	if err := opts.Genesis.Validate(); err != nil {
+		return nil, err
+	}
+
+	if opts.BlockTime == 0 {
+		opts.BlockTime = time.Duration(opts.Genesis.Params.BlockTimeMs) * time.Millisecond
+	}
+
 	if opts.BlockTime == 0 {
 		opts.BlockTime = DefaultBlockTime
 	}
@@ -50,7 +132,29 @@ func NewServer(opts ServerOpts) (*Server, error) {
 		opts.Logger = log.With(opts.Logger, "ID", opts.ID)
 	}
 
-	chain, err := core.NewBlockChain(genesisBlock())
+	if opts.Storage == nil {
+		opts.Storage = core.NewMemStore()
+	}
+
+	if opts.MaxBlockSize == 0 {
+		opts.MaxBlockSize = int(opts.Genesis.Params.MaxBlockSize)
+	}
+
+	if opts.MaxBlockSize == 0 {
+		opts.MaxBlockSize = DefaultMaxBlockSize
+	}
+
+	if opts.ConsensusOpts.TimeoutCommit == 0 {
+		opts.ConsensusOpts.TimeoutCommit = opts.BlockTime
+	}
+
+	if opts.TxOrdering == nil {
+		opts.TxOrdering = FeeOrdering{}
+	}
+
+	chain, err := core.NewBlockChainFromGenesis(opts.Genesis, core.BlockchainOpts{
+		Storage: opts.Storage,
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -59,64 +163,287 @@ func NewServer(opts ServerOpts) (*Server, error) {
 		ServerOpts:  opts,
 		chain:       chain,
 		blockTime:   opts.BlockTime,
-		memPool:     NewTxPool(),
+		memPool:     NewTxPoolWithOpts(opts.TxPoolOpts),
+		builder:     NewBlockBuilder(opts.TxOrdering, opts.MaxBlockSize),
 		isValidator: opts.PrivateKey != nil,
 		rpcCh:       make(chan RPC),
-		quitCh:      make(chan struct{}, 1),
+		doneCh:      make(chan struct{}),
+		scores:      NewPeerScorer(opts.PeerScoreOpts),
+		peers:       make(map[NetAddr]Transport),
+		senders:     make(map[types.Hash]NetAddr),
 	}
 
-	// if no custom proccessor provided then use server as a default proccessor
-	if s.RPCProccesor == nil {
-		s.RPCProccesor = s
+	// with a validator set only its members propose blocks
+	if authority := chain.Authority(); s.isValidator && authority != nil {
+		addr := opts.PrivateKey.PublicKey().Address()
+		if !authority.Validators().Has(addr) {
+			_ = opts.Logger.Log("msg", "not in the validator set, not proposing blocks", "addr", addr)
+			s.isValidator = false
+		}
+	}
+
+	s.sync, err = NewSyncManager(chain, s.sendMessage, s.penalize, opts.SyncOpts, opts.Logger)
+	if err != nil {
+		return nil, err
+	}
+
+	s.peerManager, err = NewPeerManager(opts.Transports, s.sendMessage, opts.PeerOpts, opts.Logger)
+	if err != nil {
+		return nil, err
 	}
 
 	if s.isValidator {
-		go s.validatorLoop()
+		factory := opts.Consensus
+		if factory == nil {
+			factory = s.defaultEngine
+		}
+		if s.engine, err = factory(s); err != nil {
+			return nil, err
+		}
+	}
+
+	s.gossip = NewGossipManager(s.sendMessage, s.peerManager.Peers, s.hasInv, opts.GossipOpts, opts.Logger)
+
+	chain.OnReorg(s.handleReorg)
+	chain.OnBlock(s.handleBlock)
+	chain.OnOrphan(s.handleOrphan)
+	chain.OnEvidence(s.handleEvidence)
+	s.peerManager.OnConnect(s.handlePeerConnect)
+	s.peerManager.OnDisconnect(s.handlePeerDisconnect)
+	s.peerManager.Exclude(s.isBanned)
+
+	// if no custom proccessor provided then use server as a default proccessor
+	if s.RPCProccesor == nil {
+		s.RPCProccesor = s
 	}
 
 	return s, nil
 }
 
-func (s *Server) Start() {
+// Start runs the server until ctx is done or Stop is called and then shuts
+// it down, the returned error is the one of the shutdown. A server can only
+// be started once.
+func (s *Server) Start(ctx context.Context) error {
+	s.lifecycleLock.Lock()
+	if s.cancel != nil {
+		s.lifecycleLock.Unlock()
+		return ErrServerStarted
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	s.cancel = cancel
+	s.lifecycleLock.Unlock()
+
+	defer close(s.doneCh)
+
 	s.initTransports()
 
-free:
-	for {
+	loops := &sync.WaitGroup{}
+	run := func(loop func(context.Context)) {
+		loops.Add(1)
+		go func() {
+			defer loops.Done()
+			loop(ctx)
+		}()
+	}
+
+	run(s.sync.Loop)
+	run(s.peerManager.Loop)
+	run(s.gossip.Loop)
+	if s.engine != nil {
+		run(s.engine.Run)
+	}
+
+	if err := s.broadcastStatus(); err != nil {
+		_ = s.Logger.Log("msg", "failed to broadcast status", "err", err)
+	}
+
+	for ctx.Err() == nil {
 		select {
-		case rpc := <-s.rpcCh:
-			msg, err := s.RPCDecodeFunc(rpc)
-			if err != nil {
-				_ = s.Logger.Log("err", err)
+		case rpc, ok := <-s.rpcCh:
+			if !ok {
+				// every transport was closed, nothing is left to serve
+				cancel()
+				break
 			}
+			s.handleRPC(rpc)
+		case <-ctx.Done():
+		}
+	}
+
+	s.stopErr = s.shutdown(loops)
+	_ = s.Logger.Log("msg", "Server shutdown", "err", s.stopErr)
+
+	return s.stopErr
+}
+
+// Stop shuts down a started server and waits for Start to return. It must
+// not be called from a message handler.
+func (s *Server) Stop() error {
+	s.lifecycleLock.Lock()
+	cancel := s.cancel
+	s.lifecycleLock.Unlock()
 
-			if err := s.RPCProccesor.ProccessMessage(msg); err != nil {
-				logrus.Error(err)
+	if cancel == nil {
+		return ErrServerNotStarted
+	}
+
+	cancel()
+	<-s.doneCh
+
+	return s.stopErr
+}
+
+// shutdown waits for the loops to stop, closes the transports and handles the
+// messages that were already received, then closes the storage. Messages keep
+// being handled while the loops stop since they may wait for responses.
+func (s *Server) shutdown(loops *sync.WaitGroup) error {
+	loopsDone := make(chan struct{})
+	go func() {
+		loops.Wait()
+		close(loopsDone)
+	}()
+
+	rpcCh := s.rpcCh
+	for stopped := false; !stopped; {
+		select {
+		case rpc, ok := <-rpcCh:
+			if !ok {
+				rpcCh = nil
+				break
 			}
+			s.handleRPC(rpc)
+		case <-loopsDone:
+			stopped = true
+		}
+	}
 
-		case <-s.quitCh:
-			break free
+	closeErrCh := make(chan error, 1)
+	go func() {
+		closeErrCh <- s.closeTransports()
+	}()
 
+	// rpcCh is closed once every transport stopped delivering
+	for rpc := range s.rpcCh {
+		s.handleRPC(rpc)
+	}
+
+	errs := []error{<-closeErrCh}
+	if err := s.chain.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to close storage: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (s *Server) closeTransports() error {
+	errs := []error{}
+	for _, tr := range s.Transports {
+		if err := tr.Close(); err != nil && !errors.Is(err, ErrTransportClosed) {
+			errs = append(errs, fmt.Errorf("failed to close transport %s: %w", tr.Addr(), err))
 		}
 	}
+	return errors.Join(errs...)
+}
+
+// handleRPC decodes and processes a message of a peer. Messages of banned
+// peers are dropped, oversize, undecodable and rate limited messages as
+// well as invalid signatures and blocks lower the score of the peer.
+func (s *Server) handleRPC(rpc RPC) {
+	if s.isBanned(rpc.From) {
+		// inbound peers are only noticed once they send something
+		s.peerManager.Disconnect(rpc.From)
+		return
+	}
 
-	_ = s.Logger.Log("msg", "Server shutdown")
+	maxSize := s.scores.opts.MaxMessageSize
+	data, err := io.ReadAll(io.LimitReader(rpc.Payload, int64(maxSize)+1))
+	if err != nil {
+		_ = s.Logger.Log("err", err)
+		return
+	}
+	if len(data) > maxSize {
+		s.penalize(rpc.From, OffenseOversize)
+		return
+	}
+	rpc.Payload = bytes.NewReader(data)
+
+	msg, err := s.RPCDecodeFunc(rpc)
+	if err != nil {
+		_ = s.Logger.Log("err", err)
+		s.penalize(rpc.From, OffenseUndecodable)
+		return
+	}
+
+	if !s.scores.Allow(msg.From, msg.Type, time.Now()) {
+		s.penalize(msg.From, OffenseRateLimited)
+		return
+	}
+
+	if err := s.RPCProccesor.ProccessMessage(msg); err != nil {
+		logrus.Error(err)
+
+		switch {
+		case errors.Is(err, ErrInvalidSignature):
+			s.penalize(msg.From, OffenseInvalidSignature)
+		case errors.Is(err, core.ErrTimestampTooNew):
+			s.penalize(msg.From, OffenseFutureBlock)
+		case errors.Is(err, core.ErrBlockTooLarge), errors.Is(err, core.ErrTooManyTransactions):
+			s.penalize(msg.From, OffenseOversize)
+		case errors.Is(err, ErrInvalidBlock):
+			s.penalize(msg.From, OffenseInvalidBlock)
+		case errors.Is(err, consensus.ErrInvalidMessage):
+			s.penalize(msg.From, OffenseInvalidSignature)
+		}
+	}
 }
 
-func (s *Server) validatorLoop() {
-	_ = s.Logger.Log("msg", "Starting validator loop")
+// defaultEngine commits blocks with Tendermint on chains with BFT consensus,
+// mines them on chains with proof of work and proposes them on a timer
+// otherwise.
+func (s *Server) defaultEngine(b consensus.Backend) (consensus.Engine, error) {
+	if s.chain.ProofOfWork() != nil {
+		return consensus.NewMiner(b, *s.PrivateKey, s.MinerWorkers, s.Logger)
+	}
 
-	ticker := time.NewTicker(s.blockTime)
+	state, err := consensus.LoadSignState(s.SignStateFile)
+	if err != nil {
+		return nil, err
+	}
 
-	for {
-		<-ticker.C
-		_ = s.createNewBlock()
+	if s.chain.RequiresCommit() {
+		return consensus.NewTendermint(b, *s.PrivateKey, state, s.ConsensusOpts, s.Logger)
 	}
+	return consensus.NewSolo(b, *s.PrivateKey, state, s.blockTime, s.Logger), nil
 }
 
 func (s *Server) ProccessMessage(msg *DecodedMessage) error {
 	switch t := msg.Data.(type) {
 	case *core.Transaction:
-		return s.proccessTransaction(t)
+		return s.proccessTransaction(msg.From, t)
+	case *core.Block:
+		return s.proccessBlock(msg.From, t)
+	case *consensus.Message:
+		return s.proccessConsensus(t)
+	case *GetStatusMessage:
+		return s.sendStatus(msg.From)
+	case *StatusMessage:
+		return s.proccessStatus(msg.From, t)
+	case *GetHeadersMessage:
+		return s.proccessGetHeaders(msg.From, t)
+	case *HeadersMessage:
+		s.sync.Deliver(msg.From, t.ID, t)
+	case *GetBlocksMessage:
+		return s.proccessGetBlocks(msg.From, t)
+	case *BlocksMessage:
+		s.sync.Deliver(msg.From, t.ID, t)
+	case *GetPeersMessage:
+		return s.sendGob(msg.From, MessageTypePeers, &PeersMessage{Addrs: s.peerManager.PeerAddrs(msg.From)})
+	case *PeersMessage:
+		s.peerManager.AddAddrs(msg.From, t.Addrs)
+	case *InvMessage:
+		return s.proccessInv(msg.From, t)
+	case *GetDataMessage:
+		return s.proccessGetData(msg.From, t)
 	}
 
 	return nil
@@ -132,90 +459,582 @@ func (s *Server) broadcast(payload []byte) error {
 	return nil
 }
 
-func (s *Server) proccessTransaction(tx *core.Transaction) error {
-	hash := tx.Hash(core.TxHasher{})
+// proccessConsensus hands a consensus message to the engine, nodes that
+// produce no blocks ignore them.
+func (s *Server) proccessConsensus(msg *consensus.Message) error {
+	if s.engine == nil {
+		return nil
+	}
+	return s.engine.HandleMessage(msg)
+}
+
+// proccessBlock adds a block received from a peer to the chain, it is
+// announced by handleBlock once it becomes canonical. Known blocks are
+// ignored. An orphan is kept by the chain and its missing parent requested
+// from the peer, see handleOrphan.
+//
+// Only a block that breaks the consensus rules is an ErrInvalidBlock the
+// peer is penalized for. A block that conflicts with the finalized chain or
+// does not apply to the state of its parent may come from an honest peer
+// that lags behind or raced another block, it is rejected without blame.
+func (s *Server) proccessBlock(from NetAddr, b *core.Block) error {
+	hash := b.Hash(core.BlockHasher{})
+	if s.chain.HasBlockHash(hash) {
+		return nil
+	}
+	s.gossip.MarkSeen(hash)
+
+	s.senderLock.Lock()
+	s.senders[hash] = from
+	s.senderLock.Unlock()
+
+	err := s.chain.AddBlock(b)
+
+	s.senderLock.Lock()
+	delete(s.senders, hash)
+	s.senderLock.Unlock()
+
+	if err != nil {
+		if errors.Is(err, core.ErrOrphanBlock) {
+			return nil
+		}
+		// the same block may have been added concurrently
+		if s.chain.HasBlockHash(hash) {
+			return nil
+		}
+		// a rejected block may still prove that its validator double signed
+		s.chain.ReportBlock(b)
+		if breaksConsensus(err) {
+			return fmt.Errorf("%w %s from %s: %w", ErrInvalidBlock, hash, from, err)
+		}
+		return fmt.Errorf("rejected block %s from %s: %w", hash, from, err)
+	}
+
+	return nil
+}
+
+// breaksConsensus reports whether err proves the block invalid regardless of
+// the chain of the node that checked it.
+func breaksConsensus(err error) bool {
+	for _, target := range []error{
+		core.ErrInvalidSignature,
+		core.ErrBlockRule,
+		core.ErrInvalidCommit,
+		core.ErrMissingCommit,
+		core.ErrDataHashMismatch,
+		core.ErrInvalidProofOfWork,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
 
+func (s *Server) proccessStatus(from NetAddr, status *StatusMessage) error {
+	known := s.sync.HasPeer(from)
+
+	if err := s.sync.UpdatePeer(from, status); err != nil {
+		s.BanPeer(from, 0, err.Error())
+		return err
+	}
+
+	// answer the first status of a peer so both sides know each other
+	if !known {
+		return s.sendStatus(from)
+	}
+
+	return nil
+}
+
+func (s *Server) proccessGetHeaders(from NetAddr, req *GetHeadersMessage) error {
+	resp := &HeadersMessage{ID: req.ID, Headers: []*core.Block{}}
+
+	for _, height := range s.servedHeights(req.From, req.To, s.sync.opts.MaxHeadersPerRequest) {
+		b, err := s.chain.GetBlock(height)
+		if err != nil {
+			break
+		}
+		resp.Headers = append(resp.Headers, &core.Block{
+			Header:    b.Header,
+			Validator: b.Validator,
+			Signature: b.Signature,
+			Commit:    b.Commit,
+		})
+	}
+
+	msg, err := newHeadersMessage(resp)
+	if err != nil {
+		return err
+	}
+	return s.sendMessage(from, msg)
+}
+
+func (s *Server) proccessGetBlocks(from NetAddr, req *GetBlocksMessage) error {
+	resp := &BlocksMessage{ID: req.ID, Blocks: []*core.Block{}}
+
+	for _, height := range s.servedHeights(req.From, req.To, s.sync.opts.MaxBlocksPerRequest) {
+		b, err := s.chain.GetBlock(height)
+		if err != nil {
+			break
+		}
+		resp.Blocks = append(resp.Blocks, b)
+	}
+
+	msg, err := newBlocksMessage(resp)
+	if err != nil {
+		return err
+	}
+	return s.sendMessage(from, msg)
+}
+
+// servedHeights returns the heights from..to that are served in one response.
+func (s *Server) servedHeights(from, to, max uint32) []uint32 {
+	heights := []uint32{}
+	if from > to {
+		return heights
+	}
+
+	to = min(to, s.chain.Height())
+	max = min(max, MaxBlocksPerMessage)
+	for height := from; height <= to && uint32(len(heights)) < max; height++ {
+		heights = append(heights, height)
+	}
+	return heights
+}
+
+// proccessInv requests the announced items the node is missing.
+func (s *Server) proccessInv(from NetAddr, inv *InvMessage) error {
+	missing := s.gossip.Missing(inv.Items, time.Now())
+	if len(missing) == 0 {
+		return nil
+	}
+
+	return s.sendGob(from, MessageTypeGetData, &GetDataMessage{Items: missing})
+}
+
+// proccessGetData answers every requested item the node holds with a Tx or
+// Block message, unknown items are skipped.
+func (s *Server) proccessGetData(from NetAddr, req *GetDataMessage) error {
+	items := req.Items
+	if len(items) > MaxInvPerMessage {
+		items = items[:MaxInvPerMessage]
+	}
+
+	for _, item := range items {
+		var (
+			msg *Message
+			err error
+		)
+
+		switch item.Type {
+		case InvTypeTx:
+			tx, ok := s.memPool.Get(item.Hash)
+			if !ok {
+				continue
+			}
+			msg, err = newTxMessage(tx)
+		case InvTypeBlock:
+			b, lookupErr := s.chain.GetBlockByHash(item.Hash)
+			if lookupErr != nil {
+				continue
+			}
+			msg, err = newBlockMessage(b)
+		default:
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+		if err := s.sendMessage(from, msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hasInv reports whether the node holds an announced item.
+func (s *Server) hasInv(item InvVect) bool {
+	switch item.Type {
+	case InvTypeTx:
+		return s.memPool.Has(item.Hash)
+	case InvTypeBlock:
+		return s.chain.HasBlockHash(item.Hash)
+	default:
+		// unknown items are never requested
+		return true
+	}
+}
+
+// proccessTransaction adds a transaction to the mempool and announces it to
+// every peer except the one it came from, from is empty for local ones. A
+// transaction already in the mempool is dropped before its signature is
+// checked, so only new ones are verified.
+func (s *Server) proccessTransaction(from NetAddr, tx *core.Transaction) error {
+	// the hash covers the sender key, which has to be a point on the curve
+	if key := tx.From.Key; key != nil && !key.IsOnCurve(key.X, key.Y) {
+		return fmt.Errorf("%w of transaction from %s: sender key is not on the curve", ErrInvalidSignature, from)
+	}
+
+	hash := tx.Hash(core.TxHasher{})
 	if s.memPool.Has(hash) {
 		return nil
 	}
 
 	if err := tx.Verify(); err != nil {
+		return fmt.Errorf("%w of transaction from %s: %v", ErrInvalidSignature, from, err)
+	}
+	s.gossip.MarkSeen(hash)
+
+	if err := s.validateTransaction(tx); err != nil {
 		return err
 	}
 
 	tx.SetFirstSeen(time.Now().UnixNano())
 
+	if err := s.memPool.Add(tx); err != nil {
+		return err
+	}
+
 	_ = s.Logger.Log(
-		"msg", "adding new tx to mempool",
+		"msg", "added new tx to mempool",
 		"hash", hash,
 		"mempool_length", s.memPool.Len(),
 	)
 
-	// TODO: broadcast new tx to peers
-	go s.broadcastTx(tx)
+	s.gossip.Announce(InvVect{Type: InvTypeTx, Hash: hash}, from)
 
-	return s.memPool.Add(tx)
+	return nil
 }
 
-func (s *Server) broadcastTx(tx *core.Transaction) error {
-	buf := &bytes.Buffer{}
-	if err := tx.Encode(core.NewGobTxEncoder(buf)); err != nil {
-		return err
+// validateTransaction checks a verified transaction against the current chain state.
+func (s *Server) validateTransaction(tx *core.Transaction) error {
+	if tx.ChainID != s.chain.ChainID() {
+		return fmt.Errorf("transaction %s has chain id %d, expected %d", tx.Hash(core.TxHasher{}), tx.ChainID, s.chain.ChainID())
 	}
 
-	msg := NewMessage(MessageTypeTx, buf.Bytes())
+	if nonce := s.chain.GetAccount(tx.Sender()).Nonce; tx.Nonce < nonce {
+		return fmt.Errorf("transaction %s has nonce %d, account nonce is %d", tx.Hash(core.TxHasher{}), tx.Nonce, nonce)
+	}
 
-	return s.broadcast(msg.Bytes())
+	// evidence against a validator that was already slashed never applies
+	if tx.Type == core.TxTypeEvidence {
+		e, err := core.DecodeDoubleSignEvidence(tx.Data)
+		if err != nil {
+			return fmt.Errorf("transaction %s: %w", tx.Hash(core.TxHasher{}), err)
+		}
+		if s.chain.GetAccount(e.Offender()).Stake == 0 {
+			return fmt.Errorf("transaction %s reports %s, which holds no stake", tx.Hash(core.TxHasher{}), e.Offender())
+		}
+	}
+
+	return nil
 }
 
-func (s *Server) initTransports() {
-	for _, tr := range s.Transports {
-		go func(tr Transport) {
-			for rpc := range tr.Consume() {
-				s.rpcCh <- rpc
-			}
-		}(tr)
+// handleEvidence reports a double sign detected by the chain in a
+// transaction, nodes without a key only log it.
+func (s *Server) handleEvidence(e *core.DoubleSignEvidence) {
+	_ = s.Logger.Log("msg", "validator double signed", "validator", e.Offender(), "height", e.Height())
+
+	if s.PrivateKey == nil {
+		return
 	}
-}
 
-func (s *Server) createNewBlock() error {
-	_ = s.Logger.Log("msg", "creating new block", "cur_height", s.chain.Height())
-	curHeader, err := s.chain.GetHeader(s.chain.Height())
+	sender := s.PrivateKey.PublicKey().Address()
+	nonce := s.chain.GetAccount(sender).Nonce
+	for _, pending := range s.memPool.Transactions() {
+		if pending.Sender() == sender && pending.Nonce >= nonce {
+			nonce = pending.Nonce + 1
+		}
+	}
+
+	tx, err := core.NewEvidenceTransaction(e, nonce)
 	if err != nil {
-		return err
+		_ = s.Logger.Log("msg", "failed to create evidence transaction", "err", err)
+		return
+	}
+	tx.ChainID = s.chain.ChainID()
+	if err := tx.Sign(*s.PrivateKey); err != nil {
+		_ = s.Logger.Log("msg", "failed to sign evidence transaction", "err", err)
+		return
+	}
+
+	if err := s.proccessTransaction("", tx); err != nil {
+		_ = s.Logger.Log("msg", "failed to submit evidence transaction", "err", err)
+	}
+}
+
+// handleOrphan requests the oldest missing ancestor of a new orphan from the
+// peer that sent it, once it arrives the orphan is connected or the next
+// missing ancestor is requested.
+func (s *Server) handleOrphan(orphan *core.Block, missing types.Hash) {
+	s.senderLock.Lock()
+	from, ok := s.senders[orphan.Hash(core.BlockHasher{})]
+	s.senderLock.Unlock()
+
+	if !ok || from == "" {
+		return
+	}
+
+	items := s.gossip.Missing([]InvVect{{Type: InvTypeBlock, Hash: missing}}, time.Now())
+	if len(items) == 0 {
+		return
+	}
+
+	_ = s.Logger.Log("msg", "requesting parent of orphan block", "peer", from, "height", orphan.Height, "missing", missing)
+
+	if err := s.sendGob(from, MessageTypeGetData, &GetDataMessage{Items: items}); err != nil {
+		_ = s.Logger.Log("msg", "failed to request orphan parent", "peer", from, "err", err)
 	}
+}
+
+// handleBlock announces a new canonical block to the peers and drops its
+// transactions from the mempool along with the ones that no longer apply.
+func (s *Server) handleBlock(b *core.Block) {
+	s.gossip.Announce(InvVect{Type: InvTypeBlock, Hash: b.Hash(core.BlockHasher{})}, "")
+
+	included := s.memPool.RemoveIncluded(b)
+	invalid := s.memPool.Revalidate(s.validateTransaction)
+
+	_ = s.Logger.Log(
+		"msg", "pruned mempool",
+		"height", b.Height,
+		"included", included,
+		"invalid", invalid,
+		"mempool_length", s.memPool.Len(),
+	)
+}
 
-	//TODO: delete after testing
-	txx := []core.Transaction{}
-	for _, tx := range s.memPool.Transactions() {
-		txx = append(txx, *tx)
+// handleReorg puts the transactions of the blocks that were reorged out back
+// into the mempool.
+func (s *Server) handleReorg(e core.ReorgEvent) {
+	for _, orphaned := range e.OrphanedTxs {
+		tx := *orphaned
+		if err := s.validateTransaction(&tx); err != nil {
+			continue
+		}
+		if err := s.memPool.Add(&tx); err != nil {
+			_ = s.Logger.Log("msg", "failed to reinject transaction", "hash", tx.Hash(core.TxHasher{}), "err", err)
+		}
 	}
+}
+
+func (s *Server) sendStatus(to NetAddr) error {
+	return s.sendGob(to, MessageTypeStatus, s.sync.Status())
+}
 
-	block, err := core.NewBlockFromPrevHeader(curHeader, txx)
+func (s *Server) broadcastStatus() error {
+	msg, err := NewGobMessage(MessageTypeStatus, s.sync.Status())
 	if err != nil {
 		return err
 	}
+	return s.broadcast(msg.Bytes())
+}
 
-	if block.Sign(*s.PrivateKey) != nil {
+func (s *Server) sendGob(to NetAddr, t MessageType, payload any) error {
+	msg, err := NewGobMessage(t, payload)
+	if err != nil {
 		return err
 	}
+	return s.sendMessage(to, msg)
+}
 
-	if err := s.chain.AddBlock(block); err != nil {
-		return err
+// sendMessage sends the message over the transport the peer was seen on.
+func (s *Server) sendMessage(to NetAddr, msg *Message) error {
+	s.peerLock.RLock()
+	tr, ok := s.peers[to]
+	s.peerLock.RUnlock()
+
+	if !ok {
+		tr, ok = s.transportOf(to)
 	}
 
-	s.memPool.Flush()
+	if !ok {
+		return fmt.Errorf("unknown peer %s", to)
+	}
 
-	return nil
+	if s.isBanned(to) {
+		return fmt.Errorf("banned peer %s", to)
+	}
+
+	return tr.SendMessage(to, msg.Bytes())
+}
+
+// transportOf returns the transport a peer is connected on, for peers that
+// did not send a message yet.
+func (s *Server) transportOf(addr NetAddr) (Transport, bool) {
+	for _, tr := range s.Transports {
+		for _, peer := range tr.Peers() {
+			if peer.Addr == addr {
+				return tr, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// BanPeer bans a peer for a duration, zero bans it permanently. The peer is
+// disconnected and its messages are dropped, a permanently banned peer is
+// also removed from the address book.
+func (s *Server) BanPeer(addr NetAddr, d time.Duration, reason string) {
+	s.handleBan(s.scores.Ban(addr, s.peerID(addr), d, reason, time.Now()))
+}
+
+// UnbanPeer lifts the ban of a peer.
+func (s *Server) UnbanPeer(addr NetAddr) bool {
+	return s.scores.Unban(addr, s.peerID(addr))
+}
+
+// Bans returns the active bans.
+func (s *Server) Bans() []Ban {
+	return s.scores.Bans(time.Now())
+}
+
+// PeerScore returns the reputation of a peer, zero is the best score.
+func (s *Server) PeerScore(addr NetAddr) int {
+	return s.scores.Score(addr, time.Now())
+}
+
+func (s *Server) penalize(addr NetAddr, offense Offense) {
+	ban, banned := s.scores.Penalize(addr, s.peerID(addr), offense, time.Now())
+
+	_ = s.Logger.Log("msg", "penalized peer", "peer", addr, "offense", offense, "banned", banned)
+
+	if banned {
+		s.handleBan(ban)
+	}
+}
+
+// handleBan drops the banned peer and every other peer connected with the
+// same identity.
+func (s *Server) handleBan(ban Ban) {
+	_ = s.Logger.Log("msg", "banned peer", "peer", ban.Addr, "id", ban.ID, "until", ban.Until, "reason", ban.Reason)
+
+	addrs := []NetAddr{ban.Addr}
+	for _, tr := range s.Transports {
+		for _, peer := range tr.Peers() {
+			if peer.Addr != ban.Addr && peer.ID != "" && peer.ID == ban.ID {
+				addrs = append(addrs, peer.Addr)
+			}
+		}
+	}
+
+	for _, addr := range addrs {
+		s.peerLock.Lock()
+		delete(s.peers, addr)
+		s.peerLock.Unlock()
+
+		s.sync.RemovePeer(addr)
+
+		if ban.Permanent() {
+			s.peerManager.Forget(addr)
+		} else {
+			s.peerManager.Disconnect(addr)
+		}
+	}
+}
+
+func (s *Server) isBanned(addr NetAddr) bool {
+	return s.scores.IsBanned(s.peerID(addr), time.Now())
+}
+
+// peerID returns the identity the bans of a peer apply to, see PeerInfo. A
+// peer that is not connected is identified by its address.
+func (s *Server) peerID(addr NetAddr) string {
+	for _, tr := range s.Transports {
+		for _, peer := range tr.Peers() {
+			if peer.Addr == addr && peer.ID != "" {
+				return peer.ID
+			}
+		}
+	}
+	return addr.PeerID()
+}
+
+// handlePeerConnect introduces the node to a new peer and asks for its peers.
+func (s *Server) handlePeerConnect(addr NetAddr, tr Transport) {
+	if s.isBanned(addr) {
+		_ = tr.Disconnect(addr)
+		return
+	}
+
+	s.peerLock.Lock()
+	s.peers[addr] = tr
+	s.peerLock.Unlock()
+
+	if err := s.sendStatus(addr); err != nil {
+		_ = s.Logger.Log("msg", "failed to send status", "peer", addr, "err", err)
+	}
+	if err := s.peerManager.RequestPeers(addr); err != nil {
+		_ = s.Logger.Log("msg", "failed to request peers", "peer", addr, "err", err)
+	}
+}
+
+func (s *Server) handlePeerDisconnect(addr NetAddr, _ Transport) {
+	s.peerLock.Lock()
+	delete(s.peers, addr)
+	s.peerLock.Unlock()
+
+	s.sync.RemovePeer(addr)
+	// peers that came and went between two checks are dropped as well
+	s.scores.Retain(s.peerManager.Peers())
+}
+
+// initTransports forwards the messages of every transport to rpcCh, which is
+// closed once all transports are closed.
+func (s *Server) initTransports() {
+	wg := sync.WaitGroup{}
+	for _, tr := range s.Transports {
+		wg.Add(1)
+		go func(tr Transport) {
+			defer wg.Done()
+			for rpc := range tr.Consume() {
+				s.peerLock.Lock()
+				s.peers[rpc.From] = tr
+				s.peerLock.Unlock()
+
+				s.rpcCh <- rpc
+			}
+		}(tr)
+	}
+
+	go func() {
+		wg.Wait()
+		close(s.rpcCh)
+	}()
 }
 
-func genesisBlock() *core.Block {
-	header := core.Header{
-		Version:   1,
-		DataHash:  types.Hash{},
-		Timestamp: time.Now().UnixNano(),
-		Height:    0,
+// Chain returns the chain of the server.
+func (s *Server) Chain() *core.Blockchain {
+	return s.chain
+}
+
+// BuildBlock returns an unsigned block on top of parent, which must be the
+// tip, with the mempool transactions that apply to the current state.
+func (s *Server) BuildBlock(parent *core.Header, coinbase types.Address) (*core.Block, error) {
+	_ = s.Logger.Log("msg", "creating new block", "cur_height", parent.Height)
+
+	// only include transactions that apply on top of the current state, fees
+	// are paid to the coinbase
+	transition := s.chain.NewStateTransition(coinbase)
+
+	// a commit may carry the signature of every validator
+	commitSigs := 0
+	if authority := s.chain.Authority(); authority != nil {
+		commitSigs = authority.Validators().Len()
 	}
+	txx := s.builder.Select(s.memPool.Transactions(), transition, core.BlockOverhead(commitSigs))
 
-	return core.NewBlock(&header, nil)
+	return core.NewBlockFromPrevHeader(parent, txx)
+}
+
+// Broadcast sends a consensus message to every peer.
+func (s *Server) Broadcast(msg *consensus.Message) error {
+	out, err := newConsensusMessage(msg)
+	if err != nil {
+		return err
+	}
+	return s.broadcast(out.Bytes())
 }
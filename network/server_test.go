@@ -0,0 +1,810 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go-blockchain/consensus"
+	"go-blockchain/core"
+	"go-blockchain/crypto"
+	"go-blockchain/types"
+	"math/big"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+var goroutineHeader = regexp.MustCompile(`^goroutine (\d+) `)
+
+// moduleGoroutines returns the stacks of the goroutines running code of this
+// module by goroutine id.
+func moduleGoroutines() map[string]string {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+
+	stacks := map[string]string{}
+	for _, stack := range strings.Split(string(buf), "\n\n") {
+		m := goroutineHeader.FindStringSubmatch(stack)
+		if m != nil && strings.Contains(stack, "go-blockchain/") {
+			stacks[m[1]] = stack
+		}
+	}
+	return stacks
+}
+
+// checkGoroutineLeaks fails the test if a goroutine of this module started
+// during the test is still running once it ended.
+func checkGoroutineLeaks(t *testing.T) {
+	before := moduleGoroutines()
+
+	t.Cleanup(func() {
+		leaked := []string{}
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			leaked = leaked[:0]
+			for id, stack := range moduleGoroutines() {
+				if _, ok := before[id]; !ok {
+					leaked = append(leaked, stack)
+				}
+			}
+			if len(leaked) == 0 {
+				return
+			}
+		}
+
+		t.Errorf("leaked goroutines:\n%s", strings.Join(leaked, "\n\n"))
+	})
+}
+
+func TestServerRejectsReplayAcrossChains(t *testing.T) {
+	privKey := crypto.GeneratePrivateKey()
+	alloc := core.GenesisAlloc{privKey.PublicKey().Address(): 100}
+
+	s := newTestServer(t, ServerOpts{ChainID: 2, GenesisAlloc: alloc})
+
+	tx := signedTransfer(t, privKey, 1, 10, 0)
+	assert.NotNil(t, s.proccessTransaction("", tx))
+	assert.Equal(t, 0, s.memPool.Len())
+
+	// changing the chain id invalidates the signature
+	tampered := *tx
+	tampered.ChainID = 2
+	assert.NotNil(t, tampered.Verify())
+	assert.NotNil(t, s.proccessTransaction("", &tampered))
+
+	assert.Nil(t, s.proccessTransaction("", signedTransfer(t, privKey, 2, 10, 0)))
+	assert.Equal(t, 1, s.memPool.Len())
+}
+
+func TestServerRejectsTxWithoutValidSender(t *testing.T) {
+	s := newTestServer(t, ServerOpts{})
+
+	// a peer may send a transaction without a sender or with one off the curve
+	missing := signedTransfer(t, crypto.GeneratePrivateKey(), 0, 10, 0)
+	missing.From = crypto.PublicKey{}
+	assert.ErrorIs(t, s.proccessTransaction("peer", missing), ErrInvalidSignature)
+
+	offCurve := signedTransfer(t, crypto.GeneratePrivateKey(), 0, 10, 0)
+	key := *offCurve.From.Key
+	key.Y = new(big.Int).Add(key.Y, big.NewInt(1))
+	offCurve.From = crypto.PublicKey{Key: &key}
+	assert.ErrorIs(t, s.proccessTransaction("peer", offCurve), ErrInvalidSignature)
+
+	assert.Equal(t, 0, s.memPool.Len())
+}
+
+func TestServerSkipsVerifyingKnownTxs(t *testing.T) {
+	privKey := crypto.GeneratePrivateKey()
+	alloc := core.GenesisAlloc{privKey.PublicKey().Address(): 100}
+	s := newTestServer(t, ServerOpts{GenesisAlloc: alloc})
+
+	tx := signedTransfer(t, privKey, 0, 10, 0)
+	assert.Nil(t, s.proccessTransaction("peer", tx))
+
+	// a pooled transaction is dropped before its signature is checked
+	again := *tx
+	again.Signature = nil
+	assert.Nil(t, s.proccessTransaction("peer", &again))
+	assert.Equal(t, 1, s.memPool.Len())
+}
+
+func TestServerRejectsReplayAcrossBlocks(t *testing.T) {
+	privKey := crypto.GeneratePrivateKey()
+	validator := crypto.GeneratePrivateKey()
+	alloc := core.GenesisAlloc{privKey.PublicKey().Address(): 100}
+
+	s := newTestServer(t, ServerOpts{GenesisAlloc: alloc, PrivateKey: &validator, BlockTime: 1 << 62})
+
+	tx := signedTransfer(t, privKey, 0, 10, 0)
+	assert.Nil(t, s.proccessTransaction("", tx))
+	assert.Nil(t, produceBlock(s))
+	assert.Equal(t, uint32(1), s.chain.Height())
+	assert.Equal(t, uint64(1), s.chain.GetAccount(privKey.PublicKey().Address()).Nonce)
+
+	// the same signed transaction is rejected by the mempool and by the chain
+	replay := *tx
+	assert.NotNil(t, s.proccessTransaction("", &replay))
+
+	header, err := s.chain.GetHeader(1)
+	assert.Nil(t, err)
+	b, err := core.NewBlockFromPrevHeader(header, []core.Transaction{*tx})
+	assert.Nil(t, err)
+	assert.Nil(t, b.Sign(validator))
+	assert.NotNil(t, s.chain.AddBlock(b))
+
+	// a conflicting transaction with an already pooled nonce is rejected
+	assert.Nil(t, s.proccessTransaction("", signedTransfer(t, privKey, 0, 10, 1)))
+	assert.NotNil(t, s.proccessTransaction("", signedTransfer(t, privKey, 0, 20, 1)))
+}
+
+func TestServerRemovesTxsOfReceivedBlocks(t *testing.T) {
+	privKey := crypto.GeneratePrivateKey()
+	alloc := core.GenesisAlloc{privKey.PublicKey().Address(): 100}
+
+	s := newTestServer(t, ServerOpts{GenesisAlloc: alloc})
+
+	included := signedTransfer(t, privKey, 0, 10, 0)
+	pending := signedTransfer(t, privKey, 0, 10, 1)
+	assert.Nil(t, s.proccessTransaction("", included))
+	assert.Nil(t, s.proccessTransaction("", pending))
+	assert.Nil(t, s.proccessTransaction("", signedTransfer(t, privKey, 0, 10, 5)))
+
+	// a block of another validator that also includes a conflicting nonce 1
+	header, err := s.chain.GetHeader(0)
+	assert.Nil(t, err)
+	conflicting := signedTransfer(t, privKey, 0, 20, 1)
+	b, err := core.NewBlockFromPrevHeader(header, []core.Transaction{*included, *conflicting})
+	assert.Nil(t, err)
+	assert.Nil(t, b.Sign(crypto.GeneratePrivateKey()))
+	assert.Nil(t, s.chain.AddBlock(b))
+
+	// only the transaction with the future nonce is left
+	assert.Equal(t, 1, s.memPool.Len())
+	assert.False(t, s.memPool.Has(pending.Hash(core.TxHasher{})))
+}
+
+func TestServerReinjectsReorgedTxs(t *testing.T) {
+	privKey := crypto.GeneratePrivateKey()
+	validator := crypto.GeneratePrivateKey()
+	alloc := core.GenesisAlloc{privKey.PublicKey().Address(): 100}
+
+	s := newTestServer(t, ServerOpts{GenesisAlloc: alloc, PrivateKey: &validator, BlockTime: 1 << 62})
+
+	tx := signedTransfer(t, privKey, 0, 10, 0)
+	assert.Nil(t, s.proccessTransaction("", tx))
+	assert.Nil(t, produceBlock(s))
+	assert.Equal(t, 0, s.memPool.Len())
+
+	// a longer branch without the transaction replaces the block
+	header, err := s.chain.GetHeader(0)
+	assert.Nil(t, err)
+	other := crypto.GeneratePrivateKey()
+	for i := 0; i < 2; i++ {
+		b, err := core.NewBlockFromPrevHeader(header, nil)
+		assert.Nil(t, err)
+		assert.Nil(t, b.Sign(other))
+		assert.Nil(t, s.chain.AddBlock(b))
+		header = b.Header
+	}
+
+	assert.Equal(t, uint32(2), s.chain.Height())
+	assert.True(t, s.memPool.Has(tx.Hash(core.TxHasher{})))
+
+	assert.Nil(t, produceBlock(s))
+	_, err = s.chain.GetTxByHash(tx.Hash(core.TxHasher{}))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, s.memPool.Len())
+}
+
+func TestServerKeepsTxsArrivingDuringBlockCreation(t *testing.T) {
+	validator := crypto.GeneratePrivateKey()
+	senders := make([]crypto.PrivateKey, 8)
+	alloc := core.GenesisAlloc{}
+	for i := range senders {
+		senders[i] = crypto.GeneratePrivateKey()
+		alloc[senders[i].PublicKey().Address()] = 1_000_000
+	}
+
+	s := newTestServer(t, ServerOpts{GenesisAlloc: alloc, PrivateKey: &validator, BlockTime: 1 << 62})
+
+	const txsPerSender = 50
+	hashes := make(chan types.Hash, len(senders)*txsPerSender)
+	done := make(chan struct{})
+	wg := sync.WaitGroup{}
+
+	for _, privKey := range senders {
+		wg.Add(1)
+		go func(privKey crypto.PrivateKey) {
+			defer wg.Done()
+			for nonce := uint64(0); nonce < txsPerSender; nonce++ {
+				tx := signedTransfer(t, privKey, 0, 1, nonce)
+				assert.Nil(t, s.proccessTransaction("", tx))
+				hashes <- tx.Hash(core.TxHasher{})
+			}
+		}(privKey)
+	}
+
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+loop:
+	for {
+		select {
+		case <-done:
+			break loop
+		default:
+			assert.Nil(t, produceBlock(s))
+		}
+	}
+
+	for s.memPool.Len() > 0 {
+		assert.Nil(t, produceBlock(s))
+	}
+	close(hashes)
+
+	count := 0
+	for hash := range hashes {
+		_, err := s.chain.GetTxByHash(hash)
+		assert.Nil(t, err)
+		count++
+	}
+	assert.Equal(t, len(senders)*txsPerSender, count)
+}
+
+func TestServersConvergeOnBlocks(t *testing.T) {
+	privKey := crypto.GeneratePrivateKey()
+	validator := crypto.GeneratePrivateKey()
+	alloc := core.GenesisAlloc{privKey.PublicKey().Address(): 1000}
+
+	// A - B - C, blocks of A reach C through B
+	tra := NewLocalTransport("A")
+	trb := NewLocalTransport("B")
+	trc := NewLocalTransport("C")
+	assert.Nil(t, tra.Connect(trb))
+	assert.Nil(t, trb.Connect(tra))
+	assert.Nil(t, trb.Connect(trc))
+	assert.Nil(t, trc.Connect(trb))
+
+	a := newTestServer(t, ServerOpts{ID: "A", Transports: []Transport{tra}, GenesisAlloc: alloc, PrivateKey: &validator, BlockTime: 1 << 62})
+	b := newTestServer(t, ServerOpts{ID: "B", Transports: []Transport{trb}, GenesisAlloc: alloc})
+	c := newTestServer(t, ServerOpts{ID: "C", Transports: []Transport{trc}, GenesisAlloc: alloc})
+
+	servers := []*Server{a, b, c}
+	for _, s := range servers {
+		startServer(t, s)
+	}
+
+	for nonce := uint64(0); nonce < 5; nonce++ {
+		assert.Nil(t, a.proccessTransaction("", signedTransfer(t, privKey, 0, 10, nonce)))
+		assert.Nil(t, produceBlock(a))
+	}
+
+	tip, err := a.chain.GetHeader(5)
+	assert.Nil(t, err)
+	tipHash := core.BlockHasher{}.Hash(tip)
+
+	for _, s := range servers[1:] {
+		assert.Eventually(t, func() bool {
+			if s.chain.Height() != 5 {
+				return false
+			}
+			h, err := s.chain.GetHeader(5)
+			return err == nil && core.BlockHasher{}.Hash(h) == tipHash
+		}, 5*time.Second, 10*time.Millisecond)
+
+		assert.Equal(t, uint64(5), s.chain.GetAccount(privKey.PublicKey().Address()).Nonce)
+	}
+}
+
+func TestServerFetchesParentOfOrphan(t *testing.T) {
+	producer := newSyncServer(t, NewLocalTransport("orphan-producer"), true)
+	produceBlocks(t, producer, 2)
+	parent, err := producer.chain.GetBlock(1)
+	assert.Nil(t, err)
+	orphan, err := producer.chain.GetBlock(2)
+	assert.Nil(t, err)
+
+	tr := NewLocalTransport("orphan")
+	peer := NewLocalTransport("orphan-peer")
+	t.Cleanup(func() {
+		_ = tr.Close()
+		_ = peer.Close()
+	})
+	s := newLocalServer(t, tr, false, ServerOpts{})
+	startServer(t, s)
+	assert.Nil(t, peer.Dial(tr.Addr()))
+
+	msg, err := newBlockMessage(orphan)
+	assert.Nil(t, err)
+	assert.Nil(t, peer.SendMessage(tr.Addr(), msg.Bytes()))
+
+	// the parent is asked for from the peer that sent the orphan, which
+	// does not answer any status request
+	timeout := time.After(5 * time.Second)
+	for requested := false; !requested; {
+		select {
+		case rpc := <-peer.Consume():
+			decoded, err := DefaultRPCDecodeFunc(rpc)
+			assert.Nil(t, err)
+			if req, ok := decoded.Data.(*GetDataMessage); ok {
+				assert.Equal(t, []InvVect{{Type: InvTypeBlock, Hash: parent.Hash(core.BlockHasher{})}}, req.Items)
+				requested = true
+			}
+		case <-timeout:
+			t.Fatal("parent of the orphan was not requested")
+		}
+	}
+
+	msg, err = newBlockMessage(parent)
+	assert.Nil(t, err)
+	assert.Nil(t, peer.SendMessage(tr.Addr(), msg.Bytes()))
+	assert.Eventually(t, func() bool {
+		return s.chain.Height() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestDecodeBlockMessage(t *testing.T) {
+	assert.NotEqual(t, MessageTypeTx, MessageTypeBlock)
+
+	s := newTestServer(t, ServerOpts{})
+	header, err := s.chain.GetHeader(0)
+	assert.Nil(t, err)
+	b, err := core.NewBlockFromPrevHeader(header, []core.Transaction{*signedTransfer(t, crypto.GeneratePrivateKey(), 0, 1, 0)})
+	assert.Nil(t, err)
+	assert.Nil(t, b.Sign(crypto.GeneratePrivateKey()))
+
+	buf := &bytes.Buffer{}
+	assert.Nil(t, b.Encode(core.NewCanonicalBlockEncoder(buf)))
+	msg := NewMessage(MessageTypeBlock, buf.Bytes())
+
+	decoded, err := DefaultRPCDecodeFunc(RPC{From: "A", Payload: bytes.NewReader(msg.Bytes())})
+	assert.Nil(t, err)
+	assert.Equal(t, NetAddr("A"), decoded.From)
+
+	decodedBlock, ok := decoded.Data.(*core.Block)
+	assert.True(t, ok)
+	assert.Equal(t, b.Hash(core.BlockHasher{}), decodedBlock.Hash(core.BlockHasher{}))
+	assert.Nil(t, decodedBlock.Verify())
+}
+
+func TestServerStartAndStop(t *testing.T) {
+	s := newTestServer(t, ServerOpts{Transports: []Transport{NewLocalTransport("stop-A")}})
+	assert.ErrorIs(t, s.Stop(), ErrServerNotStarted)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Start(context.Background())
+	}()
+
+	assert.Eventually(t, func() bool {
+		return s.Start(context.Background()) == ErrServerStarted
+	}, time.Second, time.Millisecond)
+
+	assert.Nil(t, s.Stop())
+	assert.Nil(t, <-errCh)
+	assert.Nil(t, s.Stop())
+
+	// the transports are closed
+	_, ok := <-s.Transports[0].Consume()
+	assert.False(t, ok)
+}
+
+// TestServersStopWithoutLeaks starts and stops connected validators and
+// followers over both transports while blocks and transactions are relayed,
+// every goroutine they started has to end.
+func TestServersStopWithoutLeaks(t *testing.T) {
+	checkGoroutineLeaks(t)
+
+	privKey := crypto.GeneratePrivateKey()
+	alloc := core.GenesisAlloc{privKey.PublicKey().Address(): 1_000_000}
+
+	for i := 0; i < 20; i++ {
+		var tra, trb Transport
+		if i%2 == 0 {
+			tra = NewLocalTransport(NetAddr(fmt.Sprintf("leak-A-%d", i)))
+			trb = NewLocalTransport(NetAddr(fmt.Sprintf("leak-B-%d", i)))
+		} else {
+			tra = newTCPTransport(t, TCPTransportOpts{})
+			trb = newTCPTransport(t, TCPTransportOpts{})
+		}
+
+		validator := crypto.GeneratePrivateKey()
+		a := newTestServer(t, ServerOpts{
+			Transports:   []Transport{tra},
+			PrivateKey:   &validator,
+			BlockTime:    5 * time.Millisecond,
+			GenesisAlloc: alloc,
+			Logger:       log.NewNopLogger(),
+		})
+		b := newTestServer(t, ServerOpts{
+			Transports:   []Transport{trb},
+			GenesisAlloc: alloc,
+			Logger:       log.NewNopLogger(),
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		errCh := make(chan error, 2)
+		for _, s := range []*Server{a, b} {
+			go func(s *Server) {
+				errCh <- s.Start(ctx)
+			}(s)
+		}
+		assert.Nil(t, trb.Dial(tra.Addr()))
+
+		for nonce := uint64(0); nonce < 5; nonce++ {
+			assert.Nil(t, b.proccessTransaction("", signedTransfer(t, privKey, 0, 10, nonce)))
+		}
+		assert.Eventually(t, func() bool {
+			return b.chain.Height() >= 2
+		}, 5*time.Second, time.Millisecond)
+
+		// one server is stopped directly, the other one through its context
+		assert.Nil(t, a.Stop())
+		cancel()
+		assert.Nil(t, <-errCh)
+		assert.Nil(t, <-errCh)
+	}
+}
+
+func TestServersTakeTurnsProposing(t *testing.T) {
+	keys := []crypto.PrivateKey{crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey()}
+	genesis := &core.Genesis{Params: core.GenesisParams{BlockTimeMs: 50}}
+	for _, key := range keys {
+		genesis.Validators = append(genesis.Validators, core.GenesisValidator{PublicKey: key.PublicKey(), Power: 1})
+	}
+
+	// the third validator is offline, the first one takes over its turns, a
+	// node outside of the set never proposes
+	tra := NewLocalTransport("poa-A")
+	trb := NewLocalTransport("poa-B")
+	trc := NewLocalTransport("poa-C")
+	t.Cleanup(func() {
+		_ = tra.Close()
+		_ = trb.Close()
+		_ = trc.Close()
+	})
+	assert.Nil(t, trb.Dial(tra.Addr()))
+	assert.Nil(t, trc.Dial(tra.Addr()))
+
+	outsider := crypto.GeneratePrivateKey()
+	a := newTestServer(t, ServerOpts{ID: "poa-A", Transports: []Transport{tra}, Genesis: genesis, PrivateKey: &keys[0]})
+	b := newTestServer(t, ServerOpts{ID: "poa-B", Transports: []Transport{trb}, Genesis: genesis, PrivateKey: &keys[1]})
+	c := newTestServer(t, ServerOpts{ID: "poa-C", Transports: []Transport{trc}, Genesis: genesis, PrivateKey: &outsider})
+	assert.False(t, c.isValidator)
+
+	for _, s := range []*Server{a, b, c} {
+		startServer(t, s)
+	}
+
+	for _, s := range []*Server{a, b, c} {
+		assert.Eventually(t, func() bool {
+			return s.chain.Height() >= 6
+		}, 10*time.Second, 10*time.Millisecond)
+	}
+
+	for height := uint32(1); height <= 6; height++ {
+		block, err := c.chain.GetBlock(height)
+		assert.Nil(t, err)
+
+		expected := keys[height%3].PublicKey()
+		if height%3 == 2 {
+			expected = keys[0].PublicKey()
+		}
+		assert.Equal(t, expected.Address(), block.Validator.Address(), "height %d", height)
+	}
+
+	// a block of the node outside of the set is rejected
+	assert.NotNil(t, produceBlock(c))
+}
+
+// equivocatingEngine votes for random blocks at the next height and never
+// proposes.
+type equivocatingEngine struct {
+	backend consensus.Backend
+	privKey crypto.PrivateKey
+}
+
+func (e *equivocatingEngine) Run(ctx context.Context) {
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		height := e.backend.Chain().Height() + 1
+		for _, voteType := range []core.VoteType{core.VotePrevote, core.VotePrecommit} {
+			v := &core.Vote{Type: voteType, Height: height, BlockHash: types.RandomHash()}
+			if err := v.Sign(e.privKey); err != nil {
+				return
+			}
+			_ = e.backend.Broadcast(&consensus.Message{Vote: v})
+		}
+	}
+}
+
+func (e *equivocatingEngine) HandleMessage(*consensus.Message) error {
+	return nil
+}
+
+func TestServersCommitBlocksWithFaultyValidator(t *testing.T) {
+	keys := []crypto.PrivateKey{crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey()}
+	privKey := crypto.GeneratePrivateKey()
+	genesis := &core.Genesis{
+		Alloc:  core.GenesisAlloc{privKey.PublicKey().Address(): 1000},
+		Params: core.GenesisParams{BlockTimeMs: 20, Consensus: core.ConsensusBFT},
+	}
+	for _, key := range keys {
+		genesis.Validators = append(genesis.Validators, core.GenesisValidator{PublicKey: key.PublicKey(), Power: 1})
+	}
+
+	// four connected validators, the second one is faulty, and a follower
+	trs := []Transport{}
+	for _, name := range []string{"bft-0", "bft-1", "bft-2", "bft-3", "bft-follower"} {
+		tr := NewLocalTransport(NetAddr(name))
+		t.Cleanup(func() { _ = tr.Close() })
+		trs = append(trs, tr)
+	}
+	for i := range keys {
+		for j := i + 1; j < len(keys); j++ {
+			assert.Nil(t, trs[i].Dial(trs[j].Addr()))
+		}
+	}
+	assert.Nil(t, trs[4].Dial(trs[0].Addr()))
+
+	opts := consensus.TendermintOpts{
+		TimeoutPropose:   100 * time.Millisecond,
+		TimeoutPrevote:   50 * time.Millisecond,
+		TimeoutPrecommit: 50 * time.Millisecond,
+		TimeoutDelta:     20 * time.Millisecond,
+	}
+	servers := []*Server{}
+	for i, tr := range trs {
+		serverOpts := ServerOpts{
+			ID:            string(tr.Addr()),
+			Transports:    []Transport{tr},
+			Genesis:       genesis,
+			ConsensusOpts: opts,
+		}
+		if i < len(keys) {
+			serverOpts.PrivateKey = &keys[i]
+		}
+		if i == 1 {
+			serverOpts.Consensus = func(b consensus.Backend) (consensus.Engine, error) {
+				return &equivocatingEngine{backend: b, privKey: keys[1]}, nil
+			}
+		}
+		servers = append(servers, newTestServer(t, serverOpts))
+	}
+	for _, s := range servers {
+		startServer(t, s)
+	}
+
+	assert.Nil(t, servers[0].proccessTransaction("", signedTransfer(t, privKey, 0, 10, 0)))
+
+	honest := []*Server{servers[0], servers[2], servers[3], servers[4]}
+	for _, s := range honest {
+		assert.Eventually(t, func() bool {
+			return s.chain.FinalizedHeight() >= 6 && s.chain.GetAccount(privKey.PublicKey().Address()).Nonce == 1
+		}, 10*time.Second, 10*time.Millisecond)
+	}
+
+	validators := servers[0].chain.Authority().Validators()
+	for height := uint32(1); height <= 6; height++ {
+		b, err := servers[4].chain.GetBlock(height)
+		assert.Nil(t, err)
+		assert.Nil(t, b.Commit.Verify(b, validators))
+
+		for _, s := range honest[:3] {
+			other, err := s.chain.GetBlock(height)
+			assert.Nil(t, err)
+			assert.Equal(t, b.Hash(core.BlockHasher{}), other.Hash(core.BlockHasher{}))
+		}
+	}
+}
+
+// doubleSigningEngine signs two blocks on its first turn and sends each of
+// them to another peer, it never proposes again.
+type doubleSigningEngine struct {
+	server  *Server
+	privKey crypto.PrivateKey
+	peers   []NetAddr
+}
+
+func (e *doubleSigningEngine) Run(ctx context.Context) {
+	ticker := time.NewTicker(5 * time.Millisecond)
+	defer ticker.Stop()
+
+	chain := e.server.Chain()
+	addr := e.privKey.PublicKey().Address()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		parent, err := chain.GetHeader(chain.Height())
+		if err != nil || chain.Authority().Validators().Proposer(parent.Height+1, 0).Address() != addr {
+			continue
+		}
+
+		for i, to := range e.peers {
+			b, err := e.server.BuildBlock(parent, addr)
+			if err != nil {
+				return
+			}
+			b.Timestamp += int64(i)
+			if err := b.Sign(e.privKey); err != nil {
+				return
+			}
+
+			msg, err := newBlockMessage(b)
+			if err != nil {
+				return
+			}
+			_ = e.server.sendMessage(to, msg)
+		}
+		return
+	}
+}
+
+func (e *doubleSigningEngine) HandleMessage(*consensus.Message) error {
+	return nil
+}
+
+func TestServersSlashDoubleSigningValidator(t *testing.T) {
+	keys := []crypto.PrivateKey{crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey()}
+	genesis := &core.Genesis{Params: core.GenesisParams{BlockTimeMs: 50}}
+	for _, key := range keys {
+		genesis.Validators = append(genesis.Validators, core.GenesisValidator{PublicKey: key.PublicKey(), Power: 1})
+	}
+
+	// three connected honest validators, the fourth one is connected to two
+	// of them and sends each a different block at its turn
+	trs := []Transport{}
+	for _, name := range []string{"slash-0", "slash-1", "slash-2", "slash-3"} {
+		tr := NewLocalTransport(NetAddr(name))
+		t.Cleanup(func() { _ = tr.Close() })
+		trs = append(trs, tr)
+	}
+	assert.Nil(t, trs[1].Dial(trs[0].Addr()))
+	assert.Nil(t, trs[2].Dial(trs[0].Addr()))
+	assert.Nil(t, trs[2].Dial(trs[1].Addr()))
+	assert.Nil(t, trs[3].Dial(trs[0].Addr()))
+	assert.Nil(t, trs[3].Dial(trs[1].Addr()))
+
+	servers := []*Server{}
+	for i, tr := range trs {
+		serverOpts := ServerOpts{
+			ID:         string(tr.Addr()),
+			Transports: []Transport{tr},
+			Genesis:    genesis,
+			PrivateKey: &keys[i],
+		}
+		if i == 3 {
+			serverOpts.Consensus = func(b consensus.Backend) (consensus.Engine, error) {
+				return &doubleSigningEngine{server: b.(*Server), privKey: keys[3], peers: []NetAddr{trs[0].Addr(), trs[1].Addr()}}, nil
+			}
+		}
+		servers = append(servers, newTestServer(t, serverOpts))
+	}
+	for _, s := range servers {
+		startServer(t, s)
+	}
+
+	offender := keys[3].PublicKey().Address()
+	honest := servers[:3]
+	for _, s := range honest {
+		assert.Eventually(t, func() bool {
+			return s.chain.GetAccount(offender).Stake == 0 && !s.chain.Authority().Validators().Has(offender)
+		}, 10*time.Second, 10*time.Millisecond)
+	}
+
+	// the evidence was included in a block
+	reported := 0
+	for height := uint32(1); height <= servers[0].chain.Height(); height++ {
+		b, err := servers[0].chain.GetBlock(height)
+		assert.Nil(t, err)
+		for _, tx := range b.Transactions {
+			if tx.Type != core.TxTypeEvidence {
+				continue
+			}
+			e, err := core.DecodeDoubleSignEvidence(tx.Data)
+			assert.Nil(t, err)
+			assert.Equal(t, offender, e.Offender())
+			reported++
+		}
+	}
+	assert.Equal(t, 1, reported)
+
+	// the honest validators go on without the offender
+	height := servers[0].chain.Height()
+	for _, s := range honest {
+		assert.Eventually(t, func() bool {
+			return s.chain.Height() >= height+3
+		}, 10*time.Second, 10*time.Millisecond)
+	}
+	for h := height + 1; h <= height+3; h++ {
+		b, err := servers[2].chain.GetBlock(h)
+		assert.Nil(t, err)
+		assert.NotEqual(t, offender, b.Validator.Address())
+	}
+}
+
+func TestServersMineBlocks(t *testing.T) {
+	privKey := crypto.GeneratePrivateKey()
+	genesis := &core.Genesis{
+		Alloc:  core.GenesisAlloc{privKey.PublicKey().Address(): 1000},
+		Params: core.GenesisParams{Consensus: core.ConsensusPoW, Bits: 0x1f0fffff, RetargetInterval: 1000},
+	}
+
+	// two miners extend each others blocks, a follower dials one of them
+	tra := NewLocalTransport("pow-A")
+	trb := NewLocalTransport("pow-B")
+	trc := NewLocalTransport("pow-C")
+	t.Cleanup(func() {
+		_ = tra.Close()
+		_ = trb.Close()
+		_ = trc.Close()
+	})
+	assert.Nil(t, trb.Dial(tra.Addr()))
+	assert.Nil(t, trc.Dial(trb.Addr()))
+
+	keys := []crypto.PrivateKey{crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey()}
+	a := newTestServer(t, ServerOpts{ID: "pow-A", Transports: []Transport{tra}, Genesis: genesis, PrivateKey: &keys[0], MinerWorkers: 1})
+	b := newTestServer(t, ServerOpts{ID: "pow-B", Transports: []Transport{trb}, Genesis: genesis, PrivateKey: &keys[1], MinerWorkers: 1})
+	c := newTestServer(t, ServerOpts{ID: "pow-C", Transports: []Transport{trc}, Genesis: genesis})
+
+	servers := []*Server{a, b, c}
+	for _, s := range servers {
+		startServer(t, s)
+	}
+
+	assert.Nil(t, c.proccessTransaction("", signedTransfer(t, privKey, 0, 10, 0)))
+
+	for _, s := range servers {
+		assert.Eventually(t, func() bool {
+			return s.chain.Height() >= 8 && s.chain.GetAccount(privKey.PublicKey().Address()).Nonce == 1
+		}, 20*time.Second, 10*time.Millisecond)
+	}
+
+	// ties at the tip may still be open, the blocks below are settled
+	assert.Eventually(t, func() bool {
+		for height := uint32(1); height <= 4; height++ {
+			expected, err := a.chain.GetHeader(height)
+			if err != nil {
+				return false
+			}
+			for _, s := range servers[1:] {
+				h, err := s.chain.GetHeader(height)
+				if err != nil || (core.BlockHasher{}).Hash(h) != (core.BlockHasher{}).Hash(expected) {
+					return false
+				}
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	b1, err := c.chain.GetBlock(1)
+	assert.Nil(t, err)
+	assert.Equal(t, core.HeaderVersionPoW, b1.Version)
+	assert.Equal(t, uint32(0x1f0fffff), b1.Bits)
+}
@@ -0,0 +1,459 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-blockchain/core"
+	"go-blockchain/types"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+const (
+	DefaultMaxHeadersPerRequest = 512
+	DefaultMaxBlocksPerRequest  = 32
+	DefaultSyncRequestTimeout   = 5 * time.Second
+	DefaultSyncRetries          = 3
+)
+
+var ErrSyncTimeout = errors.New("sync request timed out")
+
+// errBodyMismatch is returned for a block whose header was requested but
+// whose transactions do not match its data hash.
+var errBodyMismatch = errors.New("block body does not match its header")
+
+type SyncOpts struct {
+	// MaxHeadersPerRequest and MaxBlocksPerRequest cap the size of a single
+	// request, they also cap what is served to peers
+	MaxHeadersPerRequest uint32
+	MaxBlocksPerRequest  uint32
+	// RequestTimeout is how long to wait for a peer to answer
+	RequestTimeout time.Duration
+	// MaxRetries is how often a batch of blocks is requested before the sync
+	// round is given up
+	MaxRetries int
+}
+
+// SyncSendFunc sends a message to a single peer.
+type SyncSendFunc func(to NetAddr, msg *Message) error
+
+// SyncPenalizeFunc reports a peer that misbehaved during a sync.
+type SyncPenalizeFunc func(peer NetAddr, offense Offense)
+
+type syncRequest struct {
+	peer   NetAddr
+	respCh chan any
+}
+
+// SyncManager brings the chain up to date with the peers. It downloads the
+// headers of the best peer first, checks that they form a chain on top of a
+// known block and then fetches the bodies in parallel from every peer that
+// has them.
+type SyncManager struct {
+	opts        SyncOpts
+	chain       *core.Blockchain
+	genesisHash types.Hash
+	send        SyncSendFunc
+	penalize    SyncPenalizeFunc
+	logger      log.Logger
+
+	lock    sync.Mutex
+	peers   map[NetAddr]*StatusMessage
+	pending map[uint64]*syncRequest
+	nextID  uint64
+
+	triggerCh chan struct{}
+}
+
+func NewSyncManager(chain *core.Blockchain, send SyncSendFunc, penalize SyncPenalizeFunc, opts SyncOpts, logger log.Logger) (*SyncManager, error) {
+	if opts.MaxHeadersPerRequest == 0 {
+		opts.MaxHeadersPerRequest = DefaultMaxHeadersPerRequest
+	}
+	if opts.MaxBlocksPerRequest == 0 {
+		opts.MaxBlocksPerRequest = DefaultMaxBlocksPerRequest
+	}
+	if opts.RequestTimeout == 0 {
+		opts.RequestTimeout = DefaultSyncRequestTimeout
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = DefaultSyncRetries
+	}
+
+	genesis, err := chain.GetHeader(0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SyncManager{
+		opts:        opts,
+		chain:       chain,
+		genesisHash: core.BlockHasher{}.Hash(genesis),
+		send:        send,
+		penalize:    penalize,
+		logger:      logger,
+		peers:       map[NetAddr]*StatusMessage{},
+		pending:     map[uint64]*syncRequest{},
+		triggerCh:   make(chan struct{}, 1),
+	}, nil
+}
+
+// Status returns the status of the local chain.
+func (m *SyncManager) Status() *StatusMessage {
+	height := m.chain.Height()
+	tip, _ := m.chain.GetHeader(height)
+
+	return &StatusMessage{
+		GenesisHash: m.genesisHash,
+		Height:      height,
+		TipHash:     core.BlockHasher{}.Hash(tip),
+	}
+}
+
+// UpdatePeer records the status of a peer and starts a sync if the peer is
+// ahead. Peers on another genesis block are refused.
+func (m *SyncManager) UpdatePeer(addr NetAddr, status *StatusMessage) error {
+	if status.GenesisHash != m.genesisHash {
+		return fmt.Errorf("peer %s has genesis %s, expected %s", addr, status.GenesisHash, m.genesisHash)
+	}
+
+	m.lock.Lock()
+	m.peers[addr] = status
+	m.lock.Unlock()
+
+	if status.Height > m.chain.Height() {
+		m.Trigger()
+	}
+
+	return nil
+}
+
+// RemovePeer forgets the status of a disconnected peer.
+func (m *SyncManager) RemovePeer(addr NetAddr) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.peers, addr)
+}
+
+// HasPeer reports whether the status of the peer is known.
+func (m *SyncManager) HasPeer(addr NetAddr) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	_, ok := m.peers[addr]
+	return ok
+}
+
+// Trigger starts a sync round unless one is already pending.
+func (m *SyncManager) Trigger() {
+	select {
+	case m.triggerCh <- struct{}{}:
+	default:
+	}
+}
+
+// Deliver hands a response to the request waiting for it, responses from
+// other peers than the requested one are dropped.
+func (m *SyncManager) Deliver(from NetAddr, id uint64, resp any) bool {
+	m.lock.Lock()
+	req, ok := m.pending[id]
+	if ok && req.peer == from {
+		delete(m.pending, id)
+	}
+	m.lock.Unlock()
+
+	if !ok || req.peer != from {
+		return false
+	}
+
+	req.respCh <- resp
+	return true
+}
+
+// Loop runs a sync round every time one is triggered until ctx is done.
+func (m *SyncManager) Loop(ctx context.Context) {
+	for {
+		select {
+		case <-m.triggerCh:
+			m.sync(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (m *SyncManager) sync(ctx context.Context) {
+	for ctx.Err() == nil {
+		peer, status := m.bestPeer()
+		if status == nil {
+			return
+		}
+
+		_ = m.logger.Log("msg", "syncing", "peer", peer, "height", m.chain.Height(), "peer_height", status.Height)
+
+		if err := m.syncWith(ctx, peer, status); err != nil {
+			_ = m.logger.Log("msg", "sync failed", "peer", peer, "err", err)
+			// do not pick the same peer again until it sends a new status
+			m.lock.Lock()
+			if m.peers[peer] == status {
+				delete(m.peers, peer)
+			}
+			m.lock.Unlock()
+		}
+	}
+}
+
+// bestPeer returns the highest peer whose tip is unknown.
+func (m *SyncManager) bestPeer() (NetAddr, *StatusMessage) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var (
+		best   NetAddr
+		status *StatusMessage
+		height = m.chain.Height()
+	)
+	for addr, s := range m.peers {
+		if s.Height <= height || m.chain.HasBlockHash(s.TipHash) {
+			continue
+		}
+		if status == nil || s.Height > status.Height {
+			best, status = addr, s
+		}
+	}
+
+	return best, status
+}
+
+func (m *SyncManager) syncWith(ctx context.Context, peer NetAddr, status *StatusMessage) error {
+	headers, err := m.fetchHeaders(ctx, peer, status)
+	if err != nil {
+		return err
+	}
+
+	if len(headers) == 0 {
+		return fmt.Errorf("peer %s has no unknown headers", peer)
+	}
+
+	return m.fetchBlocks(ctx, peer, headers)
+}
+
+// fetchHeaders returns the next headers of the peer that are unknown locally.
+// When the first header does not connect to a known block the request is
+// moved back exponentially to find the fork point. A peer whose headers do
+// not validate is penalized.
+func (m *SyncManager) fetchHeaders(ctx context.Context, peer NetAddr, status *StatusMessage) ([]*core.Header, error) {
+	from := m.chain.Height() + 1
+	step := uint32(1)
+
+	for {
+		to := min(status.Height, from+m.opts.MaxHeadersPerRequest-1)
+		resp, err := m.request(ctx, peer, MessageTypeGetHeaders, func(id uint64) any {
+			return &GetHeadersMessage{ID: id, From: from, To: to}
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		headersMsg, ok := resp.(*HeadersMessage)
+		if !ok {
+			return nil, fmt.Errorf("peer %s answered %T to a headers request", peer, resp)
+		}
+
+		headers := headersMsg.Headers
+		if len(headers) == 0 {
+			return nil, fmt.Errorf("peer %s sent no headers from height %d", peer, from)
+		}
+
+		if headers[0] == nil || headers[0].Header == nil {
+			return nil, fmt.Errorf("peer %s sent an empty header", peer)
+		}
+
+		if headers[0].Height != from {
+			return nil, fmt.Errorf("peer %s sent header at height %d, expected %d", peer, headers[0].Height, from)
+		}
+
+		if m.chain.HasBlockHash(headers[0].PrevBlockHash) {
+			if err := m.chain.ValidateHeaders(headers); err != nil {
+				m.penalize(peer, OffenseInvalidBlock)
+				return nil, fmt.Errorf("peer %s sent an invalid header chain: %w", peer, err)
+			}
+			return m.unknownHeaders(headers), nil
+		}
+
+		if from == 1 {
+			return nil, fmt.Errorf("headers of peer %s do not connect to genesis", peer)
+		}
+		if step >= from {
+			from = 1
+		} else {
+			from -= step
+		}
+		step *= 2
+	}
+}
+
+func (m *SyncManager) unknownHeaders(blocks []*core.Block) []*core.Header {
+	headers := []*core.Header{}
+	for _, b := range blocks {
+		if len(headers) > 0 || !m.chain.HasBlockHash(b.Hash(core.BlockHasher{})) {
+			headers = append(headers, b.Header)
+		}
+	}
+	return headers
+}
+
+// fetchBlocks downloads the bodies of the headers source sent in batches,
+// spread over all peers that are high enough, and adds them to the chain in
+// order.
+func (m *SyncManager) fetchBlocks(ctx context.Context, source NetAddr, headers []*core.Header) error {
+	batches := [][]*core.Header{}
+	for i := 0; i < len(headers); i += int(m.opts.MaxBlocksPerRequest) {
+		end := min(len(headers), i+int(m.opts.MaxBlocksPerRequest))
+		batches = append(batches, headers[i:end])
+	}
+
+	peers := m.peersAtHeight(headers[len(headers)-1].Height)
+	if len(peers) == 0 {
+		return fmt.Errorf("no peer has height %d", headers[len(headers)-1].Height)
+	}
+
+	results := make([][]*core.Block, len(batches))
+	errs := make([]error, len(batches))
+	sem := make(chan struct{}, len(peers))
+	wg := sync.WaitGroup{}
+
+	for i, batch := range batches {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, batch []*core.Header) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i], errs[i] = m.fetchBatch(ctx, source, batch, peers, i)
+		}(i, batch)
+	}
+	wg.Wait()
+
+	for i := range batches {
+		if errs[i] != nil {
+			return errs[i]
+		}
+		for _, b := range results[i] {
+			if m.chain.HasBlockHash(b.Hash(core.BlockHasher{})) {
+				continue
+			}
+			if err := m.chain.AddBlock(b); err != nil {
+				return fmt.Errorf("failed to add synced block at height %d: %w", b.Height, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// fetchBatch requests the bodies of the headers, every retry asks the next peer.
+// Another peer may be on a different branch and answer with its own blocks,
+// a peer is only penalized for blocks that contradict the headers it sent
+// itself or bodies that do not match their header.
+func (m *SyncManager) fetchBatch(ctx context.Context, source NetAddr, headers []*core.Header, peers []NetAddr, offset int) ([]*core.Block, error) {
+	from, to := headers[0].Height, headers[len(headers)-1].Height
+
+	var lastErr error
+	for attempt := 0; attempt < m.opts.MaxRetries && ctx.Err() == nil; attempt++ {
+		peer := peers[(offset+attempt)%len(peers)]
+
+		resp, err := m.request(ctx, peer, MessageTypeGetBlocks, func(id uint64) any {
+			return &GetBlocksMessage{ID: id, From: from, To: to}
+		})
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		blocksMsg, ok := resp.(*BlocksMessage)
+		if !ok {
+			lastErr = fmt.Errorf("peer %s answered %T to a blocks request", peer, resp)
+			continue
+		}
+
+		blocks := blocksMsg.Blocks
+		if err := matchHeaders(blocks, headers); err != nil {
+			if peer == source || errors.Is(err, errBodyMismatch) {
+				m.penalize(peer, OffenseInvalidBlock)
+			}
+			lastErr = fmt.Errorf("peer %s: %w", peer, err)
+			continue
+		}
+
+		return blocks, nil
+	}
+
+	return nil, fmt.Errorf("failed to fetch blocks %d to %d: %w", from, to, lastErr)
+}
+
+func matchHeaders(blocks []*core.Block, headers []*core.Header) error {
+	if len(blocks) != len(headers) {
+		return fmt.Errorf("got %d blocks, expected %d", len(blocks), len(headers))
+	}
+	for i, b := range blocks {
+		if b == nil || b.Header == nil {
+			return fmt.Errorf("got block without header")
+		}
+		if b.Hash(core.BlockHasher{}) != (core.BlockHasher{}).Hash(headers[i]) {
+			return fmt.Errorf("block at height %d does not match its header", headers[i].Height)
+		}
+		if dataHash, err := core.CalculateDataHashForVersion(b.Version, b.Transactions); err != nil || dataHash != b.DataHash {
+			return fmt.Errorf("%w at height %d", errBodyMismatch, headers[i].Height)
+		}
+	}
+	return nil
+}
+
+func (m *SyncManager) peersAtHeight(height uint32) []NetAddr {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	peers := []NetAddr{}
+	for addr, s := range m.peers {
+		if s.Height >= height {
+			peers = append(peers, addr)
+		}
+	}
+	return peers
+}
+
+// request sends the message built for a new request id and waits for the
+// response of the peer or until ctx is done.
+func (m *SyncManager) request(ctx context.Context, peer NetAddr, t MessageType, build func(id uint64) any) (any, error) {
+	m.lock.Lock()
+	m.nextID++
+	id := m.nextID
+	req := &syncRequest{peer: peer, respCh: make(chan any, 1)}
+	m.pending[id] = req
+	m.lock.Unlock()
+
+	defer func() {
+		m.lock.Lock()
+		delete(m.pending, id)
+		m.lock.Unlock()
+	}()
+
+	msg, err := NewGobMessage(t, build(id))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.send(peer, msg); err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp := <-req.respCh:
+		return resp, nil
+	case <-time.After(m.opts.RequestTimeout):
+		return nil, fmt.Errorf("%w: peer %s", ErrSyncTimeout, peer)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
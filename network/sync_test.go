@@ -0,0 +1,239 @@
+package network
+
+import (
+	"go-blockchain/core"
+	"go-blockchain/crypto"
+	"go-blockchain/types"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyncLateNode(t *testing.T) {
+	tra := NewLocalTransport("A")
+	trb := NewLocalTransport("B")
+
+	a := newSyncServer(t, tra, true)
+	produceBlocks(t, a, 40)
+
+	b := newSyncServer(t, trb, false)
+	connect(t, tra, trb)
+
+	startServer(t, a)
+	startServer(t, b)
+
+	assertSynced(t, b, 40, tipHash(t, a))
+}
+
+func TestSyncRetriesUnresponsivePeer(t *testing.T) {
+	tra := NewLocalTransport("A")
+	trb := NewLocalTransport("B")
+	trx := NewLocalTransport("X")
+
+	a := newSyncServer(t, tra, true)
+	produceBlocks(t, a, 30)
+
+	b := newSyncServer(t, trb, false)
+	connect(t, tra, trb)
+	connect(t, trx, trb)
+
+	// X claims the chain of A but never answers a request
+	msg, err := NewGobMessage(MessageTypeStatus, a.sync.Status())
+	assert.Nil(t, err)
+	assert.Nil(t, trx.SendMessage(trb.Addr(), msg.Bytes()))
+	go func() {
+		for range trx.Consume() {
+		}
+	}()
+
+	startServer(t, a)
+	startServer(t, b)
+
+	assertSynced(t, b, 30, tipHash(t, a))
+}
+
+func TestSyncFromMultiplePeers(t *testing.T) {
+	tra := NewLocalTransport("A")
+	trb := NewLocalTransport("B")
+	trc := NewLocalTransport("C")
+
+	a := newSyncServer(t, tra, true)
+	produceBlocks(t, a, 20)
+
+	b := newSyncServer(t, trb, false)
+	connect(t, tra, trb)
+	startServer(t, a)
+	startServer(t, b)
+	assertSynced(t, b, 20, tipHash(t, a))
+
+	c := newSyncServer(t, trc, false)
+	connect(t, tra, trc)
+	connect(t, trb, trc)
+	startServer(t, c)
+
+	assertSynced(t, c, 20, tipHash(t, a))
+}
+
+func TestSyncReorgsToLongerFork(t *testing.T) {
+	tra := NewLocalTransport("A")
+	trb := NewLocalTransport("B")
+
+	a := newSyncServer(t, tra, true)
+	produceBlocks(t, a, 25)
+
+	b := newSyncServer(t, trb, true)
+	produceBlocks(t, b, 5)
+	assert.NotEqual(t, tipHash(t, a), tipHash(t, b))
+
+	connect(t, tra, trb)
+	startServer(t, a)
+	startServer(t, b)
+
+	assertSynced(t, b, 25, tipHash(t, a))
+}
+
+func TestSyncRefusesOtherGenesis(t *testing.T) {
+	s := newTestServer(t, ServerOpts{})
+
+	status := s.sync.Status()
+	status.GenesisHash = types.RandomHash()
+	status.Height = 10
+
+	assert.NotNil(t, s.proccessStatus("A", status))
+	assert.False(t, s.sync.HasPeer("A"))
+}
+
+func TestSyncPenalizesInvalidHeaders(t *testing.T) {
+	s, attacker := newAttackedServer(t, "headers", PeerScoreOpts{})
+	genesis, err := s.chain.GetHeader(0)
+	assert.Nil(t, err)
+
+	// the headers link up but are signed by no one
+	headers := []*core.Block{}
+	prev := genesis
+	for i := 0; i < 3; i++ {
+		b, err := core.NewBlockFromPrevHeader(prev, nil)
+		assert.Nil(t, err)
+		headers = append(headers, b)
+		prev = b.Header
+	}
+
+	status := s.sync.Status()
+	status.Height = 3
+	status.TipHash = core.BlockHasher{}.Hash(prev)
+	msg, err := NewGobMessage(MessageTypeStatus, status)
+	assert.Nil(t, err)
+	assert.Nil(t, attacker.SendMessage("headers", msg.Bytes()))
+
+	for rpc := range attacker.Consume() {
+		decoded, err := DefaultRPCDecodeFunc(rpc)
+		assert.Nil(t, err)
+		req, ok := decoded.Data.(*GetHeadersMessage)
+		if !ok {
+			continue
+		}
+
+		msg, err := newHeadersMessage(&HeadersMessage{ID: req.ID, Headers: headers})
+		assert.Nil(t, err)
+		assert.Nil(t, attacker.SendMessage("headers", msg.Bytes()))
+		break
+	}
+
+	assert.Eventually(t, func() bool {
+		return s.PeerScore(attacker.Addr()) == -DefaultPenalties[OffenseInvalidBlock]
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, uint32(0), s.chain.Height())
+}
+
+func TestServersWithDifferentGenesisRefusePeers(t *testing.T) {
+	tra := NewLocalTransport("A")
+	trb := NewLocalTransport("B")
+	connect(t, tra, trb)
+
+	privKey := crypto.GeneratePrivateKey()
+	a := newTestServer(t, ServerOpts{
+		ID:         "A",
+		Transports: []Transport{tra},
+		PrivateKey: &privKey,
+		BlockTime:  1 << 62,
+		Genesis:    &core.Genesis{ChainID: 1},
+	})
+	b := newTestServer(t, ServerOpts{
+		ID:         "B",
+		Transports: []Transport{trb},
+		Genesis:    &core.Genesis{ChainID: 2},
+	})
+
+	startServer(t, a)
+	startServer(t, b)
+
+	assert.Eventually(t, func() bool {
+		return a.isBanned("B") && b.isBanned("A")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	produceBlocks(t, a, 3)
+	assert.Equal(t, uint32(0), b.chain.Height())
+	assert.False(t, b.sync.HasPeer("A"))
+}
+
+func TestServerUsesGenesisParams(t *testing.T) {
+	s := newTestServer(t, ServerOpts{
+		Genesis: &core.Genesis{
+			ChainID: 9,
+			Params:  core.GenesisParams{BlockTimeMs: 1500, MaxBlockSize: 4096},
+		},
+	})
+
+	assert.Equal(t, 1500*time.Millisecond, s.blockTime)
+	assert.Equal(t, 4096, s.builder.MaxBlockSize)
+	assert.Equal(t, uint64(9), s.chain.ChainID())
+}
+
+func TestSyncPenalizesMismatchedBodies(t *testing.T) {
+	s, attacker := newAttackedServer(t, "bodies", PeerScoreOpts{})
+	producer := newSyncServer(t, NewLocalTransport("bodies-producer"), true)
+	produceBlocks(t, producer, 3)
+
+	blocks := []*core.Block{}
+	for height := uint32(1); height <= 3; height++ {
+		b, err := producer.chain.GetBlock(height)
+		assert.Nil(t, err)
+		blocks = append(blocks, b)
+	}
+
+	// the headers are valid but the body of the last block is swapped
+	mangled := *blocks[2]
+	mangled.Transactions = []core.Transaction{*signedTransfer(t, crypto.GeneratePrivateKey(), 0, 1, 0)}
+	bodies := []*core.Block{blocks[0], blocks[1], &mangled}
+
+	msg, err := NewGobMessage(MessageTypeStatus, producer.sync.Status())
+	assert.Nil(t, err)
+	assert.Nil(t, attacker.SendMessage("bodies", msg.Bytes()))
+
+	for rpc := range attacker.Consume() {
+		decoded, err := DefaultRPCDecodeFunc(rpc)
+		assert.Nil(t, err)
+
+		var msg *Message
+		switch req := decoded.Data.(type) {
+		case *GetHeadersMessage:
+			msg, err = newHeadersMessage(&HeadersMessage{ID: req.ID, Headers: blocks})
+		case *GetBlocksMessage:
+			msg, err = newBlocksMessage(&BlocksMessage{ID: req.ID, Blocks: bodies})
+		default:
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Nil(t, attacker.SendMessage("bodies", msg.Bytes()))
+
+		if _, ok := decoded.Data.(*GetBlocksMessage); ok {
+			break
+		}
+	}
+
+	assert.Eventually(t, func() bool {
+		return s.PeerScore(attacker.Addr()) == -DefaultPenalties[OffenseInvalidBlock]
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, uint32(0), s.chain.Height())
+}
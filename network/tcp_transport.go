@@ -0,0 +1,543 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMaxMessageSize    = 32 << 20
+	DefaultDialTimeout       = 5 * time.Second
+	DefaultMinReconnectDelay = 100 * time.Millisecond
+	DefaultMaxReconnectDelay = 30 * time.Second
+	DefaultSendQueueSize     = 1024
+)
+
+var ErrTransportClosed = errors.New("transport closed")
+
+type TCPTransportOpts struct {
+	// ListenAddr is the host:port to listen on, port 0 picks a free port
+	ListenAddr NetAddr
+	// MaxMessageSize caps the length of a single frame
+	MaxMessageSize uint32
+	DialTimeout    time.Duration
+	// MinReconnectDelay and MaxReconnectDelay bound the exponential backoff
+	// used to redial outbound peers after their connection dropped
+	MinReconnectDelay time.Duration
+	MaxReconnectDelay time.Duration
+	// SendQueueSize is the number of messages buffered per peer
+	SendQueueSize int
+	// Upgrader secures new connections, the address of the transport then
+	// carries the node id of the upgrader. Plain TCP is used when it is nil
+	Upgrader ConnUpgrader
+}
+
+// TCPTransport implements the Transport interface over TCP. Every message is
+// sent as a frame prefixed with its big-endian uint32 length. When a
+// connection is set up it is first upgraded if an Upgrader is configured,
+// then both sides send a frame with their listen address, which is the
+// NetAddr the peer is known by.
+type TCPTransport struct {
+	opts      TCPTransportOpts
+	listener  net.Listener
+	addr      NetAddr
+	consumeCh chan RPC
+
+	lock  sync.RWMutex
+	peers map[NetAddr]*tcpPeer
+	// outbound holds the addresses that were dialed and are redialed when
+	// the connection drops
+	outbound map[NetAddr]bool
+	// handshakes holds the connections that are not yet peers, so that
+	// closing the transport does not wait for their deadline
+	handshakes map[net.Conn]struct{}
+
+	quitCh    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+type tcpPeer struct {
+	addr      NetAddr
+	id        string
+	conn      net.Conn
+	sendCh    chan []byte
+	closeCh   chan struct{}
+	closeOnce sync.Once
+}
+
+func (p *tcpPeer) close() {
+	p.closeOnce.Do(func() {
+		close(p.closeCh)
+		_ = p.conn.Close()
+	})
+}
+
+// NewTCPTransport starts listening on opts.ListenAddr.
+func NewTCPTransport(opts TCPTransportOpts) (*TCPTransport, error) {
+	if opts.MaxMessageSize == 0 {
+		opts.MaxMessageSize = DefaultMaxMessageSize
+	}
+	if opts.DialTimeout == 0 {
+		opts.DialTimeout = DefaultDialTimeout
+	}
+	if opts.MinReconnectDelay == 0 {
+		opts.MinReconnectDelay = DefaultMinReconnectDelay
+	}
+	if opts.MaxReconnectDelay == 0 {
+		opts.MaxReconnectDelay = DefaultMaxReconnectDelay
+	}
+	if opts.SendQueueSize == 0 {
+		opts.SendQueueSize = DefaultSendQueueSize
+	}
+
+	ln, err := net.Listen("tcp", opts.ListenAddr.HostPort())
+	if err != nil {
+		return nil, err
+	}
+
+	t := &TCPTransport{
+		opts:       opts,
+		listener:   ln,
+		addr:       NetAddr(ln.Addr().String()),
+		consumeCh:  make(chan RPC, 1024),
+		peers:      make(map[NetAddr]*tcpPeer),
+		outbound:   make(map[NetAddr]bool),
+		handshakes: make(map[net.Conn]struct{}),
+		quitCh:     make(chan struct{}),
+	}
+
+	if opts.Upgrader != nil {
+		t.addr = NetAddr(opts.Upgrader.ID() + "@" + ln.Addr().String())
+	}
+
+	t.wg.Add(1)
+	go t.acceptLoop()
+
+	return t, nil
+}
+
+// Consume returns a channel that can be used to consume RPC messages, it is
+// closed once the transport is closed.
+func (t *TCPTransport) Consume() <-chan RPC {
+	return t.consumeCh
+}
+
+// Connect dials the address of the given transport.
+func (t *TCPTransport) Connect(tr Transport) error {
+	return t.Dial(tr.Addr())
+}
+
+// Dial connects to the peer listening on addr, once connected the connection
+// is redialed with backoff whenever it drops until the transport is closed or
+// the peer is disconnected.
+func (t *TCPTransport) Dial(addr NetAddr) error {
+	if t.isClosed() {
+		return ErrTransportClosed
+	}
+
+	t.lock.Lock()
+	t.outbound[addr] = true
+	_, connected := t.peers[addr]
+	t.lock.Unlock()
+
+	if connected {
+		return nil
+	}
+
+	if err := t.dial(addr); err != nil {
+		t.lock.Lock()
+		delete(t.outbound, addr)
+		t.lock.Unlock()
+		return err
+	}
+
+	return nil
+}
+
+func (t *TCPTransport) dial(addr NetAddr) error {
+	conn, err := net.DialTimeout("tcp", addr.HostPort(), t.opts.DialTimeout)
+	if err != nil {
+		return err
+	}
+
+	conn, _, err = t.handshake(conn, addr)
+	if err != nil {
+		return fmt.Errorf("handshake with %s failed: %w", addr, err)
+	}
+
+	return t.addPeer(addr, conn, nil)
+}
+
+// handshake upgrades a new connection and exchanges the listen addresses,
+// remote is the dialed address or empty for inbound connections. The
+// connection is closed if the handshake fails or the transport is closed in
+// the meantime.
+func (t *TCPTransport) handshake(conn net.Conn, remote NetAddr) (net.Conn, NetAddr, error) {
+	t.lock.Lock()
+	if t.isClosed() {
+		t.lock.Unlock()
+		_ = conn.Close()
+		return nil, "", ErrTransportClosed
+	}
+	t.handshakes[conn] = struct{}{}
+	t.lock.Unlock()
+
+	_ = conn.SetDeadline(time.Now().Add(t.opts.DialTimeout))
+	upgraded, addr, err := t.exchangeAddrs(conn, remote)
+	_ = conn.SetDeadline(time.Time{})
+
+	t.lock.Lock()
+	delete(t.handshakes, conn)
+	t.lock.Unlock()
+
+	if err != nil {
+		_ = conn.Close()
+		return nil, "", err
+	}
+	return upgraded, addr, nil
+}
+
+func (t *TCPTransport) exchangeAddrs(conn net.Conn, remote NetAddr) (net.Conn, NetAddr, error) {
+	id := ""
+	if t.opts.Upgrader != nil {
+		upgraded, remoteID, err := t.opts.Upgrader.Upgrade(conn, remote != "")
+		if err != nil {
+			return nil, "", err
+		}
+		conn, id = upgraded, remoteID
+	}
+
+	if remote != "" {
+		if id != remote.NodeID() {
+			return nil, "", fmt.Errorf("peer %s is node %q", remote, id)
+		}
+		if err := t.writeFrame(conn, []byte(t.addr)); err != nil {
+			return nil, "", err
+		}
+		// the answer of the peer completes the handshake
+		if _, err := t.readFrame(conn); err != nil {
+			return nil, "", err
+		}
+		return conn, remote, nil
+	}
+
+	hello, err := t.readFrame(conn)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// an inbound peer can only claim the node id it authenticated with
+	addr := NetAddr(hello)
+	if addr.HostPort() == "" {
+		return nil, "", fmt.Errorf("peer %s sent no address", conn.RemoteAddr())
+	}
+	if id != addr.NodeID() {
+		return nil, "", fmt.Errorf("peer %s claims to be %s", conn.RemoteAddr(), addr)
+	}
+
+	return conn, addr, nil
+}
+
+func (t *TCPTransport) acceptLoop() {
+	defer t.wg.Done()
+
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			if t.isClosed() {
+				return
+			}
+			continue
+		}
+
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			_ = t.accept(conn)
+		}()
+	}
+}
+
+func (t *TCPTransport) accept(conn net.Conn) error {
+	conn, addr, err := t.handshake(conn, "")
+	if err != nil {
+		return err
+	}
+
+	// the answer is queued before any other message, the dialer only
+	// returns once it received it and therefore sees the peer registered
+	return t.addPeer(addr, conn, []byte(t.addr))
+}
+
+// addPeer starts the read and write loops of a new connection, first is
+// written before anything else. A second connection to a peer that is
+// already connected is refused and closed.
+func (t *TCPTransport) addPeer(addr NetAddr, conn net.Conn, first []byte) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.isClosed() {
+		_ = conn.Close()
+		return ErrTransportClosed
+	}
+
+	if _, ok := t.peers[addr]; ok {
+		_ = conn.Close()
+		return fmt.Errorf("%s: already connected to %s", t.addr, addr)
+	}
+
+	// the node id of a secured peer is authenticated, the address a plain
+	// peer claims is not, it is identified by the host it connects from
+	id := addr.NodeID()
+	if id == "" {
+		id = NetAddr(conn.RemoteAddr().String()).PeerID()
+	}
+
+	peer := &tcpPeer{
+		addr:    addr,
+		id:      id,
+		conn:    conn,
+		sendCh:  make(chan []byte, t.opts.SendQueueSize),
+		closeCh: make(chan struct{}),
+	}
+	if first != nil {
+		peer.sendCh <- first
+	}
+	t.peers[addr] = peer
+
+	t.wg.Add(2)
+	go t.readLoop(peer)
+	go t.writeLoop(peer)
+
+	return nil
+}
+
+func (t *TCPTransport) readLoop(peer *tcpPeer) {
+	defer t.wg.Done()
+	defer t.dropPeer(peer)
+
+	for {
+		frame, err := t.readFrame(peer.conn)
+		if err != nil {
+			return
+		}
+
+		select {
+		case t.consumeCh <- RPC{From: peer.addr, Payload: bytes.NewReader(frame)}:
+		case <-t.quitCh:
+			return
+		}
+	}
+}
+
+func (t *TCPTransport) writeLoop(peer *tcpPeer) {
+	defer t.wg.Done()
+	defer t.dropPeer(peer)
+
+	for {
+		select {
+		case payload := <-peer.sendCh:
+			if err := t.writeFrame(peer.conn, payload); err != nil {
+				return
+			}
+		case <-peer.closeCh:
+			return
+		}
+	}
+}
+
+// dropPeer closes the connection of the peer and starts redialing it if it
+// is an outbound peer.
+func (t *TCPTransport) dropPeer(peer *tcpPeer) {
+	peer.close()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.peers[peer.addr] != peer {
+		return
+	}
+	delete(t.peers, peer.addr)
+
+	if t.outbound[peer.addr] && !t.isClosed() {
+		t.wg.Add(1)
+		go t.reconnect(peer.addr)
+	}
+}
+
+func (t *TCPTransport) reconnect(addr NetAddr) {
+	defer t.wg.Done()
+
+	delay := t.opts.MinReconnectDelay
+	for {
+		select {
+		case <-time.After(delay):
+		case <-t.quitCh:
+			return
+		}
+
+		t.lock.RLock()
+		_, connected := t.peers[addr]
+		wanted := t.outbound[addr]
+		t.lock.RUnlock()
+
+		if connected || !wanted {
+			return
+		}
+
+		if err := t.dial(addr); err == nil {
+			return
+		}
+
+		delay = min(2*delay, t.opts.MaxReconnectDelay)
+	}
+}
+
+func (t *TCPTransport) readFrame(r io.Reader) ([]byte, error) {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+
+	if size > t.opts.MaxMessageSize {
+		return nil, fmt.Errorf("frame of %d bytes exceeds the maximum of %d", size, t.opts.MaxMessageSize)
+	}
+
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+
+	return frame, nil
+}
+
+func (t *TCPTransport) writeFrame(w io.Writer, payload []byte) error {
+	if uint64(len(payload)) > uint64(t.opts.MaxMessageSize) {
+		return fmt.Errorf("frame of %d bytes exceeds the maximum of %d", len(payload), t.opts.MaxMessageSize)
+	}
+
+	buf := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(buf, uint32(len(payload)))
+	copy(buf[4:], payload)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// Disconnect closes the connection to a peer and stops redialing it.
+func (t *TCPTransport) Disconnect(addr NetAddr) error {
+	t.lock.Lock()
+	peer, ok := t.peers[addr]
+	delete(t.outbound, addr)
+	t.lock.Unlock()
+
+	if !ok {
+		return fmt.Errorf("%s: not connected to %s", t.addr, addr)
+	}
+
+	t.dropPeer(peer)
+	return nil
+}
+
+// Peers returns the connected peers sorted by address.
+func (t *TCPTransport) Peers() []PeerInfo {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	peers := make([]PeerInfo, 0, len(t.peers))
+	for addr, peer := range t.peers {
+		peers = append(peers, PeerInfo{Addr: addr, ID: peer.id, Outbound: t.outbound[addr]})
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Addr < peers[j].Addr
+	})
+
+	return peers
+}
+
+// SendMessage queues a message for a connected peer.
+func (t *TCPTransport) SendMessage(to NetAddr, payload []byte) error {
+	t.lock.RLock()
+	peer, ok := t.peers[to]
+	t.lock.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("%s: could not send message to %s", t.addr, to)
+	}
+
+	frame := make([]byte, len(payload))
+	copy(frame, payload)
+
+	select {
+	case peer.sendCh <- frame:
+		return nil
+	case <-peer.closeCh:
+		return fmt.Errorf("%s: connection to %s closed", t.addr, to)
+	case <-t.quitCh:
+		return ErrTransportClosed
+	}
+}
+
+// Broadcast sends a message to all connected peers
+func (t *TCPTransport) Broadcast(payload []byte) error {
+	t.lock.RLock()
+	peers := make([]NetAddr, 0, len(t.peers))
+	for addr := range t.peers {
+		peers = append(peers, addr)
+	}
+	t.lock.RUnlock()
+
+	for _, addr := range peers {
+		if err := t.SendMessage(addr, payload); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Addr returns the address the transport listens on.
+func (t *TCPTransport) Addr() NetAddr {
+	return t.addr
+}
+
+// Close stops the listener, closes every connection and waits for all
+// goroutines of the transport before closing the consume channel.
+func (t *TCPTransport) Close() error {
+	err := ErrTransportClosed
+
+	t.closeOnce.Do(func() {
+		t.lock.Lock()
+		close(t.quitCh)
+		err = t.listener.Close()
+		for _, peer := range t.peers {
+			peer.close()
+		}
+		for conn := range t.handshakes {
+			_ = conn.Close()
+		}
+		t.lock.Unlock()
+
+		t.wg.Wait()
+		close(t.consumeCh)
+	})
+
+	return err
+}
+
+func (t *TCPTransport) isClosed() bool {
+	select {
+	case <-t.quitCh:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,134 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"go-blockchain/crypto"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTCPTransport(t *testing.T, opts TCPTransportOpts) *TCPTransport {
+	if opts.ListenAddr == "" {
+		opts.ListenAddr = "127.0.0.1:0"
+	}
+
+	tr, err := NewTCPTransport(opts)
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = tr.Close() })
+
+	return tr
+}
+
+func TestTCPTransportLargeMessage(t *testing.T) {
+	tra := newTCPTransport(t, TCPTransportOpts{})
+	trb := newTCPTransport(t, TCPTransportOpts{})
+	assert.Nil(t, tra.Dial(trb.Addr()))
+
+	msg := bytes.Repeat([]byte{0xab, 0xcd}, 1<<20)
+	assert.Nil(t, tra.SendMessage(trb.Addr(), msg))
+	assert.Equal(t, msg, readPayload(t, receive(t, trb)))
+}
+
+func TestTCPTransportRejectsOversizedFrames(t *testing.T) {
+	tra := newTCPTransport(t, TCPTransportOpts{MaxMessageSize: 16})
+	trb := newTCPTransport(t, TCPTransportOpts{MaxMessageSize: 16})
+	assert.Nil(t, tra.Dial(trb.Addr()))
+
+	assert.Nil(t, tra.SendMessage(trb.Addr(), make([]byte, 16)))
+	assert.Len(t, readPayload(t, receive(t, trb)), 16)
+
+	// the writer refuses frames that are too large
+	assert.NotNil(t, tra.writeFrame(&bytes.Buffer{}, make([]byte, 17)))
+
+	// the reader drops a connection announcing a frame that is too large
+	conn, err := net.Dial("tcp", string(trb.Addr()))
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	assert.Nil(t, tra.writeFrame(conn, []byte("127.0.0.1:1")))
+	_, err = tra.readFrame(conn)
+	assert.Nil(t, err)
+	assert.Nil(t, binary.Write(conn, binary.BigEndian, uint32(1<<30)))
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+}
+
+func TestTCPTransportReconnects(t *testing.T) {
+	tra := newTCPTransport(t, TCPTransportOpts{
+		MinReconnectDelay: 10 * time.Millisecond,
+		MaxReconnectDelay: 50 * time.Millisecond,
+	})
+	trb, err := NewTCPTransport(TCPTransportOpts{ListenAddr: "127.0.0.1:0"})
+	assert.Nil(t, err)
+	addr := trb.Addr()
+
+	assert.Nil(t, tra.Dial(addr))
+	assert.Nil(t, trb.Close())
+
+	assert.Eventually(t, func() bool {
+		return tra.SendMessage(addr, []byte("lost")) != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the peer comes back on the same address
+	trb = newTCPTransport(t, TCPTransportOpts{ListenAddr: addr})
+
+	assert.Eventually(t, func() bool {
+		return tra.SendMessage(addr, []byte("hello")) == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	rpc := receive(t, trb)
+	assert.Equal(t, tra.Addr(), rpc.From)
+	assert.Equal(t, []byte("hello"), readPayload(t, rpc))
+}
+
+func TestTCPTransportCloseStopsDialing(t *testing.T) {
+	tra := newTCPTransport(t, TCPTransportOpts{})
+	assert.Nil(t, tra.Close())
+
+	assert.ErrorIs(t, tra.Dial("127.0.0.1:1"), ErrTransportClosed)
+	assert.ErrorIs(t, tra.Close(), ErrTransportClosed)
+}
+
+func TestLocalTransportRefusesOtherTransports(t *testing.T) {
+	tr := NewLocalTransport("A")
+	assert.NotNil(t, tr.Connect(newTCPTransport(t, TCPTransportOpts{})))
+}
+
+func TestServersSyncOverTCP(t *testing.T) {
+	t.Run("Plain", func(t *testing.T) {
+		testServersSyncOverTCP(t, TCPTransportOpts{}, TCPTransportOpts{})
+	})
+	t.Run("Secure", func(t *testing.T) {
+		testServersSyncOverTCP(t,
+			TCPTransportOpts{Upgrader: NewSecureUpgrader(crypto.GeneratePrivateKey())},
+			TCPTransportOpts{Upgrader: NewSecureUpgrader(crypto.GeneratePrivateKey())},
+		)
+	})
+}
+
+func testServersSyncOverTCP(t *testing.T, optsA, optsB TCPTransportOpts) {
+	tra := newTCPTransport(t, optsA)
+	trb := newTCPTransport(t, optsB)
+
+	a := newSyncServer(t, tra, true)
+	produceBlocks(t, a, 20)
+
+	b := newSyncServer(t, trb, false)
+	startServer(t, a)
+	startServer(t, b)
+	assert.Nil(t, trb.Dial(tra.Addr()))
+
+	// the dialed server learns about the peer from its status
+	msg, err := NewGobMessage(MessageTypeStatus, b.sync.Status())
+	assert.Nil(t, err)
+	assert.Nil(t, trb.SendMessage(tra.Addr(), msg.Bytes()))
+
+	assertSynced(t, b, 20, tipHash(t, a))
+}
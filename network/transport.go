@@ -1,11 +1,91 @@
 package network
 
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+
+	"go-blockchain/crypto"
+)
+
+// NetAddr is the address of a peer. Transports that authenticate their peers
+// prefix the host:port with the hex encoded node public key, as in
+// "<key>@host:port".
 type NetAddr string
 
+// NodeAddr returns the address of the node holding key and listening on hostport.
+func NodeAddr(key crypto.PublicKey, hostport string) NetAddr {
+	return NetAddr(hex.EncodeToString(key.ToSlice()) + "@" + hostport)
+}
+
+// NodeID returns the hex encoded node key of the address, it is empty if the
+// address carries none.
+func (a NetAddr) NodeID() string {
+	id, _, ok := strings.Cut(string(a), "@")
+	if !ok {
+		return ""
+	}
+	return id
+}
+
+// HostPort returns the address without its node key.
+func (a NetAddr) HostPort() string {
+	_, hostport, ok := strings.Cut(string(a), "@")
+	if !ok {
+		return string(a)
+	}
+	return hostport
+}
+
+// NodeKey parses the node key of the address.
+func (a NetAddr) NodeKey() (crypto.PublicKey, error) {
+	id := a.NodeID()
+	if id == "" {
+		return crypto.PublicKey{}, fmt.Errorf("address %s has no node key", a)
+	}
+
+	b, err := hex.DecodeString(id)
+	if err != nil {
+		return crypto.PublicKey{}, fmt.Errorf("invalid node key in %s: %w", a, err)
+	}
+	return crypto.PublicKeyFromBytes(b)
+}
+
+// PeerID returns the identity of a peer known by the address alone, its node
+// key or else its host.
+func (a NetAddr) PeerID() string {
+	if id := a.NodeID(); id != "" {
+		return id
+	}
+
+	host, _, err := net.SplitHostPort(a.HostPort())
+	if err != nil {
+		return string(a)
+	}
+	return host
+}
+
+// PeerInfo describes a connected peer, Outbound is set when the connection
+// was dialed by this node. ID is the identity of the peer as far as the
+// transport can tell, the authenticated node id or the remote host of the
+// connection. It is empty if the transport knows no more than the address.
+type PeerInfo struct {
+	Addr     NetAddr
+	ID       string
+	Outbound bool
+}
+
 type Transport interface {
 	Connect(Transport) error
+	// Dial connects to the peer listening on the address
+	Dial(NetAddr) error
+	// Disconnect closes the connection to a peer, it is not redialed
+	Disconnect(NetAddr) error
+	Peers() []PeerInfo
 	Consume() <-chan RPC
 	SendMessage(NetAddr, []byte) error
 	Broadcast([]byte) error
 	Addr() NetAddr
+	Close() error
 }
@@ -0,0 +1,125 @@
+package network
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testTransports runs the tests every Transport implementation has to pass.
+func testTransports(t *testing.T, newTransport func(t *testing.T) Transport) {
+	t.Run("SendMessage", func(t *testing.T) {
+		tra := newTransport(t)
+		trb := newTransport(t)
+		assert.Nil(t, tra.Connect(trb))
+
+		msg := []byte("hello")
+		assert.Nil(t, tra.SendMessage(trb.Addr(), msg))
+
+		rpc := receive(t, trb)
+		assert.Equal(t, tra.Addr(), rpc.From)
+		assert.Equal(t, msg, readPayload(t, rpc))
+	})
+
+	t.Run("MessagesKeepOrderAndBoundaries", func(t *testing.T) {
+		tra := newTransport(t)
+		trb := newTransport(t)
+		assert.Nil(t, tra.Connect(trb))
+
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, tra.SendMessage(trb.Addr(), []byte(fmt.Sprintf("message %d", i))))
+		}
+		assert.Nil(t, tra.SendMessage(trb.Addr(), []byte{}))
+
+		for i := 0; i < 100; i++ {
+			assert.Equal(t, []byte(fmt.Sprintf("message %d", i)), readPayload(t, receive(t, trb)))
+		}
+		assert.Empty(t, readPayload(t, receive(t, trb)))
+	})
+
+	t.Run("Broadcast", func(t *testing.T) {
+		tra := newTransport(t)
+		trb := newTransport(t)
+		trc := newTransport(t)
+		assert.Nil(t, tra.Connect(trb))
+		assert.Nil(t, tra.Connect(trc))
+
+		msg := []byte("hello world")
+		assert.Nil(t, tra.Broadcast(msg))
+
+		assert.Equal(t, msg, readPayload(t, receive(t, trb)))
+		assert.Equal(t, msg, readPayload(t, receive(t, trc)))
+	})
+
+	t.Run("Reply", func(t *testing.T) {
+		tra := newTransport(t)
+		trb := newTransport(t)
+		assert.Nil(t, tra.Connect(trb))
+		assert.Nil(t, trb.Connect(tra))
+
+		assert.Nil(t, tra.SendMessage(trb.Addr(), []byte("ping")))
+		rpc := receive(t, trb)
+		assert.Nil(t, trb.SendMessage(rpc.From, []byte("pong")))
+		assert.Equal(t, []byte("pong"), readPayload(t, receive(t, tra)))
+	})
+
+	t.Run("SendToUnknownPeer", func(t *testing.T) {
+		tra := newTransport(t)
+		trb := newTransport(t)
+
+		assert.NotNil(t, tra.SendMessage(trb.Addr(), []byte("hello")))
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		tra := newTransport(t)
+		trb := newTransport(t)
+		assert.Nil(t, tra.Connect(trb))
+
+		assert.Nil(t, trb.Close())
+		_, open := <-trb.Consume()
+		assert.False(t, open)
+
+		assert.Eventually(t, func() bool {
+			return tra.SendMessage(trb.Addr(), []byte("hello")) != nil
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+}
+
+func receive(t *testing.T, tr Transport) RPC {
+	t.Helper()
+
+	select {
+	case rpc := <-tr.Consume():
+		return rpc
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s: no message received", tr.Addr())
+		return RPC{}
+	}
+}
+
+func readPayload(t *testing.T, rpc RPC) []byte {
+	t.Helper()
+
+	b, err := io.ReadAll(rpc.Payload)
+	assert.Nil(t, err)
+	return b
+}
+
+func TestLocalTransport(t *testing.T) {
+	var n atomic.Int32
+	testTransports(t, func(t *testing.T) Transport {
+		tr := NewLocalTransport(NetAddr(fmt.Sprintf("local-%d", n.Add(1))))
+		t.Cleanup(func() { _ = tr.Close() })
+		return tr
+	})
+}
+
+func TestTCPTransport(t *testing.T) {
+	testTransports(t, func(t *testing.T) Transport {
+		return newTCPTransport(t, TCPTransportOpts{})
+	})
+}
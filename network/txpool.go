@@ -1,16 +1,59 @@
 package network
 
 import (
+	"container/heap"
+	"errors"
+	"fmt"
 	"go-blockchain/core"
 	"go-blockchain/types"
 	"sort"
+	"sync"
+	"time"
 )
 
+const (
+	DefaultMaxPoolTxs      = 50_000
+	DefaultMaxPoolBytes    = 64 << 20
+	DefaultMaxTxsPerSender = 1024
+	DefaultTxTTL           = time.Hour
+)
+
+var ErrTxPoolFull = errors.New("transaction pool is full")
+
+// TxOrdering decides which of two transactions should be included in a block first.
+type TxOrdering interface {
+	Less(a, b *core.Transaction) bool
+}
+
+// FirstSeenOrdering orders transactions by the time they were first seen locally.
+type FirstSeenOrdering struct{}
+
+func (FirstSeenOrdering) Less(a, b *core.Transaction) bool {
+	return a.FirstSeen() < b.FirstSeen()
+}
+
+// FeeOrdering orders transactions by fee, highest first, and falls back to
+// the time they were first seen.
+type FeeOrdering struct{}
+
+func (FeeOrdering) Less(a, b *core.Transaction) bool {
+	if a.Fee != b.Fee {
+		return a.Fee > b.Fee
+	}
+	return a.FirstSeen() < b.FirstSeen()
+}
+
 type TxMapSorter struct {
 	transactions []*core.Transaction
+	ordering     TxOrdering
 }
 
+// NewTxMapSorter sorts the transactions in the order they were first seen.
 func NewTxMapSorter(txMap map[types.Hash]*core.Transaction) *TxMapSorter {
+	return NewTxMapSorterWithOrdering(txMap, FirstSeenOrdering{})
+}
+
+func NewTxMapSorterWithOrdering(txMap map[types.Hash]*core.Transaction, ordering TxOrdering) *TxMapSorter {
 	txx := make([]*core.Transaction, len(txMap))
 
 	i := 0
@@ -19,7 +62,10 @@ func NewTxMapSorter(txMap map[types.Hash]*core.Transaction) *TxMapSorter {
 		i++
 	}
 
-	s := &TxMapSorter{txx}
+	s := &TxMapSorter{
+		transactions: txx,
+		ordering:     ordering,
+	}
 
 	sort.Sort(s)
 
@@ -31,41 +77,408 @@ func (s *TxMapSorter) Swap(i, j int) {
 	s.transactions[i], s.transactions[j] = s.transactions[j], s.transactions[i]
 }
 func (s *TxMapSorter) Less(i, j int) bool {
-	return s.transactions[i].FirstSeen() < s.transactions[j].FirstSeen()
+	return s.ordering.Less(s.transactions[i], s.transactions[j])
 }
 
+type TxPoolOpts struct {
+	// MaxTxs caps the number of pooled transactions
+	MaxTxs int
+	// MaxBytes caps the sum of the canonical sizes of the pooled transactions
+	MaxBytes int
+	// MaxTxsPerSender caps the number of signed transactions of a single sender
+	MaxTxsPerSender int
+	// TTL is how long a transaction is kept after it was first seen
+	TTL time.Duration
+	// Ordering decides which transactions are evicted first when the pool is
+	// full, defaults to FeeOrdering
+	Ordering TxOrdering
+}
+
+// pooledTx is a transaction together with its positions in the pool heaps.
+type pooledTx struct {
+	tx        *core.Transaction
+	hash      types.Hash
+	size      int
+	evictIdx  int
+	expiryIdx int
+}
+
+// TxPool holds the pending transactions and is safe for concurrent use. When
+// the pool is full the lowest priority transactions are evicted to make room
+// for better ones, transactions older than the TTL are dropped.
 type TxPool struct {
-	transactions map[types.Hash]*core.Transaction
+	lock sync.RWMutex
+	opts TxPoolOpts
+
+	transactions map[types.Hash]*pooledTx
+	// senders maps every sender and nonce to the hash of the pooled transaction
+	senders map[types.Address]map[uint64]types.Hash
+	bytes   int
+
+	// evict has the lowest priority transaction on top, expiry the oldest one
+	evict  *pooledTxHeap
+	expiry *pooledTxHeap
 }
 
 func NewTxPool() *TxPool {
-	return &TxPool{
-		transactions: map[types.Hash]*core.Transaction{},
+	return NewTxPoolWithOpts(TxPoolOpts{})
+}
+
+func NewTxPoolWithOpts(opts TxPoolOpts) *TxPool {
+	if opts.MaxTxs == 0 {
+		opts.MaxTxs = DefaultMaxPoolTxs
+	}
+	if opts.MaxBytes == 0 {
+		opts.MaxBytes = DefaultMaxPoolBytes
+	}
+	if opts.MaxTxsPerSender == 0 {
+		opts.MaxTxsPerSender = DefaultMaxTxsPerSender
+	}
+	if opts.TTL == 0 {
+		opts.TTL = DefaultTxTTL
+	}
+	if opts.Ordering == nil {
+		opts.Ordering = FeeOrdering{}
+	}
+
+	p := &TxPool{opts: opts}
+	p.reset()
+
+	return p
+}
+
+func (p *TxPool) reset() {
+	ordering := p.opts.Ordering
+
+	p.transactions = map[types.Hash]*pooledTx{}
+	p.senders = map[types.Address]map[uint64]types.Hash{}
+	p.bytes = 0
+	p.evict = &pooledTxHeap{
+		less:  func(a, b *pooledTx) bool { return ordering.Less(b.tx, a.tx) },
+		index: func(ptx *pooledTx) *int { return &ptx.evictIdx },
+	}
+	p.expiry = &pooledTxHeap{
+		less:  func(a, b *pooledTx) bool { return a.tx.FirstSeen() < b.tx.FirstSeen() },
+		index: func(ptx *pooledTx) *int { return &ptx.expiryIdx },
 	}
 }
 
+// Transactions returns the pooled transactions in the order they were first seen.
 func (p *TxPool) Transactions() []*core.Transaction {
-	s := NewTxMapSorter(p.transactions)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.expire()
+
+	txMap := make(map[types.Hash]*core.Transaction, len(p.transactions))
+	for hash, ptx := range p.transactions {
+		txMap[hash] = ptx.tx
+	}
+
+	s := NewTxMapSorter(txMap)
 	return s.transactions
 }
 
-// Add adds a transaction to the pool, the caller is responsible for checking if the tx already exists.
+// Add adds a transaction to the pool, adding a pooled transaction again is a no-op.
+// A different signed transaction from the same sender with the same nonce is
+// rejected, as is a transaction that has a lower priority than everything
+// that would have to be evicted to make room for it.
 func (p *TxPool) Add(tx *core.Transaction) error {
+	// the pool keeps its own copy, the hash cache and first seen time are
+	// never written to a transaction the caller may still share
+	pooled := *tx
+	tx = &pooled
+
 	hash := tx.Hash(core.TxHasher{})
-	p.transactions[hash] = tx
+	if tx.FirstSeen() == 0 {
+		tx.SetFirstSeen(time.Now().UnixNano())
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.expire()
+
+	if _, ok := p.transactions[hash]; ok {
+		return nil
+	}
+
+	if p.expired(tx) {
+		return fmt.Errorf("transaction %s first seen more than %s ago", hash, p.opts.TTL)
+	}
+
+	ptx := &pooledTx{tx: tx, hash: hash, size: tx.Size()}
+	if ptx.size > p.opts.MaxBytes {
+		return fmt.Errorf("transaction %s of %d bytes exceeds the pool size of %d bytes", hash, ptx.size, p.opts.MaxBytes)
+	}
+
+	signed := tx.Signature != nil
+	if signed {
+		sender := tx.Sender()
+		if other, ok := p.senders[sender][tx.Nonce]; ok {
+			return fmt.Errorf("transaction %s with nonce %d from %s already in pool", other, tx.Nonce, sender)
+		}
+		if len(p.senders[sender]) >= p.opts.MaxTxsPerSender {
+			return fmt.Errorf("sender %s has %d transactions in pool", sender, len(p.senders[sender]))
+		}
+	}
+
+	if err := p.makeRoom(ptx); err != nil {
+		return err
+	}
+
+	p.transactions[hash] = ptx
+	p.bytes += ptx.size
+	heap.Push(p.evict, ptx)
+	heap.Push(p.expiry, ptx)
+
+	if signed {
+		sender := tx.Sender()
+		if p.senders[sender] == nil {
+			p.senders[sender] = map[uint64]types.Hash{}
+		}
+		p.senders[sender][tx.Nonce] = hash
+	}
+
+	return nil
+}
+
+// makeRoom evicts the lowest priority transactions until ptx fits, nothing
+// is evicted if ptx does not have a higher priority than all of them. The
+// later transactions of the sender of an evicted one can no longer be
+// executed and are evicted along with it, ptx is refused if it is one of them.
+func (p *TxPool) makeRoom(ptx *pooledTx) error {
+	evicted := map[types.Hash]*pooledTx{}
+	count, bytes := len(p.transactions), p.bytes
+
+	restore := func() error {
+		for _, e := range evicted {
+			heap.Push(p.evict, e)
+		}
+		return ErrTxPoolFull
+	}
+
+	for count+1 > p.opts.MaxTxs || bytes+ptx.size > p.opts.MaxBytes {
+		worst := p.evict.peek()
+		if !p.opts.Ordering.Less(ptx.tx, worst.tx) {
+			return restore()
+		}
+
+		for _, e := range p.tail(worst) {
+			if _, ok := evicted[e.hash]; ok {
+				continue
+			}
+			heap.Remove(p.evict, e.evictIdx)
+			evicted[e.hash] = e
+			count--
+			bytes -= e.size
+		}
+	}
+
+	if ptx.tx.Signature != nil {
+		sender := ptx.tx.Sender()
+		for _, e := range evicted {
+			if e.tx.Signature != nil && e.tx.Nonce < ptx.tx.Nonce && e.tx.Sender() == sender {
+				return restore()
+			}
+		}
+	}
+
+	for _, e := range evicted {
+		heap.Push(p.evict, e)
+		p.remove(e.hash)
+	}
 
 	return nil
 }
 
+// tail returns ptx followed by the pooled transactions of its sender with a
+// higher nonce, the caller must hold the lock.
+func (p *TxPool) tail(ptx *pooledTx) []*pooledTx {
+	tail := []*pooledTx{ptx}
+	if ptx.tx.Signature == nil {
+		return tail
+	}
+
+	for nonce, hash := range p.senders[ptx.tx.Sender()] {
+		if nonce > ptx.tx.Nonce {
+			tail = append(tail, p.transactions[hash])
+		}
+	}
+	return tail
+}
+
+// Remove drops the transactions with the given hashes and returns how many were pooled.
+func (p *TxPool) Remove(hashes []types.Hash) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	removed := 0
+	for _, hash := range hashes {
+		if _, ok := p.transactions[hash]; ok {
+			p.remove(hash)
+			removed++
+		}
+	}
+
+	return removed
+}
+
+// RemoveIncluded drops the transactions of the block together with every
+// pooled transaction that uses the same sender and nonce as one of them.
+func (p *TxPool) RemoveIncluded(b *core.Block) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	removed := 0
+	for i := range b.Transactions {
+		tx := &b.Transactions[i]
+		hash := tx.Hash(core.TxHasher{})
+
+		if tx.Signature != nil {
+			if other, ok := p.senders[tx.Sender()][tx.Nonce]; ok {
+				hash = other
+			}
+		}
+
+		if _, ok := p.transactions[hash]; ok {
+			p.remove(hash)
+			removed++
+		}
+	}
+
+	return removed
+}
+
+// Revalidate drops every transaction for which valid returns an error and
+// returns how many were dropped. It is used to remove transactions that no
+// longer apply after the chain state changed.
+func (p *TxPool) Revalidate(valid func(*core.Transaction) error) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.expire()
+
+	invalid := []types.Hash{}
+	for hash, ptx := range p.transactions {
+		if valid(ptx.tx) != nil {
+			invalid = append(invalid, hash)
+		}
+	}
+
+	for _, hash := range invalid {
+		p.remove(hash)
+	}
+
+	return len(invalid)
+}
+
 func (p *TxPool) Has(hash types.Hash) bool {
-	_, ok := p.transactions[hash]
-	return ok
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	ptx, ok := p.transactions[hash]
+	return ok && !p.expired(ptx.tx)
+}
+
+// Get returns a pooled transaction by its hash.
+func (p *TxPool) Get(hash types.Hash) (*core.Transaction, bool) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	ptx, ok := p.transactions[hash]
+	if !ok || p.expired(ptx.tx) {
+		return nil, false
+	}
+	return ptx.tx, true
 }
 
 func (p *TxPool) Len() int {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
 	return len(p.transactions)
 }
 
+// Bytes returns the sum of the canonical sizes of the pooled transactions.
+func (p *TxPool) Bytes() int {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.bytes
+}
+
 func (p *TxPool) Flush() {
-	p.transactions = make(map[types.Hash]*core.Transaction)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.reset()
+}
+
+func (p *TxPool) expired(tx *core.Transaction) bool {
+	return time.Since(time.Unix(0, tx.FirstSeen())) > p.opts.TTL
+}
+
+// expire drops the transactions older than the TTL, the caller must hold the lock.
+func (p *TxPool) expire() {
+	for p.expiry.Len() > 0 && p.expired(p.expiry.peek().tx) {
+		p.remove(p.expiry.peek().hash)
+	}
+}
+
+// remove drops a transaction from the pool, the caller must hold the lock.
+func (p *TxPool) remove(hash types.Hash) {
+	ptx, ok := p.transactions[hash]
+	if !ok {
+		return
+	}
+
+	delete(p.transactions, hash)
+	p.bytes -= ptx.size
+	heap.Remove(p.evict, ptx.evictIdx)
+	heap.Remove(p.expiry, ptx.expiryIdx)
+
+	if ptx.tx.Signature == nil {
+		return
+	}
+
+	sender := ptx.tx.Sender()
+	if p.senders[sender][ptx.tx.Nonce] == hash {
+		delete(p.senders[sender], ptx.tx.Nonce)
+		if len(p.senders[sender]) == 0 {
+			delete(p.senders, sender)
+		}
+	}
+}
+
+// pooledTxHeap is a heap of pooled transactions that keeps track of the
+// position of every element so it can be removed.
+type pooledTxHeap struct {
+	txx   []*pooledTx
+	less  func(a, b *pooledTx) bool
+	index func(ptx *pooledTx) *int
+}
+
+func (h *pooledTxHeap) Len() int           { return len(h.txx) }
+func (h *pooledTxHeap) Less(i, j int) bool { return h.less(h.txx[i], h.txx[j]) }
+
+func (h *pooledTxHeap) Swap(i, j int) {
+	h.txx[i], h.txx[j] = h.txx[j], h.txx[i]
+	*h.index(h.txx[i]) = i
+	*h.index(h.txx[j]) = j
+}
+
+func (h *pooledTxHeap) Push(x any) {
+	ptx := x.(*pooledTx)
+	*h.index(ptx) = len(h.txx)
+	h.txx = append(h.txx, ptx)
+}
+
+func (h *pooledTxHeap) Pop() any {
+	n := len(h.txx)
+	ptx := h.txx[n-1]
+	h.txx = h.txx[:n-1]
+	*h.index(ptx) = -1
+	return ptx
+}
+
+func (h *pooledTxHeap) peek() *pooledTx {
+	return h.txx[0]
 }
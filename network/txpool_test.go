@@ -1,9 +1,14 @@
 package network
 
 import (
+	"fmt"
 	"go-blockchain/core"
+	"go-blockchain/crypto"
+	"go-blockchain/types"
 	"strconv"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -30,10 +35,11 @@ func TestTxPoolAddTx(t *testing.T) {
 func TestSortTx(t *testing.T) {
 	p := NewTxPool()
 	txLen := 1000
+	now := time.Now().UnixNano()
 
 	for i := 0; i < txLen; i++ {
 		tx := core.NewTransaction([]byte(strconv.Itoa(i)))
-		tx.SetFirstSeen(int64(i))
+		tx.SetFirstSeen(now + int64(i))
 		assert.Nil(t, p.Add(tx))
 	}
 
@@ -44,3 +50,303 @@ func TestSortTx(t *testing.T) {
 		assert.True(t, txx[i-1].FirstSeen() < txx[i].FirstSeen())
 	}
 }
+
+func TestTxPoolRejectsSameNonce(t *testing.T) {
+	p := NewTxPool()
+	privKey := crypto.GeneratePrivateKey()
+
+	tx := core.NewTransaction([]byte("foo"))
+	assert.Nil(t, tx.Sign(privKey))
+	assert.Nil(t, p.Add(tx))
+
+	other := core.NewTransaction([]byte("bar"))
+	assert.Nil(t, other.Sign(privKey))
+	assert.NotNil(t, p.Add(other))
+
+	other = core.NewTransaction([]byte("bar"))
+	other.Nonce = 1
+	assert.Nil(t, other.Sign(privKey))
+	assert.Nil(t, p.Add(other))
+
+	// identical payloads from different senders do not collide
+	same := core.NewTransaction([]byte("foo"))
+	assert.Nil(t, same.Sign(crypto.GeneratePrivateKey()))
+	assert.NotEqual(t, tx.Hash(core.TxHasher{}), same.Hash(core.TxHasher{}))
+	assert.Nil(t, p.Add(same))
+	assert.Equal(t, 3, p.Len())
+}
+
+func dataTx(i int, fee uint64) *core.Transaction {
+	tx := core.NewTransaction([]byte(strconv.Itoa(i)))
+	tx.Fee = fee
+	return tx
+}
+
+func TestTxPoolMaxTxsEvictsLowestFee(t *testing.T) {
+	p := NewTxPoolWithOpts(TxPoolOpts{MaxTxs: 3})
+
+	low := dataTx(0, 1)
+	assert.Nil(t, p.Add(low))
+	assert.Nil(t, p.Add(dataTx(1, 5)))
+	assert.Nil(t, p.Add(dataTx(2, 5)))
+
+	// not better than anything in the pool
+	assert.ErrorIs(t, p.Add(dataTx(3, 1)), ErrTxPoolFull)
+	assert.Equal(t, 3, p.Len())
+	assert.True(t, p.Has(low.Hash(core.TxHasher{})))
+
+	high := dataTx(4, 10)
+	assert.Nil(t, p.Add(high))
+	assert.Equal(t, 3, p.Len())
+	assert.False(t, p.Has(low.Hash(core.TxHasher{})))
+	assert.True(t, p.Has(high.Hash(core.TxHasher{})))
+}
+
+func TestTxPoolEvictsTailOfSender(t *testing.T) {
+	p := NewTxPoolWithOpts(TxPoolOpts{MaxTxs: 4})
+	privKey := crypto.GeneratePrivateKey()
+
+	// the later nonces pay more but depend on the cheapest one
+	assert.Nil(t, p.Add(feeTransfer(t, privKey, 1, 1, 0)))
+	assert.Nil(t, p.Add(feeTransfer(t, privKey, 1, 20, 1)))
+	assert.Nil(t, p.Add(feeTransfer(t, privKey, 1, 20, 2)))
+	other := dataTx(0, 5)
+	assert.Nil(t, p.Add(other))
+
+	// a gap would be left by the sender's own replacement
+	assert.ErrorIs(t, p.Add(feeTransfer(t, privKey, 1, 10, 3)), ErrTxPoolFull)
+	assert.Equal(t, 4, p.Len())
+
+	high := dataTx(1, 10)
+	assert.Nil(t, p.Add(high))
+	assert.Equal(t, 2, p.Len())
+	assert.True(t, p.Has(other.Hash(core.TxHasher{})))
+	assert.True(t, p.Has(high.Hash(core.TxHasher{})))
+	assert.Empty(t, p.senders)
+}
+
+func TestTxPoolMaxBytes(t *testing.T) {
+	size := dataTx(0, 0).Size()
+	p := NewTxPoolWithOpts(TxPoolOpts{MaxBytes: 2 * size})
+
+	assert.Nil(t, p.Add(dataTx(0, 1)))
+	assert.Nil(t, p.Add(dataTx(1, 1)))
+	assert.Equal(t, 2*size, p.Bytes())
+	assert.ErrorIs(t, p.Add(dataTx(2, 1)), ErrTxPoolFull)
+
+	// a transaction larger than the whole pool is never accepted
+	assert.NotNil(t, p.Add(core.NewTransaction(make([]byte, 3*size))))
+
+	assert.Nil(t, p.Add(dataTx(3, 2)))
+	assert.Equal(t, 2, p.Len())
+	assert.Equal(t, 2*size, p.Bytes())
+}
+
+func TestTxPoolMaxTxsPerSender(t *testing.T) {
+	p := NewTxPoolWithOpts(TxPoolOpts{MaxTxsPerSender: 2})
+	privKey := crypto.GeneratePrivateKey()
+
+	for i := 0; i < 3; i++ {
+		tx := core.NewTransaction([]byte("foo"))
+		tx.Nonce = uint64(i)
+		assert.Nil(t, tx.Sign(privKey))
+
+		if i < 2 {
+			assert.Nil(t, p.Add(tx))
+		} else {
+			assert.NotNil(t, p.Add(tx))
+		}
+	}
+
+	other := core.NewTransaction([]byte("foo"))
+	assert.Nil(t, other.Sign(crypto.GeneratePrivateKey()))
+	assert.Nil(t, p.Add(other))
+	assert.Equal(t, 3, p.Len())
+}
+
+func TestTxPoolTTL(t *testing.T) {
+	p := NewTxPoolWithOpts(TxPoolOpts{TTL: time.Minute})
+
+	old := dataTx(0, 1)
+	old.SetFirstSeen(time.Now().Add(-2 * time.Minute).UnixNano())
+	assert.NotNil(t, p.Add(old))
+
+	aging := dataTx(1, 1)
+	aging.SetFirstSeen(time.Now().Add(-time.Minute + 50*time.Millisecond).UnixNano())
+	assert.Nil(t, p.Add(aging))
+	assert.Nil(t, p.Add(dataTx(2, 1)))
+	assert.Equal(t, 2, p.Len())
+
+	time.Sleep(100 * time.Millisecond)
+	assert.False(t, p.Has(aging.Hash(core.TxHasher{})))
+	assert.Equal(t, 1, len(p.Transactions()))
+	assert.Equal(t, 1, p.Len())
+}
+
+func TestTxPoolConcurrentAccess(t *testing.T) {
+	p := NewTxPoolWithOpts(TxPoolOpts{MaxTxs: 500})
+	wg := sync.WaitGroup{}
+
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				tx := dataTx(w*1000+i, uint64(i))
+				_ = p.Add(tx)
+				p.Has(tx.Hash(core.TxHasher{}))
+				p.Len()
+				if i%50 == 0 {
+					p.Transactions()
+				}
+			}
+		}(w)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5; i++ {
+			p.Flush()
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	wg.Wait()
+	assert.LessOrEqual(t, p.Len(), 500)
+}
+
+func TestTxPoolAddSharedTx(t *testing.T) {
+	p := NewTxPool()
+	tx := dataTx(1, 1)
+	wg := sync.WaitGroup{}
+
+	// the gossip of a transaction hands the same value to several callers
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, p.Add(tx))
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, p.Len())
+	assert.Equal(t, int64(0), tx.FirstSeen())
+
+	pooled, ok := p.Get(tx.Hash(core.TxHasher{}))
+	assert.True(t, ok)
+	assert.NotZero(t, pooled.FirstSeen())
+}
+
+func BenchmarkTxPoolAdd(b *testing.B) {
+	txx := make([]*core.Transaction, 100_000)
+	for i := range txx {
+		txx[i] = dataTx(i, uint64(i%1000))
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		p := NewTxPoolWithOpts(TxPoolOpts{MaxTxs: len(txx)})
+		for _, tx := range txx {
+			_ = p.Add(tx)
+		}
+	}
+}
+
+func BenchmarkTxPoolAddFull(b *testing.B) {
+	p := NewTxPoolWithOpts(TxPoolOpts{MaxTxs: 100_000})
+	for i := 0; i < 100_000; i++ {
+		_ = p.Add(dataTx(i, uint64(i%1000)))
+	}
+
+	txx := make([]*core.Transaction, b.N)
+	for i := range txx {
+		txx[i] = dataTx(100_000+i, uint64(i%2000))
+	}
+
+	b.ResetTimer()
+	for _, tx := range txx {
+		_ = p.Add(tx)
+	}
+}
+
+func BenchmarkTxPoolTransactions(b *testing.B) {
+	p := NewTxPoolWithOpts(TxPoolOpts{MaxTxs: 100_000})
+	for i := 0; i < 100_000; i++ {
+		_ = p.Add(dataTx(i, uint64(i%1000)))
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		p.Transactions()
+	}
+}
+
+func TestTxPoolRemove(t *testing.T) {
+	p := NewTxPool()
+
+	txx := []*core.Transaction{dataTx(0, 1), dataTx(1, 1), dataTx(2, 1)}
+	for _, tx := range txx {
+		assert.Nil(t, p.Add(tx))
+	}
+
+	removed := p.Remove([]types.Hash{txx[0].Hash(core.TxHasher{}), txx[1].Hash(core.TxHasher{}), {}})
+	assert.Equal(t, 2, removed)
+	assert.Equal(t, 1, p.Len())
+	assert.Equal(t, txx[2].Size(), p.Bytes())
+	assert.True(t, p.Has(txx[2].Hash(core.TxHasher{})))
+}
+
+func TestTxPoolRemoveIncluded(t *testing.T) {
+	p := NewTxPool()
+	privKey := crypto.GeneratePrivateKey()
+
+	pooled := core.NewTransaction([]byte("foo"))
+	assert.Nil(t, pooled.Sign(privKey))
+	assert.Nil(t, p.Add(pooled))
+
+	next := core.NewTransaction([]byte("foo"))
+	next.Nonce = 1
+	assert.Nil(t, next.Sign(privKey))
+	assert.Nil(t, p.Add(next))
+
+	unsigned := dataTx(0, 0)
+	assert.Nil(t, p.Add(unsigned))
+
+	// the block includes a different transaction with the same nonce
+	included := core.NewTransaction([]byte("bar"))
+	assert.Nil(t, included.Sign(privKey))
+
+	b := core.NewBlock(&core.Header{}, []core.Transaction{*included, *unsigned})
+
+	assert.Equal(t, 2, p.RemoveIncluded(b))
+	assert.Equal(t, 1, p.Len())
+	assert.True(t, p.Has(next.Hash(core.TxHasher{})))
+
+	// the nonce is free again
+	again := core.NewTransaction([]byte("baz"))
+	assert.Nil(t, again.Sign(privKey))
+	assert.Nil(t, p.Add(again))
+}
+
+func TestTxPoolRevalidate(t *testing.T) {
+	p := NewTxPool()
+
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, p.Add(dataTx(i, uint64(i))))
+	}
+
+	invalid := p.Revalidate(func(tx *core.Transaction) error {
+		if tx.Fee < 5 {
+			return fmt.Errorf("fee too low")
+		}
+		return nil
+	})
+	assert.Equal(t, 5, invalid)
+	assert.Equal(t, 5, p.Len())
+
+	for _, tx := range p.Transactions() {
+		assert.GreaterOrEqual(t, tx.Fee, uint64(5))
+	}
+}
@@ -3,6 +3,7 @@ package types
 import (
 	"encoding/hex"
 	"fmt"
+	"strings"
 )
 
 type Address [20]uint8
@@ -28,3 +29,21 @@ func AddressFromBytes(b []byte) Address {
 
 	return Address(value)
 }
+
+// MarshalText encodes the address as hex, which also makes it usable as a JSON map key.
+func (a Address) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+func (a *Address) UnmarshalText(text []byte) error {
+	b, err := hex.DecodeString(strings.TrimPrefix(string(text), "0x"))
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %w", text, err)
+	}
+	if len(b) != len(a) {
+		return fmt.Errorf("invalid address %q: got %d bytes, expected %d", text, len(b), len(a))
+	}
+
+	copy(a[:], b)
+	return nil
+}